@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"authentication/data"
+	"authz"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// apiKeyAMR is how a token minted for an API key says the caller proved who they are
+const apiKeyAMR = "apikey"
+
+type apiKeyRequest struct {
+	Name   string   `json:"name" binding:"required,max=255"`
+	Scopes []string `json:"scopes" binding:"required,min=1"`
+	// ExpiresAt is optional; keys without it don't expire
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// apiKeyResponse is a key as its user sees it. The key itself is only included when it
+// is created.
+type apiKeyResponse struct {
+	*data.APIKey
+	Key string `json:"key,omitempty"`
+}
+
+// ListAPIKeys returns the caller's API keys that haven't been revoked
+func (app *Config) ListAPIKeys(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+
+	keys, err := app.Models.APIKey.GetForUser(c.Request.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not list API keys"), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]apiKeyResponse, len(keys))
+	for i, key := range keys {
+		response[i] = apiKeyResponse{APIKey: key}
+	}
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d API keys", len(keys)),
+		Data:    response,
+	})
+}
+
+// CreateAPIKey issues an API key for the caller, granting some of their own permissions.
+// The key is only shown in this response.
+func (app *Config) CreateAPIKey(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+	var req apiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		app.errorJSON(c, errors.New("name is required"))
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		app.errorJSON(c, errors.New("expires_at must be in the future"))
+		return
+	}
+
+	_, permissions, err := app.Models.Role.Grants(c.Request.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not create API key"), http.StatusInternalServerError)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(permissions, scope) {
+			app.errorJSON(c, fmt.Errorf("you don't have permission %s", scope), http.StatusForbidden)
+			return
+		}
+	}
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+
+	key, plainText, err := data.NewAPIKey(user.ID, name, slices.Compact(scopes), req.ExpiresAt)
+	if err == nil {
+		err = app.Models.APIKey.Insert(c.Request.Context(), key)
+	}
+	if err != nil {
+		app.errorJSON(c, errors.New("could not create API key"), http.StatusInternalServerError)
+		return
+	}
+	app.audit(fmt.Sprintf("%s created API key %s (%s)", user.Email, key.Prefix, key.Name))
+
+	app.writeJSON(c, http.StatusCreated, jsonResponse{
+		Error:   false,
+		Message: "created API key " + key.Name,
+		Data:    apiKeyResponse{APIKey: key, Key: plainText},
+	})
+}
+
+// RevokeAPIKey revokes the caller's API key with the id in the path
+func (app *Config) RevokeAPIKey(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		app.errorJSON(c, errors.New("API key not found"), http.StatusNotFound)
+		return
+	}
+
+	err = app.Models.APIKey.Revoke(c.Request.Context(), user.ID, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("API key not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not revoke API key"), http.StatusInternalServerError)
+		return
+	}
+	app.audit(fmt.Sprintf("%s revoked API key %d", user.Email, id))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("revoked API key %d", id),
+	})
+}
+
+// VerifyAPIKey checks an API key for another service and records that it was used. It
+// returns who the key belongs to, the permissions it grants, which are those of its scopes
+// that the user still has, and a short-lived access token of the user granting them.
+func (app *Config) VerifyAPIKey(c *gin.Context) {
+	var req struct {
+		Key string `json:"key" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	ctx := c.Request.Context()
+	key, err := app.Models.APIKey.Use(ctx, req.Key)
+	if errors.Is(err, data.ErrInvalidToken) {
+		app.errorJSON(c, errors.New("invalid or expired API key"), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not check API key"), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(ctx, key.UserID)
+	if err != nil || !user.Active {
+		app.errorJSON(c, errors.New("account is not active"), http.StatusUnauthorized)
+		return
+	}
+	_, permissions, err := app.Models.Role.Grants(ctx, user.ID)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not check API key"), http.StatusInternalServerError)
+		return
+	}
+	granted := []string{}
+	for _, scope := range key.Scopes {
+		if slices.Contains(permissions, scope) {
+			granted = append(granted, scope)
+		}
+	}
+
+	// Only this service signs access tokens, so the caller is given one for the key's user,
+	// carrying just the key's permissions
+	token, err := app.Tokens.Sign(authz.Claims{
+		Email:            user.Email,
+		Permissions:      granted,
+		AMR:              []string{apiKeyAMR},
+		RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.Itoa(user.ID)},
+	}, authz.ServiceTokenTTL)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not check API key"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "valid API key " + key.Prefix,
+		Data: gin.H{
+			"access_token": token,
+			"key_id":       key.ID,
+			"prefix":       key.Prefix,
+			"user_id":      user.ID,
+			"email":        user.Email,
+			"permissions":  granted,
+			"amr":          []string{apiKeyAMR},
+			"expires_at":   key.ExpiresAt,
+		},
+	})
+}
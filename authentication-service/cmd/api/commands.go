@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"authentication/data"
+	"authz"
+
+	"gorm.io/gorm"
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, `Usage:
+  %[1]s [-migrate]           serve the API
+  %[1]s migrate [up]         apply pending migrations
+  %[1]s migrate down [N]     revert the last N migrations (default 1)
+  %[1]s migrate status       list migrations and when they were applied
+  %[1]s seed                 create the admin user given by ADMIN_EMAIL and ADMIN_PASSWORD
+  %[1]s import [-format F] [-passwords plaintext|hashed] [-dry-run] FILE
+                              create users from a CSV or NDJSON file, or - for stdin
+  %[1]s export [-format F] [-password-hashes] [FILE]
+                              write every user as CSV or NDJSON, to stdout by default
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+// migrateCommand runs "migrate up", "migrate down [N]" or "migrate status"
+func migrateCommand(conn *gorm.DB, args []string) error {
+	migrator, err := data.NewMigrator(conn)
+	if err != nil {
+		return err
+	}
+
+	action := "up"
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+
+	switch {
+	case action == "up" && len(args) == 0:
+		applied, err := migrator.Up()
+		if err != nil {
+			return err
+		}
+		for _, m := range applied {
+			log.Printf("Applied migration %d_%s", m.Version, m.Name)
+		}
+		if len(applied) == 0 {
+			log.Println("The database is up to date")
+		}
+		return nil
+
+	case action == "down" && len(args) <= 1:
+		steps := 1
+		if len(args) == 1 {
+			if steps, err = strconv.Atoi(args[0]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[0])
+			}
+		}
+		reverted, err := migrator.Down(steps)
+		if err != nil {
+			return err
+		}
+		for _, m := range reverted {
+			log.Printf("Reverted migration %d_%s", m.Version, m.Name)
+		}
+		return nil
+
+	case action == "status" && len(args) == 0:
+		status, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, m := range status {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = "applied " + m.AppliedAt.UTC().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", m.Version, m.Name, applied)
+		}
+		return nil
+	}
+
+	flag.Usage()
+	return fmt.Errorf("unknown migrate command %q", action)
+}
+
+// applyMigrations brings the schema up to date before the service starts
+func applyMigrations(conn *gorm.DB) error {
+	migrator, err := data.NewMigrator(conn)
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up()
+	for _, m := range applied {
+		log.Printf("Applied migration %d_%s", m.Version, m.Name)
+	}
+	return err
+}
+
+// seedCommand creates the first administrator from ADMIN_EMAIL, ADMIN_PASSWORD and the
+// optional ADMIN_FIRST_NAME and ADMIN_LAST_NAME. Running it again is safe: an existing
+// user keeps their password and is made an active administrator.
+func seedCommand(conn *gorm.DB) error {
+	email, password := normalizeEmail(os.Getenv("ADMIN_EMAIL")), os.Getenv("ADMIN_PASSWORD")
+	if email == "" || password == "" {
+		return errors.New("ADMIN_EMAIL and ADMIN_PASSWORD must be set")
+	}
+	if err := validatePassword(password); err != nil {
+		return fmt.Errorf("ADMIN_PASSWORD: %w", err)
+	}
+
+	if err := data.SeedPermissions(conn, authz.Permissions); err != nil {
+		return fmt.Errorf("seeding permissions (have the migrations been applied?): %w", err)
+	}
+	created, err := data.SeedAdmin(conn, data.User{
+		Email:     email,
+		FirstName: os.Getenv("ADMIN_FIRST_NAME"),
+		LastName:  os.Getenv("ADMIN_LAST_NAME"),
+		Password:  password,
+	})
+	if err != nil {
+		return err
+	}
+
+	if created {
+		log.Printf("Created administrator %s", email)
+	} else {
+		log.Printf("%s already exists and is an administrator", email)
+	}
+	return nil
+}
+
+// importCommand runs "import [-format F] [-passwords plaintext|hashed] [-dry-run] FILE" and
+// prints the rows that could not be imported. It fails if any row failed.
+func importCommand(conn *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or ndjson (default from the file extension)")
+	passwords := flags.String("passwords", "plaintext", "whether the file has plaintext passwords or hashed ones")
+	dryRun := flags.Bool("dry-run", false, "check the file without creating users")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("import needs one file, or - for stdin")
+	}
+	if *passwords != "plaintext" && *passwords != "hashed" {
+		return fmt.Errorf("-passwords must be plaintext or hashed, got %q", *passwords)
+	}
+
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = formatFromExtension(path)
+	}
+	if *format != formatCSV && *format != formatNDJSON {
+		return errors.New("-format must be csv or ndjson")
+	}
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	report, err := importUsers(context.Background(), data.NewPostgresUserRepository(conn), in, importOptions{
+		Format:          *format,
+		HashedPasswords: *passwords == "hashed",
+		DryRun:          *dryRun,
+	})
+	if report == nil {
+		return err
+	}
+	for _, e := range report.Errors {
+		log.Printf("Line %d: %s: %s", e.Line, e.Email, e.Error)
+	}
+	if report.DryRun {
+		log.Printf("%d of %d users can be imported", report.Created, report.Rows)
+	} else {
+		log.Printf("Imported %d of %d users", report.Created, report.Rows)
+	}
+	if err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d users could not be imported", report.Failed)
+	}
+	return nil
+}
+
+// exportCommand runs "export [-format F] [-password-hashes] [FILE]"
+func exportCommand(conn *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "", "csv or ndjson (default from the file extension, or csv)")
+	withHashes := flags.Bool("password-hashes", false, "include the password hashes, to import the users elsewhere")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errors.New("export takes at most one file")
+	}
+
+	path := flags.Arg(0)
+	if *format == "" {
+		if *format = formatFromExtension(path); *format == "" {
+			*format = formatCSV
+		}
+	}
+	if *format != formatCSV && *format != formatNDJSON {
+		return errors.New("-format must be csv or ndjson")
+	}
+
+	out := os.Stdout
+	if path != "" && path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	if err := exportUsers(context.Background(), data.NewPostgresUserRepository(conn), w, *format, *withHashes); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
+
+// formatFromExtension returns the import format of a file name, or "" if the extension
+// doesn't say
+func formatFromExtension(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return formatCSV
+	case ".ndjson", ".jsonl":
+		return formatNDJSON
+	}
+	return ""
+}
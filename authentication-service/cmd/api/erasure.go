@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"authentication/data"
+	"authz"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// erasureStep is one step of erasing a user. It returns how many records it erased, or 0
+// when it doesn't count them.
+type erasureStep struct {
+	name string
+	run  func(ctx context.Context, user *data.User) (int, error)
+}
+
+// erasureSteps returns the steps of erasing a user, in order. The user row goes last, so
+// that a failed erasure leaves the user as it was, to be erased again.
+func (app *Config) erasureSteps() []erasureStep {
+	return []erasureStep{
+		{"sessions", func(ctx context.Context, user *data.User) (int, error) {
+			if _, err := app.revokeUserSessions(ctx, user.ID); err != nil {
+				return 0, err
+			}
+			return app.Models.Session.Anonymize(ctx, user.ID)
+		}},
+		{"api_keys", func(ctx context.Context, user *data.User) (int, error) {
+			return app.Models.APIKey.DeleteForUser(ctx, user.ID)
+		}},
+		{"tokens", func(ctx context.Context, user *data.User) (int, error) {
+			return 0, app.Models.Token.Erase(ctx, user.ID)
+		}},
+		{"mfa", func(ctx context.Context, user *data.User) (int, error) {
+			return 0, app.Models.MFA.Disable(ctx, user.ID)
+		}},
+		{"roles", func(ctx context.Context, user *data.User) (int, error) {
+			return 0, app.Models.Role.SetForUser(ctx, user.ID, nil)
+		}},
+		// The UserErased event added with the user row still needs the email, for the
+		// logger to redact; LogsRedacted scrubs it
+		{"outbox", func(ctx context.Context, user *data.User) (int, error) {
+			return app.Models.Outbox.ScrubUser(ctx, user.ID)
+		}},
+		{"user", func(ctx context.Context, user *data.User) (int, error) {
+			return 1, app.Models.User.Erase(ctx, user)
+		}},
+	}
+}
+
+// eraseUser erases the personal data of user, for its right to be forgotten, and stores the
+// report. It stops at the first step that fails, and returns the report with the error.
+// The logger service redacts the user's log entries once it gets the UserErased event, so
+// the report stays pending until LogsRedacted hears that it has.
+func (app *Config) eraseUser(ctx context.Context, user *data.User, requestedBy string) (*data.Erasure, error) {
+	report := &data.Erasure{
+		UserID:      user.ID,
+		RequestedBy: requestedBy,
+		Status:      data.ErasurePending,
+		StartedAt:   time.Now(),
+	}
+
+	var failed error
+	for _, step := range app.erasureSteps() {
+		n, err := step.run(ctx, user)
+		result := data.ErasureStep{Name: step.name, Count: n}
+		if err != nil {
+			result.Error = err.Error()
+			report.Status, failed = data.ErasureFailed, fmt.Errorf("erasing %s: %w", step.name, err)
+		}
+		report.Steps = append(report.Steps, result)
+		if failed != nil {
+			now := time.Now()
+			report.CompletedAt = &now
+			break
+		}
+	}
+
+	if err := app.Models.Erasure.Insert(ctx, report); err != nil {
+		log.Println("Error storing erasure report:", err)
+		if failed == nil {
+			failed = errors.New("storing the report failed")
+		}
+	}
+	return report, failed
+}
+
+// EraseUser erases the personal data of a user, deleted or not, and responds with the
+// report of the erasure. Erased users can't be restored.
+func (app *Config) EraseUser(c *gin.Context) {
+	user, ok := app.userFromPathWithDeleted(c)
+	if !ok {
+		return
+	}
+	if user.ErasedAt != nil {
+		app.errorJSON(c, errors.New("user was erased already"), http.StatusConflict)
+		return
+	}
+
+	id := user.ID
+	report, err := app.eraseUser(c.Request.Context(), user, requester(c))
+	if err != nil {
+		log.Printf("Error erasing user %d: %v", id, err)
+		app.writeJSON(c, http.StatusInternalServerError, jsonResponse{
+			Error:   true,
+			Message: fmt.Sprintf("could not erase user %d, try again", id),
+			Data:    report,
+		})
+		return
+	}
+	app.audit(fmt.Sprintf("user %d erased by %s", id, report.RequestedBy))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("erased user %d", id),
+		Data:    report,
+	})
+}
+
+// LogsRedacted completes the pending erasure of a user, once the logger service has
+// redacted the user's log entries. The listener service calls it after the redaction,
+// with the number of entries redacted. The UserErased event has been delivered by then,
+// so the email it carried is scrubbed first.
+func (app *Config) LogsRedacted(c *gin.Context) {
+	var req struct {
+		UserID   int `json:"user_id" binding:"required"`
+		Redacted int `json:"redacted"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	// Only an erased user's events are scrubbed
+	user, err := app.Models.User.GetWithDeleted(c.Request.Context(), req.UserID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && user.ErasedAt == nil) {
+		app.errorJSON(c, fmt.Errorf("no pending erasure of user %d", req.UserID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading erased user %d: %v", req.UserID, err)
+		app.errorJSON(c, errors.New("could not complete erasure"), http.StatusInternalServerError)
+		return
+	}
+	if _, err := app.Models.Outbox.ScrubUser(c.Request.Context(), req.UserID); err != nil {
+		log.Printf("Error scrubbing the events of erased user %d: %v", req.UserID, err)
+		app.errorJSON(c, errors.New("could not complete erasure"), http.StatusInternalServerError)
+		return
+	}
+
+	step := data.ErasureStep{Name: "logs", Count: req.Redacted}
+	erasure, err := app.Models.Erasure.Complete(c.Request.Context(), req.UserID, step, time.Now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, fmt.Errorf("no pending erasure of user %d", req.UserID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error completing the erasure of user %d: %v", req.UserID, err)
+		app.errorJSON(c, errors.New("could not complete erasure"), http.StatusInternalServerError)
+		return
+	}
+	app.audit(fmt.Sprintf("erasure of user %d completed, %d log entries redacted", req.UserID, req.Redacted))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("completed erasure of user %d", req.UserID),
+		Data:    erasure,
+	})
+}
+
+// ListErasures returns the reports of every erasure, newest first
+func (app *Config) ListErasures(c *gin.Context) {
+	erasures, err := app.Models.Erasure.GetAll(c.Request.Context())
+	if err != nil {
+		app.errorJSON(c, errors.New("could not list erasures"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d erasures", len(erasures)),
+		Data:    erasures,
+	})
+}
+
+// GetErasure returns the report of one erasure
+func (app *Config) GetErasure(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		app.errorJSON(c, errors.New("invalid erasure id"))
+		return
+	}
+
+	erasure, err := app.Models.Erasure.GetOne(c.Request.Context(), id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("erasure not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not load erasure"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("erasure of user %d", erasure.UserID),
+		Data:    erasure,
+	})
+}
+
+// requester names who made an administrator's request, for the records
+func requester(c *gin.Context) string {
+	claims, _ := authz.FromContext(c)
+	if claims.IsService() {
+		return claims.Subject
+	}
+	return "user " + claims.Subject
+}
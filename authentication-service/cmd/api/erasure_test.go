@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	"authentication/data"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectErasure stubs the steps of erasing user id that run against the database. With
+// failTokens, erasing the user's tokens fails.
+func (h *harness) expectErasure(id int, failTokens bool) {
+	h.mock.ExpectBegin()
+	revoke := h.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "user_tokens" SET "new_email"=$1,"used_at"=COALESCE(used_at, $2) WHERE user_id = $3`)).
+		WithArgs("", sqlmock.AnyArg(), id)
+	if failTokens {
+		revoke.WillReturnError(errors.New("connection reset"))
+		h.mock.ExpectRollback()
+		return
+	}
+	revoke.WillReturnResult(sqlmock.NewResult(0, 1))
+	h.mock.ExpectCommit()
+	h.mock.ExpectBegin()
+	h.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "recovery_codes" WHERE user_id = $1`)).WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 10))
+	h.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "user_mfa" WHERE user_id = $1`)).WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	h.mock.ExpectCommit()
+	h.mock.ExpectBegin()
+	h.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "user_roles" WHERE user_id = $1`)).WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	h.mock.ExpectCommit()
+}
+
+func TestUserLifecycle(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	id := h.addUser(t, "grace@example.com", "verysecret", true)
+
+	// Deactivating a user also revokes the links sent to them
+	h.expectTokensRevoked(2)
+	if status, resp := h.do(t, http.MethodPost, "/users/2/deactivate", h.admin, nil); status != http.StatusOK {
+		t.Fatalf("expected deactivation, got %d %+v", status, resp)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if status, resp := h.do(t, http.MethodPost, "/users/2/reactivate", h.admin, nil); status != http.StatusOK || !h.storedUser(t, id).Active {
+		t.Fatalf("expected reactivation, got %d %+v", status, resp)
+	}
+
+	// A deleted user is kept, out of sight, until restored
+	if status, resp := h.do(t, http.MethodDelete, "/users/2", h.admin, nil); status != http.StatusOK {
+		t.Fatalf("expected deletion, got %d %+v", status, resp)
+	}
+	if status, _ := h.do(t, http.MethodGet, "/users/2", h.admin, nil); status != http.StatusNotFound {
+		t.Errorf("expected a deleted user not to be found, got %d", status)
+	}
+	if status, _ := h.authenticate(t, "grace@example.com", "verysecret"); status != http.StatusBadRequest {
+		t.Errorf("expected a deleted user not to log in, got %d", status)
+	}
+	if status, resp := h.do(t, http.MethodPost, "/users/2/restore", h.admin, nil); status != http.StatusOK || resp.Message != "restored user grace@example.com" {
+		t.Fatalf("expected the user to be restored, got %d %+v", status, resp)
+	}
+	if status, _ := h.do(t, http.MethodPost, "/users/2/restore", h.admin, nil); status != http.StatusConflict {
+		t.Errorf("expected restoring a user that is not deleted to conflict, got %d", status)
+	}
+
+	// The email of a deleted user is free to take, and then it can't be restored
+	h.do(t, http.MethodDelete, "/users/2", h.admin, nil)
+	if _, err := h.users.Insert(context.Background(), data.User{Email: "grace@example.com", Password: "verysecret"}); err != nil {
+		t.Fatalf("expected the email of a deleted user to be free, got %v", err)
+	}
+	if status, resp := h.do(t, http.MethodPost, "/users/2/restore", h.admin, nil); status != http.StatusConflict {
+		t.Errorf("expected restoring a user whose email was taken to conflict, got %d %+v", status, resp)
+	}
+
+	events, _ := h.users.Outbox().Pending(context.Background(), 20)
+	var keys []string
+	for _, e := range events {
+		keys = append(keys, e.RoutingKey)
+	}
+	want := []string{data.UserCreated, data.UserCreated, data.UserDeactivated, data.UserActivated,
+		data.UserDeleted, data.UserRestored, data.UserDeleted, data.UserCreated}
+	if !slices.Equal(keys, want) {
+		t.Errorf("expected events %v, got %v", want, keys)
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	h := newHarness(t)
+	ctx := context.Background()
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	id := h.addUser(t, "grace@example.com", "verysecret", true)
+	if _, err := h.sessions.Create(ctx, &data.Session{UserID: id, IP: "10.0.0.1", UserAgent: "test-agent"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.apiKeys.Insert(ctx, &data.APIKey{UserID: id, Name: "grace's laptop", Hash: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed erasure leaves the user row as it was, and can be run again
+	h.expectErasure(id, true)
+	status, resp := h.do(t, http.MethodPost, "/users/2/erase", h.admin, nil)
+	report, _ := resp.Data.(map[string]any)
+	if status != http.StatusInternalServerError || report["status"] != data.ErasureFailed {
+		t.Fatalf("expected the erasure to fail, got %d %+v", status, resp)
+	}
+	if steps, _ := report["steps"].([]any); len(steps) != 3 || steps[1].(map[string]any)["count"] != float64(1) ||
+		steps[2].(map[string]any)["error"] == nil {
+		t.Errorf("expected the report to stop at the tokens, got %+v", report)
+	}
+	if h.storedUser(t, id).Email != "grace@example.com" {
+		t.Error("expected the user to be kept after a failed erasure")
+	}
+
+	h.expectErasure(id, false)
+	status, resp = h.do(t, http.MethodPost, "/users/2/erase", h.admin, nil)
+	if status != http.StatusOK || resp.Message != "erased user 2" {
+		t.Fatalf("expected the user to be erased, got %d %+v", status, resp)
+	}
+	var erasure data.Erasure
+	b, _ := json.Marshal(resp.Data)
+	json.Unmarshal(b, &erasure)
+	// It stays pending until the logger service has redacted the user's log entries
+	if erasure.Status != data.ErasurePending || erasure.CompletedAt != nil || erasure.RequestedBy != "user 1" || len(erasure.Steps) != 7 ||
+		erasure.Steps[0] != (data.ErasureStep{Name: "sessions", Count: 1}) || erasure.Steps[1] != (data.ErasureStep{Name: "api_keys"}) ||
+		erasure.Steps[5] != (data.ErasureStep{Name: "outbox", Count: 1}) {
+		t.Errorf("unexpected report %+v", erasure)
+	}
+
+	erased, err := h.users.GetWithDeleted(ctx, id)
+	if err != nil || erased.Email != "erased-2@erased.invalid" || erased.FirstName != "" || erased.Password != "" ||
+		erased.Active || erased.ErasedAt == nil || !erased.DeletedAt.Valid {
+		t.Fatalf("expected the user to be anonymized, got %+v (%v)", erased, err)
+	}
+	if sessions, _ := h.sessions.GetForUser(ctx, id); len(sessions) != 0 {
+		t.Errorf("expected the sessions to be revoked, got %+v", sessions)
+	}
+	if keys, _ := h.apiKeys.GetForUser(ctx, id); len(keys) != 0 {
+		t.Errorf("expected the API keys to be deleted, got %+v", keys)
+	}
+
+	// Other services learn the email they knew the user by, which is gone from the user's
+	// earlier events
+	events, _ := h.users.Outbox().Pending(ctx, 20)
+	eventEmails := func() []string {
+		events, _ := h.users.Outbox().Pending(ctx, 20)
+		var emails []string
+		for _, e := range events {
+			var payload data.UserEvent
+			if json.Unmarshal(e.Payload, &payload); payload.UserID == id {
+				emails = append(emails, payload.Email)
+			}
+		}
+		return emails
+	}
+	last := events[len(events)-1]
+	if last.RoutingKey != data.UserErased ||
+		!slices.Equal(eventEmails(), []string{"erased-2@erased.invalid", "grace@example.com"}) {
+		t.Errorf("unexpected events %s %v", last.RoutingKey, eventEmails())
+	}
+
+	if status, _ := h.do(t, http.MethodPost, "/users/2/erase", h.admin, nil); status != http.StatusConflict {
+		t.Errorf("expected a second erasure to conflict, got %d", status)
+	}
+	if status, _ := h.do(t, http.MethodPost, "/users/2/restore", h.admin, nil); status != http.StatusConflict {
+		t.Errorf("expected an erased user not to be restored, got %d", status)
+	}
+
+	status, resp = h.do(t, http.MethodGet, "/erasures", h.admin, nil)
+	if reports, _ := resp.Data.([]any); status != http.StatusOK || len(reports) != 2 ||
+		reports[0].(map[string]any)["status"] != data.ErasurePending {
+		t.Errorf("expected both reports, newest first, got %d %+v", status, resp)
+	}
+
+	// The listener service completes the erasure once the logger has redacted the user
+	service, _ := h.tokens.ServiceToken("listener-service")
+	redacted := map[string]int{"user_id": id, "redacted": 3}
+	if status, _ := h.do(t, http.MethodPost, "/erasures/redacted", h.userToken(t, 1), redacted); status != http.StatusForbidden {
+		t.Errorf("expected a user's token to be refused, got %d", status)
+	}
+	status, resp = h.do(t, http.MethodPost, "/erasures/redacted", service, redacted)
+	b, _ = json.Marshal(resp.Data)
+	json.Unmarshal(b, &erasure)
+	if status != http.StatusOK || erasure.ID != 2 || erasure.Status != data.ErasureCompleted || erasure.CompletedAt == nil ||
+		len(erasure.Steps) != 8 || erasure.Steps[7] != (data.ErasureStep{Name: "logs", Count: 3}) {
+		t.Errorf("expected the erasure to be completed, got %d %+v", status, resp)
+	}
+	if emails := eventEmails(); !slices.Equal(emails, []string{"erased-2@erased.invalid", "erased-2@erased.invalid"}) {
+		t.Errorf("expected the erasure event to be scrubbed once completed, got %v", emails)
+	}
+	// Only erased users are completed, and have their events scrubbed
+	if status, _ := h.do(t, http.MethodPost, "/erasures/redacted", service, map[string]int{"user_id": 1}); status != http.StatusNotFound {
+		t.Errorf("expected no pending erasure of a user that wasn't erased, got %d", status)
+	}
+	if status, _ := h.do(t, http.MethodPost, "/erasures/redacted", service, redacted); status != http.StatusNotFound {
+		t.Errorf("expected no pending erasure the second time, got %d", status)
+	}
+	if _, resp := h.do(t, http.MethodGet, "/erasures/1", h.admin, nil); resp.Data.(map[string]any)["status"] != data.ErasureFailed {
+		t.Errorf("expected the failed erasure to stay failed, got %+v", resp)
+	}
+	if status, resp := h.do(t, http.MethodGet, "/erasures/1", h.admin, nil); status != http.StatusOK || resp.Message != "erasure of user 2" {
+		t.Errorf("expected the first report, got %d %+v", status, resp)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"authentication/auth"
+	"authentication/data"
+	"authz"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+// AuthServer serves the AuthService gRPC API, with the same rules as the HTTP routes
+type AuthServer struct {
+	auth.UnimplementedAuthServiceServer
+	app *Config
+}
+
+// Authenticate checks an email and password like the HTTP Authenticate, and counts
+// towards the same limits on failed logins
+func (s *AuthServer) Authenticate(ctx context.Context, req *auth.AuthenticateRequest) (*auth.AuthenticateResponse, error) {
+	if req.GetEmail() == "" || req.GetPassword() == "" {
+		return nil, status.Error(codes.InvalidArgument, "email and password are required")
+	}
+
+	result, err := s.app.passwordLogin(ctx, req.GetEmail(), req.GetPassword(), s.app.grpcClient(ctx))
+	if err != nil {
+		return nil, loginStatus(err)
+	}
+
+	if result.MFAToken != "" {
+		return &auth.AuthenticateResponse{
+			User:        userMessage(result.User),
+			MfaRequired: true,
+			MfaToken:    result.MFAToken,
+			ExpiresIn:   int64(mfaChallengeTTL.Seconds()),
+		}, nil
+	}
+	return &auth.AuthenticateResponse{
+		User:         userMessage(result.User),
+		AccessToken:  result.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTokenTTL.Seconds()),
+		RefreshToken: result.RefreshToken,
+	}, nil
+}
+
+// ValidateToken checks an access token, including whether its session was revoked, and
+// returns its claims
+func (s *AuthServer) ValidateToken(ctx context.Context, req *auth.ValidateTokenRequest) (*auth.ValidateTokenResponse, error) {
+	claims, err := s.app.Tokens.Parse(req.GetToken())
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	resp := &auth.ValidateTokenResponse{
+		Subject:     claims.Subject,
+		Email:       claims.Email,
+		Roles:       claims.Roles,
+		Permissions: claims.Permissions,
+		Amr:         claims.AMR,
+		SessionId:   claims.SessionID,
+	}
+	if claims.ExpiresAt != nil {
+		resp.ExpiresAt = timestamppb.New(claims.ExpiresAt.Time)
+	}
+	return resp, nil
+}
+
+// GetUser returns a user, for administrators only
+func (s *AuthServer) GetUser(ctx context.Context, req *auth.GetUserRequest) (*auth.User, error) {
+	if err := s.app.grpcAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	user, err := s.app.Models.User.GetOne(ctx, int(req.GetId()))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, status.Error(codes.NotFound, "user not found")
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, "could not get user")
+	}
+	return userMessage(user), nil
+}
+
+// ListUsers returns one page of users like the HTTP ListUsers, for administrators only
+func (s *AuthServer) ListUsers(ctx context.Context, req *auth.ListUsersRequest) (*auth.ListUsersResponse, error) {
+	if err := s.app.grpcAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	page, pageSize := int(req.GetPage()), int(req.GetPageSize())
+	if page == 0 {
+		page = 1
+	}
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	if page < 1 || pageSize < 1 || pageSize > 100 || len(req.GetSearch()) > 255 {
+		return nil, status.Error(codes.InvalidArgument, "page must be at least 1, page_size from 1 to 100 and search at most 255 characters")
+	}
+
+	users, total, err := s.app.Models.User.GetPage(ctx, strings.TrimSpace(req.GetSearch()), page, pageSize)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "could not list users")
+	}
+
+	resp := &auth.ListUsersResponse{
+		Users:    make([]*auth.User, len(users)),
+		Total:    total,
+		Page:     int32(page),
+		PageSize: int32(pageSize),
+	}
+	for i, user := range users {
+		resp.Users[i] = userMessage(user)
+	}
+	return resp, nil
+}
+
+func (app *Config) gRPCListen() {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", gRPCPort))
+	if err != nil {
+		log.Fatalf("Failed to listen for gRPC: %v", err)
+	}
+
+	log.Printf("gRPC Server started on port %s", gRPCPort)
+
+	if err := app.gRPCServer().Serve(lis); err != nil {
+		log.Fatalf("Failed to listen for gRPC: %v", err)
+	}
+}
+
+// gRPCServer builds a gRPC server with the auth service registered on it
+func (app *Config) gRPCServer() *grpc.Server {
+	s := grpc.NewServer()
+
+	auth.RegisterAuthServiceServer(s, &AuthServer{app: app})
+
+	return s
+}
+
+// grpcAdmin does the checks of requireAdmin on the bearer token in a call's
+// "authorization" metadata
+func (app *Config) grpcAdmin(ctx context.Context) error {
+	token, ok := strings.CutPrefix(firstMetadata(ctx, "authorization"), "Bearer ")
+	if !ok || token == "" {
+		return status.Error(codes.Unauthenticated, "missing access token")
+	}
+	claims, err := app.Tokens.Parse(token)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	if !claims.Can(authz.UsersAdmin) {
+		return status.Error(codes.PermissionDenied, "missing permission "+authz.UsersAdmin)
+	}
+	if !claims.IsService() && !slices.Contains(claims.AMR, "mfa") {
+		return status.Error(codes.PermissionDenied, "administrators must log in with MFA")
+	}
+	return nil
+}
+
+// grpcClient returns where a call comes from. Like the HTTP routes, it only believes the
+// "x-forwarded-for" and "x-forwarded-user-agent" metadata of calls from TrustedProxies.
+func (app *Config) grpcClient(ctx context.Context) loginClient {
+	client := loginClient{UserAgent: firstMetadata(ctx, "user-agent")}
+	if p, ok := peer.FromContext(ctx); ok {
+		if addr, err := netip.ParseAddrPort(p.Addr.String()); err == nil {
+			client.IP = addr.Addr().Unmap().String()
+		}
+	}
+	if !app.trustedProxy(client.IP) {
+		return client
+	}
+
+	if forwarded := firstMetadata(ctx, "x-forwarded-for"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		client.IP = strings.TrimSpace(hops[len(hops)-1])
+	}
+	if userAgent := firstMetadata(ctx, "x-forwarded-user-agent"); userAgent != "" {
+		client.UserAgent = userAgent
+	}
+	return client
+}
+
+// trustedProxy reports whether ip is one of TrustedProxies, which are addresses or CIDRs
+func (app *Config) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, proxy := range app.TrustedProxies {
+		if prefix, err := netip.ParsePrefix(proxy); err == nil && prefix.Contains(addr) {
+			return true
+		} else if trusted, err := netip.ParseAddr(proxy); err == nil && trusted == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// firstMetadata returns the first value of key in a call's metadata
+func firstMetadata(ctx context.Context, key string) string {
+	if values := metadata.ValueFromIncomingContext(ctx, key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// loginStatus turns an error from a login step into a gRPC status
+func loginStatus(err error) error {
+	var throttled *throttledError
+	switch {
+	case errors.As(err, &throttled):
+		st, _ := status.New(codes.ResourceExhausted, err.Error()).
+			WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(throttled.wait)})
+		return st.Err()
+	case errors.Is(err, errInvalidCredentials):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, errInactiveAccount):
+		return status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// userMessage converts a user to its AuthService message
+func userMessage(user *data.User) *auth.User {
+	return &auth.User{
+		Id:        int64(user.ID),
+		Email:     user.Email,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Active:    user.Active,
+		CreatedAt: timestamppb.New(user.CreatedAt),
+		UpdatedAt: timestamppb.New(user.UpdatedAt),
+	}
+}
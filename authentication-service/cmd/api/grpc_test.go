@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"authentication/auth"
+	"authz"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// grpcClient serves the harness's service over gRPC and returns a client for it
+func (h *harness) grpcClient(t *testing.T) auth.AuthServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 16)
+	s := h.app.gRPCServer()
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return auth.NewAuthServiceClient(conn)
+}
+
+func withBearer(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestGRPCAuthenticate(t *testing.T) {
+	h := newHarness(t)
+	client := h.grpcClient(t)
+	ctx := context.Background()
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	h.addUser(t, "inactive@example.com", "verysecret", false)
+
+	tests := map[string]struct {
+		email, password string
+		code            codes.Code
+	}{
+		"missing password": {"admin@example.com", "", codes.InvalidArgument},
+		"wrong password":   {"admin@example.com", "wrongsecret", codes.Unauthenticated},
+		"unknown email":    {"nobody@example.com", "verysecret", codes.Unauthenticated},
+		"inactive account": {"inactive@example.com", "verysecret", codes.PermissionDenied},
+	}
+	for name, tt := range tests {
+		_, err := client.Authenticate(ctx, &auth.AuthenticateRequest{Email: tt.email, Password: tt.password})
+		if status.Code(err) != tt.code {
+			t.Errorf("%s: expected %s, got %v", name, tt.code, err)
+		}
+	}
+
+	h.expectMFA(t, 1, "")
+	h.expectGrants(1, [2]string{"admin", authz.UsersAdmin})
+	resp, err := client.Authenticate(ctx, &auth.AuthenticateRequest{Email: "admin@example.com", Password: "verysecret"})
+	if err != nil || resp.GetUser().GetEmail() != "admin@example.com" || resp.GetAccessToken() == "" || resp.GetRefreshToken() == "" {
+		t.Fatalf("expected a login, got %+v, %v", resp, err)
+	}
+
+	valid, err := client.ValidateToken(ctx, &auth.ValidateTokenRequest{Token: resp.GetAccessToken()})
+	if err != nil || valid.GetSubject() != "1" || valid.GetPermissions()[0] != authz.UsersAdmin ||
+		valid.GetSessionId() == "" || valid.GetExpiresAt() == nil {
+		t.Fatalf("unexpected claims %+v, %v", valid, err)
+	}
+	if _, err := client.ValidateToken(ctx, &auth.ValidateTokenRequest{Token: "not-a-token"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected an invalid token to be refused, got %v", err)
+	}
+
+	// A locked account is told when to try again
+	for i := 0; i < accountLimitPolicy.LockAfter; i++ {
+		h.limiter.fail("admin@example.com", "10.0.0.1")
+	}
+	_, err = client.Authenticate(ctx, &auth.AuthenticateRequest{Email: "admin@example.com", Password: "verysecret"})
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted || len(st.Details()) != 1 {
+		t.Fatalf("expected a throttled login, got %v", err)
+	}
+	if retry, ok := st.Details()[0].(*errdetails.RetryInfo); !ok || retry.GetRetryDelay().AsDuration() <= 0 {
+		t.Errorf("expected RetryInfo, got %+v", st.Details())
+	}
+}
+
+func TestGRPCUsersRequireAdmin(t *testing.T) {
+	h := newHarness(t)
+	client := h.grpcClient(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	h.addUser(t, "grace@example.com", "verysecret", true)
+
+	withoutMFA, err := h.tokens.Sign(authz.Claims{
+		Permissions:      []string{authz.UsersAdmin},
+		AMR:              []string{"pwd"},
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "1"},
+	}, accessTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := h.tokens.Sign(authz.Claims{
+		Permissions:      []string{authz.LogsRead},
+		AMR:              []string{"pwd", "otp", "mfa"},
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "1"},
+	}, accessTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		ctx  context.Context
+		code codes.Code
+	}{
+		"no token":           {context.Background(), codes.Unauthenticated},
+		"invalid token":      {withBearer("wrong-key"), codes.Unauthenticated},
+		"missing permission": {withBearer(reader), codes.PermissionDenied},
+		"login without MFA":  {withBearer(withoutMFA), codes.PermissionDenied},
+	}
+	for name, tt := range tests {
+		if _, err := client.GetUser(tt.ctx, &auth.GetUserRequest{Id: 1}); status.Code(err) != tt.code {
+			t.Errorf("%s: expected %s from GetUser, got %v", name, tt.code, err)
+		}
+		if _, err := client.ListUsers(tt.ctx, &auth.ListUsersRequest{}); status.Code(err) != tt.code {
+			t.Errorf("%s: expected %s from ListUsers, got %v", name, tt.code, err)
+		}
+	}
+
+	ctx := withBearer(h.admin)
+	user, err := client.GetUser(ctx, &auth.GetUserRequest{Id: 2})
+	if err != nil || user.GetEmail() != "grace@example.com" || !user.GetActive() || user.GetCreatedAt() == nil {
+		t.Fatalf("unexpected user %+v, %v", user, err)
+	}
+	if _, err := client.GetUser(ctx, &auth.GetUserRequest{Id: 42}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected an unknown user not to be found, got %v", err)
+	}
+
+	page, err := client.ListUsers(ctx, &auth.ListUsersRequest{PageSize: 1})
+	if err != nil || page.GetTotal() != 2 || len(page.GetUsers()) != 1 || page.GetPage() != 1 {
+		t.Fatalf("unexpected page %+v, %v", page, err)
+	}
+	if _, err := client.ListUsers(ctx, &auth.ListUsersRequest{PageSize: 101}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected an oversized page to be refused, got %v", err)
+	}
+}
+
+func TestGRPCClientBehindTrustedProxy(t *testing.T) {
+	app := &Config{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}}
+	for ip, want := range map[string]bool{"10.1.2.3": true, "192.168.1.1": true, "192.168.1.2": false, "": false} {
+		if got := app.trustedProxy(ip); got != want {
+			t.Errorf("trustedProxy(%q) = %v, want %v", ip, got, want)
+		}
+	}
+}
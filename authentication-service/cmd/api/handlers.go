@@ -1,15 +1,61 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"authentication/data"
+	"authentication/event"
+	"authz"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// accessTokenTTL is how long the access tokens issued on login are valid
+const accessTokenTTL = 15 * time.Minute
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errInactiveAccount    = errors.New("account is not active")
 )
 
+// throttledError is returned for a login attempt that has to wait, because of earlier
+// failed attempts on the account or from the client IP
+type throttledError struct {
+	wait time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return "too many failed login attempts, try again later"
+}
+
+// loginClient is where a login attempt comes from
+type loginClient struct {
+	IP        string
+	UserAgent string
+}
+
+// loginResult is a successful login step: either a new session with its tokens, or, for
+// users with MFA enabled, a challenge token to present along with their code
+type loginResult struct {
+	User         *data.User
+	AccessToken  string
+	RefreshToken string
+	MFAToken     string
+}
+
+// Authenticate checks an email and password. Failed attempts are counted per account and
+// per client IP, and too many of them make further attempts wait, or lock the account or
+// IP for a while; those attempts get a 429 with a Retry-After header. For users with MFA
+// enabled, the password only earns a challenge token, which VerifyMFA exchanges for the
+// access token.
 func (app *Config) Authenticate(c *gin.Context) {
 	var requestPayload struct {
 		Email    string `json:"email"`
@@ -21,66 +67,219 @@ func (app *Config) Authenticate(c *gin.Context) {
 		return
 	}
 
-	// Validate the user against the database
-	user, err := app.Models.User.GetByEmail(requestPayload.Email)
+	result, err := app.passwordLogin(c.Request.Context(), requestPayload.Email, requestPayload.Password, clientOf(c))
 	if err != nil {
-		app.errorJSON(c, errors.New("invalid credentials"), http.StatusBadRequest)
+		app.loginError(c, err)
 		return
 	}
+	app.writeLogin(c, result)
+}
+
+// passwordLogin checks an email and password from client, and starts a session or, for
+// users with MFA enabled, an MFA challenge. It fails with a *throttledError,
+// errInvalidCredentials or errInactiveAccount, or with an error that is safe to show for
+// anything else that goes wrong.
+func (app *Config) passwordLogin(ctx context.Context, email, password string, client loginClient) (*loginResult, error) {
+	account, ip := normalizeEmail(email), client.IP
+	if wait, ok := app.Limiter.allow(account, ip); !ok {
+		return nil, &throttledError{wait: wait}
+	}
 
-	valid, err := user.PasswordMatches(requestPayload.Password)
+	// Validate the user against the database, by the email as it was stored. An unknown
+	// email still costs a password comparison, so it takes as long to reject as a wrong
+	// password.
+	user, err := app.Models.User.GetByEmail(ctx, account)
+	if err != nil {
+		data.SimulatePasswordCheck(password)
+		app.Limiter.fail(account, ip)
+		app.loginFailed(account, ip, "unknown email")
+		return nil, errInvalidCredentials
+	}
+
+	valid, err := app.Models.User.PasswordMatches(ctx, user, password)
 	if err != nil || !valid {
-		app.errorJSON(c, errors.New("invalid credentials"), http.StatusBadRequest)
+		app.Limiter.fail(account, ip)
+		app.loginFailed(account, ip, "wrong password")
+		return nil, errInvalidCredentials
+	}
+
+	// Only verified accounts that haven't been deactivated can log in
+	if !user.Active {
+		app.loginFailed(account, ip, "account is not active")
+		return nil, errInactiveAccount
+	}
+
+	// Failures are only forgotten once the second factor is verified too, or a stolen
+	// password could be used to keep guessing codes
+	mfa, err := app.Models.MFA.Get(ctx, user.ID)
+	if err == nil && mfa.Enabled {
+		return app.challengeMFA(ctx, user, "pwd")
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errors.New("could not log in")
+	}
+
+	app.Limiter.succeed(account)
+	return app.startSession(ctx, user, []string{"pwd"}, client)
+}
+
+// completeLogin starts a session for user, who proved who they are in the ways listed in
+// amr, and writes the login response with its access and refresh tokens
+func (app *Config) completeLogin(c *gin.Context, user *data.User, amr []string) {
+	result, err := app.startSession(c.Request.Context(), user, amr, clientOf(c))
+	if err != nil {
+		app.loginError(c, err)
 		return
 	}
+	app.writeLogin(c, result)
+}
 
-	// Log authentication
-	err = app.logRequest("authentication", fmt.Sprintf("%s logged in", user.Email))
+// startSession starts a session on client for user, who proved who they are in the ways
+// listed in amr, and issues its tokens
+func (app *Config) startSession(ctx context.Context, user *data.User, amr []string, client loginClient) (*loginResult, error) {
+	session := &data.Session{
+		UserID:    user.ID,
+		Device:    describeDevice(client.UserAgent),
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+		AMR:       amr,
+	}
+	refreshToken, err := app.Models.Session.Create(ctx, session, sessionTTL)
 	if err != nil {
-		app.errorJSON(c, err)
+		return nil, errors.New("could not start session")
+	}
+
+	token, err := app.accessToken(ctx, user, session)
+	if err != nil {
+		return nil, errors.New("could not issue access token")
+	}
+
+	app.logEvent(event.Info, "authentication", fmt.Sprintf("%s logged in from %s", user.Email, client.IP))
+	return &loginResult{User: user, AccessToken: token, RefreshToken: refreshToken}, nil
+}
+
+// writeLogin writes the response to a successful login step
+func (app *Config) writeLogin(c *gin.Context, result *loginResult) {
+	if result.MFAToken != "" {
+		app.writeJSON(c, http.StatusAccepted, jsonResponse{
+			Error:   false,
+			Message: "Enter the code from your authenticator app",
+			Data: gin.H{
+				"mfa_required": true,
+				"mfa_token":    result.MFAToken,
+				"expires_in":   int(mfaChallengeTTL.Seconds()),
+			},
+		})
 		return
 	}
+	app.writeSessionTokens(c, fmt.Sprintf("Logged in user %s", result.User.Email), result.User, result.AccessToken, result.RefreshToken)
+}
 
+// loginError writes the response to a failed login step
+func (app *Config) loginError(c *gin.Context, err error) {
+	var throttled *throttledError
+	switch {
+	case errors.As(err, &throttled):
+		app.tooManyAttempts(c, throttled.wait)
+	case errors.Is(err, errInvalidCredentials):
+		app.errorJSON(c, err, http.StatusBadRequest)
+	case errors.Is(err, errInactiveAccount):
+		app.errorJSON(c, err, http.StatusForbidden)
+	default:
+		app.errorJSON(c, err, http.StatusInternalServerError)
+	}
+}
+
+// clientOf returns where a login request comes from
+func clientOf(c *gin.Context) loginClient {
+	return loginClient{IP: c.ClientIP(), UserAgent: c.Request.UserAgent()}
+}
+
+// writeSessionTokens writes the response to a login or a refresh
+func (app *Config) writeSessionTokens(c *gin.Context, message string, user *data.User, token, refreshToken string) {
 	payload := gin.H{
 		"error":   false,
-		"message": fmt.Sprintf("Logged in user %s", user.Email),
-		"data":    user,
+		"message": message,
+		"data": gin.H{
+			"user":          user,
+			"access_token":  token,
+			"token_type":    "Bearer",
+			"expires_in":    int(accessTokenTTL.Seconds()),
+			"refresh_token": refreshToken,
+		},
 	}
 
 	c.JSON(http.StatusAccepted, payload)
 }
-func (app *Config) logRequest(name, data string) error {
-	entry := struct {
-		Name string `json:"name"`
-		Data string `json:"data"`
-	}{
-		Name: name,
-		Data: data,
-	}
 
-	jsonData, err := json.MarshalIndent(entry, "", "\t")
-	if err != nil {
-		return err
-	}
+// tooManyAttempts tells the client to wait before trying to log in again
+func (app *Config) tooManyAttempts(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	app.errorJSON(c, errors.New("too many failed login attempts, try again later"), http.StatusTooManyRequests)
+}
 
-	logServiceURL := "http://logger-service/log"
-	request, err := http.NewRequest("POST", logServiceURL, bytes.NewBuffer(jsonData))
+// accessToken issues an access token for user in session, carrying their roles and
+// permissions
+func (app *Config) accessToken(ctx context.Context, user *data.User, session *data.Session) (string, error) {
+	roles, permissions, err := app.Models.Role.Grants(ctx, user.ID)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return app.Tokens.Sign(authz.Claims{
+		Email:            user.Email,
+		Roles:            roles,
+		Permissions:      permissions,
+		AMR:              session.AMR,
+		AuthTime:         jwt.NewNumericDate(session.AuthenticatedAt),
+		SessionID:        session.ID,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.Itoa(user.ID)},
+	}, accessTokenTTL)
+}
 
-	request.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	response, err := client.Do(request)
+// setServiceToken authorizes a request to another service with a token of this service's
+// own
+func (app *Config) setServiceToken(r *http.Request) error {
+	token, err := app.Tokens.ServiceToken("authentication-service")
 	if err != nil {
 		return err
 	}
-	defer response.Body.Close()
+	r.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
 
-	if response.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("error logging request: status code %d", response.StatusCode)
+// lockoutEvent records a lock or unlock from the login limiter in the audit log
+func (app *Config) lockoutEvent(e lockEvent) {
+	if e.Locked {
+		app.logEvent(event.Warning, "audit", fmt.Sprintf("%s %s locked until %s after %d failed logins",
+			e.Kind, e.Key, e.Until.UTC().Format(time.RFC3339), e.Failures))
+	} else {
+		app.logEvent(event.Info, "audit", fmt.Sprintf("%s %s unlocked: %s", e.Kind, e.Key, e.Reason))
 	}
+}
 
-	return nil
+// loginFailed records a failed login attempt for email from ip in the audit log
+func (app *Config) loginFailed(email, ip, reason string) {
+	app.logEvent(event.Warning, "authentication", fmt.Sprintf("failed login for %s from %s: %s", email, ip, reason))
+}
+
+// audit records msg in the audit log
+func (app *Config) audit(msg string) {
+	app.logEvent(event.Info, "audit", msg)
+}
+
+// EventStats reports how many log events were published, are waiting to be, were returned
+// because no queue took them, or were dropped because they couldn't be kept until RabbitMQ
+// took them
+func (app *Config) EventStats(c *gin.Context) {
+	stats := app.Events.Stats()
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d events dropped", stats.Dropped),
+		Data:    stats,
+	})
+}
+
+// logEvent publishes an entry for the logger service under topic. It returns at once and
+// can't fail: a logger or RabbitMQ outage must never fail the request that is logged.
+func (app *Config) logEvent(topic, name, data string) {
+	app.Events.Publish(topic, event.Entry{Name: name, Data: data})
 }
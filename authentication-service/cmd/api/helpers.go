@@ -3,10 +3,13 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
 )
 
 type jsonResponse struct {
@@ -68,3 +71,47 @@ func (app *Config) errorJSON(c *gin.Context, err error, status ...int) error {
 
 	return app.writeJSON(c, statusCode, payload)
 }
+
+// validationError turns the error returned by gin's binding into a message that names the
+// offending fields by their JSON or query names
+func validationError(err error) error {
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return fmt.Errorf("invalid request: %w", err)
+	}
+
+	problems := make([]string, 0, len(verrs))
+	for _, fe := range verrs {
+		field := toSnakeCase(fe.Field())
+		switch fe.Tag() {
+		case "required":
+			problems = append(problems, field+" is required")
+		case "email":
+			problems = append(problems, field+" must be a valid email address")
+		case "min":
+			problems = append(problems, fmt.Sprintf("%s must be at least %s", field, fe.Param()))
+		case "max":
+			problems = append(problems, fmt.Sprintf("%s must be at most %s", field, fe.Param()))
+		case "oneof":
+			problems = append(problems, fmt.Sprintf("%s must be one of %s", field, strings.ReplaceAll(fe.Param(), " ", ", ")))
+		default:
+			problems = append(problems, field+" is invalid")
+		}
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// toSnakeCase converts a Go field name such as FirstName into first_name
+func toSnakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
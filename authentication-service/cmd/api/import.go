@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"authentication/data"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+)
+
+// The formats users are imported from and exported to
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+// maxImportBytes limits the size of a file imported over HTTP
+const maxImportBytes = 64 << 20
+
+// importColumns are the columns an import file may have. An export has the same columns
+// except password, so that it can be imported elsewhere; its id and created_at are
+// ignored.
+var importColumns = []string{"id", "email", "first_name", "last_name", "active", "created_at", "password", "password_hash"}
+
+// importRow is one user in an import file
+type importRow struct {
+	Email        string `json:"email" binding:"required,email,max=255"`
+	FirstName    string `json:"first_name" binding:"max=255"`
+	LastName     string `json:"last_name" binding:"max=255"`
+	Password     string `json:"password"`
+	PasswordHash string `json:"password_hash"`
+	// Active is optional; users are imported active by default
+	Active *bool `json:"active"`
+}
+
+// exportRow is one user in an export file
+type exportRow struct {
+	ID           int       `json:"id"`
+	Email        string    `json:"email"`
+	FirstName    string    `json:"first_name"`
+	LastName     string    `json:"last_name"`
+	Active       bool      `json:"active"`
+	CreatedAt    time.Time `json:"created_at"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+}
+
+type importOptions struct {
+	Format string
+	// HashedPasswords says the rows have a password_hash, made by this or another
+	// installation, rather than a plain text password
+	HashedPasswords bool
+	// DryRun checks every row, and whether its email is taken, without creating users
+	DryRun bool
+}
+
+// importError is why the row on Line was not imported
+type importError struct {
+	Line  int    `json:"line"`
+	Email string `json:"email,omitempty"`
+	Error string `json:"error"`
+}
+
+// importReport is the outcome of an import. In a dry run, Created counts the users that
+// would be created.
+type importReport struct {
+	DryRun  bool          `json:"dry_run"`
+	Rows    int           `json:"rows"`
+	Created int           `json:"created"`
+	Failed  int           `json:"failed"`
+	Errors  []importError `json:"errors"`
+}
+
+type importQuery struct {
+	Format    string `form:"format" binding:"omitempty,oneof=csv ndjson"`
+	Passwords string `form:"passwords" binding:"omitempty,oneof=plaintext hashed"`
+	DryRun    bool   `form:"dry_run"`
+}
+
+type exportQuery struct {
+	Format         string `form:"format" binding:"omitempty,oneof=csv ndjson"`
+	PasswordHashes bool   `form:"password_hashes"`
+}
+
+// ImportUsers creates users from the CSV or NDJSON file in the request body. The format is
+// taken from the format query parameter or the Content-Type. Rows that can't be imported
+// are listed in the response with their line numbers; the others are created, unless
+// dry_run is set.
+func (app *Config) ImportUsers(c *gin.Context) {
+	var query importQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+	format := query.Format
+	if format == "" {
+		format = formatFromContentType(c.ContentType())
+	}
+	if format == "" {
+		app.errorJSON(c, errors.New("format must be one of csv, ndjson"))
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	report, err := importUsers(c.Request.Context(), app.Models.User, body, importOptions{
+		Format:          format,
+		HashedPasswords: query.Passwords == "hashed",
+		DryRun:          query.DryRun,
+	})
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		app.errorJSON(c, fmt.Errorf("the file must be at most %d MiB", maxImportBytes>>20), http.StatusRequestEntityTooLarge)
+		return
+	} else if report == nil {
+		app.errorJSON(c, err)
+		return
+	}
+	if !report.DryRun && report.Created > 0 {
+		app.audit(fmt.Sprintf("%d users imported by an administrator", report.Created))
+	}
+	if err != nil {
+		log.Println("Error importing users:", err)
+		app.writeJSON(c, http.StatusInternalServerError, jsonResponse{
+			Error:   true,
+			Message: fmt.Sprintf("could not import users, %d were created before the failure", report.Created),
+			Data:    report,
+		})
+		return
+	}
+
+	message := fmt.Sprintf("imported %d of %d users", report.Created, report.Rows)
+	if report.DryRun {
+		message = fmt.Sprintf("%d of %d users can be imported", report.Created, report.Rows)
+	}
+	app.writeJSON(c, http.StatusOK, jsonResponse{Error: false, Message: message, Data: report})
+}
+
+// ExportUsers streams every user as CSV (the default) or NDJSON. Password hashes are only
+// included when password_hashes is set.
+func (app *Config) ExportUsers(c *gin.Context) {
+	var query exportQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+	format, contentType := formatCSV, "text/csv"
+	if query.Format == formatNDJSON {
+		format, contentType = formatNDJSON, "application/x-ndjson"
+	}
+
+	msg := "users exported by an administrator"
+	if query.PasswordHashes {
+		msg = "users exported with their password hashes by an administrator"
+	}
+	app.audit(msg)
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+	c.Status(http.StatusOK)
+	if err := exportUsers(c.Request.Context(), app.Models.User, c.Writer, format, query.PasswordHashes); err != nil {
+		// The status is sent already, so the file just ends early
+		log.Println("Error exporting users:", err)
+	}
+}
+
+// formatFromContentType returns the import format of a Content-Type, or "" if it is not
+// one
+func formatFromContentType(contentType string) string {
+	switch contentType {
+	case "text/csv":
+		return formatCSV
+	case "application/x-ndjson", "application/jsonl":
+		return formatNDJSON
+	}
+	return ""
+}
+
+// importUsers reads users from r and creates them in users. It returns no report when r
+// can't be read as a whole, and a report of what was created along with the error when
+// storing the users failed.
+func importUsers(ctx context.Context, users data.UserRepository, r io.Reader, opts importOptions) (*importReport, error) {
+	report := &importReport{DryRun: opts.DryRun, Errors: []importError{}}
+	var valid []data.User
+	var lines []int
+	err := readImport(r, opts.Format, func(line int, row importRow, err error) {
+		report.Rows++
+		var user data.User
+		if err == nil {
+			user, err = row.user(opts)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, importError{Line: line, Email: row.Email, Error: err.Error()})
+			return
+		}
+		valid = append(valid, user)
+		lines = append(lines, line)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	failed, err := users.Import(ctx, valid, opts.DryRun)
+	for i, user := range valid {
+		if rowErr, ok := failed[i]; ok {
+			if errors.Is(rowErr, gorm.ErrDuplicatedKey) {
+				rowErr = errors.New("a user with that email already exists")
+			}
+			report.Errors = append(report.Errors, importError{Line: lines[i], Email: user.Email, Error: rowErr.Error()})
+		} else if opts.DryRun || user.ID != 0 {
+			report.Created++
+		}
+	}
+	sort.SliceStable(report.Errors, func(i, j int) bool { return report.Errors[i].Line < report.Errors[j].Line })
+	report.Failed = len(report.Errors)
+	return report, err
+}
+
+// user returns the user to create for row, with its password hashed
+func (row importRow) user(opts importOptions) (data.User, error) {
+	row.Email = strings.TrimSpace(row.Email)
+	if err := binding.Validator.ValidateStruct(&row); err != nil {
+		return data.User{}, validationError(err)
+	}
+	user := data.User{
+		Email:     normalizeEmail(row.Email),
+		FirstName: strings.TrimSpace(row.FirstName),
+		LastName:  strings.TrimSpace(row.LastName),
+		Active:    row.Active == nil || *row.Active,
+	}
+
+	if opts.HashedPasswords {
+		switch {
+		case row.Password != "":
+			return data.User{}, errors.New("password must be empty when importing password hashes")
+		case row.PasswordHash == "":
+			return data.User{}, errors.New("password_hash is required")
+		case data.CheckPasswordHash(row.PasswordHash) != nil:
+			return data.User{}, errors.New("password_hash must be an argon2id or bcrypt hash")
+		}
+		user.Password = row.PasswordHash
+		return user, nil
+	}
+
+	if row.PasswordHash != "" {
+		return data.User{}, errors.New("password_hash must be empty when importing plain text passwords")
+	}
+	if err := validatePassword(row.Password); err != nil {
+		return data.User{}, err
+	}
+	// A dry run skips the hashing, which takes most of the time of an import
+	if !opts.DryRun {
+		hash, err := data.HashPassword(row.Password)
+		if err != nil {
+			return data.User{}, err
+		}
+		user.Password = hash
+	}
+	return user, nil
+}
+
+// readImport calls fn with every row of r, by line number. Rows that can't be parsed come
+// with an error. It fails when r as a whole can't be read, such as a CSV file without a
+// header or with unknown columns.
+func readImport(r io.Reader, format string, fn func(line int, row importRow, err error)) error {
+	if format == formatNDJSON {
+		return readNDJSON(r, fn)
+	}
+	return readCSV(r, fn)
+}
+
+func readNDJSON(r io.Reader, fn func(line int, row importRow, err error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var row importRow
+		if err := json.Unmarshal([]byte(text), &row); err != nil {
+			fn(line, row, errors.New("invalid JSON"))
+			continue
+		}
+		fn(line, row, nil)
+	}
+	return scanner.Err()
+}
+
+func readCSV(r io.Reader, fn func(line int, row importRow, err error)) error {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return errors.New("the file is empty")
+	} else if err != nil {
+		return err
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		// Spreadsheets may start the file with a byte order mark
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !slices.Contains(importColumns, name) {
+			return fmt.Errorf("unknown column %q, the columns are %s", name, strings.Join(importColumns, ", "))
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["email"]; !ok {
+		return errors.New("the email column is required")
+	}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		line, _ := reader.FieldPos(0)
+		if errors.Is(err, csv.ErrFieldCount) {
+			fn(line, importRow{}, fmt.Errorf("expected %d fields, got %d", len(header), len(record)))
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return record[i]
+			}
+			return ""
+		}
+		row := importRow{
+			Email:        field("email"),
+			FirstName:    field("first_name"),
+			LastName:     field("last_name"),
+			Password:     field("password"),
+			PasswordHash: field("password_hash"),
+		}
+		if active := strings.TrimSpace(field("active")); active != "" {
+			value, err := strconv.ParseBool(active)
+			if err != nil {
+				fn(line, row, errors.New("active must be true or false"))
+				continue
+			}
+			row.Active = &value
+		}
+		fn(line, row, nil)
+	}
+}
+
+// exportUsers writes every user in users to w in format, with their password hashes if
+// withHashes is set
+func exportUsers(ctx context.Context, users data.UserRepository, w io.Writer, format string, withHashes bool) error {
+	row := func(user *data.User) exportRow {
+		r := exportRow{
+			ID:        user.ID,
+			Email:     user.Email,
+			FirstName: user.FirstName,
+			LastName:  user.LastName,
+			Active:    user.Active,
+			CreatedAt: user.CreatedAt.UTC(),
+		}
+		if withHashes {
+			r.PasswordHash = user.Password
+		}
+		return r
+	}
+
+	if format == formatNDJSON {
+		enc := json.NewEncoder(w)
+		return users.Each(ctx, func(user *data.User) error {
+			return enc.Encode(row(user))
+		})
+	}
+
+	writer := csv.NewWriter(w)
+	header := []string{"id", "email", "first_name", "last_name", "active", "created_at"}
+	if withHashes {
+		header = append(header, "password_hash")
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	err := users.Each(ctx, func(user *data.User) error {
+		r := row(user)
+		record := []string{strconv.Itoa(r.ID), r.Email, r.FirstName, r.LastName, strconv.FormatBool(r.Active), r.CreatedAt.Format(time.RFC3339)}
+		if withHashes {
+			record = append(record, r.PasswordHash)
+		}
+		return writer.Write(record)
+	})
+	writer.Flush()
+	if err != nil {
+		return err
+	}
+	return writer.Error()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"authentication/data"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// upload sends body to path as an administrator and returns the status and response
+func (h *harness) upload(t *testing.T, path, contentType, body string) (int, jsonResponse) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, h.server.URL+path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+h.admin)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out jsonResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, out
+}
+
+// importReportOf decodes the report in an import response
+func importReportOf(t *testing.T, resp jsonResponse) importReport {
+	t.Helper()
+	b, _ := json.Marshal(resp.Data)
+	var report importReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestImportUsersFromCSV(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "taken@example.com", "verysecret", true)
+
+	file := "\ufeffemail,first_name,last_name,password,active\n" +
+		"Ada@Example.com,Ada,Lovelace,verysecret,\n" +
+		"not-an-email,Bad,Email,verysecret,true\n" +
+		"grace@example.com,Grace,Hopper,short,true\n" +
+		"taken@example.com,Already,There,verysecret,true\n" +
+		"ada@example.com,Ada,Again,verysecret,true\n" +
+		"linus@example.com,Linus,Torvalds,verysecret,no\n" +
+		"too,many,fields,here,true,extra\n"
+	want := []importError{
+		{Line: 3, Email: "not-an-email", Error: "email must be a valid email address"},
+		{Line: 4, Email: "grace@example.com", Error: "password must be at least 8 characters"},
+		{Line: 5, Email: "taken@example.com", Error: "a user with that email already exists"},
+		{Line: 6, Email: "ada@example.com", Error: "a user with that email already exists"},
+		{Line: 7, Email: "linus@example.com", Error: "active must be true or false"},
+		{Line: 8, Error: "expected 5 fields, got 6"},
+	}
+
+	// A dry run reports the same problems, but creates nobody
+	status, resp := h.upload(t, "/users/import?dry_run=true", "text/csv", file)
+	report := importReportOf(t, resp)
+	if status != http.StatusOK || resp.Message != "1 of 7 users can be imported" || !report.DryRun || len(report.Errors) != len(want) {
+		t.Fatalf("unexpected dry run %d %+v", status, resp)
+	}
+	if _, err := h.users.GetByEmail(context.Background(), "ada@example.com"); err == nil {
+		t.Fatal("a dry run should not create users")
+	}
+
+	status, resp = h.upload(t, "/users/import", "text/csv", file)
+	report = importReportOf(t, resp)
+	if status != http.StatusOK || resp.Message != "imported 1 of 7 users" || report.Failed != 6 {
+		t.Fatalf("unexpected import %d %+v", status, resp)
+	}
+	for i := range want {
+		if report.Errors[i] != want[i] {
+			t.Errorf("error %d: got %+v, want %+v", i, report.Errors[i], want[i])
+		}
+	}
+
+	user, err := h.users.GetByEmail(context.Background(), "ada@example.com")
+	if err != nil || user.FirstName != "Ada" || !user.Active {
+		t.Fatalf("expected Ada to be imported active, got %+v, %v", user, err)
+	}
+	h.expectMFA(t, user.ID, "")
+	h.expectGrants(user.ID)
+	if status, _ := h.authenticate(t, "ada@example.com", "verysecret"); status != http.StatusAccepted {
+		t.Errorf("expected the imported user to log in, got %d", status)
+	}
+}
+
+func TestImportUsersWithHashedPasswords(t *testing.T) {
+	h := newHarness(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("verysecret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := `{"email":"ada@example.com","first_name":"Ada","password_hash":"` + string(hash) + `"}` + "\n" +
+		"\n" +
+		`{"email":"grace@example.com","password_hash":"plain text"}` + "\n" +
+		`{"email":"linus@example.com","password":"verysecret"}` + "\n" +
+		`{"email":` + "\n"
+	status, resp := h.upload(t, "/users/import?passwords=hashed", "application/x-ndjson", file)
+	report := importReportOf(t, resp)
+	if status != http.StatusOK || report.Rows != 4 || report.Created != 1 {
+		t.Fatalf("unexpected import %d %+v", status, resp)
+	}
+	want := []importError{
+		{Line: 3, Email: "grace@example.com", Error: "password_hash must be an argon2id or bcrypt hash"},
+		{Line: 4, Email: "linus@example.com", Error: "password must be empty when importing password hashes"},
+		{Line: 5, Error: "invalid JSON"},
+	}
+	for i := range want {
+		if i >= len(report.Errors) || report.Errors[i] != want[i] {
+			t.Fatalf("got errors %+v, want %+v", report.Errors, want)
+		}
+	}
+
+	// The hash is kept as it is
+	h.expectMFA(t, 1, "")
+	h.expectGrants(1)
+	if status, _ := h.authenticate(t, "ada@example.com", "verysecret"); status != http.StatusAccepted {
+		t.Errorf("expected the imported user to log in, got %d", status)
+	}
+
+	if status, resp := h.upload(t, "/users/import", "application/octet-stream", file); status != http.StatusBadRequest ||
+		resp.Message != "format must be one of csv, ndjson" {
+		t.Errorf("expected an unknown format to be refused, got %d %+v", status, resp)
+	}
+	if status, resp := h.upload(t, "/users/import?format=csv", "text/plain", "mail,password\n"); status != http.StatusBadRequest ||
+		!strings.HasPrefix(resp.Message, `unknown column "mail"`) {
+		t.Errorf("expected an unknown column to be refused, got %d %+v", status, resp)
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "ada@example.com", "verysecret", true)
+	h.addUser(t, "grace@example.com", "verysecret", false)
+
+	get := func(path string) (string, string) {
+		req, _ := http.NewRequest(http.MethodGet, h.server.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+h.admin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", resp.StatusCode, body)
+		}
+		return resp.Header.Get("Content-Type"), string(body)
+	}
+
+	contentType, body := get("/users/export")
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if contentType != "text/csv" || len(lines) != 3 || lines[0] != "id,email,first_name,last_name,active,created_at" ||
+		!strings.HasPrefix(lines[1], "1,ada@example.com,Admin,User,true,") ||
+		!strings.HasPrefix(lines[2], "2,grace@example.com,Admin,User,false,") {
+		t.Fatalf("unexpected CSV export %s:\n%s", contentType, body)
+	}
+
+	// An export with password hashes can be imported into another installation
+	contentType, body = get("/users/export?format=ndjson&password_hashes=true")
+	if contentType != "application/x-ndjson" || strings.Count(body, "\n") != 2 ||
+		!strings.Contains(body, `"password_hash":"$2a$04$`) {
+		t.Fatalf("unexpected NDJSON export %s:\n%s", contentType, body)
+	}
+	other := newHarness(t)
+	status, resp := other.upload(t, "/users/import?passwords=hashed", "application/x-ndjson", body)
+	if report := importReportOf(t, resp); status != http.StatusOK || report.Created != 2 {
+		t.Fatalf("expected the export to import, got %d %+v", status, resp)
+	}
+	imported, err := other.users.GetByEmail(context.Background(), "grace@example.com")
+	if err != nil || imported.Active || imported.Password != h.storedUser(t, 2).Password {
+		t.Errorf("unexpected imported user %+v, %v", imported, err)
+	}
+	if events, _ := other.users.Outbox().Pending(context.Background(), 10); len(events) != 2 || events[0].RoutingKey != data.UserCreated {
+		t.Errorf("expected a user.created event for each imported user, got %+v", events)
+	}
+}
@@ -0,0 +1,1322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"authentication/data"
+	"authentication/event"
+	"authz"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type logEntry struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+// harness runs the authentication router against an in-memory user store, a stubbed
+// database for everything else, a fake mail service, and records the log events it
+// publishes
+type harness struct {
+	server   *httptest.Server
+	users    *data.MemoryUserRepository
+	oauth    *data.MemoryOAuthRepository
+	sessions *data.MemorySessionRepository
+	apiKeys  *data.MemoryAPIKeyRepository
+	keys     *keyRing
+	mock     sqlmock.Sqlmock
+	limiter  *loginLimiter
+	tokens   *authz.Tokens
+	// admin is an access token of user 1 as an administrator, logged in with MFA
+	admin string
+	// publicKey verifies the tokens signed with tokens
+	publicKey ed25519.PublicKey
+	secrets   *secretBox
+	events    *event.Publisher
+	app       *Config
+	// userEvents receives the messages relayed from the outbox
+	userEvents *fakeSink
+
+	mu         sync.Mutex
+	logs       []logEntry
+	loggerDown bool
+	mails      []mailMessage
+}
+
+var testPasswordParams = data.PasswordParams{Algorithm: data.Bcrypt, BcryptCost: bcrypt.MinCost}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	// Match the cheap hashes the fixtures use, so logins don't upgrade them
+	if err := data.SetPasswordParams(testPasswordParams); err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	conn, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := newSecretBox(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &harness{
+		users:     data.NewMemoryUserRepository(),
+		oauth:     data.NewMemoryOAuthRepository(),
+		sessions:  data.NewMemorySessionRepository(),
+		apiKeys:   data.NewMemoryAPIKeyRepository(),
+		mock:      mock,
+		tokens:    authz.NewSigner(private),
+		publicKey: public,
+		secrets:   secrets,
+	}
+
+	h.admin, err = h.tokens.Sign(authz.Claims{
+		Permissions:      []string{authz.UsersAdmin},
+		AMR:              []string{"pwd", "mfa"},
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "1"},
+	}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Log events go to the harness itself, as their sink
+	h.events, err = event.NewPublisher(h, event.Options{
+		BufferSize:    100,
+		SpillFile:     filepath.Join(t.TempDir(), "events.jsonl"),
+		RetryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	go h.events.Run(stop)
+	t.Cleanup(func() { close(stop) })
+
+	mailer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg mailMessage
+		if !h.authorized(r, authz.MailSend) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/send" || json.NewDecoder(r.Body).Decode(&msg) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		h.mu.Lock()
+		h.mails = append(h.mails, msg)
+		h.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(mailer.Close)
+
+	models := data.New(conn)
+	models.User = h.users
+	models.OAuth = h.oauth
+	models.Session = h.sessions
+	models.APIKey = h.apiKeys
+	models.Outbox = h.users.Outbox()
+	models.Erasure = data.NewMemoryErasureRepository()
+	h.userEvents = &fakeSink{}
+	h.keys = newKeyRing(h.oauth, h.secrets, 24*time.Hour)
+	app := &Config{
+		DB:              conn,
+		Models:          models,
+		MailServiceURL:  mailer.URL,
+		PublicURL:       "http://auth.test",
+		FrontendURL:     "http://frontend.test",
+		TokenSigningKey: []byte("test-signing-key"),
+		Tokens:          h.tokens,
+		ServiceSecrets:  map[string]string{"broker-service": "broker-secret", "billing-service": "billing-secret"},
+		Secrets:         h.secrets,
+		Keys:            h.keys,
+		Events:          h.events,
+		OutboxSinks:     map[string]event.Sink{data.UsersExchange: h.userEvents},
+	}
+	h.app = app
+	app.Revocations = authz.NewRevocationList(app.revokedSessions)
+	h.tokens.CheckRevocations(app.Revocations)
+	app.Limiter = newLoginLimiter(accountLimitPolicy, ipLimitPolicy, app.lockoutEvent)
+	h.limiter = app.Limiter
+	app.MagicLinks = newLinkLimiter(magicLinkLimit, magicLinkWindow)
+	app.PasswordResets = newLinkLimiter(passwordResetLimit, passwordResetWindow)
+	h.server = httptest.NewServer(app.routes())
+	t.Cleanup(h.server.Close)
+
+	return h
+}
+
+// addUser stores a user and returns its ID. IDs start at 1.
+func (h *harness) addUser(t *testing.T, email, password string, active bool) int {
+	t.Helper()
+	id, err := h.users.Insert(context.Background(), data.User{
+		Email: email, FirstName: "Admin", LastName: "User", Password: password, Active: active,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// storedUser returns the user with id as stored
+func (h *harness) storedUser(t *testing.T, id int) *data.User {
+	t.Helper()
+	user, err := h.users.GetOne(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// expectMFA stubs the lookup of a user's MFA settings on login. With an empty secret the
+// user has no MFA; otherwise it is enabled with that TOTP secret.
+func (h *harness) expectMFA(t *testing.T, userID int, secret string) {
+	t.Helper()
+	query := h.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_mfa" WHERE user_id = $1`)).
+		WithArgs(userID, 1)
+	if secret == "" {
+		query.WillReturnError(gorm.ErrRecordNotFound)
+		return
+	}
+	sealed, err := h.secrets.seal([]byte(secret), mfaContext(userID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query.WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret", "enabled", "last_used_step"}).
+		AddRow(userID, sealed, true, 0))
+}
+
+// expectGrants stubs the lookup of a user's roles and permissions on login. Each row is a
+// role name followed by one of its permissions.
+func (h *harness) expectGrants(userID int, rows ...[2]string) {
+	result := sqlmock.NewRows([]string{"role", "permission"})
+	for _, row := range rows {
+		result.AddRow(row[0], row[1])
+	}
+	h.mock.ExpectQuery(regexp.QuoteMeta(`SELECT roles.name AS role, permissions.name AS permission FROM "user_roles"`)).
+		WithArgs(userID).
+		WillReturnRows(result)
+}
+
+// authorized reports whether a request to a fake service carries a token granting permission
+func (h *harness) authorized(r *http.Request, permission string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	claims, err := h.tokens.Parse(token)
+	return err == nil && claims.Can(permission)
+}
+
+// Send takes the service's log events, or fails while loggerDown is set
+func (h *harness) Send(ctx context.Context, topic string, body []byte) error {
+	var entry logEntry
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.loggerDown {
+		return errors.New("connection refused")
+	}
+	h.logs = append(h.logs, entry)
+	return nil
+}
+
+// fakeSink records the routing keys of the messages it is sent, and fails while down is set
+type fakeSink struct {
+	mu   sync.Mutex
+	down bool
+	keys []string
+}
+
+func (s *fakeSink) Send(ctx context.Context, topic string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errors.New("connection refused")
+	}
+	s.keys = append(s.keys, topic)
+	return nil
+}
+
+func (s *fakeSink) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *fakeSink) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.keys...)
+}
+
+func (h *harness) setLoggerDown(down bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.loggerDown = down
+}
+
+func (h *harness) loggedEntries() []logEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]logEntry(nil), h.logs...)
+}
+
+func (h *harness) sentMails() []mailMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]mailMessage(nil), h.mails...)
+}
+
+// waitFor polls cond until it holds, for work that handlers finish after responding
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// do sends a request to the authentication service and decodes its JSON response
+func (h *harness) do(t *testing.T, method, path, token string, payload any) (int, jsonResponse) {
+	t.Helper()
+	var body bytes.Buffer
+	if payload != nil {
+		json.NewEncoder(&body).Encode(payload)
+	}
+	req, _ := http.NewRequest(method, h.server.URL+path, &body)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out jsonResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, out
+}
+
+func (h *harness) authenticate(t *testing.T, email, password string) (int, jsonResponse) {
+	t.Helper()
+	return h.do(t, http.MethodPost, "/authenticate", "", map[string]string{"email": email, "password": password})
+}
+
+func TestAuthenticateLogsLogin(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	h.expectMFA(t, 1, "")
+	h.expectGrants(1, [2]string{"admin", authz.LogsRead}, [2]string{"admin", authz.UsersAdmin}, [2]string{"auditor", authz.LogsRead})
+
+	status, resp := h.authenticate(t, "admin@example.com", "verysecret")
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("expected 202 without error, got %d %+v", status, resp)
+	}
+	login, _ := resp.Data.(map[string]any)
+	if user, _ := login["user"].(map[string]any); user["email"] != "admin@example.com" || user["password"] != nil {
+		t.Errorf("unexpected user in response: %+v", user)
+	}
+
+	token, _ := login["access_token"].(string)
+	claims, err := h.tokens.Parse(token)
+	if err != nil {
+		t.Fatalf("invalid access token %q: %v", token, err)
+	}
+	if claims.Subject != "1" || claims.Email != "admin@example.com" ||
+		!slices.Equal(claims.Roles, []string{"admin", "auditor"}) ||
+		!slices.Equal(claims.Permissions, []string{authz.LogsRead, authz.UsersAdmin}) ||
+		!slices.Equal(claims.AMR, []string{"pwd"}) {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	waitFor(t, "login event", func() bool { return len(h.loggedEntries()) == 1 })
+	logs := h.loggedEntries()
+	want := logEntry{Name: "authentication", Data: "admin@example.com logged in from 127.0.0.1"}
+	if len(logs) != 1 || logs[0] != want {
+		t.Fatalf("logger received %+v, want [%+v]", logs, want)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthenticateUpgradesPasswordHash(t *testing.T) {
+	h := newHarness(t)
+
+	// The user's bcrypt hash is replaced with an argon2id one
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	if err := data.SetPasswordParams(data.PasswordParams{Algorithm: data.Argon2id, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 1}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { data.SetPasswordParams(testPasswordParams) })
+	h.expectMFA(t, 1, "")
+	h.expectGrants(1)
+
+	status, resp := h.authenticate(t, "admin@example.com", "verysecret")
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("expected 202 without error, got %d %+v", status, resp)
+	}
+	if hash := h.storedUser(t, 1).Password; !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("expected the hash to be upgraded, got %q", hash)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthenticateIgnoresEmailCase(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+
+	h.login(t, 1, " Admin@Example.COM ", "verysecret")
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthenticateRejectsBadPassword(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+
+	status, resp := h.authenticate(t, "admin@example.com", "wrong")
+	if status == http.StatusAccepted || !resp.Error || resp.Message != "invalid credentials" {
+		t.Fatalf("expected invalid credentials, got %d %+v", status, resp)
+	}
+	waitFor(t, "failed login event", func() bool { return len(h.loggedEntries()) == 1 })
+	want := logEntry{Name: "authentication", Data: "failed login for admin@example.com from 127.0.0.1: wrong password"}
+	if logs := h.loggedEntries(); logs[0] != want {
+		t.Errorf("logger received %+v, want [%+v]", logs, want)
+	}
+}
+
+func TestAuthenticateUnknownUser(t *testing.T) {
+	h := newHarness(t)
+
+	status, resp := h.authenticate(t, "nobody@example.com", "whatever")
+	if status == http.StatusAccepted || resp.Message != "invalid credentials" {
+		t.Fatalf("expected invalid credentials, got %d %+v", status, resp)
+	}
+}
+
+func TestAuthenticateRejectsInactiveUser(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "new@example.com", "verysecret", false)
+
+	status, resp := h.authenticate(t, "new@example.com", "verysecret")
+	if status != http.StatusForbidden || resp.Message != "account is not active" {
+		t.Fatalf("expected inactive account to be rejected, got %d %+v", status, resp)
+	}
+	waitFor(t, "failed login event", func() bool { return len(h.loggedEntries()) == 1 })
+	want := logEntry{Name: "authentication", Data: "failed login for new@example.com from 127.0.0.1: account is not active"}
+	if logs := h.loggedEntries(); logs[0] != want {
+		t.Errorf("logger received %+v, want [%+v]", logs, want)
+	}
+}
+
+func TestAuthenticateWhileLoggerIsDown(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	h.setLoggerDown(true)
+
+	// Logins neither fail nor wait for the logger
+	h.expectMFA(t, 1, "")
+	h.expectGrants(1)
+	if status, resp := h.authenticate(t, "admin@example.com", "verysecret"); status != http.StatusAccepted {
+		t.Fatalf("expected login to succeed without the logger, got %d %+v", status, resp)
+	}
+	if status, _ := h.authenticate(t, "admin@example.com", "wrong"); status != http.StatusBadRequest {
+		t.Fatalf("expected invalid credentials, got %d", status)
+	}
+	waitFor(t, "events to wait", func() bool {
+		stats := h.events.Stats()
+		return stats.Buffered+int(stats.Spilled) == 1
+	})
+
+	_, resp := h.do(t, http.MethodGet, "/events/stats", h.admin, nil)
+	stats, _ := resp.Data.(map[string]any)
+	if stats["published"] != float64(0) || stats["dropped"] != float64(0) {
+		t.Errorf("unexpected event stats %+v", resp.Data)
+	}
+
+	// Once the logger is back, the events arrive in order
+	h.setLoggerDown(false)
+	waitFor(t, "events", func() bool { return len(h.loggedEntries()) == 2 })
+	logs := h.loggedEntries()
+	if logs[0].Data != "admin@example.com logged in from 127.0.0.1" ||
+		logs[1].Data != "failed login for admin@example.com from 127.0.0.1: wrong password" {
+		t.Errorf("unexpected events %+v", logs)
+	}
+	if stats := h.events.Stats(); stats.Published != 2 || stats.Dropped != 0 {
+		t.Errorf("unexpected event stats %+v", stats)
+	}
+}
+
+func TestRegisterAndVerify(t *testing.T) {
+	h := newHarness(t)
+
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`INSERT INTO "user_tokens" .* RETURNING "id"`).
+		WithArgs(1, data.TokenEmailVerification, sqlmock.AnyArg(), "", sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	h.mock.ExpectCommit()
+
+	status, resp := h.do(t, http.MethodPost, "/register", "", map[string]string{
+		"email": "New@Example.com", "first_name": "Ada", "last_name": "Lovelace", "password": "correct horse",
+	})
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("expected 202, got %d %+v", status, resp)
+	}
+	if user := h.storedUser(t, 1); user.Email != "new@example.com" || user.FirstName != "Ada" || user.Active {
+		t.Fatalf("expected an inactive account, got %+v", user)
+	}
+
+	mails := h.sentMails()
+	if len(mails) != 1 || mails[0].To != "new@example.com" || mails[0].Template != "verify-email" {
+		t.Fatalf("unexpected verification mails %+v", mails)
+	}
+	link, _ := mails[0].Data["link"].(string)
+	token, found := strings.CutPrefix(link, "http://auth.test/verify?token=")
+	if !found || token == "" {
+		t.Fatalf("unexpected verification link %q", link)
+	}
+
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`UPDATE "user_tokens" SET "used_at"=.* WHERE .*used_at IS NULL.* RETURNING \*`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "purpose"}).AddRow(1, 1, data.TokenEmailVerification))
+	h.mock.ExpectCommit()
+
+	status, resp = h.do(t, http.MethodGet, "/verify?token="+token, "", nil)
+	if status != http.StatusOK || resp.Error {
+		t.Fatalf("expected 200, got %d %+v", status, resp)
+	}
+	if !h.storedUser(t, 1).Active {
+		t.Error("expected the account to be activated")
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyRejectsUsedToken(t *testing.T) {
+	h := newHarness(t)
+
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`UPDATE "user_tokens"`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	h.mock.ExpectCommit()
+
+	status, resp := h.do(t, http.MethodGet, "/verify?token=already-used", "", nil)
+	if status != http.StatusBadRequest || resp.Message != data.ErrInvalidToken.Error() {
+		t.Fatalf("expected invalid token, got %d %+v", status, resp)
+	}
+}
+
+func TestForgotPasswordDoesNotRevealEmail(t *testing.T) {
+	h := newHarness(t)
+
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	unknownStatus, unknown := h.do(t, http.MethodPost, "/forgot-password", "", map[string]string{"email": "nobody@example.com"})
+
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`INSERT INTO "user_tokens"`).
+		WithArgs(1, data.TokenPasswordReset, sqlmock.AnyArg(), "", sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	h.mock.ExpectCommit()
+	knownStatus, known := h.do(t, http.MethodPost, "/forgot-password", "", map[string]string{"email": "admin@example.com"})
+
+	if unknownStatus != http.StatusAccepted || unknownStatus != knownStatus || unknown != known {
+		t.Fatalf("responses differ: %d %+v vs %d %+v", unknownStatus, unknown, knownStatus, known)
+	}
+
+	waitFor(t, "reset email", func() bool { return len(h.sentMails()) == 1 })
+	mail := h.sentMails()[0]
+	link, _ := mail.Data["link"].(string)
+	if mail.To != "admin@example.com" || mail.Template != "password-reset" ||
+		!strings.HasPrefix(link, "http://frontend.test/reset-password?token=") {
+		t.Errorf("unexpected reset email %+v", mail)
+	}
+}
+
+func TestForgotPasswordIsLimited(t *testing.T) {
+	h := newHarness(t)
+
+	// Unknown addresses count too, so being limited doesn't tell whether one is registered
+	for i := 0; i < passwordResetLimit; i++ {
+		if status, resp := h.do(t, http.MethodPost, "/forgot-password", "", map[string]string{"email": "nobody@example.com"}); status != http.StatusAccepted {
+			t.Fatalf("request %d: got %d %+v", i+1, status, resp)
+		}
+	}
+	status, resp := h.do(t, http.MethodPost, "/forgot-password", "", map[string]string{"email": "Nobody@Example.com"})
+	if status != http.StatusTooManyRequests || resp.Message != "too many password reset links requested, try again later" {
+		t.Fatalf("expected the requests to be limited, got %d %+v", status, resp)
+	}
+	if status, _ := h.do(t, http.MethodPost, "/forgot-password", "", map[string]string{"email": "other@example.com"}); status != http.StatusAccepted {
+		t.Errorf("expected other addresses not to be limited, got %d", status)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	h := newHarness(t)
+	app := &Config{TokenSigningKey: []byte("test-signing-key")}
+	signed := app.signToken(data.TokenPasswordReset, "plain-token", time.Now().Add(time.Hour))
+	h.addUser(t, "admin@example.com", "verysecret", true)
+
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`UPDATE "user_tokens" SET "used_at"=.* RETURNING \*`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), data.TokenPasswordReset, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "purpose"}).AddRow(1, 1, data.TokenPasswordReset))
+	h.mock.ExpectCommit()
+	h.expectTokensRevoked(1)
+
+	status, resp := h.do(t, http.MethodPost, "/reset-password", "", map[string]string{
+		"token": signed, "password": "brand new password",
+	})
+	if status != http.StatusOK || resp.Error {
+		t.Fatalf("expected 200, got %d %+v", status, resp)
+	}
+	user := h.storedUser(t, 1)
+	if ok, _ := h.users.PasswordMatches(context.Background(), user, "brand new password"); !ok {
+		t.Error("expected the new password to be stored")
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// expectTokensRevoked expects the outstanding single-use tokens of userID to be revoked
+func (h *harness) expectTokensRevoked(userID int) {
+	h.mock.ExpectBegin()
+	h.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "user_tokens" SET "used_at"=$1 WHERE user_id = $2 AND used_at IS NULL`)).
+		WithArgs(sqlmock.AnyArg(), userID).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	h.mock.ExpectCommit()
+}
+
+func TestResetPasswordRejectsBadTokens(t *testing.T) {
+	h := newHarness(t)
+	app := &Config{TokenSigningKey: []byte("test-signing-key")}
+	valid := app.signToken(data.TokenPasswordReset, "plain-token", time.Now().Add(time.Hour))
+
+	tests := map[string]string{
+		"tampered":      strings.Replace(valid, "plain-token", "other-token", 1),
+		"expired":       app.signToken(data.TokenPasswordReset, "plain-token", time.Now().Add(-time.Minute)),
+		"wrong purpose": app.signToken(data.TokenEmailVerification, "plain-token", time.Now().Add(time.Hour)),
+		"wrong key":     (&Config{TokenSigningKey: []byte("other")}).signToken(data.TokenPasswordReset, "plain-token", time.Now().Add(time.Hour)),
+		"malformed":     "plain-token",
+	}
+	for name, token := range tests {
+		status, resp := h.do(t, http.MethodPost, "/reset-password", "", map[string]string{"token": token, "password": "brand new password"})
+		if status != http.StatusBadRequest || resp.Message != data.ErrInvalidToken.Error() {
+			t.Errorf("%s: expected invalid token, got %d %+v", name, status, resp)
+		}
+	}
+
+	status, resp := h.do(t, http.MethodPost, "/reset-password", "", map[string]string{"token": valid, "password": "short"})
+	if status != http.StatusBadRequest || resp.Message != "password must be at least 8 characters" {
+		t.Errorf("expected password rules to be enforced, got %d %+v", status, resp)
+	}
+
+	// None of the rejected requests may reach the database
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUserAPIRequiresAdmin(t *testing.T) {
+	h := newHarness(t)
+
+	for _, token := range []string{"", "wrong-key"} {
+		status, resp := h.do(t, http.MethodGet, "/users", token, nil)
+		if status != http.StatusUnauthorized || !resp.Error {
+			t.Errorf("token %q: expected 401, got %d %+v", token, status, resp)
+		}
+	}
+
+	mailer, _ := h.tokens.ServiceToken("authentication-service")
+	status, resp := h.do(t, http.MethodGet, "/roles", mailer, nil)
+	if status != http.StatusForbidden || resp.Message != "missing permission users:admin" {
+		t.Errorf("expected 403 for a token without users:admin, got %d %+v", status, resp)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListRolesWithAccessToken(t *testing.T) {
+	h := newHarness(t)
+
+	withoutMFA, _ := h.tokens.Sign(authz.Claims{Permissions: []string{authz.UsersAdmin}, AMR: []string{"pwd"}}, time.Minute)
+	status, resp := h.do(t, http.MethodGet, "/roles", withoutMFA, nil)
+	if status != http.StatusForbidden || resp.Message != "administrators must log in with MFA" {
+		t.Fatalf("expected a login without MFA to be refused, got %d %+v", status, resp)
+	}
+
+	token, _ := h.tokens.Sign(authz.Claims{Permissions: []string{authz.UsersAdmin}, AMR: []string{"pwd", "mfa"}}, time.Minute)
+
+	h.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "roles" ORDER BY name`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description"}).AddRow(1, "admin", "Can do everything"))
+	h.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "role_permissions" WHERE "role_permissions"."role_id" = $1`)).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"role_id", "permission_id"}).AddRow(1, 1).AddRow(1, 2))
+	h.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "permissions" WHERE "permissions"."id" IN ($1,$2)`)).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, authz.LogsRead).AddRow(2, authz.UsersAdmin))
+
+	status, resp = h.do(t, http.MethodGet, "/roles", token, nil)
+	if status != http.StatusOK || resp.Error {
+		t.Fatalf("expected 200, got %d %+v", status, resp)
+	}
+	roles, _ := resp.Data.([]any)
+	if len(roles) != 1 {
+		t.Fatalf("unexpected roles %+v", resp.Data)
+	}
+	role := roles[0].(map[string]any)
+	if perms, _ := role["permissions"].([]any); role["name"] != "admin" || len(perms) != 2 || perms[1] != authz.UsersAdmin {
+		t.Errorf("unexpected role %+v", role)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetUserRolesRejectsUnknownRole(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "roles" WHERE name IN ($1,$2)`)).
+		WithArgs("admin", "no-such-role").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "admin"))
+	h.mock.ExpectRollback()
+
+	status, resp := h.do(t, http.MethodPut, "/users/1/roles", h.admin, map[string]any{"roles": []string{"admin", "no-such-role"}})
+	if status != http.StatusBadRequest || resp.Message != "unknown role" {
+		t.Fatalf("expected unknown role, got %d %+v", status, resp)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateRoleRejectsUnknownPermission(t *testing.T) {
+	h := newHarness(t)
+
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "permissions" WHERE name IN ($1,$2)`)).
+		WithArgs(authz.LogsRead, "logs:delete").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, authz.LogsRead))
+	h.mock.ExpectRollback()
+
+	status, resp := h.do(t, http.MethodPost, "/roles", h.admin, map[string]any{
+		"name":        "auditor",
+		"permissions": []string{authz.LogsRead, "logs:delete"},
+	})
+	if status != http.StatusBadRequest || resp.Message != "unknown permission" {
+		t.Fatalf("expected unknown permission, got %d %+v", status, resp)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	h := newHarness(t)
+	for i := 1; i <= 11; i++ {
+		h.addUser(t, fmt.Sprintf("a_b%02d@example.com", i), "verysecret", true)
+	}
+	h.addUser(t, "other@example.com", "verysecret", true)
+
+	status, resp := h.do(t, http.MethodGet, "/users?page=2&page_size=10&search=a_b", h.admin, nil)
+	if status != http.StatusOK || resp.Error {
+		t.Fatalf("expected 200, got %d %+v", status, resp)
+	}
+
+	page, _ := resp.Data.(map[string]any)
+	users, _ := page["users"].([]any)
+	if page["total"] != float64(11) || page["page"] != float64(2) || len(users) != 1 {
+		t.Fatalf("unexpected page %+v", page)
+	}
+	if user := users[0].(map[string]any); user["email"] != "a_b11@example.com" || user["password"] != nil {
+		t.Errorf("unexpected user in response: %+v", user)
+	}
+}
+
+func TestCreateUserValidation(t *testing.T) {
+	h := newHarness(t)
+
+	tests := []struct {
+		body map[string]any
+		want string
+	}{
+		{map[string]any{"password": "longenough"}, "email is required"},
+		{map[string]any{"email": "not-an-email", "password": "longenough"}, "email must be a valid email address"},
+		{map[string]any{"email": "a@b.com", "password": "short"}, "password must be at least 8 characters"},
+	}
+	for _, tt := range tests {
+		status, resp := h.do(t, http.MethodPost, "/users", h.admin, tt.body)
+		if status != http.StatusBadRequest || resp.Message != tt.want {
+			t.Errorf("%v: got %d %q, want %q", tt.body, status, resp.Message, tt.want)
+		}
+	}
+}
+
+func TestOutboxRelaysUserEvents(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	if status, resp := h.do(t, http.MethodPost, "/users/1/deactivate", h.admin, nil); status != http.StatusOK {
+		t.Fatalf("expected deactivation, got %d %+v", status, resp)
+	}
+
+	// While RabbitMQ is down, the events wait in the outbox
+	h.userEvents.setDown(true)
+	if err := h.app.relayPending(); err == nil {
+		t.Fatal("expected relaying to fail")
+	}
+	status, resp := h.do(t, http.MethodGet, "/outbox", h.admin, nil)
+	messages, _ := resp.Data.([]any)
+	if status != http.StatusOK || len(messages) != 2 || resp.Message != "2 pending messages, 1 stuck" {
+		t.Fatalf("expected 2 pending messages, got %d %+v", status, resp)
+	}
+	if first, _ := messages[0].(map[string]any); first["routing_key"] != data.UserCreated ||
+		first["attempts"] != float64(1) || first["last_error"] != "connection refused" || first["stuck"] != true {
+		t.Errorf("unexpected message %+v", first)
+	}
+
+	h.userEvents.setDown(false)
+	if err := h.app.relayPending(); err != nil {
+		t.Fatal(err)
+	}
+	if sent := h.userEvents.sent(); !slices.Equal(sent, []string{data.UserCreated, data.UserDeactivated}) {
+		t.Errorf("unexpected events %v", sent)
+	}
+	if _, resp := h.do(t, http.MethodGet, "/outbox", h.admin, nil); resp.Message != "0 pending messages, 0 stuck" {
+		t.Errorf("expected the outbox to be empty, got %+v", resp)
+	}
+	if status, _ := h.do(t, http.MethodDelete, "/outbox/1", h.admin, nil); status != http.StatusNotFound {
+		t.Errorf("expected a published message not to be discarded, got %d", status)
+	}
+}
+
+func TestAuthenticateLocksOutAccount(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	for i := 0; i < accountLimitPolicy.LockAfter; i++ {
+		h.limiter.fail("admin@example.com", "192.0.2.1")
+	}
+
+	status, resp := h.authenticate(t, "Admin@Example.com", "verysecret")
+	if status != http.StatusTooManyRequests || resp.Message != "too many failed login attempts, try again later" {
+		t.Fatalf("expected 429, got %d %+v", status, resp)
+	}
+	waitFor(t, "lockout audit event", func() bool { return len(h.loggedEntries()) == 1 })
+	if e := h.loggedEntries()[0]; e.Name != "audit" || !strings.HasPrefix(e.Data, "account admin@example.com locked until") {
+		t.Errorf("unexpected audit entry %+v", e)
+	}
+
+	status, resp = h.do(t, http.MethodPost, "/users/1/unlock", h.admin, nil)
+	if status != http.StatusOK || resp.Message != "unlocked admin@example.com" {
+		t.Fatalf("expected unlock, got %d %+v", status, resp)
+	}
+	waitFor(t, "unlock audit event", func() bool { return len(h.loggedEntries()) == 2 })
+	want := logEntry{Name: "audit", Data: "account admin@example.com unlocked: unlocked by administrator"}
+	if e := h.loggedEntries()[1]; e != want {
+		t.Errorf("got audit entry %+v, want %+v", e, want)
+	}
+
+	h.expectMFA(t, 1, "")
+	h.expectGrants(1)
+	if status, resp := h.authenticate(t, "Admin@Example.com", "verysecret"); status != http.StatusAccepted {
+		t.Fatalf("expected login after unlock, got %d %+v", status, resp)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthenticateDelaysRepeatedFailures(t *testing.T) {
+	h := newHarness(t)
+
+	for i := 0; i < accountLimitPolicy.FreeAttempts+1; i++ {
+		if status, _ := h.authenticate(t, "nobody@example.com", "whatever"); status != http.StatusBadRequest {
+			t.Fatalf("attempt %d: expected 400, got %d", i+1, status)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, h.server.URL+"/authenticate",
+		strings.NewReader(`{"email":"nobody@example.com","password":"whatever"}`))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with Retry-After 1, got %d %q", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginWithMFA(t *testing.T) {
+	h := newHarness(t)
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: "admin@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The password only earns a challenge token
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	h.expectMFA(t, 1, key.Secret())
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`INSERT INTO "user_tokens" .* RETURNING "id"`).
+		WithArgs(1, data.TokenMFAChallenge, sqlmock.AnyArg(), "", sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	h.mock.ExpectCommit()
+
+	status, resp := h.authenticate(t, "admin@example.com", "verysecret")
+	challenge, _ := resp.Data.(map[string]any)
+	if status != http.StatusAccepted || challenge["mfa_required"] != true || challenge["access_token"] != nil {
+		t.Fatalf("expected an MFA challenge, got %d %+v", status, resp)
+	}
+	mfaToken, _ := challenge["mfa_token"].(string)
+
+	expectChallenge := func() {
+		h.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_tokens" WHERE hash = $1 AND purpose = $2`)).
+			WithArgs(sqlmock.AnyArg(), data.TokenMFAChallenge, sqlmock.AnyArg(), 1).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "purpose"}).AddRow(1, 1, data.TokenMFAChallenge))
+		h.expectMFA(t, 1, key.Secret())
+	}
+
+	// A wrong code leaves the challenge usable
+	expectChallenge()
+	status, resp = h.do(t, http.MethodPost, "/mfa/verify", "", map[string]string{"mfa_token": mfaToken, "code": "000000"})
+	if status != http.StatusBadRequest || resp.Message != "invalid code" {
+		t.Fatalf("expected a wrong code to be rejected, got %d %+v", status, resp)
+	}
+
+	code, err := totp.GenerateCode(key.Secret(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectChallenge()
+	h.mock.ExpectBegin()
+	h.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "user_mfa" SET "last_used_step"=$1,"updated_at"=$2 WHERE user_id = $3 AND last_used_step < $4`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	h.mock.ExpectCommit()
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`UPDATE "user_tokens" SET "used_at"=.* RETURNING \*`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "purpose"}).AddRow(1, 1, data.TokenMFAChallenge))
+	h.mock.ExpectCommit()
+	h.expectGrants(1, [2]string{"admin", authz.UsersAdmin})
+
+	status, resp = h.do(t, http.MethodPost, "/mfa/verify", "", map[string]string{"mfa_token": mfaToken, "code": code})
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("expected login to complete, got %d %+v", status, resp)
+	}
+	login, _ := resp.Data.(map[string]any)
+	claims, err := h.tokens.Parse(login["access_token"].(string))
+	if err != nil || !slices.Equal(claims.AMR, []string{"pwd", "otp", "mfa"}) {
+		t.Fatalf("unexpected access token claims %+v (%v)", claims, err)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSecretBox(t *testing.T) {
+	box, err := newSecretBox(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := box.seal([]byte("JBSWY3DPEHPK3PXP"), mfaContext(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "JBSWY3DPEHPK3PXP") {
+		t.Fatal("secret is stored in the clear")
+	}
+	if plain, err := box.open(sealed, mfaContext(1)); err != nil || string(plain) != "JBSWY3DPEHPK3PXP" {
+		t.Fatalf("open: got %q, %v", plain, err)
+	}
+	if _, err := box.open(sealed, mfaContext(2)); err == nil {
+		t.Error("a secret sealed for one user opened for another")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorted := slices.Clone(codes)
+	slices.Sort(sorted)
+	if len(codes) != recoveryCodeCount || len(slices.Compact(sorted)) != recoveryCodeCount {
+		t.Fatalf("expected %d distinct codes, got %v", recoveryCodeCount, codes)
+	}
+	if got := normalizeRecoveryCode(" " + strings.ToUpper(codes[0])); got != strings.Replace(codes[0], "-", "", 1) {
+		t.Errorf("normalized %q to %q", codes[0], got)
+	}
+}
+
+// login logs the user with id in without MFA and returns their access and refresh tokens
+func (h *harness) login(t *testing.T, id int, email, password string) (string, string) {
+	t.Helper()
+	h.expectMFA(t, id, "")
+	h.expectGrants(id)
+	status, resp := h.authenticate(t, email, password)
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("login: got %d %+v", status, resp)
+	}
+	login, _ := resp.Data.(map[string]any)
+	access, _ := login["access_token"].(string)
+	refresh, _ := login["refresh_token"].(string)
+	if access == "" || refresh == "" {
+		t.Fatalf("login returned no tokens: %+v", login)
+	}
+	return access, refresh
+}
+
+// refresh exchanges a refresh token
+func (h *harness) refresh(t *testing.T, refreshToken string) (int, jsonResponse) {
+	t.Helper()
+	return h.do(t, http.MethodPost, "/refresh", "", map[string]string{"refresh_token": refreshToken})
+}
+
+func sessionID(t *testing.T, h *harness, token string) string {
+	t.Helper()
+	claims, err := h.tokens.Parse(token)
+	if err != nil {
+		t.Fatalf("invalid access token: %v", err)
+	}
+	return claims.SessionID
+}
+
+func TestRefreshSession(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	access, refresh := h.login(t, 1, "admin@example.com", "verysecret")
+	sid := sessionID(t, h, access)
+	if sid == "" {
+		t.Fatal("access token has no session")
+	}
+
+	// Each refresh hands out a new refresh token for the same session
+	h.expectGrants(1)
+	status, resp := h.refresh(t, refresh)
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("refresh: got %d %+v", status, resp)
+	}
+	tokens, _ := resp.Data.(map[string]any)
+	next, _ := tokens["refresh_token"].(string)
+	newAccess, _ := tokens["access_token"].(string)
+	if next == "" || next == refresh || sessionID(t, h, newAccess) != sid {
+		t.Fatalf("unexpected refresh response %+v", tokens)
+	}
+
+	// Using the old refresh token again revokes the session, and its access tokens with it
+	status, _ = h.refresh(t, refresh)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: got %d, want 401", status)
+	}
+	if status, _ := h.refresh(t, next); status != http.StatusUnauthorized {
+		t.Errorf("refresh after reuse: got %d, want 401", status)
+	}
+	if status, resp := h.do(t, http.MethodGet, "/sessions", newAccess, nil); status != http.StatusUnauthorized {
+		t.Errorf("access token of revoked session: got %d %+v", status, resp)
+	}
+	waitFor(t, "audit log entry", func() bool {
+		logs := h.loggedEntries()
+		return len(logs) == 2 && logs[1].Name == "audit" && strings.Contains(logs[1].Data, "reused")
+	})
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	laptop, _ := h.login(t, 1, "admin@example.com", "verysecret")
+	phone, phoneRefresh := h.login(t, 1, "admin@example.com", "verysecret")
+
+	status, resp := h.do(t, http.MethodGet, "/sessions", laptop, nil)
+	sessions, _ := resp.Data.([]any)
+	if status != http.StatusOK || len(sessions) != 2 {
+		t.Fatalf("list sessions: got %d %+v", status, resp)
+	}
+	var current int
+	for _, s := range sessions {
+		session, _ := s.(map[string]any)
+		if session["current"] == true {
+			current++
+			if session["id"] != sessionID(t, h, laptop) {
+				t.Errorf("wrong session marked current: %+v", session)
+			}
+		}
+		if session["device"] != "Go-http-client" || session["ip"] == "" || session["refresh_hash"] != nil {
+			t.Errorf("unexpected session %+v", session)
+		}
+	}
+	if current != 1 {
+		t.Errorf("%d sessions marked current", current)
+	}
+
+	// Revoking the phone's session ends its access and refresh tokens
+	status, _ = h.do(t, http.MethodDelete, "/sessions/"+sessionID(t, h, phone), laptop, nil)
+	if status != http.StatusOK {
+		t.Fatalf("revoke session: got %d", status)
+	}
+	if status, _ := h.do(t, http.MethodGet, "/sessions", phone, nil); status != http.StatusUnauthorized {
+		t.Errorf("revoked session's access token: got %d, want 401", status)
+	}
+	if status, _ := h.refresh(t, phoneRefresh); status != http.StatusUnauthorized {
+		t.Errorf("revoked session's refresh token: got %d, want 401", status)
+	}
+	if status, _ := h.do(t, http.MethodDelete, "/sessions/unknown", laptop, nil); status != http.StatusNotFound {
+		t.Errorf("revoke unknown session: got %d, want 404", status)
+	}
+
+	// Logging out ends the caller's own session
+	if status, _ := h.do(t, http.MethodPost, "/logout", laptop, nil); status != http.StatusOK {
+		t.Fatalf("logout: got %d", status)
+	}
+	if status, _ := h.do(t, http.MethodGet, "/sessions", laptop, nil); status != http.StatusUnauthorized {
+		t.Errorf("access token after logout: got %d, want 401", status)
+	}
+}
+
+func TestAdminRevokesUserSessions(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	access, refresh := h.login(t, 1, "admin@example.com", "verysecret")
+
+	// Another service refuses the token once it has read the revoked sessions
+	other := authz.NewVerifier(h.publicKey)
+	serviceTokens := authz.ServiceTokensFromURL(h.server.URL+"/service-tokens", "broker-service", "broker-secret")
+	revocations := authz.NewRevocationList(authz.RevocationsFromURL(h.server.URL+"/sessions/revoked", serviceTokens))
+	other.CheckRevocations(revocations)
+	if err := revocations.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Parse(access); err != nil {
+		t.Fatalf("token before revocation: %v", err)
+	}
+
+	status, resp := h.do(t, http.MethodDelete, "/users/1/sessions", h.admin, nil)
+	if status != http.StatusOK || resp.Message != "revoked 1 sessions of admin@example.com" {
+		t.Fatalf("revoke user sessions: got %d %+v", status, resp)
+	}
+	if err := revocations.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Parse(access); err != authz.ErrRevokedToken {
+		t.Errorf("token after revocation: got %v", err)
+	}
+	if status, _ := h.refresh(t, refresh); status != http.StatusUnauthorized {
+		t.Errorf("refresh after revocation: got %d, want 401", status)
+	}
+
+	// Only services can read the revoked sessions
+	if status, _ := h.do(t, http.MethodGet, "/sessions/revoked", h.userToken(t, 1), nil); status != http.StatusForbidden {
+		t.Errorf("revoked sessions with a user's token: got %d, want 403", status)
+	}
+}
+
+func TestAdminChangesEndUserSessions(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	h.addUser(t, "grace@example.com", "verysecret", true)
+
+	// Deactivating a user through an update ends their sessions
+	_, refresh := h.login(t, 2, "grace@example.com", "verysecret")
+	h.expectTokensRevoked(2)
+	if status, resp := h.do(t, http.MethodPut, "/users/2", h.admin, map[string]any{"active": false}); status != http.StatusOK {
+		t.Fatalf("deactivate: got %d %+v", status, resp)
+	}
+	if status, _ := h.refresh(t, refresh); status != http.StatusUnauthorized {
+		t.Errorf("refresh after deactivation: got %d, want 401", status)
+	}
+
+	// So does resetting their password
+	h.do(t, http.MethodPost, "/users/2/reactivate", h.admin, nil)
+	_, refresh = h.login(t, 2, "grace@example.com", "verysecret")
+	h.expectTokensRevoked(2)
+	if status, resp := h.do(t, http.MethodPost, "/users/2/reset-password", h.admin, map[string]string{"password": "newsecret123"}); status != http.StatusOK {
+		t.Fatalf("reset password: got %d %+v", status, resp)
+	}
+	if status, _ := h.refresh(t, refresh); status != http.StatusUnauthorized {
+		t.Errorf("refresh after password reset: got %d, want 401", status)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	user := h.userToken(t, 1)
+
+	// Keys can only grant permissions the user has
+	h.expectGrants(1, [2]string{"auditor", authz.LogsRead})
+	status, resp := h.do(t, http.MethodPost, "/api-keys", user, map[string]any{"name": "nightly", "scopes": []string{authz.UsersAdmin}})
+	if status != http.StatusForbidden || resp.Message != "you don't have permission users:admin" {
+		t.Fatalf("key with a permission the user lacks: got %d %+v", status, resp)
+	}
+
+	h.expectGrants(1, [2]string{"auditor", authz.LogsRead})
+	status, resp = h.do(t, http.MethodPost, "/api-keys", user, map[string]any{"name": "nightly", "scopes": []string{authz.LogsRead}})
+	created, _ := resp.Data.(map[string]any)
+	key, _ := created["key"].(string)
+	if status != http.StatusCreated || !strings.HasPrefix(key, created["prefix"].(string)+"_") || created["hash"] != nil {
+		t.Fatalf("create key: got %d %+v", status, resp)
+	}
+
+	status, resp = h.do(t, http.MethodGet, "/api-keys", user, nil)
+	keys, _ := resp.Data.([]any)
+	if status != http.StatusOK || len(keys) != 1 {
+		t.Fatalf("list keys: got %d %+v", status, resp)
+	}
+	if listed, _ := keys[0].(map[string]any); listed["key"] != nil || listed["prefix"] != created["prefix"] {
+		t.Errorf("listed key %+v", listed)
+	}
+
+	// Services check keys and get the permissions the user still has
+	service, _ := h.tokens.ServiceToken("broker-service")
+	h.expectGrants(1, [2]string{"auditor", authz.LogsRead})
+	status, resp = h.do(t, http.MethodPost, "/api-keys/verify", service, map[string]string{"key": key})
+	verified, _ := resp.Data.(map[string]any)
+	if status != http.StatusOK || verified["email"] != "admin@example.com" ||
+		fmt.Sprint(verified["permissions"]) != "[logs:read]" {
+		t.Fatalf("verify key: got %d %+v", status, resp)
+	}
+	// with a token of the user granting just those, as only this service can sign one
+	access, _ := verified["access_token"].(string)
+	claims, err := authz.NewVerifier(h.publicKey).Parse(access)
+	if err != nil || claims.Subject != "1" || !slices.Equal(claims.Permissions, []string{authz.LogsRead}) || !slices.Equal(claims.AMR, []string{apiKeyAMR}) {
+		t.Errorf("token of the key: got %+v (%v)", claims, err)
+	}
+	if stored, _ := h.apiKeys.GetForUser(context.Background(), 1); stored[0].LastUsedAt == nil {
+		t.Error("use of the key was not recorded")
+	}
+	if status, _ := h.do(t, http.MethodPost, "/api-keys/verify", user, map[string]string{"key": key}); status != http.StatusForbidden {
+		t.Errorf("verify with a user's token: got %d, want 403", status)
+	}
+
+	// Tokens minted for a key can't create more keys, or change anything else of the user
+	minted, _ := h.tokens.Sign(authz.Claims{AMR: []string{apiKeyAMR}, RegisteredClaims: jwt.RegisteredClaims{Subject: "1"}}, time.Minute)
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/api-keys"},
+		{http.MethodDelete, fmt.Sprintf("/api-keys/%v", created["id"])},
+		{http.MethodPut, "/profile"},
+		{http.MethodDelete, "/sessions/1"},
+		{http.MethodPost, "/mfa/enroll"},
+		{http.MethodPost, "/mfa/disable"},
+		{http.MethodPost, "/oauth/authorize"},
+		{http.MethodPost, "/reauthenticate"},
+	} {
+		status, resp := h.do(t, route.method, route.path, minted, map[string]any{"name": "x", "scopes": []string{authz.LogsRead}})
+		if status != http.StatusForbidden || resp.Message != "API keys can't be used for this" {
+			t.Errorf("%s %s with an API key: got %d %+v, want 403", route.method, route.path, status, resp)
+		}
+	}
+
+	status, _ = h.do(t, http.MethodDelete, fmt.Sprintf("/api-keys/%v", created["id"]), user, nil)
+	if status != http.StatusOK {
+		t.Fatalf("revoke key: got %d", status)
+	}
+	if status, _ := h.do(t, http.MethodPost, "/api-keys/verify", service, map[string]string{"key": key}); status != http.StatusUnauthorized {
+		t.Errorf("verify revoked key: got %d, want 401", status)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceTokens(t *testing.T) {
+	h := newHarness(t)
+
+	issue := func(service, secret string) (int, jsonResponse) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, h.server.URL+"/service-tokens", nil)
+		req.SetBasicAuth(service, secret)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var resp jsonResponse
+		json.NewDecoder(res.Body).Decode(&resp)
+		return res.StatusCode, resp
+	}
+
+	// Services get a token granting their fixed set of permissions
+	status, resp := issue("broker-service", "broker-secret")
+	issued, _ := resp.Data.(map[string]any)
+	token, _ := issued["access_token"].(string)
+	claims, err := authz.NewVerifier(h.publicKey).Parse(token)
+	if status != http.StatusOK || err != nil || claims.Subject != "service:broker-service" ||
+		!slices.Equal(claims.Permissions, authz.ServicePermissions["broker-service"]) {
+		t.Fatalf("issue: got %d %+v (%v)", status, claims, err)
+	}
+
+	for _, tt := range []struct {
+		service, secret string
+		status          int
+	}{
+		{"broker-service", "wrong", http.StatusUnauthorized},
+		{"listener-service", "broker-secret", http.StatusUnauthorized},
+		{"billing-service", "billing-secret", http.StatusForbidden},
+	} {
+		if status, resp := issue(tt.service, tt.secret); status != tt.status || !resp.Error {
+			t.Errorf("%s with %q: got %d %+v, want %d", tt.service, tt.secret, status, resp, tt.status)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// limitPolicy describes how failed logins against one key (an account or a client IP)
+// are throttled
+type limitPolicy struct {
+	// FreeAttempts is how many failures are allowed before delays start
+	FreeAttempts int
+	// BaseDelay is the wait imposed after the first failure past FreeAttempts. It doubles
+	// with every further failure, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockAfter failures lock the key for LockFor
+	LockAfter int
+	LockFor   time.Duration
+	// Window is how long a failure is remembered after the most recent one
+	Window time.Duration
+}
+
+var (
+	accountLimitPolicy = limitPolicy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     30 * time.Second,
+		LockAfter:    10,
+		LockFor:      15 * time.Minute,
+		Window:       15 * time.Minute,
+	}
+	ipLimitPolicy = limitPolicy{
+		FreeAttempts: 10,
+		BaseDelay:    time.Second,
+		MaxDelay:     30 * time.Second,
+		LockAfter:    50,
+		LockFor:      15 * time.Minute,
+		Window:       15 * time.Minute,
+	}
+)
+
+// lockEvent reports that an account or client IP was locked or unlocked
+type lockEvent struct {
+	Locked   bool
+	Kind     string // "account" or "ip"
+	Key      string
+	Until    time.Time
+	Failures int
+	Reason   string
+}
+
+type attempts struct {
+	failures    int
+	lastFailure time.Time
+	nextAllowed time.Time
+	lockedUntil time.Time
+}
+
+// loginLimiter tracks failed logins per account and per client IP. Each failure past a
+// policy's free attempts makes the next attempt wait longer, and enough failures lock
+// the account or IP for a while. State is kept in memory, per instance of the service.
+type loginLimiter struct {
+	mu       sync.Mutex
+	accounts map[string]*attempts
+	ips      map[string]*attempts
+
+	accountPolicy limitPolicy
+	ipPolicy      limitPolicy
+
+	notify func(lockEvent)
+	now    func() time.Time
+}
+
+// newLoginLimiter returns a limiter that calls notify, outside of any lock, whenever an
+// account or IP is locked or unlocked
+func newLoginLimiter(accountPolicy, ipPolicy limitPolicy, notify func(lockEvent)) *loginLimiter {
+	return &loginLimiter{
+		accounts:      make(map[string]*attempts),
+		ips:           make(map[string]*attempts),
+		accountPolicy: accountPolicy,
+		ipPolicy:      ipPolicy,
+		notify:        notify,
+		now:           time.Now,
+	}
+}
+
+// allow reports whether a login to account from ip may be attempted now. If not, it
+// returns how long the caller has to wait.
+func (l *loginLimiter) allow(account, ip string) (time.Duration, bool) {
+	l.mu.Lock()
+	now := l.now()
+	var events []lockEvent
+	wait := max(
+		l.waitFor(l.accounts, "account", account, now, &events),
+		l.waitFor(l.ips, "ip", ip, now, &events),
+	)
+	l.mu.Unlock()
+
+	l.fire(events)
+	return wait, wait <= 0
+}
+
+// fail records a failed login to account from ip
+func (l *loginLimiter) fail(account, ip string) {
+	l.mu.Lock()
+	now := l.now()
+	var events []lockEvent
+	l.recordFailure(l.accounts, "account", account, l.accountPolicy, now, &events)
+	l.recordFailure(l.ips, "ip", ip, l.ipPolicy, now, &events)
+	l.mu.Unlock()
+
+	l.fire(events)
+}
+
+// succeed forgets the failed logins of account. Failures from the client's IP are kept,
+// so that one valid account can't be used to reset the IP's count.
+func (l *loginLimiter) succeed(account string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.accounts, account)
+}
+
+// unlock lifts a lock on account before it expires and forgets its failures. It reports
+// whether the account was locked.
+func (l *loginLimiter) unlock(account, reason string) bool {
+	l.mu.Lock()
+	a, ok := l.accounts[account]
+	locked := ok && l.now().Before(a.lockedUntil)
+	delete(l.accounts, account)
+	l.mu.Unlock()
+
+	if locked {
+		l.fire([]lockEvent{{Kind: "account", Key: account, Reason: reason}})
+	}
+	return locked
+}
+
+// sweep forgets keys whose failures have aged out and reports locks that have expired
+func (l *loginLimiter) sweep() {
+	l.mu.Lock()
+	now := l.now()
+	var events []lockEvent
+	l.sweepKeys(l.accounts, "account", l.accountPolicy, now, &events)
+	l.sweepKeys(l.ips, "ip", l.ipPolicy, now, &events)
+	l.mu.Unlock()
+
+	l.fire(events)
+}
+
+// run sweeps every interval until stop is closed
+func (l *loginLimiter) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.sweep()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (l *loginLimiter) waitFor(keys map[string]*attempts, kind, key string, now time.Time, events *[]lockEvent) time.Duration {
+	a, ok := keys[key]
+	if !ok {
+		return 0
+	}
+	if !a.lockedUntil.IsZero() {
+		if now.Before(a.lockedUntil) {
+			return a.lockedUntil.Sub(now)
+		}
+		delete(keys, key)
+		*events = append(*events, lockEvent{Kind: kind, Key: key, Reason: "lock expired"})
+		return 0
+	}
+	if now.Before(a.nextAllowed) {
+		return a.nextAllowed.Sub(now)
+	}
+	return 0
+}
+
+func (l *loginLimiter) recordFailure(keys map[string]*attempts, kind, key string, p limitPolicy, now time.Time, events *[]lockEvent) {
+	a, ok := keys[key]
+	if !ok || now.Sub(a.lastFailure) > p.Window {
+		a = &attempts{}
+		keys[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+
+	if a.failures >= p.LockAfter {
+		if a.lockedUntil.IsZero() {
+			a.lockedUntil = now.Add(p.LockFor)
+			*events = append(*events, lockEvent{
+				Locked:   true,
+				Kind:     kind,
+				Key:      key,
+				Until:    a.lockedUntil,
+				Failures: a.failures,
+			})
+		}
+		return
+	}
+
+	if extra := a.failures - p.FreeAttempts; extra > 0 {
+		delay := p.BaseDelay << (extra - 1)
+		if delay > p.MaxDelay || delay <= 0 {
+			delay = p.MaxDelay
+		}
+		a.nextAllowed = now.Add(delay)
+	}
+}
+
+func (l *loginLimiter) sweepKeys(keys map[string]*attempts, kind string, p limitPolicy, now time.Time, events *[]lockEvent) {
+	for key, a := range keys {
+		switch {
+		case !a.lockedUntil.IsZero():
+			if !now.Before(a.lockedUntil) {
+				delete(keys, key)
+				*events = append(*events, lockEvent{Kind: kind, Key: key, Reason: "lock expired"})
+			}
+		case now.Sub(a.lastFailure) > p.Window:
+			delete(keys, key)
+		}
+	}
+}
+
+func (l *loginLimiter) fire(events []lockEvent) {
+	if l.notify == nil {
+		return
+	}
+	for _, e := range events {
+		l.notify(e)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testLimiter(events *[]lockEvent) (*loginLimiter, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	policy := limitPolicy{
+		FreeAttempts: 2,
+		BaseDelay:    time.Second,
+		MaxDelay:     4 * time.Second,
+		LockAfter:    6,
+		LockFor:      time.Minute,
+		Window:       10 * time.Minute,
+	}
+	l := newLoginLimiter(policy, policy, func(e lockEvent) { *events = append(*events, e) })
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestLoginLimiterDelays(t *testing.T) {
+	var events []lockEvent
+	l, now := testLimiter(&events)
+
+	// Waits after each failure: none for the free attempts, then doubling up to MaxDelay
+	want := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second}
+	for i, w := range want {
+		if wait, ok := l.allow("a@example.com", "10.0.0.1"); !ok {
+			t.Fatalf("attempt %d: blocked for %s", i+1, wait)
+		}
+		l.fail("a@example.com", "10.0.0.1")
+		wait, ok := l.allow("a@example.com", "10.0.0.1")
+		if wait != w || ok != (w == 0) {
+			t.Fatalf("after failure %d: got wait %s, allowed %v, want %s", i+1, wait, ok, w)
+		}
+		*now = now.Add(w)
+	}
+	if len(events) != 0 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	// Other accounts from other IPs are unaffected
+	if _, ok := l.allow("b@example.com", "10.0.0.2"); !ok {
+		t.Fatal("unrelated login was blocked")
+	}
+}
+
+func TestLoginLimiterLocksAndUnlocks(t *testing.T) {
+	var events []lockEvent
+	l, now := testLimiter(&events)
+
+	for i := 0; i < 6; i++ {
+		l.fail("a@example.com", "10.0.0.1")
+	}
+	if wait, ok := l.allow("a@example.com", "10.0.0.9"); ok || wait != time.Minute {
+		t.Fatalf("expected account to be locked for a minute, got %s %v", wait, ok)
+	}
+	if len(events) != 2 || !events[0].Locked || events[0].Kind != "account" || events[1].Kind != "ip" {
+		t.Fatalf("expected account and ip lock events, got %+v", events)
+	}
+
+	// A successful login elsewhere doesn't clear the IP's failures
+	l.succeed("b@example.com")
+	if _, ok := l.allow("b@example.com", "10.0.0.1"); ok {
+		t.Fatal("locked IP was allowed")
+	}
+
+	if !l.unlock("a@example.com", "unlocked by administrator") {
+		t.Fatal("unlock reported the account was not locked")
+	}
+	if _, ok := l.allow("a@example.com", "10.0.0.9"); !ok {
+		t.Fatal("unlocked account is still blocked")
+	}
+	if e := events[2]; e.Locked || e.Key != "a@example.com" || e.Reason != "unlocked by administrator" {
+		t.Fatalf("unexpected unlock event %+v", e)
+	}
+
+	*now = now.Add(time.Minute)
+	l.sweep()
+	if e := events[len(events)-1]; len(events) != 4 || e.Kind != "ip" || e.Reason != "lock expired" {
+		t.Fatalf("expected the IP lock to expire, got %+v", events)
+	}
+	if len(l.accounts) != 0 || len(l.ips) != 0 {
+		t.Errorf("sweep left state behind: %v %v", l.accounts, l.ips)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"authentication/data"
+	"authentication/event"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	magicLinkTTL = 15 * time.Minute
+	// magicLinkLimit links can be requested for an email in every magicLinkWindow
+	magicLinkLimit  = 5
+	magicLinkWindow = time.Hour
+)
+
+type magicLinkRequest struct {
+	Email string `json:"email" binding:"required,email,max=255"`
+}
+
+type magicLinkLoginRequest struct {
+	Token       string `json:"token" binding:"required"`
+	DeviceToken string `json:"device_token" binding:"required"`
+}
+
+// RequestMagicLink emails a single-use login link to the address in the request if it
+// belongs to an active account. The response carries a device token, which the client
+// keeps and sends back with the link's token: the link only works on the device that
+// asked for it, so a forwarded or intercepted email is of no use. Like ForgotPassword,
+// the response is the same whether or not the email is registered.
+func (app *Config) RequestMagicLink(c *gin.Context) {
+	var req magicLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	email := normalizeEmail(req.Email)
+	if wait, ok := app.MagicLinks.allow(email); !ok {
+		app.tooManyLinks(c, "login", wait)
+		return
+	}
+
+	deviceToken, err := newDeviceToken()
+	if err != nil {
+		app.errorJSON(c, errors.New("could not send login link"), http.StatusInternalServerError)
+		return
+	}
+
+	go app.sendMagicLink(email, deviceToken)
+
+	app.writeJSON(c, http.StatusAccepted, jsonResponse{
+		Error:   false,
+		Message: "If that email address belongs to an account, a login link is on its way.",
+		Data: gin.H{
+			"device_token": deviceToken,
+			"expires_in":   int(magicLinkTTL.Seconds()),
+		},
+	})
+}
+
+// sendMagicLink issues a login token for the active user with the given email, if there is
+// one, and mails them a link to the frontend's login page, signed together with
+// deviceToken. It runs after the response is sent, so it doesn't use the request's context.
+func (app *Config) sendMagicLink(email, deviceToken string) {
+	ctx := context.Background()
+	user, err := app.Models.User.GetByEmail(ctx, email)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Println("Error looking up user for login link:", err)
+		}
+		return
+	}
+	if !user.Active {
+		return
+	}
+
+	expires := time.Now().Add(magicLinkTTL)
+	plainText, err := app.Models.Token.Issue(ctx, user.ID, data.TokenMagicLink, magicLinkTTL)
+	if err != nil {
+		log.Println("Error issuing login link token:", err)
+		return
+	}
+
+	signed := app.signToken(magicLinkPurpose(deviceToken), plainText, expires)
+	err = app.sendMail(mailMessage{
+		To:       user.Email,
+		Subject:  "Your login link",
+		Template: "magic-link",
+		Data: map[string]any{
+			"first_name": user.FirstName,
+			"link":       app.FrontendURL + "/magic-link?token=" + url.QueryEscape(signed),
+			"expires_in": "15 minutes",
+		},
+	})
+	if err != nil {
+		log.Println("Error sending login link email:", err)
+		return
+	}
+
+	app.logEvent(event.Info, "authentication", fmt.Sprintf("login link requested for %s", user.Email))
+}
+
+// MagicLinkLogin completes a login started by RequestMagicLink. It takes the token from the
+// emailed link and the device token that came with the request for it, and responds like
+// a successful Authenticate: users with MFA enabled still have to give a code.
+func (app *Config) MagicLinkLogin(c *gin.Context) {
+	var req magicLinkLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	// A link opened on another device fails here, as its signature covers the device token
+	plainText, err := app.verifySignedToken(magicLinkPurpose(req.DeviceToken), req.Token)
+	if err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+
+	token, err := app.Models.Token.Find(c.Request.Context(), data.TokenMagicLink, plainText)
+	if errors.Is(err, data.ErrInvalidToken) {
+		app.errorJSON(c, err)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not log in"), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(c.Request.Context(), token.UserID)
+	if err != nil {
+		app.errorJSON(c, data.ErrInvalidToken)
+		return
+	}
+
+	// A locked account stays locked however the login is attempted, and the link still
+	// works once the lock is lifted
+	account, ip := normalizeEmail(user.Email), c.ClientIP()
+	if wait, ok := app.Limiter.allow(account, ip); !ok {
+		app.tooManyAttempts(c, wait)
+		return
+	}
+
+	if !user.Active {
+		app.loginFailed(account, ip, "account is not active")
+		app.errorJSON(c, errors.New("account is not active"), http.StatusForbidden)
+		return
+	}
+
+	if _, err := app.Models.Token.Consume(c.Request.Context(), data.TokenMagicLink, plainText); err != nil {
+		app.errorJSON(c, data.ErrInvalidToken)
+		return
+	}
+
+	mfa, err := app.Models.MFA.Get(c.Request.Context(), user.ID)
+	if err == nil && mfa.Enabled {
+		app.startMFAChallenge(c, user, "email")
+		return
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("could not log in"), http.StatusInternalServerError)
+		return
+	}
+
+	app.Limiter.succeed(account)
+	app.completeLogin(c, user, []string{"email"})
+}
+
+// tooManyLinks tells the client to wait before asking for another link of kind, such as
+// "login"
+func (app *Config) tooManyLinks(c *gin.Context, kind string, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	app.errorJSON(c, fmt.Errorf("too many %s links requested, try again later", kind), http.StatusTooManyRequests)
+}
+
+// magicLinkPurpose binds a signed login link to the device token of the request for it
+func magicLinkPurpose(deviceToken string) string {
+	return data.TokenMagicLink + ":" + deviceToken
+}
+
+// newDeviceToken returns a random secret for the device that asks for a login link
+func newDeviceToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// linkLimiter limits how many links, such as login or password reset links, are sent to
+// each email address in a window of time. Requests for unknown addresses count too, so that being limited says nothing
+// about whether an address is registered. State is kept in memory, per instance.
+type linkLimiter struct {
+	mu     sync.Mutex
+	sent   map[string][]time.Time
+	limit  int
+	window time.Duration
+	now    func() time.Time
+}
+
+func newLinkLimiter(limit int, window time.Duration) *linkLimiter {
+	return &linkLimiter{
+		sent:   make(map[string][]time.Time),
+		limit:  limit,
+		window: window,
+		now:    time.Now,
+	}
+}
+
+// allow records a request for a link to email and reports whether it may be sent. If not,
+// it returns how long until the next one may be.
+func (l *linkLimiter) allow(email string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	times := l.recent(email, now)
+	if len(times) >= l.limit {
+		return times[0].Add(l.window).Sub(now), false
+	}
+	l.sent[email] = append(times, now)
+	return 0, true
+}
+
+// recent returns the times in the current window that a link was sent to email
+func (l *linkLimiter) recent(email string, now time.Time) []time.Time {
+	times := l.sent[email]
+	for len(times) > 0 && now.Sub(times[0]) >= l.window {
+		times = times[1:]
+	}
+	return times
+}
+
+// run forgets addresses without recent links every interval until stop is closed
+func (l *linkLimiter) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			now := l.now()
+			for email := range l.sent {
+				if len(l.recent(email, now)) == 0 {
+					delete(l.sent, email)
+				}
+			}
+			l.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
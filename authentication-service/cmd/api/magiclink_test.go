@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	"authentication/data"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/pquerna/otp/totp"
+)
+
+// expectMagicLink stubs the lookup and use of a login link token for user 1
+func (h *harness) expectMagicLink() {
+	h.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_tokens" WHERE hash = $1 AND purpose = $2`)).
+		WithArgs(sqlmock.AnyArg(), data.TokenMagicLink, sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "purpose"}).AddRow(1, 1, data.TokenMagicLink))
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`UPDATE "user_tokens" SET "used_at"=.* RETURNING \*`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), data.TokenMagicLink, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "purpose"}).AddRow(1, 1, data.TokenMagicLink))
+	h.mock.ExpectCommit()
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	h := newHarness(t)
+	h.addUser(t, "admin@example.com", "verysecret", true)
+
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`INSERT INTO "user_tokens"`).
+		WithArgs(1, data.TokenMagicLink, sqlmock.AnyArg(), "", sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	h.mock.ExpectCommit()
+	status, resp := h.do(t, http.MethodPost, "/magic-link", "", map[string]string{"email": "Admin@Example.com"})
+	requested, _ := resp.Data.(map[string]any)
+	deviceToken, _ := requested["device_token"].(string)
+	if status != http.StatusAccepted || deviceToken == "" {
+		t.Fatalf("expected a device token, got %d %+v", status, resp)
+	}
+
+	waitFor(t, "login link email", func() bool { return len(h.sentMails()) == 1 })
+	mail := h.sentMails()[0]
+	link, err := url.Parse(mail.Data["link"].(string))
+	if err != nil || mail.To != "admin@example.com" || mail.Template != "magic-link" ||
+		link.Host != "frontend.test" || link.Path != "/magic-link" {
+		t.Fatalf("unexpected login link email %+v", mail)
+	}
+	token := link.Query().Get("token")
+
+	// The link is no use on any other device, and is turned away before the database
+	status, resp = h.do(t, http.MethodPost, "/magic-link/login", "", map[string]string{"token": token, "device_token": "other-device"})
+	if status != http.StatusBadRequest || resp.Message != data.ErrInvalidToken.Error() {
+		t.Fatalf("expected another device to be refused, got %d %+v", status, resp)
+	}
+
+	h.expectMagicLink()
+	h.expectMFA(t, 1, "")
+	h.expectGrants(1)
+	status, resp = h.do(t, http.MethodPost, "/magic-link/login", "", map[string]string{"token": token, "device_token": deviceToken})
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("expected the link to log in, got %d %+v", status, resp)
+	}
+	login, _ := resp.Data.(map[string]any)
+	claims, err := h.tokens.Parse(login["access_token"].(string))
+	if err != nil || !slices.Equal(claims.AMR, []string{"email"}) || login["refresh_token"] == "" {
+		t.Fatalf("unexpected login %+v, claims %+v (%v)", login, claims, err)
+	}
+	if sessions, _ := h.sessions.GetForUser(context.Background(), 1); len(sessions) != 1 {
+		t.Errorf("expected a session to be started, got %+v", sessions)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMagicLinkLoginWithMFA(t *testing.T) {
+	h := newHarness(t)
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: "admin@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.addUser(t, "admin@example.com", "verysecret", true)
+	token := h.app.signToken(magicLinkPurpose("device"), "plain-token", time.Now().Add(magicLinkTTL))
+
+	h.expectMagicLink()
+	h.expectMFA(t, 1, key.Secret())
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`INSERT INTO "user_tokens" .* RETURNING "id"`).
+		WithArgs(1, data.TokenMFAChallenge, sqlmock.AnyArg(), "", sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	h.mock.ExpectCommit()
+	status, resp := h.do(t, http.MethodPost, "/magic-link/login", "", map[string]string{"token": token, "device_token": "device"})
+	challenge, _ := resp.Data.(map[string]any)
+	if status != http.StatusAccepted || challenge["mfa_required"] != true {
+		t.Fatalf("expected an MFA challenge, got %d %+v", status, resp)
+	}
+
+	code, err := totp.GenerateCode(key.Secret(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_tokens" WHERE hash = $1 AND purpose = $2`)).
+		WithArgs(sqlmock.AnyArg(), data.TokenMFAChallenge, sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "purpose"}).AddRow(2, 1, data.TokenMFAChallenge))
+	h.expectMFA(t, 1, key.Secret())
+	h.mock.ExpectBegin()
+	h.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "user_mfa" SET "last_used_step"=$1,"updated_at"=$2 WHERE user_id = $3 AND last_used_step < $4`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	h.mock.ExpectCommit()
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`UPDATE "user_tokens" SET "used_at"=.* RETURNING \*`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "purpose"}).AddRow(2, 1, data.TokenMFAChallenge))
+	h.mock.ExpectCommit()
+	h.expectGrants(1)
+
+	// The access token records that the login started with the emailed link
+	status, resp = h.do(t, http.MethodPost, "/mfa/verify", "", map[string]string{"mfa_token": challenge["mfa_token"].(string), "code": code})
+	login, _ := resp.Data.(map[string]any)
+	if status != http.StatusAccepted || login["access_token"] == nil {
+		t.Fatalf("expected login to complete, got %d %+v", status, resp)
+	}
+	claims, err := h.tokens.Parse(login["access_token"].(string))
+	if err != nil || !slices.Equal(claims.AMR, []string{"email", "otp", "mfa"}) {
+		t.Fatalf("unexpected access token claims %+v (%v)", claims, err)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMagicLinkRateLimitedPerEmail(t *testing.T) {
+	h := newHarness(t)
+
+	// Unknown addresses are limited too, so being limited reveals nothing
+	for i := 0; i < magicLinkLimit; i++ {
+		if status, resp := h.do(t, http.MethodPost, "/magic-link", "", map[string]string{"email": "nobody@example.com"}); status != http.StatusAccepted {
+			t.Fatalf("request %d: expected 202, got %d %+v", i+1, status, resp)
+		}
+	}
+	status, resp := h.do(t, http.MethodPost, "/magic-link", "", map[string]string{"email": "NOBODY@example.com"})
+	if status != http.StatusTooManyRequests || resp.Message != "too many login links requested, try again later" {
+		t.Fatalf("expected the address to be limited, got %d %+v", status, resp)
+	}
+	if status, _ := h.do(t, http.MethodPost, "/magic-link", "", map[string]string{"email": "other@example.com"}); status != http.StatusAccepted {
+		t.Errorf("expected other addresses not to be limited, got %d", status)
+	}
+
+	limiter := newLinkLimiter(2, time.Hour)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	limiter.allow("a@example.com")
+	now = now.Add(10 * time.Minute)
+	limiter.allow("a@example.com")
+	if wait, ok := limiter.allow("a@example.com"); ok || wait != 50*time.Minute {
+		t.Errorf("expected to wait 50m for the first link to age out, got %s, %v", wait, ok)
+	}
+	now = now.Add(50 * time.Minute)
+	if _, ok := limiter.allow("a@example.com"); !ok {
+		t.Error("expected a link once the first aged out")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// mailMessage is the payload accepted by the mail service's /send endpoint. Template names
+// one of the mail service's templates and Data holds the values it renders.
+type mailMessage struct {
+	To       string         `json:"to"`
+	Subject  string         `json:"subject"`
+	Template string         `json:"template"`
+	Data     map[string]any `json:"data"`
+}
+
+// sendMail asks the mail service to send msg
+func (app *Config) sendMail(msg mailMessage) error {
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", app.MailServiceURL+"/send", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if err := app.setServiceToken(request); err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("error sending mail: status code %d", response.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"authentication/data"
+	"authentication/event"
+	"authz"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	totpIssuer        = "Go Microservices"
+	totpPeriod        = 30
+	recoveryCodeCount = 10
+)
+
+var errInvalidCode = errors.New("invalid code")
+
+type verifyMFARequest struct {
+	MFAToken     string `json:"mfa_token" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type mfaCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// firstFactors are the ways a login can start before an MFA challenge: a password, or a
+// link emailed to the user
+var firstFactors = []string{"pwd", "email"}
+
+// startMFAChallenge answers a user with MFA enabled, who proved who they are with method
+// (one of firstFactors), with a short-lived, single-use token to present along with their
+// code
+func (app *Config) startMFAChallenge(c *gin.Context, user *data.User, method string) {
+	result, err := app.challengeMFA(c.Request.Context(), user, method)
+	if err != nil {
+		app.loginError(c, err)
+		return
+	}
+	app.writeLogin(c, result)
+}
+
+// challengeMFA issues the challenge token of startMFAChallenge
+func (app *Config) challengeMFA(ctx context.Context, user *data.User, method string) (*loginResult, error) {
+	expires := time.Now().Add(mfaChallengeTTL)
+	plainText, err := app.Models.Token.Issue(ctx, user.ID, data.TokenMFAChallenge, mfaChallengeTTL)
+	if err != nil {
+		return nil, errors.New("could not log in")
+	}
+	return &loginResult{User: user, MFAToken: app.signToken(mfaChallengePurpose(method), plainText, expires)}, nil
+}
+
+// VerifyMFA completes a login started by Authenticate for a user with MFA enabled. It
+// takes the challenge token and either a current TOTP code or an unused recovery code, and
+// responds like a successful Authenticate. Wrong codes count as failed logins.
+func (app *Config) VerifyMFA(c *gin.Context) {
+	var req verifyMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+	if (req.Code == "") == (req.RecoveryCode == "") {
+		app.errorJSON(c, errors.New("provide either code or recovery_code"))
+		return
+	}
+
+	method, plainText, err := app.verifyMFAChallenge(req.MFAToken)
+	if err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+	challenge, err := app.Models.Token.Find(c.Request.Context(), data.TokenMFAChallenge, plainText)
+	if errors.Is(err, data.ErrInvalidToken) {
+		app.errorJSON(c, err)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not log in"), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(c.Request.Context(), challenge.UserID)
+	if err != nil {
+		app.errorJSON(c, data.ErrInvalidToken)
+		return
+	}
+	mfa, err := app.Models.MFA.Get(c.Request.Context(), user.ID)
+	if err != nil || !mfa.Enabled {
+		app.errorJSON(c, data.ErrInvalidToken)
+		return
+	}
+
+	account, ip := normalizeEmail(user.Email), c.ClientIP()
+	if wait, ok := app.Limiter.allow(account, ip); !ok {
+		app.tooManyAttempts(c, wait)
+		return
+	}
+
+	amr, err := app.checkSecondFactor(c.Request.Context(), mfa, req.Code, req.RecoveryCode)
+	if errors.Is(err, errInvalidCode) {
+		app.Limiter.fail(account, ip)
+		app.loginFailed(account, ip, "wrong MFA code")
+		app.errorJSON(c, err)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not log in"), http.StatusInternalServerError)
+		return
+	}
+
+	// The challenge is used up only now, so that a mistyped code can be corrected
+	if _, err := app.Models.Token.Consume(c.Request.Context(), data.TokenMFAChallenge, plainText); err != nil {
+		app.errorJSON(c, data.ErrInvalidToken)
+		return
+	}
+
+	app.Limiter.succeed(account)
+	app.completeLogin(c, user, append([]string{method}, amr...))
+}
+
+// verifyMFAChallenge checks a token made by startMFAChallenge and returns the method the
+// login started with, which the signature covers, and the plain text token inside it
+func (app *Config) verifyMFAChallenge(signed string) (string, string, error) {
+	for _, method := range firstFactors {
+		if plainText, err := app.verifySignedToken(mfaChallengePurpose(method), signed); err == nil {
+			return method, plainText, nil
+		}
+	}
+	return "", "", data.ErrInvalidToken
+}
+
+// mfaChallengePurpose binds a signed MFA challenge token to the method its login started
+// with
+func mfaChallengePurpose(method string) string {
+	return data.TokenMFAChallenge + ":" + method
+}
+
+// MFAStatus reports whether the caller has MFA enabled and how many recovery codes they
+// have left
+func (app *Config) MFAStatus(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+
+	status := gin.H{"enabled": false}
+	mfa, err := app.Models.MFA.Get(c.Request.Context(), user.ID)
+	if err == nil && mfa.Enabled {
+		remaining, err := app.Models.MFA.RemainingRecoveryCodes(c.Request.Context(), mfa.UserID)
+		if err != nil {
+			app.errorJSON(c, errors.New("could not load MFA status"), http.StatusInternalServerError)
+			return
+		}
+		status = gin.H{"enabled": true, "recovery_codes_remaining": remaining}
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("could not load MFA status"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{Error: false, Message: "MFA status", Data: status})
+}
+
+// EnrollMFA generates a new TOTP secret for the caller and returns it as text, as an
+// otpauth:// URI and as a QR code PNG for authenticator apps to scan. MFA is not enabled
+// until ConfirmMFA receives a code generated from the secret.
+func (app *Config) EnrollMFA(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: user.Email,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		app.errorJSON(c, errors.New("could not generate secret"), http.StatusInternalServerError)
+		return
+	}
+
+	sealed, err := app.Secrets.seal([]byte(key.Secret()), mfaContext(user.ID))
+	if err != nil {
+		app.errorJSON(c, errors.New("could not generate secret"), http.StatusInternalServerError)
+		return
+	}
+	if err := app.Models.MFA.SavePending(c.Request.Context(), user.ID, sealed); errors.Is(err, gorm.ErrDuplicatedKey) {
+		app.errorJSON(c, errors.New("MFA is already enabled"), http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not save secret"), http.StatusInternalServerError)
+		return
+	}
+
+	img, err := key.Image(256, 256)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not generate QR code"), http.StatusInternalServerError)
+		return
+	}
+	var qr bytes.Buffer
+	if err := png.Encode(&qr, img); err != nil {
+		app.errorJSON(c, errors.New("could not generate QR code"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "Scan the QR code with your authenticator app, then confirm with a code from it",
+		Data: gin.H{
+			"secret":      key.Secret(),
+			"otpauth_url": key.URL(),
+			"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr.Bytes()),
+		},
+	})
+}
+
+// ConfirmMFA enables MFA for the caller once they send a code from the secret EnrollMFA
+// gave them, and returns their recovery codes. This is the only time the codes are shown.
+func (app *Config) ConfirmMFA(c *gin.Context) {
+	user, req, ok := app.mfaCodeRequest(c)
+	if !ok {
+		return
+	}
+
+	mfa, err := app.Models.MFA.Get(c.Request.Context(), user.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && mfa.Enabled) {
+		app.errorJSON(c, errors.New("there is no MFA enrollment to confirm"), http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not confirm MFA"), http.StatusInternalServerError)
+		return
+	}
+
+	if err := app.checkTOTP(c.Request.Context(), mfa, req.Code); err != nil {
+		app.mfaCodeError(c, err)
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		app.errorJSON(c, errors.New("could not confirm MFA"), http.StatusInternalServerError)
+		return
+	}
+	if err := app.Models.MFA.Enable(c.Request.Context(), mfa, normalizeRecoveryCodes(codes)); err != nil {
+		app.errorJSON(c, errors.New("could not confirm MFA"), http.StatusInternalServerError)
+		return
+	}
+
+	app.logEvent(event.Info, "audit", fmt.Sprintf("%s enabled MFA", user.Email))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "MFA is enabled. Keep your recovery codes somewhere safe, they won't be shown again.",
+		Data:    gin.H{"recovery_codes": codes},
+	})
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes. It needs a current code
+// or an unused recovery code.
+func (app *Config) RegenerateRecoveryCodes(c *gin.Context) {
+	user, req, ok := app.mfaCodeRequest(c)
+	if !ok {
+		return
+	}
+	mfa, ok := app.enabledMFA(c, user)
+	if !ok {
+		return
+	}
+
+	if _, err := app.checkSecondFactor(c.Request.Context(), mfa, req.Code, req.RecoveryCode); err != nil {
+		app.mfaCodeError(c, err)
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		app.errorJSON(c, errors.New("could not generate recovery codes"), http.StatusInternalServerError)
+		return
+	}
+	if err := app.Models.MFA.ReplaceRecoveryCodes(c.Request.Context(), mfa.UserID, normalizeRecoveryCodes(codes)); err != nil {
+		app.errorJSON(c, errors.New("could not generate recovery codes"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "New recovery codes generated, the old ones no longer work",
+		Data:    gin.H{"recovery_codes": codes},
+	})
+}
+
+// DisableMFA turns MFA off for the caller. It needs a current code or an unused recovery
+// code.
+func (app *Config) DisableMFA(c *gin.Context) {
+	user, req, ok := app.mfaCodeRequest(c)
+	if !ok {
+		return
+	}
+	mfa, ok := app.enabledMFA(c, user)
+	if !ok {
+		return
+	}
+
+	if _, err := app.checkSecondFactor(c.Request.Context(), mfa, req.Code, req.RecoveryCode); err != nil {
+		app.mfaCodeError(c, err)
+		return
+	}
+	if err := app.Models.MFA.Disable(c.Request.Context(), mfa.UserID); err != nil {
+		app.errorJSON(c, errors.New("could not disable MFA"), http.StatusInternalServerError)
+		return
+	}
+
+	app.logEvent(event.Info, "audit", fmt.Sprintf("%s disabled MFA", user.Email))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{Error: false, Message: "MFA is disabled"})
+}
+
+// ResetUserMFA turns MFA off for the user with the id in the path, for users who lost both
+// their authenticator and their recovery codes
+func (app *Config) ResetUserMFA(c *gin.Context) {
+	user, ok := app.userFromPath(c)
+	if !ok {
+		return
+	}
+
+	if err := app.Models.MFA.Disable(c.Request.Context(), user.ID); err != nil {
+		app.errorJSON(c, errors.New("could not reset MFA"), http.StatusInternalServerError)
+		return
+	}
+
+	app.logEvent(event.Info, "audit", fmt.Sprintf("MFA reset for %s by an administrator", user.Email))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{Error: false, Message: "MFA reset for " + user.Email})
+}
+
+// currentUser loads the user that the request's access token was issued to. When that
+// fails it writes the error response and returns false.
+func (app *Config) currentUser(c *gin.Context) (*data.User, bool) {
+	claims, ok := authz.FromContext(c)
+	if !ok {
+		app.errorJSON(c, errors.New("unauthorized"), http.StatusUnauthorized)
+		return nil, false
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil || claims.IsService() {
+		app.errorJSON(c, errors.New("this needs a user's access token"), http.StatusForbidden)
+		return nil, false
+	}
+
+	user, err := app.Models.User.GetOne(c.Request.Context(), id)
+	if err != nil {
+		app.errorJSON(c, errors.New("unauthorized"), http.StatusUnauthorized)
+		return nil, false
+	}
+	return user, true
+}
+
+// mfaCodeRequest loads the caller and reads a request body carrying a code
+func (app *Config) mfaCodeRequest(c *gin.Context) (*data.User, mfaCodeRequest, bool) {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return nil, req, false
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		app.errorJSON(c, errors.New("code is required"))
+		return nil, req, false
+	}
+
+	user, ok := app.currentUser(c)
+	return user, req, ok
+}
+
+// enabledMFA loads the MFA settings of user, failing unless MFA is enabled
+func (app *Config) enabledMFA(c *gin.Context, user *data.User) (*data.MFA, bool) {
+	mfa, err := app.Models.MFA.Get(c.Request.Context(), user.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !mfa.Enabled) {
+		app.errorJSON(c, errors.New("MFA is not enabled"), http.StatusConflict)
+		return nil, false
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not load MFA settings"), http.StatusInternalServerError)
+		return nil, false
+	}
+	return mfa, true
+}
+
+func (app *Config) mfaCodeError(c *gin.Context, err error) {
+	if errors.Is(err, errInvalidCode) {
+		app.errorJSON(c, err)
+		return
+	}
+	app.errorJSON(c, errors.New("could not check code"), http.StatusInternalServerError)
+}
+
+// checkSecondFactor checks a TOTP code or, if code is empty, a recovery code, and returns
+// the authentication methods to record in the access token after the first factor
+func (app *Config) checkSecondFactor(ctx context.Context, mfa *data.MFA, code, recoveryCode string) ([]string, error) {
+	if code != "" {
+		if err := app.checkTOTP(ctx, mfa, code); err != nil {
+			return nil, err
+		}
+		return []string{"otp", "mfa"}, nil
+	}
+
+	err := app.Models.MFA.UseRecoveryCode(ctx, mfa.UserID, normalizeRecoveryCode(recoveryCode))
+	if errors.Is(err, data.ErrInvalidRecoveryCode) {
+		return nil, errInvalidCode
+	} else if err != nil {
+		return nil, err
+	}
+	return []string{"mfa"}, nil
+}
+
+// checkTOTP accepts a code for the current 30 second step or the ones either side of it,
+// to allow for clock drift. A code is only accepted once.
+func (app *Config) checkTOTP(ctx context.Context, mfa *data.MFA, code string) error {
+	secret, err := app.Secrets.open(mfa.Secret, mfaContext(mfa.UserID))
+	if err != nil {
+		return err
+	}
+
+	code = strings.TrimSpace(code)
+	now := time.Now().Unix() / totpPeriod
+	for step := now - 1; step <= now+1; step++ {
+		expected, err := totp.GenerateCodeCustom(string(secret), time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			if err := app.Models.MFA.UseStep(ctx, mfa, step); errors.Is(err, data.ErrCodeReused) {
+				return errInvalidCode
+			} else if err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+	return errInvalidCode
+}
+
+// mfaContext binds an encrypted TOTP secret to the user it belongs to
+func mfaContext(userID int) string {
+	return "mfa:" + strconv.Itoa(userID)
+}
+
+// newRecoveryCodes returns a fresh set of recovery codes, formatted like "abcde-fghij"
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode lets recovery codes be typed without the dash or in upper case.
+// Codes are stored in this form.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func normalizeRecoveryCodes(codes []string) []string {
+	normalized := make([]string, len(codes))
+	for i, code := range codes {
+		normalized[i] = normalizeRecoveryCode(code)
+	}
+	return normalized
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"authz"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireService only lets requests through when they carry a token that a service minted
+// for itself
+func (app *Config) requireService() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !app.Tokens.Authorize(c) {
+			return
+		}
+		if claims, _ := authz.FromContext(c); !claims.IsService() {
+			app.errorJSON(c, errors.New("only services can call this"), http.StatusForbidden)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireLogin only lets requests through when they carry an access token of a user's
+// login. The tokens API keys are swapped for are refused, so that a leaked key can't
+// change its user's account, sessions, MFA or keys, or approve OAuth clients.
+func (app *Config) requireLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !app.Tokens.Authorize(c) {
+			return
+		}
+		if claims, _ := authz.FromContext(c); slices.Contains(claims.AMR, apiKeyAMR) {
+			app.errorJSON(c, errors.New("API keys can't be used for this"), http.StatusForbidden)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireAdmin only lets requests through when they carry an access token with the
+// users:admin permission, from a login that used MFA. The first administrator is created
+// with "authApp seed".
+func (app *Config) requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !app.Tokens.Authorize(c, authz.UsersAdmin) {
+			return
+		}
+		if claims, _ := authz.FromContext(c); !claims.IsService() && !slices.Contains(claims.AMR, "mfa") {
+			app.errorJSON(c, errors.New("administrators must log in with MFA"), http.StatusForbidden)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireRecentLogin only lets users through who proved who they are, by logging in or
+// with POST /reauthenticate, within the last reauthenticationWindow. It must follow a
+// middleware that checks the access token.
+func (app *Config) requireRecentLogin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := authz.FromContext(c)
+		if !ok || claims.AuthTime == nil || time.Since(claims.AuthTime.Time) > reauthenticationWindow {
+			app.writeJSON(c, http.StatusForbidden, jsonResponse{
+				Error:   true,
+				Message: "please re-authenticate to continue",
+				Data:    gin.H{"reauthentication_required": true},
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
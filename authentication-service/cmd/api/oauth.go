@@ -0,0 +1,804 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"authentication/data"
+	"authz"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	oauthCodeTTL = time.Minute
+	idTokenTTL   = time.Hour
+
+	scopeOpenID  = "openid"
+	scopeProfile = "profile"
+	scopeEmail   = "email"
+
+	// accessTokenType is the typ header of access tokens for OAuth clients (RFC 9068),
+	// which keeps ID tokens from being accepted in their place
+	accessTokenType = "at+jwt"
+)
+
+// userScopes are the scopes a client can ask a user for. Permissions are only granted to
+// clients acting for themselves, through the client credentials grant.
+var userScopes = []string{scopeOpenID, scopeProfile, scopeEmail}
+
+// pkceVerifier matches a valid PKCE code verifier (RFC 7636)
+var pkceVerifier = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+var errInvalidOAuthToken = errors.New("invalid or expired access token")
+
+// oauthScopes returns every scope a client can be allowed
+func oauthScopes() []string {
+	return append(slices.Clone(userScopes), authz.Permissions...)
+}
+
+// oauthError is an error response of the OAuth endpoints, in the shape RFC 6749 defines
+// rather than the service's usual one, since it is read by OAuth client libraries
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	status      int
+}
+
+func newOAuthError(code, description string) *oauthError {
+	return &oauthError{Code: code, Description: description}
+}
+
+func (e *oauthError) withStatus(status int) *oauthError {
+	e.status = status
+	return e
+}
+
+// writeOAuthError writes e, with a 400 status unless it has another one
+func writeOAuthError(c *gin.Context, e *oauthError) {
+	status := http.StatusBadRequest
+	if e.status != 0 {
+		status = e.status
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, e)
+}
+
+// oauthAccessClaims are the claims of an access token issued to an OAuth client. The
+// subject is the user's id, or "client:<client_id>" when the client acts for itself.
+type oauthAccessClaims struct {
+	ClientID string   `json:"client_id"`
+	Scope    string   `json:"scope,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// hasScope reports whether the token was granted scope
+func (c *oauthAccessClaims) hasScope(scope string) bool {
+	return slices.Contains(strings.Fields(c.Scope), scope)
+}
+
+// userClaims are the standard OpenID Connect claims about a user that the profile and
+// email scopes release
+type userClaims struct {
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	GivenName     string `json:"given_name,omitempty"`
+	FamilyName    string `json:"family_name,omitempty"`
+}
+
+// idTokenClaims are the claims of an OpenID Connect ID token
+type idTokenClaims struct {
+	Nonce    string   `json:"nonce,omitempty"`
+	AuthTime int64    `json:"auth_time,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+	userClaims
+	jwt.RegisteredClaims
+}
+
+func newUserClaims(user *data.User, scopes []string) userClaims {
+	var claims userClaims
+	if slices.Contains(scopes, scopeEmail) {
+		// Only verified accounts can log in
+		verified := true
+		claims.Email, claims.EmailVerified = user.Email, &verified
+	}
+	if slices.Contains(scopes, scopeProfile) {
+		claims.GivenName, claims.FamilyName = user.FirstName, user.LastName
+		claims.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	}
+	return claims
+}
+
+// OpenIDConfiguration serves the discovery document, which tells OAuth and OpenID Connect
+// clients where the endpoints are and what they support
+func (app *Config) OpenIDConfiguration(c *gin.Context) {
+	issuer := app.PublicURL
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                        issuer,
+		"authorization_endpoint":                        issuer + "/oauth/authorize",
+		"token_endpoint":                                issuer + "/oauth/token",
+		"userinfo_endpoint":                             issuer + "/oauth/userinfo",
+		"jwks_uri":                                      issuer + "/.well-known/jwks.json",
+		"introspection_endpoint":                        issuer + "/oauth/introspect",
+		"revocation_endpoint":                           issuer + "/oauth/revoke",
+		"scopes_supported":                              oauthScopes(),
+		"response_types_supported":                      []string{"code"},
+		"response_modes_supported":                      []string{"query"},
+		"grant_types_supported":                         []string{data.GrantAuthorizationCode, data.GrantClientCredentials},
+		"subject_types_supported":                       []string{"public"},
+		"id_token_signing_alg_values_supported":         []string{"RS256"},
+		"token_endpoint_auth_methods_supported":         []string{"client_secret_basic", "client_secret_post", "none"},
+		"introspection_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"revocation_endpoint_auth_methods_supported":    []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":              []string{"S256"},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "amr",
+			"email", "email_verified", "name", "given_name", "family_name",
+		},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+// JWKS serves the public keys that ID tokens and access tokens are signed with
+func (app *Config) JWKS(c *gin.Context) {
+	keys, err := app.Keys.published(c.Request.Context())
+	if err != nil {
+		app.errorJSON(c, errors.New("could not load signing keys"), http.StatusInternalServerError)
+		return
+	}
+
+	set := make([]jwk, len(keys))
+	for i, key := range keys {
+		set[i] = publicJWK(key.id, &key.key.PublicKey)
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": set})
+}
+
+// RotateSigningKey makes a new signing key take over right away, for example when the
+// current one may have leaked. Tokens signed with the old key stay valid until they expire.
+func (app *Config) RotateSigningKey(c *gin.Context) {
+	key, err := app.Keys.rotate(c.Request.Context())
+	if err != nil {
+		app.errorJSON(c, errors.New("could not rotate the signing key"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "rotated signing key",
+		Data:    gin.H{"kid": key.id},
+	})
+}
+
+// authorizeRequest is an OAuth authorization request. Authorize reads it from the query
+// string and ApproveAuthorization from the body.
+type authorizeRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	// Deny is set when the user turns the client down
+	Deny bool `form:"deny" json:"deny"`
+}
+
+// Authorize starts the authorization code flow. A valid request is passed on to the
+// frontend's /oauth/authorize page, where the user logs in and approves the client; an
+// invalid one is sent back to the client with an error, unless the client or its redirect
+// URI can't be trusted, in which case the error is shown to the user.
+func (app *Config) Authorize(c *gin.Context) {
+	var req authorizeRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	client, redirectURI, err := app.authorizationClient(c.Request.Context(), req)
+	if err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+	if _, oauthErr := checkAuthorizeRequest(client, req); oauthErr != nil {
+		c.Redirect(http.StatusFound, app.authorizationResponse(redirectURI, req.State, oauthErrorParams(oauthErr)))
+		return
+	}
+
+	// The page shows the client's name when asking the user
+	query := c.Request.URL.Query()
+	query.Set("client_name", client.Name)
+	c.Redirect(http.StatusFound, app.FrontendURL+"/oauth/authorize?"+query.Encode())
+}
+
+// ApproveAuthorization is called by the frontend once the logged-in user has approved
+// (or denied) an authorization request. It issues an authorization code and answers with
+// the address to send the user back to the client with.
+func (app *Config) ApproveAuthorization(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+	var req authorizeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	client, redirectURI, err := app.authorizationClient(c.Request.Context(), req)
+	if err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+	if !user.Active {
+		app.errorJSON(c, errors.New("account is not active"), http.StatusForbidden)
+		return
+	}
+
+	scopes, oauthErr := checkAuthorizeRequest(client, req)
+	if oauthErr == nil && req.Deny {
+		oauthErr = newOAuthError("access_denied", "the user denied the request")
+	}
+	if oauthErr != nil {
+		app.writeRedirect(c, client, app.authorizationResponse(redirectURI, req.State, oauthErrorParams(oauthErr)))
+		return
+	}
+
+	claims, _ := authz.FromContext(c)
+	authTime := time.Now()
+	if claims.AuthTime != nil {
+		authTime = claims.AuthTime.Time
+	} else if claims.IssuedAt != nil {
+		authTime = claims.IssuedAt.Time
+	}
+	code, err := app.Models.OAuth.IssueCode(c.Request.Context(), data.OAuthCode{
+		ClientID:         client.ID,
+		UserID:           user.ID,
+		RedirectURI:      redirectURI,
+		RedirectURIGiven: req.RedirectURI != "",
+		Scope:            strings.Join(scopes, " "),
+		Nonce:            req.Nonce,
+		CodeChallenge:    req.CodeChallenge,
+		AMR:              claims.AMR,
+		AuthTime:         authTime,
+	}, oauthCodeTTL)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not authorize the client"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeRedirect(c, client, app.authorizationResponse(redirectURI, req.State, url.Values{"code": {code}}))
+}
+
+// writeRedirect answers ApproveAuthorization with the address to send the user to
+func (app *Config) writeRedirect(c *gin.Context, client *data.OAuthClient, redirectTo string) {
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "returning to " + client.Name,
+		Data:    gin.H{"redirect_to": redirectTo},
+	})
+}
+
+// authorizationClient looks up the client of an authorization request and the redirect
+// URI to answer it on, which must be one the client registered. It may be left out when
+// the client registered only one.
+func (app *Config) authorizationClient(ctx context.Context, req authorizeRequest) (*data.OAuthClient, string, error) {
+	if req.ClientID == "" {
+		return nil, "", errors.New("client_id is required")
+	}
+	client, err := app.Models.OAuth.GetClient(ctx, req.ClientID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", errors.New("unknown client")
+	} else if err != nil {
+		return nil, "", errors.New("could not load client")
+	}
+
+	switch {
+	case req.RedirectURI == "" && len(client.RedirectURIs) == 1:
+		return client, client.RedirectURIs[0], nil
+	case req.RedirectURI != "" && slices.Contains(client.RedirectURIs, req.RedirectURI):
+		return client, req.RedirectURI, nil
+	default:
+		return nil, "", errors.New("redirect_uri is not registered for this client")
+	}
+}
+
+// checkAuthorizeRequest checks the parts of an authorization request that are reported
+// back to the client, and returns the requested scopes
+func checkAuthorizeRequest(client *data.OAuthClient, req authorizeRequest) ([]string, *oauthError) {
+	if req.ResponseType != "code" {
+		return nil, newOAuthError("unsupported_response_type", "response_type must be code")
+	}
+	if !slices.Contains(client.GrantTypes, data.GrantAuthorizationCode) {
+		return nil, newOAuthError("unauthorized_client", "the client may not use the authorization code grant")
+	}
+	if req.CodeChallenge == "" {
+		return nil, newOAuthError("invalid_request", "code_challenge is required")
+	}
+	if req.CodeChallengeMethod != "S256" {
+		return nil, newOAuthError("invalid_request", "code_challenge_method must be S256")
+	}
+	if len(req.CodeChallenge) != 43 {
+		return nil, newOAuthError("invalid_request", "code_challenge must be a base64url encoded SHA-256 hash")
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		return nil, newOAuthError("invalid_scope", "scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(userScopes, scope) || !slices.Contains(client.Scopes, scope) {
+			return nil, newOAuthError("invalid_scope", "scope "+scope+" is not allowed")
+		}
+	}
+	return scopes, nil
+}
+
+// authorizationResponse returns redirectURI with the response parameters added to its
+// query, along with the state and the issuer (RFC 9207)
+func (app *Config) authorizationResponse(redirectURI, state string, params url.Values) string {
+	u, _ := url.Parse(redirectURI)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	query.Set("iss", app.PublicURL)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func oauthErrorParams(e *oauthError) url.Values {
+	params := url.Values{"error": {e.Code}}
+	if e.Description != "" {
+		params.Set("error_description", e.Description)
+	}
+	return params
+}
+
+// Token is the token endpoint. It exchanges an authorization code and its PKCE verifier
+// for an access token and, for the openid scope, an ID token, or issues an access token
+// to a confidential client acting for itself.
+func (app *Config) Token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, oauthErr := app.authenticateClient(c)
+	if oauthErr != nil {
+		writeOAuthError(c, oauthErr)
+		return
+	}
+
+	switch grant := c.PostForm("grant_type"); grant {
+	case data.GrantAuthorizationCode:
+		app.authorizationCodeGrant(c, client)
+	case data.GrantClientCredentials:
+		app.clientCredentialsGrant(c, client)
+	case "":
+		writeOAuthError(c, newOAuthError("invalid_request", "grant_type is required"))
+	default:
+		writeOAuthError(c, newOAuthError("unsupported_grant_type", "grant_type "+grant+" is not supported"))
+	}
+}
+
+func (app *Config) authorizationCodeGrant(c *gin.Context, client *data.OAuthClient) {
+	if !slices.Contains(client.GrantTypes, data.GrantAuthorizationCode) {
+		writeOAuthError(c, newOAuthError("unauthorized_client", "the client may not use the authorization code grant"))
+		return
+	}
+	plainText, redirectURI, verifier := c.PostForm("code"), c.PostForm("redirect_uri"), c.PostForm("code_verifier")
+	if plainText == "" || verifier == "" {
+		writeOAuthError(c, newOAuthError("invalid_request", "code and code_verifier are required"))
+		return
+	}
+
+	// The request is checked against the code before the code is used up, so that only the
+	// client it was issued to, with the verifier, can redeem it or set off the revocation
+	// of a reused code
+	code, err := app.Models.OAuth.FindCode(c.Request.Context(), plainText)
+	if errors.Is(err, data.ErrInvalidToken) {
+		writeOAuthError(c, newOAuthError("invalid_grant", "invalid or expired code"))
+		return
+	} else if err != nil {
+		writeOAuthError(c, newOAuthError("server_error", "could not check the code").withStatus(http.StatusInternalServerError))
+		return
+	}
+	if code.ClientID != client.ID {
+		writeOAuthError(c, newOAuthError("invalid_grant", "the code was issued to another client"))
+		return
+	}
+	// The redirect URI must be repeated if the authorization request named it, and can
+	// only be left out if that did too
+	if redirectURI == "" && code.RedirectURIGiven {
+		writeOAuthError(c, newOAuthError("invalid_request", "redirect_uri is required, as in the authorization request"))
+		return
+	}
+	if redirectURI != "" && redirectURI != code.RedirectURI {
+		writeOAuthError(c, newOAuthError("invalid_grant", "redirect_uri does not match the authorization request"))
+		return
+	}
+	if !pkceVerifier.MatchString(verifier) || !pkceMatches(verifier, code.CodeChallenge) {
+		writeOAuthError(c, newOAuthError("invalid_grant", "code_verifier does not match the code_challenge"))
+		return
+	}
+
+	// The ID of the access token is recorded with the code before the token is issued, so
+	// that it can be revoked if the code turns up again
+	jti, err := newTokenID()
+	if err != nil {
+		writeOAuthError(c, newOAuthError("server_error", "could not issue tokens").withStatus(http.StatusInternalServerError))
+		return
+	}
+	code, err = app.Models.OAuth.ConsumeCode(c.Request.Context(), plainText, jti)
+	if errors.Is(err, data.ErrAuthorizationCodeReused) {
+		// The code may have been stolen, so the token it was exchanged for is revoked too
+		// (RFC 6749 section 4.1.2). The token was issued right after the code was used.
+		if code.TokenID != "" {
+			if err := app.Models.OAuth.RevokeToken(c.Request.Context(), code.TokenID, code.UsedAt.Add(accessTokenTTL+time.Minute)); err != nil {
+				log.Println("Error revoking the token of a reused authorization code:", err)
+			}
+		}
+		writeOAuthError(c, newOAuthError("invalid_grant", "invalid or expired code"))
+		return
+	} else if errors.Is(err, data.ErrInvalidToken) {
+		writeOAuthError(c, newOAuthError("invalid_grant", "invalid or expired code"))
+		return
+	} else if err != nil {
+		writeOAuthError(c, newOAuthError("server_error", "could not check the code").withStatus(http.StatusInternalServerError))
+		return
+	}
+
+	user, err := app.Models.User.GetOne(c.Request.Context(), code.UserID)
+	if err != nil || !user.Active {
+		writeOAuthError(c, newOAuthError("invalid_grant", "the user can no longer log in"))
+		return
+	}
+
+	scopes := strings.Fields(code.Scope)
+	accessToken, err := app.oauthAccessToken(c.Request.Context(), client, jti, strconv.Itoa(user.ID), scopes, code.AMR)
+	if err != nil {
+		writeOAuthError(c, newOAuthError("server_error", "could not issue tokens").withStatus(http.StatusInternalServerError))
+		return
+	}
+	response := gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(accessTokenTTL.Seconds()),
+		"scope":        code.Scope,
+	}
+
+	if slices.Contains(scopes, scopeOpenID) {
+		idToken, err := app.idToken(c.Request.Context(), client, user, code)
+		if err != nil {
+			writeOAuthError(c, newOAuthError("server_error", "could not issue tokens").withStatus(http.StatusInternalServerError))
+			return
+		}
+		response["id_token"] = idToken
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (app *Config) clientCredentialsGrant(c *gin.Context, client *data.OAuthClient) {
+	if client.Public() || !slices.Contains(client.GrantTypes, data.GrantClientCredentials) {
+		writeOAuthError(c, newOAuthError("unauthorized_client", "the client may not use the client credentials grant"))
+		return
+	}
+
+	// Without a scope the client gets every permission it is allowed
+	scopes := strings.Fields(c.PostForm("scope"))
+	if len(scopes) == 0 {
+		for _, scope := range client.Scopes {
+			if !slices.Contains(userScopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	for _, scope := range scopes {
+		if slices.Contains(userScopes, scope) || !slices.Contains(client.Scopes, scope) {
+			writeOAuthError(c, newOAuthError("invalid_scope", "scope "+scope+" is not allowed"))
+			return
+		}
+	}
+
+	jti, err := newTokenID()
+	if err != nil {
+		writeOAuthError(c, newOAuthError("server_error", "could not issue tokens").withStatus(http.StatusInternalServerError))
+		return
+	}
+	accessToken, err := app.oauthAccessToken(c.Request.Context(), client, jti, "client:"+client.ID, scopes, nil)
+	if err != nil {
+		writeOAuthError(c, newOAuthError("server_error", "could not issue tokens").withStatus(http.StatusInternalServerError))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(accessTokenTTL.Seconds()),
+		"scope":        strings.Join(scopes, " "),
+	})
+}
+
+// pkceMatches reports whether verifier hashes to the S256 challenge
+func pkceMatches(verifier, challenge string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+// authenticateClient identifies the client calling the token, introspection or
+// revocation endpoint, by HTTP Basic authentication or by client_id and client_secret in
+// the form. Public clients only send their client_id.
+func (app *Config) authenticateClient(c *gin.Context) (*data.OAuthClient, *oauthError) {
+	id, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// The credentials are form encoded before they are put in the header (RFC 6749)
+		var err1, err2 error
+		id, err1 = url.QueryUnescape(id)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			return nil, app.invalidClient(c, basic)
+		}
+	} else {
+		id, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	if id == "" {
+		return nil, app.invalidClient(c, basic)
+	}
+
+	client, err := app.Models.OAuth.GetClient(c.Request.Context(), id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, app.invalidClient(c, basic)
+	} else if err != nil {
+		return nil, newOAuthError("server_error", "could not load client").withStatus(http.StatusInternalServerError)
+	}
+
+	if client.Public() {
+		if secret != "" {
+			return nil, app.invalidClient(c, basic)
+		}
+	} else if !client.SecretMatches(secret) {
+		return nil, app.invalidClient(c, basic)
+	}
+	return client, nil
+}
+
+// invalidClient is the error for a failed client authentication
+func (app *Config) invalidClient(c *gin.Context, basic bool) *oauthError {
+	if basic {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	return newOAuthError("invalid_client", "client authentication failed").withStatus(http.StatusUnauthorized)
+}
+
+// oauthAccessToken issues an access token with ID jti to client for subject
+func (app *Config) oauthAccessToken(ctx context.Context, client *data.OAuthClient, jti, subject string, scopes, amr []string) (string, error) {
+	now := time.Now()
+	return app.signOAuthToken(ctx, accessTokenType, &oauthAccessClaims{
+		ClientID: client.ID,
+		Scope:    strings.Join(scopes, " "),
+		AMR:      amr,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    app.PublicURL,
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{client.ID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+			ID:        jti,
+		},
+	})
+}
+
+// idToken issues the ID token for a user who authorized client with code
+func (app *Config) idToken(ctx context.Context, client *data.OAuthClient, user *data.User, code *data.OAuthCode) (string, error) {
+	now := time.Now()
+	return app.signOAuthToken(ctx, "JWT", &idTokenClaims{
+		Nonce:      code.Nonce,
+		AuthTime:   code.AuthTime.Unix(),
+		AMR:        code.AMR,
+		userClaims: newUserClaims(user, strings.Fields(code.Scope)),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    app.PublicURL,
+			Subject:   strconv.Itoa(user.ID),
+			Audience:  jwt.ClaimStrings{client.ID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(idTokenTTL)),
+		},
+	})
+}
+
+// signOAuthToken signs claims with the current signing key
+func (app *Config) signOAuthToken(ctx context.Context, typ string, claims jwt.Claims) (string, error) {
+	key, err := app.Keys.current(ctx)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.id
+	token.Header["typ"] = typ
+	return token.SignedString(key.key)
+}
+
+// parseOAuthToken verifies an access token issued to an OAuth client and returns its
+// claims. Revoked tokens are refused.
+func (app *Config) parseOAuthToken(ctx context.Context, token string) (*oauthAccessClaims, error) {
+	var claims oauthAccessClaims
+	parsed, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return app.Keys.publicKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(app.PublicURL),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || parsed.Header["typ"] != accessTokenType || claims.ID == "" {
+		return nil, errInvalidOAuthToken
+	}
+
+	revoked, err := app.Models.OAuth.TokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errInvalidOAuthToken
+	}
+	return &claims, nil
+}
+
+// UserInfo returns the claims about the user that an access token with the openid scope
+// was granted
+func (app *Config) UserInfo(c *gin.Context) {
+	token, ok := authz.BearerToken(c)
+	if !ok {
+		c.Header("WWW-Authenticate", "Bearer")
+		writeOAuthError(c, newOAuthError("invalid_request", "missing access token").withStatus(http.StatusUnauthorized))
+		return
+	}
+	claims, err := app.parseOAuthToken(c.Request.Context(), token)
+	if errors.Is(err, errInvalidOAuthToken) {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(c, newOAuthError("invalid_token", err.Error()).withStatus(http.StatusUnauthorized))
+		return
+	} else if err != nil {
+		writeOAuthError(c, newOAuthError("server_error", "could not check the token").withStatus(http.StatusInternalServerError))
+		return
+	}
+	if !claims.hasScope(scopeOpenID) {
+		c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		writeOAuthError(c, newOAuthError("insufficient_scope", "the token was not granted the openid scope").withStatus(http.StatusForbidden))
+		return
+	}
+
+	id, _ := strconv.Atoi(claims.Subject)
+	user, err := app.Models.User.GetOne(c.Request.Context(), id)
+	if err != nil || !user.Active {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(c, newOAuthError("invalid_token", "the user can no longer log in").withStatus(http.StatusUnauthorized))
+		return
+	}
+
+	c.JSON(http.StatusOK, struct {
+		Subject string `json:"sub"`
+		userClaims
+	}{claims.Subject, newUserClaims(user, strings.Fields(claims.Scope))})
+}
+
+// Introspect tells a confidential client whether an access token is active, and what it
+// grants (RFC 7662)
+func (app *Config) Introspect(c *gin.Context) {
+	client, oauthErr := app.authenticateClient(c)
+	if oauthErr != nil {
+		writeOAuthError(c, oauthErr)
+		return
+	}
+	if client.Public() {
+		writeOAuthError(c, newOAuthError("invalid_client", "public clients can't introspect tokens").withStatus(http.StatusUnauthorized))
+		return
+	}
+	token := c.PostForm("token")
+	if token == "" {
+		writeOAuthError(c, newOAuthError("invalid_request", "token is required"))
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	claims, err := app.parseOAuthToken(c.Request.Context(), token)
+	if errors.Is(err, errInvalidOAuthToken) {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	} else if err != nil {
+		writeOAuthError(c, newOAuthError("server_error", "could not check the token").withStatus(http.StatusInternalServerError))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"active":     true,
+		"scope":      claims.Scope,
+		"client_id":  claims.ClientID,
+		"sub":        claims.Subject,
+		"aud":        claims.Audience,
+		"iss":        claims.Issuer,
+		"exp":        claims.ExpiresAt.Unix(),
+		"iat":        claims.IssuedAt.Unix(),
+		"jti":        claims.ID,
+		"token_type": "Bearer",
+	})
+}
+
+// Revoke revokes an access token issued to the calling client (RFC 7009). Tokens that
+// are invalid or already expired need no revoking, and are answered the same way.
+func (app *Config) Revoke(c *gin.Context) {
+	client, oauthErr := app.authenticateClient(c)
+	if oauthErr != nil {
+		writeOAuthError(c, oauthErr)
+		return
+	}
+	token := c.PostForm("token")
+	if token == "" {
+		writeOAuthError(c, newOAuthError("invalid_request", "token is required"))
+		return
+	}
+
+	claims, err := app.parseOAuthToken(c.Request.Context(), token)
+	if errors.Is(err, errInvalidOAuthToken) {
+		c.Status(http.StatusOK)
+		return
+	} else if err != nil {
+		writeOAuthError(c, newOAuthError("server_error", "could not check the token").withStatus(http.StatusInternalServerError))
+		return
+	}
+	if claims.ClientID != client.ID {
+		writeOAuthError(c, newOAuthError("unauthorized_client", "the token was issued to another client"))
+		return
+	}
+
+	if err := app.Models.OAuth.RevokeToken(c.Request.Context(), claims.ID, claims.ExpiresAt.Time); err != nil {
+		writeOAuthError(c, newOAuthError("server_error", "could not revoke the token").withStatus(http.StatusInternalServerError))
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// purgeOAuth deletes expired authorization codes, revocation records and retired signing
+// keys every interval, until stop is closed
+func (app *Config) purgeOAuth(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := app.Models.OAuth.PurgeExpired(context.Background(), time.Now(), app.Keys.retiredBefore())
+			if err != nil {
+				log.Println("Error purging expired OAuth data:", err)
+			}
+		}
+	}
+}
+
+// newTokenID returns a random ID for an access token, which it can be revoked by
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
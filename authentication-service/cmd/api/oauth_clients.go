@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"authentication/data"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type oauthClientRequest struct {
+	Name         string   `json:"name" binding:"required,max=255"`
+	RedirectURIs []string `json:"redirect_uris"`
+	GrantTypes   []string `json:"grant_types" binding:"required,min=1"`
+	Scopes       []string `json:"scopes" binding:"required,min=1"`
+	// Public is only read when the client is registered
+	Public bool `json:"public"`
+}
+
+// oauthClientResponse is a client as the management endpoints show it. The secret is
+// only included when the client is registered.
+type oauthClientResponse struct {
+	*data.OAuthClient
+	Public       bool   `json:"public"`
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// ListOAuthClients returns every registered OAuth client
+func (app *Config) ListOAuthClients(c *gin.Context) {
+	clients, err := app.Models.OAuth.GetClients(c.Request.Context())
+	if err != nil {
+		app.errorJSON(c, errors.New("could not list clients"), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]oauthClientResponse, len(clients))
+	for i, client := range clients {
+		response[i] = oauthClientResponse{OAuthClient: client, Public: client.Public()}
+	}
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d clients", len(clients)),
+		Data:    response,
+	})
+}
+
+// GetOAuthClient returns the client with the id in the path
+func (app *Config) GetOAuthClient(c *gin.Context) {
+	client, ok := app.oauthClientFromPath(c)
+	if !ok {
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "client " + client.Name,
+		Data:    oauthClientResponse{OAuthClient: client, Public: client.Public()},
+	})
+}
+
+// CreateOAuthClient registers an OAuth client. Confidential clients get a secret, which
+// is only shown in this response.
+func (app *Config) CreateOAuthClient(c *gin.Context) {
+	var req oauthClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	client, secret, err := data.NewOAuthClient(req.Public)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not register client"), http.StatusInternalServerError)
+		return
+	}
+	if err := applyOAuthClientRequest(client, req); err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+
+	if err := app.Models.OAuth.InsertClient(c.Request.Context(), client); err != nil {
+		app.errorJSON(c, errors.New("could not register client"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusCreated, jsonResponse{
+		Error:   false,
+		Message: "registered client " + client.Name,
+		Data:    oauthClientResponse{OAuthClient: client, Public: client.Public(), ClientSecret: secret},
+	})
+}
+
+// UpdateOAuthClient replaces the settings of the client with the id in the path. Whether
+// it is public, and its secret, stay the same.
+func (app *Config) UpdateOAuthClient(c *gin.Context) {
+	client, ok := app.oauthClientFromPath(c)
+	if !ok {
+		return
+	}
+
+	var req oauthClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+	if err := applyOAuthClientRequest(client, req); err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+
+	if err := app.Models.OAuth.UpdateClient(c.Request.Context(), client); err != nil {
+		app.errorJSON(c, errors.New("could not update client"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "updated client " + client.Name,
+		Data:    oauthClientResponse{OAuthClient: client, Public: client.Public()},
+	})
+}
+
+// DeleteOAuthClient removes the client with the id in the path. Tokens already issued to
+// it stay valid until they expire.
+func (app *Config) DeleteOAuthClient(c *gin.Context) {
+	client, ok := app.oauthClientFromPath(c)
+	if !ok {
+		return
+	}
+
+	if err := app.Models.OAuth.DeleteClient(c.Request.Context(), client.ID); err != nil {
+		app.errorJSON(c, errors.New("could not delete client"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "deleted client " + client.Name,
+	})
+}
+
+// applyOAuthClientRequest checks the settings in req and copies them to client
+func applyOAuthClientRequest(client *data.OAuthClient, req oauthClientRequest) error {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return errors.New("name is required")
+	}
+
+	for _, grant := range req.GrantTypes {
+		if grant != data.GrantAuthorizationCode && grant != data.GrantClientCredentials {
+			return fmt.Errorf("unknown grant type %s", grant)
+		}
+	}
+	if client.Public() && slices.Contains(req.GrantTypes, data.GrantClientCredentials) {
+		return errors.New("public clients can't use the client credentials grant")
+	}
+	if slices.Contains(req.GrantTypes, data.GrantAuthorizationCode) && len(req.RedirectURIs) == 0 {
+		return errors.New("redirect_uris are required for the authorization code grant")
+	}
+
+	for _, uri := range req.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+			return fmt.Errorf("redirect URI %s must be an absolute URL without a fragment", uri)
+		}
+	}
+
+	supported := oauthScopes()
+	for _, scope := range req.Scopes {
+		if !slices.Contains(supported, scope) {
+			return fmt.Errorf("unknown scope %s", scope)
+		}
+	}
+
+	grants := slices.Clone(req.GrantTypes)
+	slices.Sort(grants)
+	client.Name = name
+	client.RedirectURIs = req.RedirectURIs
+	client.GrantTypes = slices.Compact(grants)
+	client.Scopes = req.Scopes
+	return nil
+}
+
+// oauthClientFromPath loads the client with the id path parameter. When that fails it
+// writes the error response and returns false.
+func (app *Config) oauthClientFromPath(c *gin.Context) (*data.OAuthClient, bool) {
+	client, err := app.Models.OAuth.GetClient(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("client not found"), http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not load client"), http.StatusInternalServerError)
+		return nil, false
+	}
+	return client, true
+}
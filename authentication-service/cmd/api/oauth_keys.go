@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"authentication/data"
+)
+
+const (
+	signingKeyBits = 2048
+	// keyReloadInterval is how often the keys are read again from the database, to pick
+	// up keys created by other instances
+	keyReloadInterval = time.Minute
+	// keyRetryInterval is the least time between reloads caused by a token signed with a
+	// key that isn't known yet
+	keyRetryInterval = 5 * time.Second
+)
+
+var errUnknownKey = errors.New("unknown signing key")
+
+// oauthKey is a parsed data.SigningKey
+type oauthKey struct {
+	id        string
+	key       *rsa.PrivateKey
+	createdAt time.Time
+}
+
+// keyRing holds the RSA keys that the tokens issued to OAuth clients are signed with. The
+// newest key signs. Once it is older than rotateEvery a new key takes over, and the old
+// one stays published for another rotateEvery, so that tokens it signed can still be
+// checked. Keys are stored in the database, encrypted, so every instance uses the same
+// ones.
+type keyRing struct {
+	repo        data.OAuthRepository
+	box         *secretBox
+	rotateEvery time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	keys     []oauthKey // newest first
+	loadedAt time.Time
+}
+
+func newKeyRing(repo data.OAuthRepository, box *secretBox, rotateEvery time.Duration) *keyRing {
+	return &keyRing{repo: repo, box: box, rotateEvery: rotateEvery, now: time.Now}
+}
+
+// current returns the key to sign with, creating a new one when there is none yet or the
+// newest one is due to be rotated
+func (r *keyRing) current(ctx context.Context) (oauthKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.ensureCurrent(ctx); err != nil {
+		return oauthKey{}, err
+	}
+	return r.keys[0], nil
+}
+
+// rotate creates a new key, which signs from now on
+func (r *keyRing) rotate(ctx context.Context) (oauthKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rotateLocked(ctx)
+}
+
+// published returns the keys whose public halves belong in the JWKS, newest first. The
+// key that signs next is among them.
+func (r *keyRing) published(ctx context.Context) ([]oauthKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.ensureCurrent(ctx); err != nil {
+		return nil, err
+	}
+	return append([]oauthKey(nil), r.keys...), nil
+}
+
+// publicKey returns the public half of the published key with id kid
+func (r *keyRing) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.refresh(ctx, keyReloadInterval); err != nil {
+		return nil, err
+	}
+	if key, ok := r.find(kid); ok {
+		return &key.key.PublicKey, nil
+	}
+	// The key may have just been created by another instance
+	if err := r.refresh(ctx, keyRetryInterval); err != nil {
+		return nil, err
+	}
+	if key, ok := r.find(kid); ok {
+		return &key.key.PublicKey, nil
+	}
+	return nil, errUnknownKey
+}
+
+func (r *keyRing) find(kid string) (oauthKey, bool) {
+	for _, key := range r.keys {
+		if key.id == kid {
+			return key, true
+		}
+	}
+	return oauthKey{}, false
+}
+
+// ensureCurrent loads the keys and creates a new one when there is none yet or the newest
+// one is due to be rotated. The lock must be held.
+func (r *keyRing) ensureCurrent(ctx context.Context) error {
+	if err := r.refresh(ctx, keyReloadInterval); err != nil {
+		return err
+	}
+	if !r.due() {
+		return nil
+	}
+	// Another instance may have rotated the key already
+	if err := r.refresh(ctx, 0); err != nil {
+		return err
+	}
+	if r.due() {
+		_, err := r.rotateLocked(ctx)
+		return err
+	}
+	return nil
+}
+
+// due reports whether a new key is needed. The lock must be held.
+func (r *keyRing) due() bool {
+	return len(r.keys) == 0 || r.now().Sub(r.keys[0].createdAt) >= r.rotateEvery
+}
+
+// retiredBefore is the creation time before which keys are no longer published
+func (r *keyRing) retiredBefore() time.Time {
+	return r.now().Add(-2 * r.rotateEvery)
+}
+
+// refresh reads the published keys from the database, unless they were read less than
+// maxAge ago. The lock must be held.
+func (r *keyRing) refresh(ctx context.Context, maxAge time.Duration) error {
+	now := r.now()
+	if !r.loadedAt.IsZero() && now.Sub(r.loadedAt) < maxAge {
+		return nil
+	}
+
+	stored, err := r.repo.SigningKeys(ctx, r.retiredBefore())
+	if err != nil {
+		return err
+	}
+	keys := make([]oauthKey, 0, len(stored))
+	for _, s := range stored {
+		// Keys don't change, so the ones parsed before can be kept
+		if key, ok := r.find(s.ID); ok {
+			keys = append(keys, key)
+			continue
+		}
+		key, err := r.open(s)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", s.ID, err)
+		}
+		keys = append(keys, key)
+	}
+	r.keys, r.loadedAt = keys, now
+	return nil
+}
+
+// rotateLocked creates and stores a new key. The lock must be held.
+func (r *keyRing) rotateLocked(ctx context.Context) (oauthKey, error) {
+	private, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+	if err != nil {
+		return oauthKey{}, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return oauthKey{}, err
+	}
+
+	key := oauthKey{id: keyID(&private.PublicKey), key: private, createdAt: r.now()}
+	sealed, err := r.box.seal(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), signingKeyContext(key.id))
+	if err != nil {
+		return oauthKey{}, err
+	}
+	err = r.repo.InsertSigningKey(ctx, &data.SigningKey{ID: key.id, PrivateKey: sealed, CreatedAt: key.createdAt})
+	if err != nil {
+		return oauthKey{}, err
+	}
+
+	r.keys = append([]oauthKey{key}, r.keys...)
+	return key, nil
+}
+
+// open decrypts and parses a stored key
+func (r *keyRing) open(s data.SigningKey) (oauthKey, error) {
+	plainText, err := r.box.open(s.PrivateKey, signingKeyContext(s.ID))
+	if err != nil {
+		return oauthKey{}, err
+	}
+	block, _ := pem.Decode(plainText)
+	if block == nil {
+		return oauthKey{}, errors.New("malformed private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return oauthKey{}, err
+	}
+	private, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return oauthKey{}, errors.New("not an RSA key")
+	}
+	return oauthKey{id: s.ID, key: private, createdAt: s.CreatedAt}, nil
+}
+
+// signingKeyContext binds an encrypted signing key to its id
+func signingKeyContext(kid string) string {
+	return "oauth-signing-key:" + kid
+}
+
+// jwk is the JSON Web Key form of an RSA public key
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+func publicJWK(kid string, key *rsa.PublicKey) jwk {
+	return jwk{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: "RS256",
+		KeyID:     kid,
+		N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// keyID returns the JWK thumbprint of key (RFC 7638), which names it in tokens and the JWKS
+func keyID(key *rsa.PublicKey) string {
+	k := publicJWK("", key)
+	sum := sha256.Sum256([]byte(`{"e":"` + k.E + `","kty":"RSA","n":"` + k.N + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"authentication/data"
+	"authz"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The tests in this file walk through the OAuth2 and OpenID Connect endpoints the way a
+// conformance suite would, using only the test servers
+
+const (
+	testRedirectURI = "https://app.example.com/callback"
+	testVerifier    = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// registerClient registers an OAuth client through the management API and returns its ID
+// and secret
+func (h *harness) registerClient(t *testing.T, client map[string]any) (string, string) {
+	t.Helper()
+	status, resp := h.do(t, http.MethodPost, "/oauth/clients", h.admin, client)
+	if status != http.StatusCreated || resp.Error {
+		t.Fatalf("expected the client to be registered, got %d %+v", status, resp)
+	}
+	registered := resp.Data.(map[string]any)
+	secret, _ := registered["client_secret"].(string)
+	return registered["client_id"].(string), secret
+}
+
+// webClient registers a confidential client that signs users in
+func (h *harness) webClient(t *testing.T) (string, string) {
+	t.Helper()
+	return h.registerClient(t, map[string]any{
+		"name":          "Partner App",
+		"redirect_uris": []string{testRedirectURI},
+		"grant_types":   []string{data.GrantAuthorizationCode},
+		"scopes":        []string{"openid", "profile", "email"},
+	})
+}
+
+// userToken returns an access token for the user with id, as the frontend would hold
+// after logging them in
+func (h *harness) userToken(t *testing.T, id int) string {
+	t.Helper()
+	token, err := h.tokens.Sign(authz.Claims{
+		AMR:              []string{"pwd"},
+		RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.Itoa(id)},
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// postForm posts a form to an OAuth endpoint, with HTTP Basic client authentication
+// unless clientID is empty, and decodes the JSON response
+func (h *harness) postForm(t *testing.T, path string, form url.Values, clientID, secret string) (int, map[string]any, http.Header) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, h.server.URL+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+	}
+	return h.send(t, req)
+}
+
+func (h *harness) send(t *testing.T, req *http.Request) (int, map[string]any, http.Header) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out map[string]any
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out, resp.Header
+}
+
+// getJSON fetches path with an optional bearer token and decodes the JSON response
+func (h *harness) getJSON(t *testing.T, path, token string) (int, map[string]any, http.Header) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, h.server.URL+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return h.send(t, req)
+}
+
+// authorizeLocation sends the browser's authorization request and returns where it is
+// redirected to
+func (h *harness) authorizeLocation(t *testing.T, params url.Values) (int, *url.URL) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(h.server.URL + "/oauth/authorize?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	return resp.StatusCode, location
+}
+
+// approve is the frontend approving an authorization request for the logged-in user. It
+// returns where the user is sent back to.
+func (h *harness) approve(t *testing.T, userToken string, params map[string]any) *url.URL {
+	t.Helper()
+	status, resp := h.do(t, http.MethodPost, "/oauth/authorize", userToken, params)
+	if status != http.StatusOK || resp.Error {
+		t.Fatalf("expected the request to be approved, got %d %+v", status, resp)
+	}
+	redirect, err := url.Parse(resp.Data.(map[string]any)["redirect_to"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return redirect
+}
+
+// authorizationParams is a valid authorization request for clientID
+func authorizationParams(clientID string) map[string]any {
+	return map[string]any{
+		"response_type":         "code",
+		"client_id":             clientID,
+		"redirect_uri":          testRedirectURI,
+		"scope":                 "openid email profile",
+		"state":                 "af0ifjsldkj",
+		"nonce":                 "n-0S6_WzA2Mj",
+		"code_challenge":        pkceChallenge(testVerifier),
+		"code_challenge_method": "S256",
+	}
+}
+
+func queryOf(params map[string]any) url.Values {
+	query := url.Values{}
+	for key, value := range params {
+		query.Set(key, value.(string))
+	}
+	return query
+}
+
+// authorizationCode runs the authorization request for the user with id and returns the
+// code the client receives
+func (h *harness) authorizationCode(t *testing.T, clientID string, userID int) string {
+	t.Helper()
+	redirect := h.approve(t, h.userToken(t, userID), authorizationParams(clientID))
+	code := redirect.Query().Get("code")
+	if code == "" {
+		t.Fatalf("expected a code in %s", redirect)
+	}
+	return code
+}
+
+// exchange redeems a code at the token endpoint
+func (h *harness) exchange(t *testing.T, clientID, secret, code, verifier string) (int, map[string]any) {
+	t.Helper()
+	status, body, _ := h.postForm(t, "/oauth/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	}, clientID, secret)
+	return status, body
+}
+
+// verifyWithJWKS checks a token's signature against the published keys, the way a
+// relying party would, and returns its header and claims
+func (h *harness) verifyWithJWKS(t *testing.T, token string) (map[string]any, jwt.MapClaims) {
+	t.Helper()
+	status, body, _ := h.getJSON(t, "/.well-known/jwks.json", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected the JWKS, got %d", status)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range body["keys"].([]any) {
+		k := k.(map[string]any)
+		if k["kty"] != "RSA" || k["use"] != "sig" || k["alg"] != "RS256" {
+			t.Fatalf("unexpected key %+v", k)
+		}
+		n, _ := base64.RawURLEncoding.DecodeString(k["n"].(string))
+		e, _ := base64.RawURLEncoding.DecodeString(k["e"].(string))
+		keys[k["kid"].(string)] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	claims := jwt.MapClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		return keys[t.Header["kid"].(string)], nil
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer("http://auth.test"), jwt.WithExpirationRequired())
+	if err != nil {
+		t.Fatalf("token does not verify against the JWKS: %v", err)
+	}
+	return parsed.Header, claims
+}
+
+func TestOpenIDDiscovery(t *testing.T) {
+	h := newHarness(t)
+
+	status, doc, _ := h.getJSON(t, "/.well-known/openid-configuration", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	want := map[string]string{
+		"issuer":                 "http://auth.test",
+		"authorization_endpoint": "http://auth.test/oauth/authorize",
+		"token_endpoint":         "http://auth.test/oauth/token",
+		"userinfo_endpoint":      "http://auth.test/oauth/userinfo",
+		"jwks_uri":               "http://auth.test/.well-known/jwks.json",
+		"introspection_endpoint": "http://auth.test/oauth/introspect",
+		"revocation_endpoint":    "http://auth.test/oauth/revoke",
+	}
+	for key, value := range want {
+		if doc[key] != value {
+			t.Errorf("%s: got %v, want %s", key, doc[key], value)
+		}
+	}
+	// Every advertised endpoint is served
+	for key, value := range want {
+		if key == "issuer" {
+			continue
+		}
+		path := strings.TrimPrefix(value, "http://auth.test")
+		status, _, _ := h.getJSON(t, path, "")
+		if strings.HasSuffix(key, "tion_endpoint") || key == "token_endpoint" {
+			status, _, _ = h.postForm(t, path, url.Values{}, "", "")
+		}
+		if status == http.StatusNotFound {
+			t.Errorf("%s %s is not served", key, path)
+		}
+	}
+
+	contains := func(key, value string) {
+		values, _ := doc[key].([]any)
+		if !slices.Contains(values, any(value)) {
+			t.Errorf("%s: %v lacks %s", key, values, value)
+		}
+	}
+	contains("scopes_supported", "openid")
+	contains("response_types_supported", "code")
+	contains("grant_types_supported", "authorization_code")
+	contains("grant_types_supported", "client_credentials")
+	contains("subject_types_supported", "public")
+	contains("id_token_signing_alg_values_supported", "RS256")
+	contains("code_challenge_methods_supported", "S256")
+	contains("token_endpoint_auth_methods_supported", "client_secret_basic")
+
+	// A relying party can fetch the keys before any token was issued
+	status, jwks, _ := h.getJSON(t, "/.well-known/jwks.json", "")
+	if keys, _ := jwks["keys"].([]any); status != http.StatusOK || len(keys) != 1 {
+		t.Fatalf("expected one published key, got %d %+v", status, jwks)
+	}
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	h := newHarness(t)
+	userID := h.addUser(t, "ada@example.com", "verysecret", true)
+	clientID, secret := h.webClient(t)
+
+	// The browser is sent on to the frontend's login and consent page
+	params := authorizationParams(clientID)
+	status, location := h.authorizeLocation(t, queryOf(params))
+	if status != http.StatusFound || location.Host != "frontend.test" || location.Path != "/oauth/authorize" {
+		t.Fatalf("expected a redirect to the frontend, got %d %s", status, location)
+	}
+	if location.Query().Get("code_challenge") != params["code_challenge"] || location.Query().Get("client_name") != "Partner App" {
+		t.Errorf("the frontend page lost the request parameters: %s", location)
+	}
+
+	// Once the user approves, they go back to the client with a code, the state and the
+	// issuer
+	redirect := h.approve(t, h.userToken(t, userID), params)
+	if got := redirect.Scheme + "://" + redirect.Host + redirect.Path; got != testRedirectURI {
+		t.Fatalf("expected to return to %s, got %s", testRedirectURI, redirect)
+	}
+	query := redirect.Query()
+	if query.Get("code") == "" || query.Get("state") != "af0ifjsldkj" || query.Get("iss") != "http://auth.test" {
+		t.Fatalf("unexpected authorization response %s", redirect)
+	}
+
+	status, tokens := h.exchange(t, clientID, secret, query.Get("code"), testVerifier)
+	if status != http.StatusOK {
+		t.Fatalf("expected tokens, got %d %+v", status, tokens)
+	}
+	if tokens["token_type"] != "Bearer" || tokens["expires_in"] != float64(900) || tokens["scope"] != "openid email profile" {
+		t.Errorf("unexpected token response %+v", tokens)
+	}
+
+	header, idClaims := h.verifyWithJWKS(t, tokens["id_token"].(string))
+	if header["typ"] != "JWT" {
+		t.Errorf("unexpected ID token header %+v", header)
+	}
+	if idClaims["sub"] != strconv.Itoa(userID) || idClaims["nonce"] != "n-0S6_WzA2Mj" ||
+		idClaims["email"] != "ada@example.com" || idClaims["email_verified"] != true ||
+		idClaims["given_name"] != "Admin" || idClaims["auth_time"] == nil {
+		t.Errorf("unexpected ID token claims %+v", idClaims)
+	}
+	if aud, _ := idClaims.GetAudience(); !slices.Equal(aud, []string{clientID}) {
+		t.Errorf("expected the ID token to be for %s, got %v", clientID, aud)
+	}
+
+	header, accessClaims := h.verifyWithJWKS(t, tokens["access_token"].(string))
+	if header["typ"] != "at+jwt" || accessClaims["client_id"] != clientID || accessClaims["jti"] == nil {
+		t.Errorf("unexpected access token %+v %+v", header, accessClaims)
+	}
+
+	status, info, _ := h.getJSON(t, "/oauth/userinfo", tokens["access_token"].(string))
+	if status != http.StatusOK || info["sub"] != strconv.Itoa(userID) || info["email"] != "ada@example.com" || info["name"] != "Admin User" {
+		t.Errorf("unexpected userinfo %d %+v", status, info)
+	}
+
+	// A code can only be redeemed once, and redeeming it again revokes its access token
+	status, body := h.exchange(t, clientID, secret, query.Get("code"), testVerifier)
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("expected a reused code to be refused, got %d %+v", status, body)
+	}
+	if status, _, _ := h.getJSON(t, "/oauth/userinfo", tokens["access_token"].(string)); status != http.StatusUnauthorized {
+		t.Errorf("expected the token of a reused code to be revoked, got %d", status)
+	}
+}
+
+func TestOAuthPublicClient(t *testing.T) {
+	h := newHarness(t)
+	userID := h.addUser(t, "ada@example.com", "verysecret", true)
+	clientID, secret := h.registerClient(t, map[string]any{
+		"name":          "Single Page App",
+		"public":        true,
+		"redirect_uris": []string{testRedirectURI},
+		"grant_types":   []string{data.GrantAuthorizationCode},
+		"scopes":        []string{"openid"},
+	})
+	if secret != "" {
+		t.Fatal("a public client was given a secret")
+	}
+
+	// With a single registered redirect URI, both requests can leave it out
+	params := authorizationParams(clientID)
+	params["scope"] = "openid"
+	delete(params, "redirect_uri")
+	code := h.approve(t, h.userToken(t, userID), params).Query().Get("code")
+
+	// Public clients identify themselves with client_id in the form
+	status, tokens, _ := h.postForm(t, "/oauth/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID},
+		"code":          {code},
+		"code_verifier": {testVerifier},
+	}, "", "")
+	if status != http.StatusOK || tokens["id_token"] == nil {
+		t.Fatalf("expected tokens, got %d %+v", status, tokens)
+	}
+	if _, claims := h.verifyWithJWKS(t, tokens["id_token"].(string)); claims["email"] != nil {
+		t.Errorf("the email was released without the email scope: %+v", claims)
+	}
+
+	// Public clients can't introspect
+	status, body, _ := h.postForm(t, "/oauth/introspect", url.Values{
+		"client_id": {clientID}, "token": {tokens["access_token"].(string)},
+	}, "", "")
+	if status != http.StatusUnauthorized || body["error"] != "invalid_client" {
+		t.Errorf("expected a public client to be refused, got %d %+v", status, body)
+	}
+}
+
+func TestOAuthAuthorizationErrors(t *testing.T) {
+	h := newHarness(t)
+	userID := h.addUser(t, "ada@example.com", "verysecret", true)
+	clientID, _ := h.webClient(t)
+	serviceID, _ := h.registerClient(t, map[string]any{
+		"name":        "Batch Job",
+		"grant_types": []string{data.GrantClientCredentials},
+		"scopes":      []string{authz.LogsRead},
+	})
+
+	// Requests that can't be trusted to go back to the client are refused on the spot
+	for name, change := range map[string]map[string]any{
+		"unknown client":         {"client_id": "nope"},
+		"unregistered redirect":  {"redirect_uri": "https://evil.example.com/callback"},
+		"redirect with a suffix": {"redirect_uri": testRedirectURI + "/../steal"},
+	} {
+		params := authorizationParams(clientID)
+		for key, value := range change {
+			params[key] = value
+		}
+		if status, location := h.authorizeLocation(t, queryOf(params)); status != http.StatusBadRequest || location.String() != "" {
+			t.Errorf("%s: expected 400 without a redirect, got %d %s", name, status, location)
+		}
+	}
+
+	// Other errors are sent back to the client
+	tests := []struct {
+		name   string
+		change map[string]any
+		error  string
+	}{
+		{"token response", map[string]any{"response_type": "token"}, "unsupported_response_type"},
+		{"no PKCE", map[string]any{"code_challenge": ""}, "invalid_request"},
+		{"plain PKCE", map[string]any{"code_challenge_method": "plain"}, "invalid_request"},
+		{"short challenge", map[string]any{"code_challenge": "abc"}, "invalid_request"},
+		{"no scope", map[string]any{"scope": ""}, "invalid_scope"},
+		{"permission scope", map[string]any{"scope": "openid logs:read"}, "invalid_scope"},
+		{"client credentials client", map[string]any{"client_id": serviceID, "redirect_uri": ""}, "unauthorized_client"},
+	}
+	for _, tt := range tests {
+		params := authorizationParams(clientID)
+		for key, value := range tt.change {
+			params[key] = value
+		}
+		if tt.change["client_id"] == serviceID {
+			// Without a registered redirect URI, there is nowhere to send the error
+			if status, _ := h.authorizeLocation(t, queryOf(params)); status != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d", tt.name, status)
+			}
+			continue
+		}
+		status, location := h.authorizeLocation(t, queryOf(params))
+		if status != http.StatusFound || !strings.HasPrefix(location.String(), testRedirectURI+"?") {
+			t.Errorf("%s: expected a redirect to the client, got %d %s", tt.name, status, location)
+			continue
+		}
+		if q := location.Query(); q.Get("error") != tt.error || q.Get("state") != "af0ifjsldkj" || q.Get("code") != "" {
+			t.Errorf("%s: got %s, want error %s", tt.name, location, tt.error)
+		}
+	}
+
+	// The user can turn the client down
+	params := authorizationParams(clientID)
+	params["deny"] = true
+	if q := h.approve(t, h.userToken(t, userID), params).Query(); q.Get("error") != "access_denied" || q.Get("code") != "" {
+		t.Errorf("expected access_denied, got %v", q)
+	}
+
+	// Approving needs a user's token
+	status, resp := h.do(t, http.MethodPost, "/oauth/authorize", "", authorizationParams(clientID))
+	if status != http.StatusUnauthorized || !resp.Error {
+		t.Errorf("expected 401 without a token, got %d %+v", status, resp)
+	}
+	service, _ := h.tokens.ServiceToken("broker-service")
+	if status, _ := h.do(t, http.MethodPost, "/oauth/authorize", service, authorizationParams(clientID)); status != http.StatusForbidden {
+		t.Errorf("expected a service token to be refused, got %d", status)
+	}
+}
+
+func TestOAuthTokenErrors(t *testing.T) {
+	h := newHarness(t)
+	userID := h.addUser(t, "ada@example.com", "verysecret", true)
+	clientID, secret := h.webClient(t)
+	otherID, otherSecret := h.webClient(t)
+
+	expectError := func(name string, status int, body map[string]any, wantStatus int, want string) {
+		t.Helper()
+		if status != wantStatus || body["error"] != want {
+			t.Errorf("%s: got %d %+v, want %d %s", name, status, body, wantStatus, want)
+		}
+	}
+
+	status, body := h.exchange(t, clientID, secret, h.authorizationCode(t, clientID, userID), strings.Repeat("x", 43))
+	expectError("wrong verifier", status, body, http.StatusBadRequest, "invalid_grant")
+
+	status, body = h.exchange(t, clientID, secret, h.authorizationCode(t, clientID, userID), "short")
+	expectError("malformed verifier", status, body, http.StatusBadRequest, "invalid_grant")
+
+	// Requests that fail the checks don't use the code up, so they can't make the client's
+	// own exchange look like a reuse
+	code := h.authorizationCode(t, clientID, userID)
+	status, body = h.exchange(t, otherID, otherSecret, code, testVerifier)
+	expectError("another client's code", status, body, http.StatusBadRequest, "invalid_grant")
+	status, body = h.exchange(t, clientID, secret, code, strings.Repeat("x", 43))
+	expectError("wrong verifier for an unused code", status, body, http.StatusBadRequest, "invalid_grant")
+	if status, body := h.exchange(t, clientID, secret, code, testVerifier); status != http.StatusOK {
+		t.Errorf("expected the code to be redeemed after failed attempts, got %d %+v", status, body)
+	}
+
+	status, body, header := h.postForm(t, "/oauth/token", url.Values{
+		"grant_type": {"authorization_code"}, "code": {h.authorizationCode(t, clientID, userID)}, "code_verifier": {testVerifier},
+		"redirect_uri": {"https://app.example.com/other"},
+	}, clientID, secret)
+	expectError("other redirect URI", status, body, http.StatusBadRequest, "invalid_grant")
+
+	status, body, _ = h.postForm(t, "/oauth/token", url.Values{
+		"grant_type": {"authorization_code"}, "code": {h.authorizationCode(t, clientID, userID)}, "code_verifier": {testVerifier},
+	}, clientID, secret)
+	expectError("redirect URI left out", status, body, http.StatusBadRequest, "invalid_request")
+
+	status, body, header = h.postForm(t, "/oauth/token", url.Values{"grant_type": {"client_credentials"}}, clientID, "wrong")
+	expectError("wrong secret", status, body, http.StatusUnauthorized, "invalid_client")
+	if header.Get("WWW-Authenticate") == "" {
+		t.Error("expected a WWW-Authenticate header for failed Basic authentication")
+	}
+
+	status, body, _ = h.postForm(t, "/oauth/token", url.Values{"grant_type": {"client_credentials"}, "client_id": {clientID}}, "", "")
+	expectError("no secret", status, body, http.StatusUnauthorized, "invalid_client")
+
+	status, body, _ = h.postForm(t, "/oauth/token", url.Values{"grant_type": {"password"}}, clientID, secret)
+	expectError("password grant", status, body, http.StatusBadRequest, "unsupported_grant_type")
+
+	status, body, _ = h.postForm(t, "/oauth/token", url.Values{}, clientID, secret)
+	expectError("no grant type", status, body, http.StatusBadRequest, "invalid_request")
+
+	status, body, _ = h.postForm(t, "/oauth/token", url.Values{"grant_type": {"client_credentials"}}, clientID, secret)
+	expectError("grant the client may not use", status, body, http.StatusBadRequest, "unauthorized_client")
+
+	// A deactivated user's codes can't be redeemed
+	code = h.authorizationCode(t, clientID, userID)
+	user := h.storedUser(t, userID)
+	user.Active = false
+	h.users.Update(context.Background(), user)
+	status, body = h.exchange(t, clientID, secret, code, testVerifier)
+	expectError("deactivated user", status, body, http.StatusBadRequest, "invalid_grant")
+}
+
+func TestOAuthClientCredentials(t *testing.T) {
+	h := newHarness(t)
+	clientID, secret := h.registerClient(t, map[string]any{
+		"name":        "Batch Job",
+		"grant_types": []string{data.GrantClientCredentials},
+		"scopes":      []string{authz.LogsRead, authz.LogsWrite},
+	})
+
+	status, tokens, header := h.postForm(t, "/oauth/token", url.Values{"grant_type": {"client_credentials"}}, clientID, secret)
+	if status != http.StatusOK || tokens["scope"] != "logs:read logs:write" || tokens["id_token"] != nil {
+		t.Fatalf("expected an access token for every allowed scope, got %d %+v", status, tokens)
+	}
+	if header.Get("Cache-Control") != "no-store" {
+		t.Errorf("token responses must not be cached, got %q", header.Get("Cache-Control"))
+	}
+	if _, claims := h.verifyWithJWKS(t, tokens["access_token"].(string)); claims["sub"] != "client:"+clientID {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	// client_secret_post works as well as Basic authentication
+	status, tokens, _ = h.postForm(t, "/oauth/token", url.Values{
+		"grant_type": {"client_credentials"}, "client_id": {clientID}, "client_secret": {secret}, "scope": {"logs:read"},
+	}, "", "")
+	if status != http.StatusOK || tokens["scope"] != "logs:read" {
+		t.Errorf("expected a token for logs:read, got %d %+v", status, tokens)
+	}
+
+	for _, scope := range []string{"users:admin", "openid"} {
+		status, body, _ := h.postForm(t, "/oauth/token", url.Values{"grant_type": {"client_credentials"}, "scope": {scope}}, clientID, secret)
+		if status != http.StatusBadRequest || body["error"] != "invalid_scope" {
+			t.Errorf("%s: expected invalid_scope, got %d %+v", scope, status, body)
+		}
+	}
+
+	// A client token has no user to describe
+	status, body, _ := h.getJSON(t, "/oauth/userinfo", tokens["access_token"].(string))
+	if status != http.StatusForbidden || body["error"] != "insufficient_scope" {
+		t.Errorf("expected insufficient_scope, got %d %+v", status, body)
+	}
+}
+
+func TestOAuthIntrospectionAndRevocation(t *testing.T) {
+	h := newHarness(t)
+	userID := h.addUser(t, "ada@example.com", "verysecret", true)
+	clientID, secret := h.webClient(t)
+	otherID, otherSecret := h.webClient(t)
+
+	_, tokens := h.exchange(t, clientID, secret, h.authorizationCode(t, clientID, userID), testVerifier)
+	accessToken := tokens["access_token"].(string)
+
+	introspect := func(token string) map[string]any {
+		t.Helper()
+		status, body, _ := h.postForm(t, "/oauth/introspect", url.Values{"token": {token}}, otherID, otherSecret)
+		if status != http.StatusOK {
+			t.Fatalf("expected 200, got %d %+v", status, body)
+		}
+		return body
+	}
+
+	if info := introspect(accessToken); info["active"] != true || info["client_id"] != clientID ||
+		info["sub"] != strconv.Itoa(userID) || info["scope"] != "openid email profile" {
+		t.Errorf("unexpected introspection %+v", info)
+	}
+	for name, token := range map[string]string{
+		"garbage":    "not-a-token",
+		"ID token":   tokens["id_token"].(string),
+		"user token": h.userToken(t, userID),
+	} {
+		if info := introspect(token); len(info) != 1 || info["active"] != false {
+			t.Errorf("%s: expected an inactive token, got %+v", name, info)
+		}
+	}
+	if status, body, _ := h.postForm(t, "/oauth/introspect", url.Values{"token": {accessToken}}, "", ""); status != http.StatusUnauthorized {
+		t.Errorf("expected introspection to need client authentication, got %d %+v", status, body)
+	}
+
+	// Only the client the token was issued to can revoke it
+	status, body, _ := h.postForm(t, "/oauth/revoke", url.Values{"token": {accessToken}}, otherID, otherSecret)
+	if status != http.StatusBadRequest || body["error"] != "unauthorized_client" {
+		t.Errorf("expected another client's revocation to be refused, got %d %+v", status, body)
+	}
+
+	status, _, _ = h.postForm(t, "/oauth/revoke", url.Values{"token": {accessToken}, "token_type_hint": {"access_token"}}, clientID, secret)
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if info := introspect(accessToken); info["active"] != false {
+		t.Errorf("expected a revoked token to be inactive, got %+v", info)
+	}
+	status, body, header := h.getJSON(t, "/oauth/userinfo", accessToken)
+	if status != http.StatusUnauthorized || body["error"] != "invalid_token" || !strings.Contains(header.Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("expected a revoked token to be refused, got %d %+v", status, body)
+	}
+
+	// Revoking an invalid token is not an error
+	if status, _, _ := h.postForm(t, "/oauth/revoke", url.Values{"token": {"not-a-token"}}, clientID, secret); status != http.StatusOK {
+		t.Errorf("expected 200 for an invalid token, got %d", status)
+	}
+}
+
+func TestOAuthKeyRotation(t *testing.T) {
+	h := newHarness(t)
+	userID := h.addUser(t, "ada@example.com", "verysecret", true)
+	clientID, secret := h.webClient(t)
+
+	_, tokens := h.exchange(t, clientID, secret, h.authorizationCode(t, clientID, userID), testVerifier)
+	oldToken := tokens["access_token"].(string)
+	oldHeader, _ := h.verifyWithJWKS(t, oldToken)
+
+	status, resp := h.do(t, http.MethodPost, "/oauth/keys/rotate", h.admin, nil)
+	if status != http.StatusOK || resp.Error {
+		t.Fatalf("expected the key to be rotated, got %d %+v", status, resp)
+	}
+	newKID := resp.Data.(map[string]any)["kid"]
+
+	_, tokens = h.exchange(t, clientID, secret, h.authorizationCode(t, clientID, userID), testVerifier)
+	newHeader, _ := h.verifyWithJWKS(t, tokens["access_token"].(string))
+	if newHeader["kid"] != newKID || newHeader["kid"] == oldHeader["kid"] {
+		t.Errorf("expected new tokens to be signed with %v, got %v", newKID, newHeader["kid"])
+	}
+
+	// Tokens signed with the old key still verify
+	h.verifyWithJWKS(t, oldToken)
+	if status, info, _ := h.postForm(t, "/oauth/introspect", url.Values{"token": {oldToken}}, clientID, secret); status != http.StatusOK || info["active"] != true {
+		t.Errorf("expected a token signed with the old key to stay active, got %d %+v", status, info)
+	}
+
+	// The key is replaced once it is older than the rotation period, and keys are
+	// dropped from the JWKS a period after that
+	published := func() []string {
+		keys, err := h.keys.published(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(keys))
+		for i, key := range keys {
+			ids[i] = key.id
+		}
+		return ids
+	}
+	start := time.Now()
+	h.keys.now = func() time.Time { return start.Add(25 * time.Hour) }
+	if ids := published(); len(ids) != 3 || ids[1] != newKID {
+		t.Errorf("expected a new key in front of the two before, got %v", ids)
+	}
+	h.keys.now = func() time.Time { return start.Add(49 * time.Hour) }
+	if ids := published(); len(ids) != 2 || slices.Contains(ids, oldHeader["kid"].(string)) {
+		t.Errorf("expected the first keys to be retired, got %v", ids)
+	}
+}
+
+func TestOAuthClientManagement(t *testing.T) {
+	h := newHarness(t)
+	clientID, _ := h.webClient(t)
+
+	for name, client := range map[string]map[string]any{
+		"public client credentials": {"name": "x", "public": true, "grant_types": []string{"client_credentials"}, "scopes": []string{"logs:read"}},
+		"no redirect URI":           {"name": "x", "grant_types": []string{"authorization_code"}, "scopes": []string{"openid"}},
+		"relative redirect URI":     {"name": "x", "redirect_uris": []string{"/callback"}, "grant_types": []string{"authorization_code"}, "scopes": []string{"openid"}},
+		"implicit grant":            {"name": "x", "grant_types": []string{"implicit"}, "scopes": []string{"openid"}},
+		"unknown scope":             {"name": "x", "grant_types": []string{"client_credentials"}, "scopes": []string{"everything"}},
+	} {
+		if status, resp := h.do(t, http.MethodPost, "/oauth/clients", h.admin, client); status != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d %+v", name, status, resp)
+		}
+	}
+
+	status, resp := h.do(t, http.MethodGet, "/oauth/clients", h.admin, nil)
+	if clients, _ := resp.Data.([]any); status != http.StatusOK || len(clients) != 1 {
+		t.Fatalf("expected one client, got %d %+v", status, resp)
+	}
+	if client := resp.Data.([]any)[0].(map[string]any); client["client_secret"] != nil || client["public"] != false {
+		t.Errorf("unexpected client in the list %+v", client)
+	}
+
+	status, resp = h.do(t, http.MethodPut, "/oauth/clients/"+clientID, h.admin, map[string]any{
+		"name": "Renamed", "redirect_uris": []string{testRedirectURI}, "grant_types": []string{"authorization_code"}, "scopes": []string{"openid"},
+	})
+	if status != http.StatusOK || resp.Data.(map[string]any)["name"] != "Renamed" {
+		t.Errorf("expected the client to be updated, got %d %+v", status, resp)
+	}
+
+	if status, _ := h.do(t, http.MethodDelete, "/oauth/clients/"+clientID, h.admin, nil); status != http.StatusOK {
+		t.Errorf("expected the client to be deleted, got %d", status)
+	}
+	if status, _ := h.do(t, http.MethodGet, "/oauth/clients/"+clientID, h.admin, nil); status != http.StatusNotFound {
+		t.Errorf("expected a deleted client to be gone, got %d", status)
+	}
+	if status, _ := h.do(t, http.MethodGet, "/oauth/clients", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected the management API to need a token, got %d", status)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"authentication/data"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// outboxBatchSize is how many outbox messages are relayed in one transaction
+	outboxBatchSize = 100
+	// outboxRetention is how long published outbox messages are kept, to look into what
+	// was sent
+	outboxRetention = 7 * 24 * time.Hour
+	// outboxStuckAfter is how old a pending message is when it is reported as stuck
+	outboxStuckAfter = time.Minute
+)
+
+// outboxResponse is an outbox message as administrators see it
+type outboxResponse struct {
+	*data.OutboxMessage
+	// Stuck is set on messages that failed to publish or have waited too long
+	Stuck bool `json:"stuck"`
+}
+
+// ListOutbox returns the outbox messages that are not published yet, oldest first, so
+// that administrators can find the ones that are stuck
+func (app *Config) ListOutbox(c *gin.Context) {
+	messages, err := app.Models.Outbox.Pending(c.Request.Context(), outboxBatchSize)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not list outbox"), http.StatusInternalServerError)
+		return
+	}
+
+	stuck := 0
+	response := make([]outboxResponse, len(messages))
+	for i, msg := range messages {
+		response[i] = outboxResponse{
+			OutboxMessage: msg,
+			Stuck:         msg.Attempts > 0 || time.Since(msg.CreatedAt) > outboxStuckAfter,
+		}
+		if response[i].Stuck {
+			stuck++
+		}
+	}
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d pending messages, %d stuck", len(messages), stuck),
+		Data:    response,
+	})
+}
+
+// DiscardOutboxMessage deletes the pending outbox message with the id in the path, for a
+// message that can never be published and holds up the ones after it
+func (app *Config) DiscardOutboxMessage(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		app.errorJSON(c, errors.New("message not found"), http.StatusNotFound)
+		return
+	}
+
+	err = app.Models.Outbox.Discard(c.Request.Context(), id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("message not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not discard message"), http.StatusInternalServerError)
+		return
+	}
+	app.audit(fmt.Sprintf("outbox message %d discarded by an administrator", id))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("discarded message %d", id),
+	})
+}
+
+// relayOutbox publishes the pending outbox messages every interval until stop is closed.
+// A message that fails to publish is tried again on the next round, before any later one.
+func (app *Config) relayOutbox(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := app.relayPending()
+		if err != nil && !failing {
+			log.Printf("Error relaying outbox, retrying every %s: %v", interval, err)
+		} else if err == nil && failing {
+			log.Println("Relaying outbox again")
+		}
+		failing = err != nil
+	}
+}
+
+// relayPending publishes outbox messages until none are pending or one fails
+func (app *Config) relayPending() error {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		var failure error
+		published, err := app.Models.Outbox.Relay(ctx, outboxBatchSize, func(msg *data.OutboxMessage) error {
+			sink, ok := app.OutboxSinks[msg.Exchange]
+			if !ok {
+				failure = fmt.Errorf("no sink for exchange %s", msg.Exchange)
+			} else {
+				failure = sink.Send(ctx, msg.RoutingKey, msg.Payload)
+			}
+			return failure
+		})
+		cancel()
+		if err != nil {
+			return err
+		} else if failure != nil {
+			return failure
+		}
+		if published < outboxBatchSize {
+			return nil
+		}
+	}
+}
+
+// purgeOutbox deletes outbox messages published longer than outboxRetention ago, every
+// interval until stop is closed
+func (app *Config) purgeOutbox(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := app.Models.Outbox.PurgePublished(context.Background(), time.Now().Add(-outboxRetention)); err != nil {
+				log.Println("Error purging outbox:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"authentication/data"
+	"authentication/event"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	passwordResetTokenTTL = time.Hour
+	// passwordResetLimit reset links can be requested for an email in every
+	// passwordResetWindow
+	passwordResetLimit  = 5
+	passwordResetWindow = time.Hour
+)
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email,max=255"`
+}
+
+type completePasswordResetRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// ForgotPassword emails a password reset link to the address in the request if it belongs
+// to an active account. The response is always the same and the work happens after it is
+// sent, so neither the response nor its timing reveals whether the email is registered.
+func (app *Config) ForgotPassword(c *gin.Context) {
+	var req forgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	email := normalizeEmail(req.Email)
+	if wait, ok := app.PasswordResets.allow(email); !ok {
+		app.tooManyLinks(c, "password reset", wait)
+		return
+	}
+
+	go app.sendPasswordReset(email)
+
+	app.writeJSON(c, http.StatusAccepted, jsonResponse{
+		Error:   false,
+		Message: "If that email address belongs to an account, a link to reset its password is on its way.",
+	})
+}
+
+// sendPasswordReset issues a reset token for the active user with the given email, if
+// there is one, and mails them a signed link to the frontend's reset page. It runs after
+// the response is sent, so it doesn't use the request's context.
+func (app *Config) sendPasswordReset(email string) {
+	ctx := context.Background()
+	user, err := app.Models.User.GetByEmail(ctx, email)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Println("Error looking up user for password reset:", err)
+		}
+		return
+	}
+	if !user.Active {
+		return
+	}
+
+	expires := time.Now().Add(passwordResetTokenTTL)
+	plainText, err := app.Models.Token.Issue(ctx, user.ID, data.TokenPasswordReset, passwordResetTokenTTL)
+	if err != nil {
+		log.Println("Error issuing password reset token:", err)
+		return
+	}
+
+	signed := app.signToken(data.TokenPasswordReset, plainText, expires)
+	err = app.sendMail(mailMessage{
+		To:       user.Email,
+		Subject:  "Reset your password",
+		Template: "password-reset",
+		Data: map[string]any{
+			"first_name": user.FirstName,
+			"link":       app.FrontendURL + "/reset-password?token=" + url.QueryEscape(signed),
+			"expires_in": "1 hour",
+		},
+	})
+	if err != nil {
+		log.Println("Error sending password reset email:", err)
+		return
+	}
+
+	app.logEvent(event.Info, "password reset", fmt.Sprintf("password reset requested for %s", user.Email))
+}
+
+// ResetPassword completes a password reset started by ForgotPassword. It takes the signed
+// token from the emailed link and the new password, which must follow the password rules.
+// Each link works once, and a successful reset revokes the user's other sessions.
+func (app *Config) ResetPassword(c *gin.Context) {
+	var req completePasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+
+	plainText, err := app.verifySignedToken(data.TokenPasswordReset, req.Token)
+	if err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+
+	token, err := app.Models.Token.Consume(c.Request.Context(), data.TokenPasswordReset, plainText)
+	if errors.Is(err, data.ErrInvalidToken) {
+		app.errorJSON(c, err)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not reset password"), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(c.Request.Context(), token.UserID)
+	if err != nil {
+		app.errorJSON(c, data.ErrInvalidToken)
+		return
+	}
+
+	if err := app.Models.User.ResetPassword(c.Request.Context(), user, req.Password); err != nil {
+		app.errorJSON(c, errors.New("could not reset password"), http.StatusInternalServerError)
+		return
+	}
+
+	if err := app.revokeSessions(c.Request.Context(), user.ID); err != nil {
+		log.Println("Error revoking sessions after password reset:", err)
+	}
+
+	app.logEvent(event.Info, "password reset", fmt.Sprintf("%s reset their password", user.Email))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "Your password has been reset. You can now log in.",
+	})
+}
+
+// revokeSessions ends everything that lets someone act as the user without knowing their
+// current password. All of the user's login sessions and outstanding single-use tokens,
+// such as other reset links, are revoked.
+func (app *Config) revokeSessions(ctx context.Context, userID int) error {
+	if _, err := app.revokeUserSessions(ctx, userID); err != nil {
+		return err
+	}
+	return app.Models.Token.RevokeAll(ctx, userID)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"authentication/data"
+	"authentication/event"
+	"authz"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// reauthenticationWindow is how long after proving who they are a user can make
+	// sensitive changes, such as changing their email
+	reauthenticationWindow = 10 * time.Minute
+	emailChangeTokenTTL    = 24 * time.Hour
+)
+
+type updateProfileRequest struct {
+	FirstName *string `json:"first_name" binding:"omitempty,max=255"`
+	LastName  *string `json:"last_name" binding:"omitempty,max=255"`
+}
+
+type reauthenticateRequest struct {
+	Password     string `json:"password" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type changeEmailRequest struct {
+	Email string `json:"email" binding:"required,email,max=255"`
+}
+
+// GetProfile returns the logged in user
+func (app *Config) GetProfile(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "user " + user.Email,
+		Data:    user,
+	})
+}
+
+// UpdateProfile changes the names of the logged in user. The email is changed with
+// ChangeEmail instead, as the new address has to be confirmed.
+func (app *Config) UpdateProfile(c *gin.Context) {
+	var req updateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+
+	if req.FirstName != nil {
+		user.FirstName = strings.TrimSpace(*req.FirstName)
+	}
+	if req.LastName != nil {
+		user.LastName = strings.TrimSpace(*req.LastName)
+	}
+
+	if err := app.Models.User.Update(c.Request.Context(), user); err != nil {
+		app.userWriteError(c, err)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "updated your profile",
+		Data:    user,
+	})
+}
+
+// Reauthenticate has the logged in user prove who they are again, with their password and,
+// if they use MFA, a code, and responds with a new access token for the same session. The
+// token lets them make sensitive changes for the next reauthenticationWindow. Wrong
+// passwords count towards the brute-force limits, like failed logins.
+func (app *Config) Reauthenticate(c *gin.Context) {
+	var req reauthenticateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+	claims, _ := authz.FromContext(c)
+	if claims.SessionID == "" {
+		app.errorJSON(c, errors.New("this needs a login session"), http.StatusForbidden)
+		return
+	}
+
+	ctx := c.Request.Context()
+	account, ip := user.Email, c.ClientIP()
+	if wait, ok := app.Limiter.allow(account, ip); !ok {
+		app.tooManyAttempts(c, wait)
+		return
+	}
+	valid, err := app.Models.User.PasswordMatches(ctx, user, req.Password)
+	if err != nil || !valid {
+		app.Limiter.fail(account, ip)
+		app.loginFailed(account, ip, "wrong password on re-authentication")
+		app.errorJSON(c, errInvalidCredentials)
+		return
+	}
+
+	mfa, err := app.Models.MFA.Get(ctx, user.ID)
+	if err == nil && mfa.Enabled {
+		if req.Code == "" && req.RecoveryCode == "" {
+			app.errorJSON(c, errors.New("code is required"))
+			return
+		}
+		if _, err := app.checkSecondFactor(ctx, mfa, req.Code, req.RecoveryCode); err != nil {
+			if errors.Is(err, errInvalidCode) {
+				app.Limiter.fail(account, ip)
+			}
+			app.mfaCodeError(c, err)
+			return
+		}
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("could not re-authenticate"), http.StatusInternalServerError)
+		return
+	}
+	app.Limiter.succeed(account)
+
+	session, err := app.Models.Session.Reauthenticate(ctx, user.ID, claims.SessionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("session has ended"), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not re-authenticate"), http.StatusInternalServerError)
+		return
+	}
+	token, err := app.accessToken(ctx, user, session)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not issue access token"), http.StatusInternalServerError)
+		return
+	}
+
+	app.logEvent(event.Info, "authentication", fmt.Sprintf("%s re-authenticated from %s", user.Email, ip))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "Re-authenticated",
+		Data: gin.H{
+			"access_token": token,
+			"token_type":   "Bearer",
+			"expires_in":   int(accessTokenTTL.Seconds()),
+		},
+	})
+}
+
+// ChangeEmail starts changing the email of the logged in user. It emails a confirmation
+// link to the new address and a notice to the current one; the email only changes once the
+// link is opened. Only the latest change asked for can be confirmed.
+func (app *Config) ChangeEmail(c *gin.Context) {
+	var req changeEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	email := normalizeEmail(req.Email)
+	if email == user.Email {
+		app.errorJSON(c, errors.New("that is your email address already"))
+		return
+	}
+	if _, err := app.Models.User.GetByEmail(ctx, email); err == nil {
+		app.userWriteError(c, gorm.ErrDuplicatedKey)
+		return
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("could not change email"), http.StatusInternalServerError)
+		return
+	}
+
+	plainText, err := app.Models.Token.IssueEmailChange(ctx, user.ID, email, emailChangeTokenTTL)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not change email"), http.StatusInternalServerError)
+		return
+	}
+	err = app.sendMail(mailMessage{
+		To:       email,
+		Subject:  "Confirm your new email address",
+		Template: "confirm-email-change",
+		Data: map[string]any{
+			"first_name": user.FirstName,
+			"link":       app.PublicURL + "/confirm-email?token=" + url.QueryEscape(plainText),
+			"expires_in": "24 hours",
+		},
+	})
+	if err != nil {
+		log.Println("Error sending email change confirmation:", err)
+		app.errorJSON(c, errors.New("could not send confirmation email, please try again"), http.StatusBadGateway)
+		return
+	}
+
+	// The notice tells the owner of the account, should someone else have asked
+	err = app.sendMail(mailMessage{
+		To:       user.Email,
+		Subject:  "Your email address is being changed",
+		Template: "email-change-notice",
+		Data: map[string]any{
+			"first_name": user.FirstName,
+			"new_email":  email,
+		},
+	})
+	if err != nil {
+		log.Println("Error sending email change notice:", err)
+	}
+
+	app.logEvent(event.Info, "audit", fmt.Sprintf("%s asked to change their email to %s", user.Email, email))
+
+	app.writeJSON(c, http.StatusAccepted, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Check %s for a link to confirm the change.", email),
+	})
+}
+
+// ConfirmEmailChange changes the email of the user that the token in the query string was
+// issued for to the address the token was sent to. Each token can only be used once, and
+// the single-use links sent to the old address stop working.
+func (app *Config) ConfirmEmailChange(c *gin.Context) {
+	plainText := c.Query("token")
+	if plainText == "" {
+		app.errorJSON(c, data.ErrInvalidToken)
+		return
+	}
+
+	ctx := c.Request.Context()
+	token, err := app.Models.Token.Consume(ctx, data.TokenEmailChange, plainText)
+	if errors.Is(err, data.ErrInvalidToken) {
+		app.errorJSON(c, err)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not change email"), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(ctx, token.UserID)
+	if err != nil {
+		app.errorJSON(c, data.ErrInvalidToken)
+		return
+	}
+
+	previous := user.Email
+	if err := app.Models.User.ChangeEmail(ctx, user, token.NewEmail); errors.Is(err, gorm.ErrDuplicatedKey) {
+		app.errorJSON(c, errors.New("that email address was taken in the meantime"), http.StatusConflict)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not change email"), http.StatusInternalServerError)
+		return
+	}
+	if err := app.Models.Token.RevokeAll(ctx, user.ID); err != nil {
+		log.Println("Error revoking tokens after email change:", err)
+	}
+
+	app.logEvent(event.Info, "audit", fmt.Sprintf("%s changed their email to %s", previous, user.Email))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("Your email address is now %s.", user.Email),
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"authentication/data"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// staleToken returns an access token for the session of access that the user logged in to
+// an hour ago
+func (h *harness) staleToken(t *testing.T, access string) string {
+	t.Helper()
+	claims, err := h.tokens.Parse(access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims.AuthTime = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	token, err := h.tokens.Sign(*claims, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// expectEmailChange stubs issuing an email change token for userID
+func (h *harness) expectEmailChange(userID int, email string) {
+	h.mock.ExpectBegin()
+	h.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "user_tokens" SET "used_at"=$1 WHERE user_id = $2 AND purpose = $3 AND used_at IS NULL`)).
+		WithArgs(sqlmock.AnyArg(), userID, data.TokenEmailChange).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	h.mock.ExpectQuery(`INSERT INTO "user_tokens" .* RETURNING "id"`).
+		WithArgs(userID, data.TokenEmailChange, sqlmock.AnyArg(), email, sqlmock.AnyArg(), nil, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	h.mock.ExpectCommit()
+}
+
+// expectEmailConfirmation stubs consuming an email change token of userID for email
+func (h *harness) expectEmailConfirmation(userID int, email string) {
+	h.mock.ExpectBegin()
+	h.mock.ExpectQuery(`UPDATE "user_tokens" SET "used_at"=.* RETURNING \*`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), data.TokenEmailChange, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "purpose", "new_email"}).
+			AddRow(1, userID, data.TokenEmailChange, email))
+	h.mock.ExpectCommit()
+}
+
+func TestUpdateProfile(t *testing.T) {
+	h := newHarness(t)
+	id := h.addUser(t, "grace@example.com", "verysecret", true)
+	access, _ := h.login(t, id, "grace@example.com", "verysecret")
+
+	status, resp := h.do(t, http.MethodPut, "/profile", access, map[string]string{
+		"first_name": " Grace ", "last_name": "Hopper", "email": "other@example.com",
+	})
+	if status != http.StatusOK || resp.Error {
+		t.Fatalf("expected the profile to be updated, got %d %+v", status, resp)
+	}
+	if user := h.storedUser(t, id); user.FirstName != "Grace" || user.LastName != "Hopper" || user.Email != "grace@example.com" {
+		t.Errorf("expected only the names to change, got %+v", user)
+	}
+
+	status, resp = h.do(t, http.MethodGet, "/profile", access, nil)
+	if user, _ := resp.Data.(map[string]any); status != http.StatusOK || user["last_name"] != "Hopper" {
+		t.Errorf("unexpected profile %d %+v", status, resp)
+	}
+	if status, _ := h.do(t, http.MethodGet, "/profile", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("expected the profile to need a login, got %d", status)
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	h := newHarness(t)
+	id := h.addUser(t, "grace@example.com", "verysecret", true)
+	access, _ := h.login(t, id, "grace@example.com", "verysecret")
+	stale := h.staleToken(t, access)
+
+	status, resp := h.do(t, http.MethodPost, "/profile/email", stale, map[string]string{"email": "new@example.com"})
+	if data, _ := resp.Data.(map[string]any); status != http.StatusForbidden || data["reauthentication_required"] != true {
+		t.Fatalf("expected an old login to need re-authentication, got %d %+v", status, resp)
+	}
+
+	if status, _ := h.do(t, http.MethodPost, "/reauthenticate", stale, map[string]string{"password": "wrong"}); status != http.StatusBadRequest {
+		t.Errorf("expected a wrong password to be refused, got %d", status)
+	}
+
+	h.expectMFA(t, id, "")
+	h.expectGrants(id)
+	status, resp = h.do(t, http.MethodPost, "/reauthenticate", stale, map[string]string{"password": "verysecret"})
+	body, _ := resp.Data.(map[string]any)
+	fresh, _ := body["access_token"].(string)
+	if status != http.StatusOK || fresh == "" {
+		t.Fatalf("expected a new access token, got %d %+v", status, resp)
+	}
+	claims, err := h.tokens.Parse(fresh)
+	old, _ := h.tokens.Parse(stale)
+	if err != nil || claims.SessionID != old.SessionID || claims.AuthTime == nil || time.Since(claims.AuthTime.Time) > time.Minute {
+		t.Fatalf("expected a recent login in the same session, got %+v (%v)", claims, err)
+	}
+
+	// Past the check, the request itself is validated
+	if status, _ := h.do(t, http.MethodPost, "/profile/email", fresh, map[string]string{"email": "not an email"}); status != http.StatusBadRequest {
+		t.Errorf("expected a recent login to be let through, got %d", status)
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChangeEmail(t *testing.T) {
+	h := newHarness(t)
+	id := h.addUser(t, "grace@example.com", "verysecret", true)
+	h.addUser(t, "ada@example.com", "verysecret", true)
+	access, _ := h.login(t, id, "grace@example.com", "verysecret")
+
+	if status, _ := h.do(t, http.MethodPost, "/profile/email", access, map[string]string{"email": "Ada@example.com"}); status != http.StatusConflict {
+		t.Errorf("expected a taken email to conflict, got %d", status)
+	}
+
+	h.expectEmailChange(id, "grace.new@example.com")
+	status, resp := h.do(t, http.MethodPost, "/profile/email", access, map[string]string{"email": "Grace.New@Example.com"})
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("expected the change to be started, got %d %+v", status, resp)
+	}
+	if h.storedUser(t, id).Email != "grace@example.com" {
+		t.Error("expected the email to stay until the change is confirmed")
+	}
+
+	mails := h.sentMails()
+	if len(mails) != 2 || mails[0].To != "grace.new@example.com" || mails[0].Template != "confirm-email-change" ||
+		mails[1].To != "grace@example.com" || mails[1].Template != "email-change-notice" || mails[1].Data["new_email"] != "grace.new@example.com" {
+		t.Fatalf("unexpected mails %+v", mails)
+	}
+	link, _ := mails[0].Data["link"].(string)
+	token, found := strings.CutPrefix(link, "http://auth.test/confirm-email?token=")
+	if !found || token == "" {
+		t.Fatalf("unexpected confirmation link %q", link)
+	}
+
+	h.expectEmailConfirmation(id, "grace.new@example.com")
+	h.mock.ExpectBegin()
+	h.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "user_tokens" SET "used_at"=$1 WHERE user_id = $2 AND used_at IS NULL`)).
+		WithArgs(sqlmock.AnyArg(), id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	h.mock.ExpectCommit()
+	status, resp = h.do(t, http.MethodGet, "/confirm-email?token="+token, "", nil)
+	if status != http.StatusOK || resp.Message != "Your email address is now grace.new@example.com." {
+		t.Fatalf("expected the change to be confirmed, got %d %+v", status, resp)
+	}
+	if h.storedUser(t, id).Email != "grace.new@example.com" {
+		t.Error("expected the email to change")
+	}
+
+	events, _ := h.users.Outbox().Pending(context.Background(), 20)
+	last := events[len(events)-1]
+	var payload data.UserEvent
+	if err := json.Unmarshal(last.Payload, &payload); err != nil || last.RoutingKey != data.UserEmailChanged ||
+		payload.Email != "grace.new@example.com" || payload.PreviousEmail != "grace@example.com" {
+		t.Errorf("unexpected event %s %s", last.RoutingKey, last.Payload)
+	}
+
+	// The address was taken between asking and confirming
+	h.expectEmailConfirmation(id, "ada@example.com")
+	if status, resp := h.do(t, http.MethodGet, "/confirm-email?token=other", "", nil); status != http.StatusConflict {
+		t.Errorf("expected a taken email to conflict, got %d %+v", status, resp)
+	}
+	if h.storedUser(t, id).Email != "grace.new@example.com" {
+		t.Error("expected the email to stay after a conflict")
+	}
+	if err := h.mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChangeEmailNeedsUserToken(t *testing.T) {
+	h := newHarness(t)
+	token, err := h.tokens.ServiceToken("broker-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := h.do(t, http.MethodPost, "/reauthenticate", token, map[string]string{"password": "verysecret"}); status != http.StatusForbidden {
+		t.Errorf("expected a service token to be refused, got %d", status)
+	}
+}
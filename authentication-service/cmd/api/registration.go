@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"authentication/data"
+	"authentication/event"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const verificationTokenTTL = 24 * time.Hour
+
+type registerRequest struct {
+	Email     string `json:"email" binding:"required,email,max=255"`
+	FirstName string `json:"first_name" binding:"max=255"`
+	LastName  string `json:"last_name" binding:"max=255"`
+	Password  string `json:"password" binding:"required"`
+}
+
+// Register creates an inactive account and emails a verification link to its address.
+// The response is the same whether or not the email is already registered, so it can't
+// be used to find out which addresses have accounts.
+func (app *Config) Register(c *gin.Context) {
+	var req registerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+
+	accepted := jsonResponse{
+		Error:   false,
+		Message: "Thanks for registering. Check your email for a link to verify your account.",
+	}
+
+	user := data.User{
+		Email:     normalizeEmail(req.Email),
+		FirstName: strings.TrimSpace(req.FirstName),
+		LastName:  strings.TrimSpace(req.LastName),
+		Password:  req.Password,
+		Active:    false,
+	}
+
+	id, err := app.Models.User.Insert(c.Request.Context(), user)
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		app.writeJSON(c, http.StatusAccepted, accepted)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not register user"), http.StatusInternalServerError)
+		return
+	}
+	user.ID = id
+
+	if err := app.sendVerificationEmail(c.Request.Context(), &user); err != nil {
+		// Without the email the account could never be activated, so don't keep it
+		log.Println("Error sending verification email:", err)
+		if err := app.Models.User.Delete(c.Request.Context(), &user); err != nil {
+			log.Println("Error removing unverifiable user:", err)
+		}
+		app.errorJSON(c, errors.New("could not send verification email, please try again"), http.StatusBadGateway)
+		return
+	}
+
+	app.logEvent(event.Info, "registration", fmt.Sprintf("%s registered", user.Email))
+
+	app.writeJSON(c, http.StatusAccepted, accepted)
+}
+
+// VerifyEmail activates the account that the verification token in the query string
+// was issued for. Each token can only be used once.
+func (app *Config) VerifyEmail(c *gin.Context) {
+	plainText := c.Query("token")
+	if plainText == "" {
+		app.errorJSON(c, data.ErrInvalidToken)
+		return
+	}
+
+	token, err := app.Models.Token.Consume(c.Request.Context(), data.TokenEmailVerification, plainText)
+	if errors.Is(err, data.ErrInvalidToken) {
+		app.errorJSON(c, err)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not verify email"), http.StatusInternalServerError)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(c.Request.Context(), token.UserID)
+	if err != nil {
+		app.errorJSON(c, data.ErrInvalidToken)
+		return
+	}
+
+	if err := app.Models.User.Verify(c.Request.Context(), user); err != nil {
+		app.errorJSON(c, errors.New("could not verify email"), http.StatusInternalServerError)
+		return
+	}
+
+	app.logEvent(event.Info, "registration", fmt.Sprintf("%s verified their email", user.Email))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "Your email address is verified. You can now log in.",
+	})
+}
+
+// sendVerificationEmail issues a verification token for user and mails them the link
+func (app *Config) sendVerificationEmail(ctx context.Context, user *data.User) error {
+	plainText, err := app.Models.Token.Issue(ctx, user.ID, data.TokenEmailVerification, verificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return app.sendMail(mailMessage{
+		To:       user.Email,
+		Subject:  "Verify your email address",
+		Template: "verify-email",
+		Data: map[string]any{
+			"first_name": user.FirstName,
+			"link":       app.PublicURL + "/verify?token=" + url.QueryEscape(plainText),
+			"expires_in": "24 hours",
+		},
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"authentication/data"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type createRoleRequest struct {
+	Name        string   `json:"name" binding:"required,max=64"`
+	Description string   `json:"description" binding:"max=255"`
+	Permissions []string `json:"permissions"`
+}
+
+type updateRoleRequest struct {
+	Description *string  `json:"description" binding:"omitempty,max=255"`
+	Permissions []string `json:"permissions" binding:"required"`
+}
+
+type setUserRolesRequest struct {
+	Roles []string `json:"roles" binding:"required"`
+}
+
+// ListRoles returns every role with the permissions it grants
+func (app *Config) ListRoles(c *gin.Context) {
+	roles, err := app.Models.Role.GetAll(c.Request.Context())
+	if err != nil {
+		app.errorJSON(c, errors.New("could not list roles"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d roles", len(roles)),
+		Data:    roles,
+	})
+}
+
+// GetRole returns the role named in the path
+func (app *Config) GetRole(c *gin.Context) {
+	role, ok := app.roleFromPath(c)
+	if !ok {
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "role " + role.Name,
+		Data:    role,
+	})
+}
+
+// CreateRole creates a role granting the permissions in the request, which must all exist
+func (app *Config) CreateRole(c *gin.Context) {
+	var req createRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(req.Name))
+	if name == "" {
+		app.errorJSON(c, errors.New("name is required"))
+		return
+	}
+
+	_, err := app.Models.Role.Insert(c.Request.Context(), data.Role{
+		Name:        name,
+		Description: strings.TrimSpace(req.Description),
+	}, req.Permissions)
+	if err != nil {
+		app.roleWriteError(c, err)
+		return
+	}
+
+	role, err := app.Models.Role.GetByName(c.Request.Context(), name)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not load role"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusCreated, jsonResponse{
+		Error:   false,
+		Message: "created role " + role.Name,
+		Data:    role,
+	})
+}
+
+// UpdateRole replaces the permissions of the role named in the path, and its description
+// if one is given
+func (app *Config) UpdateRole(c *gin.Context) {
+	role, ok := app.roleFromPath(c)
+	if !ok {
+		return
+	}
+
+	var req updateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+	if req.Description != nil {
+		role.Description = strings.TrimSpace(*req.Description)
+	}
+
+	if err := app.Models.Role.Update(c.Request.Context(), role, req.Permissions); err != nil {
+		app.roleWriteError(c, err)
+		return
+	}
+
+	role, err := app.Models.Role.GetByName(c.Request.Context(), role.Name)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not load role"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "updated role " + role.Name,
+		Data:    role,
+	})
+}
+
+// DeleteRole deletes the role named in the path and takes it away from its users. The
+// admin role can't be deleted.
+func (app *Config) DeleteRole(c *gin.Context) {
+	role, ok := app.roleFromPath(c)
+	if !ok {
+		return
+	}
+	if role.Name == data.AdminRole {
+		app.errorJSON(c, errors.New("the admin role can't be deleted"), http.StatusConflict)
+		return
+	}
+
+	if err := app.Models.Role.Delete(c.Request.Context(), role); err != nil {
+		app.errorJSON(c, errors.New("could not delete role"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "deleted role " + role.Name,
+	})
+}
+
+// GetUserRoles returns the roles assigned to the user with the id in the path
+func (app *Config) GetUserRoles(c *gin.Context) {
+	user, ok := app.userFromPath(c)
+	if !ok {
+		return
+	}
+
+	roles, err := app.Models.Role.ForUser(c.Request.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not load roles"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d roles for %s", len(roles), user.Email),
+		Data:    roles,
+	})
+}
+
+// SetUserRoles replaces the roles of the user with the id in the path with the named
+// ones. The change shows in the user's access tokens from their next login.
+func (app *Config) SetUserRoles(c *gin.Context) {
+	user, ok := app.userFromPath(c)
+	if !ok {
+		return
+	}
+
+	var req setUserRolesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	if err := app.Models.Role.SetForUser(c.Request.Context(), user.ID, req.Roles); errors.Is(err, data.ErrUnknownRole) {
+		app.errorJSON(c, err)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not assign roles"), http.StatusInternalServerError)
+		return
+	}
+
+	roles, err := app.Models.Role.ForUser(c.Request.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not load roles"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "updated roles for " + user.Email,
+		Data:    roles,
+	})
+}
+
+// roleFromPath loads the role named by the name path parameter. When that fails it
+// writes the error response and returns false.
+func (app *Config) roleFromPath(c *gin.Context) (*data.Role, bool) {
+	role, err := app.Models.Role.GetByName(c.Request.Context(), c.Param("name"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("role not found"), http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not load role"), http.StatusInternalServerError)
+		return nil, false
+	}
+	return role, true
+}
+
+// roleWriteError reports a failed insert or update of a role
+func (app *Config) roleWriteError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, data.ErrUnknownPermission):
+		app.errorJSON(c, err)
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		app.errorJSON(c, errors.New("a role with that name already exists"), http.StatusConflict)
+	default:
+		app.errorJSON(c, errors.New("could not save role"), http.StatusInternalServerError)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"net/http"
 
 	"github.com/gin-contrib/cors"
@@ -10,6 +11,11 @@ import (
 func (app *Config) routes() *gin.Engine {
 	r := gin.Default()
 
+	// Only trust X-Forwarded-For from the configured proxies, such as the broker
+	if err := r.SetTrustedProxies(app.TrustedProxies); err != nil {
+		log.Panic(err)
+	}
+
 	// CORS configuration
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
@@ -27,6 +33,111 @@ func (app *Config) routes() *gin.Engine {
 
 	// Routes
 	r.POST("/authenticate", app.Authenticate)
+	r.POST("/register", app.Register)
+	r.GET("/verify", app.VerifyEmail)
+	r.GET("/confirm-email", app.ConfirmEmailChange)
+	r.POST("/forgot-password", app.ForgotPassword)
+	r.POST("/reset-password", app.ResetPassword)
+	r.POST("/magic-link", app.RequestMagicLink)
+	r.POST("/magic-link/login", app.MagicLinkLogin)
+	r.POST("/mfa/verify", app.VerifyMFA)
+	r.POST("/refresh", app.RefreshSession)
+	r.POST("/logout", app.requireLogin(), app.Logout)
+	r.POST("/reauthenticate", app.requireLogin(), app.Reauthenticate)
+
+	// Profile of the logged in user. Changing the email needs a recent login.
+	profile := r.Group("/profile", app.requireLogin())
+	profile.GET("", app.GetProfile)
+	profile.PUT("", app.UpdateProfile)
+	profile.POST("/email", app.requireRecentLogin(), app.ChangeEmail)
+
+	// Sessions of the logged in user
+	sessions := r.Group("/sessions", app.requireLogin())
+	sessions.GET("", app.ListSessions)
+	sessions.DELETE("/:id", app.RevokeSession)
+
+	// API keys of the logged in user
+	apiKeys := r.Group("/api-keys", app.requireLogin())
+	apiKeys.GET("", app.ListAPIKeys)
+	apiKeys.POST("", app.CreateAPIKey)
+	apiKeys.DELETE("/:id", app.RevokeAPIKey)
+
+	// For other services: their own tokens, the revoked sessions, whose access tokens they
+	// refuse, checking the API keys they are sent, and completing erasures once the user's
+	// log entries are redacted
+	r.POST("/service-tokens", app.IssueServiceToken)
+	r.GET("/sessions/revoked", app.requireService(), app.RevokedSessions)
+	r.POST("/api-keys/verify", app.requireService(), app.VerifyAPIKey)
+	r.POST("/erasures/redacted", app.requireService(), app.LogsRedacted)
+
+	// OAuth2 and OpenID Connect provider
+	r.GET("/.well-known/openid-configuration", app.OpenIDConfiguration)
+	r.GET("/.well-known/jwks.json", app.JWKS)
+	r.GET("/oauth/authorize", app.Authorize)
+	r.POST("/oauth/authorize", app.requireLogin(), app.ApproveAuthorization)
+	r.POST("/oauth/token", app.Token)
+	r.GET("/oauth/userinfo", app.UserInfo)
+	r.POST("/oauth/userinfo", app.UserInfo)
+	r.POST("/oauth/introspect", app.Introspect)
+	r.POST("/oauth/revoke", app.Revoke)
+
+	// MFA settings of the logged in user
+	mfa := r.Group("/mfa", app.requireLogin())
+	mfa.GET("", app.MFAStatus)
+	mfa.POST("/enroll", app.EnrollMFA)
+	mfa.POST("/confirm", app.ConfirmMFA)
+	mfa.POST("/recovery-codes", app.RegenerateRecoveryCodes)
+	mfa.POST("/disable", app.DisableMFA)
+
+	// User management, for administrators only
+	users := r.Group("/users", app.requireAdmin())
+	users.GET("", app.ListUsers)
+	users.POST("", app.CreateUser)
+	users.POST("/import", app.ImportUsers)
+	users.GET("/export", app.ExportUsers)
+	users.GET("/:id", app.GetUser)
+	users.PUT("/:id", app.UpdateUser)
+	users.DELETE("/:id", app.DeleteUser)
+	users.POST("/:id/deactivate", app.DeactivateUser)
+	users.POST("/:id/reactivate", app.ReactivateUser)
+	users.POST("/:id/restore", app.RestoreUser)
+	users.POST("/:id/erase", app.EraseUser)
+	users.POST("/:id/reset-password", app.ResetUserPassword)
+	users.POST("/:id/unlock", app.UnlockUser)
+	users.GET("/:id/roles", app.GetUserRoles)
+	users.PUT("/:id/roles", app.SetUserRoles)
+	users.DELETE("/:id/mfa", app.ResetUserMFA)
+	users.DELETE("/:id/sessions", app.RevokeUserSessions)
+
+	// Roles and the permissions they grant, for administrators only
+	roles := r.Group("/roles", app.requireAdmin())
+	roles.GET("", app.ListRoles)
+	roles.POST("", app.CreateRole)
+	roles.GET("/:name", app.GetRole)
+	roles.PUT("/:name", app.UpdateRole)
+	roles.DELETE("/:name", app.DeleteRole)
+
+	// OAuth clients and signing keys, for administrators only
+	clients := r.Group("/oauth/clients", app.requireAdmin())
+	clients.GET("", app.ListOAuthClients)
+	clients.POST("", app.CreateOAuthClient)
+	clients.GET("/:id", app.GetOAuthClient)
+	clients.PUT("/:id", app.UpdateOAuthClient)
+	clients.DELETE("/:id", app.DeleteOAuthClient)
+	r.POST("/oauth/keys/rotate", app.requireAdmin(), app.RotateSigningKey)
+
+	// How the log events this service publishes are faring, for administrators only
+	r.GET("/events/stats", app.requireAdmin(), app.EventStats)
+
+	// Reports of the erasures of users' personal data, for administrators only
+	erasures := r.Group("/erasures", app.requireAdmin())
+	erasures.GET("", app.ListErasures)
+	erasures.GET("/:id", app.GetErasure)
+
+	// User events waiting in the outbox, for administrators only
+	outbox := r.Group("/outbox", app.requireAdmin())
+	outbox.GET("", app.ListOutbox)
+	outbox.DELETE("/:id", app.DiscardOutboxMessage)
 
 	return r
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// secretBox encrypts secrets that are stored in the database, such as TOTP secrets, with
+// AES-256-GCM
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+func newSecretBox(key []byte) (*secretBox, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretBox{aead: aead}, nil
+}
+
+// seal encrypts plainText and returns it base64 encoded. context is authenticated along
+// with it, so the result can only be opened with the same context, which stops a secret
+// from being copied to another user's row.
+func (b *secretBox) seal(plainText []byte, context string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, plainText, []byte(context))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value returned by seal with the same context
+func (b *secretBox) open(sealed, context string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < b.aead.NonceSize() {
+		return nil, errors.New("malformed encrypted secret")
+	}
+	nonce, cipherText := raw[:b.aead.NonceSize()], raw[b.aead.NonceSize():]
+	return b.aead.Open(nil, nonce, cipherText, []byte(context))
+}
+
+// encryptionKey returns the base64 encoded 32 byte key in MFA_ENCRYPTION_KEY. Without it
+// the service can't start, since TOTP secrets encrypted with a random key would be lost on
+// restart.
+func encryptionKey() []byte {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("MFA_ENCRYPTION_KEY"))
+	if err != nil || len(key) != 32 {
+		log.Panic("MFA_ENCRYPTION_KEY must be 32 bytes, base64 encoded")
+	}
+	return key
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"authz"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IssueServiceToken gives another service a token of its own, granting the permissions
+// authz.ServicePermissions sets for it. The service proves who it is with HTTP basic
+// auth, its name and its secret from SERVICE_SECRETS.
+func (app *Config) IssueServiceToken(c *gin.Context) {
+	service, secret, ok := c.Request.BasicAuth()
+	want, known := app.ServiceSecrets[service]
+	if !ok || !known || subtle.ConstantTimeCompare([]byte(secret), []byte(want)) != 1 {
+		c.Header("WWW-Authenticate", `Basic realm="service-tokens"`)
+		app.errorJSON(c, errors.New("invalid service credentials"), http.StatusUnauthorized)
+		return
+	}
+
+	token, err := app.Tokens.ServiceToken(service)
+	if errors.Is(err, authz.ErrUnknownService) {
+		app.errorJSON(c, fmt.Errorf("%s has no service permissions", service), http.StatusForbidden)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not issue service token"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "service token for " + service,
+		Data: gin.H{
+			"access_token": token,
+			"token_type":   "Bearer",
+			"expires_in":   int(authz.ServiceTokenTTL.Seconds()),
+		},
+	})
+}
+
+// serviceSecrets reads SERVICE_SECRETS, a comma separated list of service=secret pairs
+func serviceSecrets(s string) map[string]string {
+	secrets := map[string]string{}
+	for _, item := range splitList(s) {
+		service, secret, ok := strings.Cut(item, "=")
+		if !ok || secret == "" {
+			log.Panicf("SERVICE_SECRETS must be service=secret pairs, got %q", item)
+		}
+		secrets[strings.TrimSpace(service)] = strings.TrimSpace(secret)
+	}
+	return secrets
+}
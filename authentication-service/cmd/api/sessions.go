@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"authentication/data"
+	"authentication/event"
+	"authz"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// sessionTTL is how long a session lasts without its refresh token being used. Each
+// refresh extends it again.
+const sessionTTL = 30 * 24 * time.Hour
+
+// sessionResponse is a session as its user sees it
+type sessionResponse struct {
+	*data.Session
+	// Current is set on the session of the access token the list was asked for with
+	Current bool `json:"current"`
+}
+
+// RefreshSession exchanges a refresh token for a new access token and a new refresh token.
+// Each refresh token works once. When one is used a second time it may have been stolen,
+// so the whole session is revoked.
+func (app *Config) RefreshSession(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	ctx := c.Request.Context()
+	session, refreshToken, err := app.Models.Session.Refresh(ctx, req.RefreshToken, c.ClientIP(), c.Request.UserAgent(), sessionTTL)
+	if errors.Is(err, data.ErrRefreshTokenReused) {
+		app.Revocations.Add(session.ID)
+		app.logEvent(event.Warning, "audit", fmt.Sprintf("session %s revoked after its refresh token was reused", session.ID))
+		app.errorJSON(c, data.ErrInvalidToken, http.StatusUnauthorized)
+		return
+	} else if errors.Is(err, data.ErrInvalidToken) {
+		app.errorJSON(c, err, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not refresh session"), http.StatusInternalServerError)
+		return
+	}
+
+	// The account may have been deactivated since the login
+	user, err := app.Models.User.GetOne(ctx, session.UserID)
+	if err != nil || !user.Active {
+		if err := app.Models.Session.Revoke(ctx, session.UserID, session.ID); err == nil {
+			app.Revocations.Add(session.ID)
+		}
+		app.errorJSON(c, errors.New("account is not active"), http.StatusForbidden)
+		return
+	}
+
+	token, err := app.accessToken(ctx, user, session)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not issue access token"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeSessionTokens(c, "Refreshed session", user, token, refreshToken)
+}
+
+// ListSessions returns the caller's active sessions, most recently used first
+func (app *Config) ListSessions(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+
+	sessions, err := app.Models.Session.GetForUser(c.Request.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not list sessions"), http.StatusInternalServerError)
+		return
+	}
+
+	claims, _ := authz.FromContext(c)
+	response := make([]sessionResponse, len(sessions))
+	for i, session := range sessions {
+		response[i] = sessionResponse{Session: session, Current: session.ID == claims.SessionID}
+	}
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d sessions", len(sessions)),
+		Data:    response,
+	})
+}
+
+// RevokeSession logs the caller out of the session with the id in the path
+func (app *Config) RevokeSession(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+	app.revokeSession(c, user, c.Param("id"))
+}
+
+// Logout revokes the session of the caller's access token
+func (app *Config) Logout(c *gin.Context) {
+	user, ok := app.currentUser(c)
+	if !ok {
+		return
+	}
+	claims, _ := authz.FromContext(c)
+	if claims.SessionID == "" {
+		app.errorJSON(c, errors.New("this access token has no session"))
+		return
+	}
+	app.revokeSession(c, user, claims.SessionID)
+}
+
+// RevokeUserSessions logs a user out everywhere
+func (app *Config) RevokeUserSessions(c *gin.Context) {
+	user, ok := app.userFromPath(c)
+	if !ok {
+		return
+	}
+
+	ids, err := app.revokeUserSessions(c.Request.Context(), user.ID)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not revoke sessions"), http.StatusInternalServerError)
+		return
+	}
+	app.audit(fmt.Sprintf("%d sessions of %s revoked by an administrator", len(ids), user.Email))
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("revoked %d sessions of %s", len(ids), user.Email),
+	})
+}
+
+// RevokedSessions lists the sessions revoked recently enough that access tokens issued
+// for them may still be valid. Services poll it to refuse those tokens.
+func (app *Config) RevokedSessions(c *gin.Context) {
+	ids, err := app.revokedSessions(c.Request.Context())
+	if err != nil {
+		app.errorJSON(c, errors.New("could not list revoked sessions"), http.StatusInternalServerError)
+		return
+	}
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d revoked sessions", len(ids)),
+		Data:    gin.H{"session_ids": ids},
+	})
+}
+
+// revokeSession revokes one of user's sessions and writes the response
+func (app *Config) revokeSession(c *gin.Context, user *data.User, id string) {
+	err := app.Models.Session.Revoke(c.Request.Context(), user.ID, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("session not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not revoke session"), http.StatusInternalServerError)
+		return
+	}
+	app.Revocations.Add(id)
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "revoked session " + id,
+	})
+}
+
+// revokeUserSessions revokes every session of userID and returns their IDs
+func (app *Config) revokeUserSessions(ctx context.Context, userID int) ([]string, error) {
+	ids, err := app.Models.Session.RevokeAll(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	app.Revocations.Add(ids...)
+	return ids, nil
+}
+
+// revokedSessions is the source of this service's own revocation list
+func (app *Config) revokedSessions(ctx context.Context) ([]string, error) {
+	return app.Models.Session.RevokedSince(ctx, time.Now().Add(-accessTokenTTL))
+}
+
+// purgeSessions deletes sessions that expired, or were revoked, longer ago than an access
+// token lives, every interval until stop is closed
+func (app *Config) purgeSessions(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := app.Models.Session.PurgeExpired(context.Background(), time.Now().Add(-accessTokenTTL))
+			if err != nil {
+				log.Println("Error purging expired sessions:", err)
+			}
+		}
+	}
+}
+
+// describeDevice names the browser and operating system in a User-Agent header, such as
+// "Firefox on Windows", for users to recognize their sessions by
+func describeDevice(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	var browser string
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	var system string
+	for _, s := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	// Other clients, such as curl/8.5.0, start with their name
+	name, _, _ := strings.Cut(userAgent, "/")
+	name, _, _ = strings.Cut(name, " ")
+	return name
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"authentication/data"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	minPasswordLength = 8
+	// New hashes are argon2id by default, but PASSWORD_HASH_ALGORITHM can still select
+	// bcrypt, which refuses passwords longer than 72 bytes. Passwords must work with both.
+	maxPasswordLength = 72
+)
+
+type listUsersQuery struct {
+	Page     int    `form:"page" binding:"omitempty,min=1"`
+	PageSize int    `form:"page_size" binding:"omitempty,min=1,max=100"`
+	Search   string `form:"search" binding:"max=255"`
+}
+
+type createUserRequest struct {
+	Email     string `json:"email" binding:"required,email,max=255"`
+	FirstName string `json:"first_name" binding:"max=255"`
+	LastName  string `json:"last_name" binding:"max=255"`
+	Password  string `json:"password" binding:"required"`
+	Active    *bool  `json:"active"`
+}
+
+type updateUserRequest struct {
+	Email     *string `json:"email" binding:"omitempty,email,max=255"`
+	FirstName *string `json:"first_name" binding:"omitempty,max=255"`
+	LastName  *string `json:"last_name" binding:"omitempty,max=255"`
+	Active    *bool   `json:"active"`
+}
+
+type resetPasswordRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// ListUsers returns one page of users. It accepts the query parameters page (starting at 1),
+// page_size (at most 100) and search, which filters on email, first name and last name.
+func (app *Config) ListUsers(c *gin.Context) {
+	var query listUsersQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+	if query.Page == 0 {
+		query.Page = 1
+	}
+	if query.PageSize == 0 {
+		query.PageSize = defaultPageSize
+	}
+
+	users, total, err := app.Models.User.GetPage(c.Request.Context(), strings.TrimSpace(query.Search), query.Page, query.PageSize)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not list users"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d users", total),
+		Data: gin.H{
+			"users":     users,
+			"total":     total,
+			"page":      query.Page,
+			"page_size": query.PageSize,
+		},
+	})
+}
+
+// GetUser returns the user identified by the id path parameter
+func (app *Config) GetUser(c *gin.Context) {
+	user, ok := app.userFromPath(c)
+	if !ok {
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "user " + user.Email,
+		Data:    user,
+	})
+}
+
+// CreateUser inserts a new user. Users are created active unless active is false.
+func (app *Config) CreateUser(c *gin.Context) {
+	var req createUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+
+	user := data.User{
+		Email:     normalizeEmail(req.Email),
+		FirstName: strings.TrimSpace(req.FirstName),
+		LastName:  strings.TrimSpace(req.LastName),
+		Password:  req.Password,
+		Active:    req.Active == nil || *req.Active,
+	}
+
+	id, err := app.Models.User.Insert(c.Request.Context(), user)
+	if err != nil {
+		app.userWriteError(c, err)
+		return
+	}
+
+	created, err := app.Models.User.GetOne(c.Request.Context(), id)
+	if err != nil {
+		app.errorJSON(c, errors.New("could not load created user"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusCreated, jsonResponse{
+		Error:   false,
+		Message: "created user " + created.Email,
+		Data:    created,
+	})
+}
+
+// UpdateUser changes the email, names or active flag of a user. Fields that are omitted
+// from the request are left untouched. Deactivating the user revokes their sessions.
+func (app *Config) UpdateUser(c *gin.Context) {
+	var req updateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+
+	user, ok := app.userFromPath(c)
+	if !ok {
+		return
+	}
+
+	if req.Email != nil {
+		user.Email = normalizeEmail(*req.Email)
+	}
+	if req.FirstName != nil {
+		user.FirstName = strings.TrimSpace(*req.FirstName)
+	}
+	if req.LastName != nil {
+		user.LastName = strings.TrimSpace(*req.LastName)
+	}
+	deactivated := req.Active != nil && user.Active && !*req.Active
+	if req.Active != nil {
+		user.Active = *req.Active
+	}
+
+	if err := app.Models.User.Update(c.Request.Context(), user); err != nil {
+		app.userWriteError(c, err)
+		return
+	}
+	if deactivated {
+		if err := app.revokeSessions(c.Request.Context(), user.ID); err != nil {
+			log.Println("Error revoking sessions of deactivated user:", err)
+		}
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "updated user " + user.Email,
+		Data:    user,
+	})
+}
+
+// DeactivateUser marks a user as inactive without deleting it, and revokes their sessions
+// and outstanding links
+func (app *Config) DeactivateUser(c *gin.Context) {
+	user, ok := app.userFromPath(c)
+	if !ok {
+		return
+	}
+
+	user.Active = false
+	if err := app.Models.User.Update(c.Request.Context(), user); err != nil {
+		app.userWriteError(c, err)
+		return
+	}
+	if err := app.revokeSessions(c.Request.Context(), user.ID); err != nil {
+		log.Println("Error revoking sessions of deactivated user:", err)
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "deactivated user " + user.Email,
+		Data:    user,
+	})
+}
+
+// ReactivateUser marks a deactivated user as active again
+func (app *Config) ReactivateUser(c *gin.Context) {
+	user, ok := app.userFromPath(c)
+	if !ok {
+		return
+	}
+
+	user.Active = true
+	if err := app.Models.User.Update(c.Request.Context(), user); err != nil {
+		app.userWriteError(c, err)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "reactivated user " + user.Email,
+		Data:    user,
+	})
+}
+
+// DeleteUser deletes a user. It can be restored with RestoreUser until it is erased.
+func (app *Config) DeleteUser(c *gin.Context) {
+	user, ok := app.userFromPath(c)
+	if !ok {
+		return
+	}
+
+	// Revoked first, so that the user's access tokens stop working too
+	if _, err := app.revokeUserSessions(c.Request.Context(), user.ID); err != nil {
+		app.errorJSON(c, errors.New("could not delete user"), http.StatusInternalServerError)
+		return
+	}
+	if err := app.Models.User.Delete(c.Request.Context(), user); err != nil {
+		app.errorJSON(c, errors.New("could not delete user"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "deleted user " + user.Email,
+	})
+}
+
+// RestoreUser undoes the deletion of a user. Its sessions stay revoked.
+func (app *Config) RestoreUser(c *gin.Context) {
+	user, ok := app.userFromPathWithDeleted(c)
+	if !ok {
+		return
+	}
+	switch {
+	case user.ErasedAt != nil:
+		app.errorJSON(c, errors.New("erased users can't be restored"), http.StatusConflict)
+		return
+	case !user.DeletedAt.Valid:
+		app.errorJSON(c, errors.New("user is not deleted"), http.StatusConflict)
+		return
+	}
+
+	if err := app.Models.User.Restore(c.Request.Context(), user); err != nil {
+		app.userWriteError(c, err)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "restored user " + user.Email,
+		Data:    user,
+	})
+}
+
+// ResetUserPassword sets a new password for a user, and revokes their sessions
+func (app *Config) ResetUserPassword(c *gin.Context) {
+	var req resetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		app.errorJSON(c, validationError(err))
+		return
+	}
+	if err := validatePassword(req.Password); err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+
+	user, ok := app.userFromPath(c)
+	if !ok {
+		return
+	}
+
+	if err := app.Models.User.ResetPassword(c.Request.Context(), user, req.Password); err != nil {
+		app.errorJSON(c, errors.New("could not reset password"), http.StatusInternalServerError)
+		return
+	}
+	if err := app.revokeSessions(c.Request.Context(), user.ID); err != nil {
+		log.Println("Error revoking sessions after password reset:", err)
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "password reset for " + user.Email,
+	})
+}
+
+// UnlockUser lifts a lockout on a user's account caused by failed logins, before it
+// expires on its own
+func (app *Config) UnlockUser(c *gin.Context) {
+	user, ok := app.userFromPath(c)
+	if !ok {
+		return
+	}
+
+	if !app.Limiter.unlock(normalizeEmail(user.Email), "unlocked by administrator") {
+		app.writeJSON(c, http.StatusOK, jsonResponse{
+			Error:   false,
+			Message: user.Email + " is not locked",
+		})
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "unlocked " + user.Email,
+	})
+}
+
+// userFromPath loads the user named by the id path parameter. When that fails it writes
+// the error response and returns false.
+func (app *Config) userFromPath(c *gin.Context) (*data.User, bool) {
+	return app.loadUserFromPath(c, app.Models.User.GetOne)
+}
+
+// userFromPathWithDeleted is userFromPath for the routes that also act on deleted users
+func (app *Config) userFromPathWithDeleted(c *gin.Context) (*data.User, bool) {
+	return app.loadUserFromPath(c, app.Models.User.GetWithDeleted)
+}
+
+func (app *Config) loadUserFromPath(c *gin.Context, get func(ctx context.Context, id int) (*data.User, error)) (*data.User, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		app.errorJSON(c, errors.New("invalid user id"))
+		return nil, false
+	}
+
+	user, err := get(c.Request.Context(), id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		app.errorJSON(c, errors.New("user not found"), http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		app.errorJSON(c, errors.New("could not load user"), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// userWriteError reports a failed insert or update, treating a unique index violation
+// as a conflict on the email address
+func (app *Config) userWriteError(c *gin.Context, err error) {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		app.errorJSON(c, errors.New("a user with that email already exists"), http.StatusConflict)
+		return
+	}
+	app.errorJSON(c, errors.New("could not save user"), http.StatusInternalServerError)
+}
+
+// validatePassword enforces the rules every new password must follow
+func validatePassword(password string) error {
+	switch {
+	case len(password) < minPasswordLength:
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	case len(password) > maxPasswordLength:
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordLength)
+	case strings.TrimSpace(password) == "":
+		return errors.New("password must not be blank")
+	}
+	return nil
+}
+
+// normalizeEmail trims and lower-cases an email address before it is stored
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
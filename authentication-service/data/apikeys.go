@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// apiKeyPrefix starts every API key, so that leaked keys are easy to recognize
+const apiKeyPrefix = "ak_"
+
+// APIKey lets a script act as the user who created it, with some of their permissions.
+// Only a hash of the key is stored. Its prefix, such as "ak_1f2e3d4c", is kept so that
+// users can tell their keys apart.
+type APIKey struct {
+	ID         int        `gorm:"primaryKey" json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"-"`
+	Scopes     []string   `gorm:"serializer:json" json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+// NewAPIKey returns a key for userID with a new random secret, which is returned in plain
+// text and must be handed to the user. A nil expiresAt means the key doesn't expire.
+func NewAPIKey(userID int, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	secret, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	prefix := apiKeyPrefix + hex.EncodeToString(b)
+	plainText := prefix + "_" + secret
+	return &APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    prefix,
+		Hash:      hashToken(plainText),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}, plainText, nil
+}
+
+// APIKeyRepository stores API keys. Lookups of keys that don't exist fail with
+// gorm.ErrRecordNotFound, whatever the implementation.
+type APIKeyRepository interface {
+	// GetForUser returns the keys of userID that are not revoked, newest first. Expired
+	// keys are included.
+	GetForUser(ctx context.Context, userID int) ([]*APIKey, error)
+	// Insert stores a new key
+	Insert(ctx context.Context, key *APIKey) error
+	// Revoke revokes key id of userID
+	Revoke(ctx context.Context, userID, id int) error
+	// DeleteForUser deletes every key of userID, revoked ones included, and returns how
+	// many there were
+	DeleteForUser(ctx context.Context, userID int) (int, error)
+	// Use returns the key matching plainText and records that it was used. It returns
+	// ErrInvalidToken unless the key exists, has not expired and has not been revoked.
+	Use(ctx context.Context, plainText string) (*APIKey, error)
+}
+
+// postgresAPIKeys is the APIKeyRepository backed by the api_keys table
+type postgresAPIKeys struct {
+	db *gorm.DB
+}
+
+// NewPostgresAPIKeyRepository returns an APIKeyRepository that stores keys in Postgres
+func NewPostgresAPIKeyRepository(conn *gorm.DB) APIKeyRepository {
+	return &postgresAPIKeys{db: conn}
+}
+
+func (r *postgresAPIKeys) GetForUser(ctx context.Context, userID int) ([]*APIKey, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var keys []*APIKey
+	err := db.Where("user_id = ? AND revoked_at IS NULL", userID).Order("created_at DESC").Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (r *postgresAPIKeys) Insert(ctx context.Context, key *APIKey) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	return db.Create(key).Error
+}
+
+func (r *postgresAPIKeys) Revoke(ctx context.Context, userID, id int) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	result := db.Model(&APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *postgresAPIKeys) DeleteForUser(ctx context.Context, userID int) (int, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	result := db.Where("user_id = ?", userID).Delete(&APIKey{})
+	return int(result.RowsAffected), result.Error
+}
+
+func (r *postgresAPIKeys) Use(ctx context.Context, plainText string) (*APIKey, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var key APIKey
+	now := time.Now()
+	result := db.Model(&key).
+		Clauses(clause.Returning{}).
+		Where("hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", hashToken(plainText), now).
+		Update("last_used_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrInvalidToken
+	}
+	return &key, nil
+}
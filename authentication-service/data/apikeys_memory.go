@@ -0,0 +1,110 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MemoryAPIKeyRepository is an APIKeyRepository that keeps keys in memory, for tests and
+// for running handlers without Postgres
+type MemoryAPIKeyRepository struct {
+	mu     sync.Mutex
+	keys   map[int]APIKey
+	nextID int
+}
+
+// NewMemoryAPIKeyRepository returns an empty MemoryAPIKeyRepository
+func NewMemoryAPIKeyRepository() *MemoryAPIKeyRepository {
+	return &MemoryAPIKeyRepository{keys: map[int]APIKey{}, nextID: 1}
+}
+
+func (r *MemoryAPIKeyRepository) GetForUser(ctx context.Context, userID int) ([]*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var keys []*APIKey
+	for _, key := range r.keys {
+		if key.UserID == userID && key.RevokedAt == nil {
+			k := key
+			keys = append(keys, &k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID > keys[j].ID })
+	return keys, nil
+}
+
+func (r *MemoryAPIKeyRepository) Insert(ctx context.Context, key *APIKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key.ID, key.CreatedAt = r.nextID, time.Now()
+	r.nextID++
+	r.keys[key.ID] = *key
+	return nil
+}
+
+func (r *MemoryAPIKeyRepository) Revoke(ctx context.Context, userID, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, ok := r.keys[id]
+	if !ok || key.UserID != userID || key.RevokedAt != nil {
+		return gorm.ErrRecordNotFound
+	}
+	now := time.Now()
+	key.RevokedAt = &now
+	r.keys[id] = key
+	return nil
+}
+
+func (r *MemoryAPIKeyRepository) DeleteForUser(ctx context.Context, userID int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for id, key := range r.keys {
+		if key.UserID == userID {
+			delete(r.keys, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *MemoryAPIKeyRepository) Use(ctx context.Context, plainText string) (*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hash, now := hashToken(plainText), time.Now()
+	for id, key := range r.keys {
+		if key.Hash != hash {
+			continue
+		}
+		if key.RevokedAt != nil || (key.ExpiresAt != nil && !key.ExpiresAt.After(now)) {
+			break
+		}
+		key.LastUsedAt = &now
+		r.keys[id] = key
+		return &key, nil
+	}
+	return nil, ErrInvalidToken
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Statuses of an erasure. A pending erasure has erased the user in this service, and
+// waits for the logger service to redact the user's log entries.
+const (
+	ErasurePending   = "pending"
+	ErasureCompleted = "completed"
+	ErasureFailed    = "failed"
+)
+
+// Erasure is the report of a job that erased the personal data of a user, on their
+// request. It names the user only by ID. A failed erasure can be run again; the steps
+// that were done already change nothing the second time.
+type Erasure struct {
+	ID          int           `gorm:"primaryKey" json:"id"`
+	UserID      int           `json:"user_id"`
+	RequestedBy string        `json:"requested_by"`
+	Status      string        `json:"status"`
+	Steps       []ErasureStep `gorm:"serializer:json" json:"steps"`
+	StartedAt   time.Time     `json:"started_at"`
+	CompletedAt *time.Time    `json:"completed_at,omitempty"`
+}
+
+// ErasureStep is one step of an erasure, such as removing the user's API keys
+type ErasureStep struct {
+	Name string `json:"name"`
+	// Count is how many records the step erased, for the steps that count them
+	Count int    `json:"count,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ErasureRepository stores the reports of erasures. Lookups of reports that don't exist
+// fail with gorm.ErrRecordNotFound, whatever the implementation.
+type ErasureRepository interface {
+	// Insert stores a new report
+	Insert(ctx context.Context, erasure *Erasure) error
+	// GetAll returns every report, newest first
+	GetAll(ctx context.Context) ([]*Erasure, error)
+	// GetOne returns one report by id
+	GetOne(ctx context.Context, id int) (*Erasure, error)
+	// Complete adds step to the pending report of user userID and completes it at
+	// completedAt
+	Complete(ctx context.Context, userID int, step ErasureStep, completedAt time.Time) (*Erasure, error)
+}
+
+// postgresErasures is the ErasureRepository backed by the erasures table
+type postgresErasures struct {
+	db *gorm.DB
+}
+
+// NewPostgresErasureRepository returns an ErasureRepository that keeps reports in Postgres
+func NewPostgresErasureRepository(conn *gorm.DB) ErasureRepository {
+	return &postgresErasures{db: conn}
+}
+
+func (r *postgresErasures) Insert(ctx context.Context, erasure *Erasure) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	return db.Create(erasure).Error
+}
+
+func (r *postgresErasures) GetAll(ctx context.Context) ([]*Erasure, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var erasures []*Erasure
+	if err := db.Order("id DESC").Find(&erasures).Error; err != nil {
+		return nil, err
+	}
+	return erasures, nil
+}
+
+func (r *postgresErasures) GetOne(ctx context.Context, id int) (*Erasure, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var erasure Erasure
+	if err := db.First(&erasure, id).Error; err != nil {
+		return nil, err
+	}
+	return &erasure, nil
+}
+
+func (r *postgresErasures) Complete(ctx context.Context, userID int, step ErasureStep, completedAt time.Time) (*Erasure, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var erasure Erasure
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND status = ?", userID, ErasurePending).Order("id DESC").First(&erasure).Error
+		if err != nil {
+			return err
+		}
+		erasure.Steps = append(erasure.Steps, step)
+		erasure.Status, erasure.CompletedAt = ErasureCompleted, &completedAt
+		return tx.Save(&erasure).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &erasure, nil
+}
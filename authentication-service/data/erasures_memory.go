@@ -0,0 +1,82 @@
+package data
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MemoryErasureRepository is an ErasureRepository that keeps reports in memory, for tests
+// and for running handlers without Postgres
+type MemoryErasureRepository struct {
+	mu       sync.Mutex
+	erasures []Erasure
+}
+
+// NewMemoryErasureRepository returns an empty MemoryErasureRepository
+func NewMemoryErasureRepository() *MemoryErasureRepository {
+	return &MemoryErasureRepository{}
+}
+
+func (r *MemoryErasureRepository) Insert(ctx context.Context, erasure *Erasure) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	erasure.ID = len(r.erasures) + 1
+	r.erasures = append(r.erasures, *erasure)
+	return nil
+}
+
+func (r *MemoryErasureRepository) GetAll(ctx context.Context) ([]*Erasure, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	erasures := make([]*Erasure, 0, len(r.erasures))
+	for i := len(r.erasures) - 1; i >= 0; i-- {
+		e := r.erasures[i]
+		erasures = append(erasures, &e)
+	}
+	return erasures, nil
+}
+
+func (r *MemoryErasureRepository) GetOne(ctx context.Context, id int) (*Erasure, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id < 1 || id > len(r.erasures) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	e := r.erasures[id-1]
+	return &e, nil
+}
+
+func (r *MemoryErasureRepository) Complete(ctx context.Context, userID int, step ErasureStep, completedAt time.Time) (*Erasure, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := len(r.erasures) - 1; i >= 0; i-- {
+		e := &r.erasures[i]
+		if e.UserID != userID || e.Status != ErasurePending {
+			continue
+		}
+		e.Steps = append(append([]ErasureStep(nil), e.Steps...), step)
+		e.Status, e.CompletedAt = ErasureCompleted, &completedAt
+		completed := *e
+		return &completed, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
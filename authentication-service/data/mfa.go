@@ -0,0 +1,181 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrCodeReused is returned when a TOTP code is used for a time step that is not newer
+	// than the last accepted one
+	ErrCodeReused = errors.New("code was already used")
+	// ErrInvalidRecoveryCode is returned for recovery codes that don't exist or were used
+	ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+)
+
+// MFA holds a user's TOTP secret. The secret is stored encrypted, and is only used to log
+// in once Enabled is set by confirming a first code.
+type MFA struct {
+	UserID int   `gorm:"primaryKey"`
+	User   *User `gorm:"constraint:OnDelete:CASCADE"`
+	// Secret is the encrypted TOTP secret
+	Secret  string `gorm:"not null"`
+	Enabled bool   `gorm:"not null;default:false"`
+	// LastUsedStep is the TOTP time step of the last accepted code, so no code works twice
+	LastUsedStep int64 `gorm:"not null;default:0"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// TableName keeps the table name readable
+func (MFA) TableName() string {
+	return "user_mfa"
+}
+
+// RecoveryCode is a single-use code that can stand in for a TOTP code. Only a SHA-256 hash
+// of the code is stored.
+type RecoveryCode struct {
+	ID     int    `gorm:"primaryKey"`
+	UserID int    `gorm:"index;not null"`
+	User   *User  `gorm:"constraint:OnDelete:CASCADE"`
+	Hash   string `gorm:"uniqueIndex;not null"`
+	UsedAt *time.Time
+}
+
+// MFAStore stores users' MFA settings and recovery codes
+type MFAStore struct {
+	db *gorm.DB
+}
+
+// Get returns the MFA settings of userID, or gorm.ErrRecordNotFound if there are none
+func (s *MFAStore) Get(ctx context.Context, userID int) (*MFA, error) {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	var mfa MFA
+	if err := db.Where("user_id = ?", userID).First(&mfa).Error; err != nil {
+		return nil, err
+	}
+	return &mfa, nil
+}
+
+// SavePending stores a new encrypted secret for userID that is not enabled yet, replacing
+// any earlier one that was never confirmed. It fails if MFA is already enabled.
+func (s *MFAStore) SavePending(ctx context.Context, userID int, secret string) error {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	result := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"secret", "last_used_step", "updated_at"}),
+		Where:     clause.Where{Exprs: []clause.Expression{clause.Eq{Column: "user_mfa.enabled", Value: false}}},
+	}).Create(&MFA{UserID: userID, Secret: secret})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return gorm.ErrDuplicatedKey
+	}
+	return nil
+}
+
+// UseStep records that a code for the TOTP time step was accepted for m. It returns
+// ErrCodeReused unless step is newer than the last accepted one, so that a code can't be
+// replayed, even by two requests at once.
+func (s *MFAStore) UseStep(ctx context.Context, m *MFA, step int64) error {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	result := db.Model(&MFA{}).
+		Where("user_id = ? AND last_used_step < ?", m.UserID, step).
+		Update("last_used_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return ErrCodeReused
+	}
+	m.LastUsedStep = step
+	return nil
+}
+
+// Enable turns on MFA for m's user and replaces their recovery codes with the given plain
+// text ones
+func (s *MFAStore) Enable(ctx context.Context, m *MFA, recoveryCodes []string) error {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&MFA{}).Where("user_id = ?", m.UserID).Update("enabled", true).Error; err != nil {
+			return err
+		}
+		m.Enabled = true
+		return replaceRecoveryCodes(tx, m.UserID, recoveryCodes)
+	})
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of userID with the given plain text ones
+func (s *MFAStore) ReplaceRecoveryCodes(ctx context.Context, userID int, recoveryCodes []string) error {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userID, recoveryCodes)
+	})
+}
+
+// UseRecoveryCode marks a recovery code of userID as used. It returns
+// ErrInvalidRecoveryCode if there is no such unused code.
+func (s *MFAStore) UseRecoveryCode(ctx context.Context, userID int, plainText string) error {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	result := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND hash = ? AND used_at IS NULL", userID, hashToken(plainText)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		return ErrInvalidRecoveryCode
+	}
+	return nil
+}
+
+// RemainingRecoveryCodes returns how many of the recovery codes of userID are unused
+func (s *MFAStore) RemainingRecoveryCodes(ctx context.Context, userID int) (int64, error) {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	var n int64
+	err := db.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&n).Error
+	return n, err
+}
+
+// Disable removes the TOTP secret and recovery codes of userID
+func (s *MFAStore) Disable(ctx context.Context, userID int) error {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&MFA{}).Error
+	})
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID int, plainTexts []string) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return err
+	}
+	codes := make([]RecoveryCode, len(plainTexts))
+	for i, plainText := range plainTexts {
+		codes[i] = RecoveryCode{UserID: userID, Hash: hashToken(plainText)}
+	}
+	return tx.Create(&codes).Error
+}
@@ -0,0 +1,228 @@
+package data
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the key of the Postgres advisory lock that keeps two instances from
+// migrating at the same time
+const migrationLock = 7_406_932_471
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one versioned change to the schema, read from the pair of files
+// migrations/<version>_<name>.up.sql and migrations/<version>_<name>.down.sql
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and when it was applied, if it was
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// schemaMigration records an applied migration
+type schemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// Migrator applies and reverts the migrations, keeping track of them in the
+// schema_migrations table
+type Migrator struct {
+	conn       *gorm.DB
+	migrations []Migration
+}
+
+// NewMigrator returns a Migrator for the migrations built into the service
+func NewMigrator(conn *gorm.DB) (*Migrator, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return newMigrator(conn, sub)
+}
+
+func newMigrator(conn *gorm.DB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{conn: conn, migrations: migrations}, nil
+}
+
+// loadMigrations reads the migrations in fsys, sorted by version. Every migration needs
+// both an up and a down file.
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, f := range files {
+		match := migrationName.FindStringSubmatch(f.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", f.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		sql, err := fs.ReadFile(fsys, f.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Up applies every migration that hasn't been applied yet, in order, and returns them.
+// They run in one transaction, so either all of them are applied or none are.
+func (m *Migrator) Up() ([]Migration, error) {
+	var applied []Migration
+	err := m.locked(func(tx *gorm.DB, done map[int]schemaMigration) error {
+		for _, migration := range m.migrations {
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+			if err := tx.Exec(migration.Up).Error; err != nil {
+				return fmt.Errorf("applying migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			record := schemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}
+			if err := tx.Create(&record).Error; err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns them
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	known := make(map[int]Migration, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+
+	var reverted []Migration
+	err := m.locked(func(tx *gorm.DB, done map[int]schemaMigration) error {
+		latest := make([]schemaMigration, 0, len(done))
+		for _, record := range done {
+			latest = append(latest, record)
+		}
+		sort.Slice(latest, func(i, j int) bool { return latest[i].Version > latest[j].Version })
+		if len(latest) > steps {
+			latest = latest[:steps]
+		}
+
+		for _, record := range latest {
+			migration, ok := known[record.Version]
+			if !ok {
+				return fmt.Errorf("migration %d_%s was applied by a newer version of the service", record.Version, record.Name)
+			}
+			if err := tx.Exec(migration.Down).Error; err != nil {
+				return fmt.Errorf("reverting migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			if err := tx.Delete(&record).Error; err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+// Status lists every migration with when it was applied
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	status := make([]MigrationStatus, len(m.migrations))
+	err := m.locked(func(tx *gorm.DB, done map[int]schemaMigration) error {
+		for i, migration := range m.migrations {
+			status[i].Migration = migration
+			if record, ok := done[migration.Version]; ok {
+				status[i].AppliedAt = &record.AppliedAt
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// locked runs fn in a transaction holding the migration lock, with the migrations applied
+// so far
+func (m *Migrator) locked(fn func(tx *gorm.DB, done map[int]schemaMigration) error) error {
+	return m.conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLock).Error; err != nil {
+			return err
+		}
+		err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    bigint PRIMARY KEY,
+			name       text NOT NULL,
+			applied_at timestamptz NOT NULL
+		)`).Error
+		if err != nil {
+			return err
+		}
+
+		var records []schemaMigration
+		if err := tx.Find(&records).Error; err != nil {
+			return err
+		}
+		done := make(map[int]schemaMigration, len(records))
+		for _, record := range records {
+			done[record.Version] = record
+		}
+		return fn(tx, done)
+	})
+}
@@ -0,0 +1,158 @@
+package data
+
+import (
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newMockMigrator(t *testing.T, files fstest.MapFS) (*Migrator, sqlmock.Sqlmock) {
+	t.Helper()
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	conn, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := newMigrator(conn, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrator, mock
+}
+
+var testMigrations = fstest.MapFS{
+	"0001_create_things.up.sql":    {Data: []byte("CREATE TABLE things ()")},
+	"0001_create_things.down.sql":  {Data: []byte("DROP TABLE things")},
+	"0002_add_thing_name.up.sql":   {Data: []byte("ALTER TABLE things ADD name text")},
+	"0002_add_thing_name.down.sql": {Data: []byte("ALTER TABLE things DROP name")},
+	"0010_create_widgets.up.sql":   {Data: []byte("CREATE TABLE widgets ()")},
+	"0010_create_widgets.down.sql": {Data: []byte("DROP TABLE widgets")},
+}
+
+// expectLocked stubs the start of every migrator operation: taking the lock, creating
+// schema_migrations and reading the applied versions
+func expectLocked(mock sqlmock.Sqlmock, applied ...int) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_advisory_xact_lock($1)`)).
+		WithArgs(migrationLock).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"version", "name", "applied_at"})
+	for _, version := range applied {
+		rows.AddRow(version, "", time.Now())
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "schema_migrations"`)).WillReturnRows(rows)
+}
+
+func TestMigratorUpAppliesPendingInOrder(t *testing.T) {
+	migrator, mock := newMockMigrator(t, testMigrations)
+
+	expectLocked(mock, 1)
+	for _, m := range []struct {
+		version int
+		name    string
+		sql     string
+	}{
+		{2, "add_thing_name", "ALTER TABLE things ADD name text"},
+		{10, "create_widgets", "CREATE TABLE widgets ()"},
+	} {
+		mock.ExpectExec(regexp.QuoteMeta(m.sql)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "schema_migrations" ("version","name","applied_at") VALUES ($1,$2,$3)`)).
+			WithArgs(m.version, m.name, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || applied[0].Version != 2 || applied[1].Version != 10 {
+		t.Errorf("expected migrations 2 and 10 to be applied, got %+v", applied)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigratorUpRollsBackOnError(t *testing.T) {
+	migrator, mock := newMockMigrator(t, testMigrations)
+
+	expectLocked(mock, 1, 2)
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE widgets ()")).WillReturnError(gorm.ErrInvalidData)
+	mock.ExpectRollback()
+
+	if _, err := migrator.Up(); err == nil {
+		t.Fatal("expected the failed migration to be reported")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigratorDownRevertsNewestFirst(t *testing.T) {
+	migrator, mock := newMockMigrator(t, testMigrations)
+
+	expectLocked(mock, 1, 2, 10)
+	for _, m := range []struct {
+		version int
+		sql     string
+	}{
+		{10, "DROP TABLE widgets"},
+		{2, "ALTER TABLE things DROP name"},
+	} {
+		mock.ExpectExec(regexp.QuoteMeta(m.sql)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "schema_migrations" WHERE "schema_migrations"."version" = $1`)).
+			WithArgs(m.version).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	reverted, err := migrator.Down(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != 2 || reverted[0].Version != 10 || reverted[1].Version != 2 {
+		t.Errorf("expected migrations 10 and 2 to be reverted, got %+v", reverted)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrator, err := NewMigrator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrator.migrations) == 0 || migrator.migrations[0].Name != "create_users" {
+		t.Errorf("expected the built-in migrations to start with create_users, got %+v", migrator.migrations)
+	}
+
+	for name, files := range map[string]fstest.MapFS{
+		"missing down": {"0001_a.up.sql": {Data: []byte("SELECT 1")}},
+		"bad name":     {"first.sql": {Data: []byte("SELECT 1")}},
+		"name clash": {
+			"0001_a.up.sql":   {Data: []byte("SELECT 1")},
+			"0001_b.down.sql": {Data: []byte("SELECT 1")},
+		},
+	} {
+		if _, err := loadMigrations(files); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+-- Databases set up before migrations existed already have this table
+CREATE TABLE IF NOT EXISTS users (
+    id         bigserial PRIMARY KEY,
+    email      text NOT NULL CONSTRAINT uni_users_email UNIQUE,
+    first_name text,
+    last_name  text,
+    password   text,
+    active     boolean,
+    created_at timestamptz,
+    updated_at timestamptz
+);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id         bigserial PRIMARY KEY,
+    user_id    bigint NOT NULL,
+    purpose    text NOT NULL,
+    hash       text NOT NULL,
+    expires_at timestamptz NOT NULL,
+    used_at    timestamptz,
+    created_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_tokens_user_id ON user_tokens (user_id);
+CREATE INDEX IF NOT EXISTS idx_user_tokens_purpose ON user_tokens (purpose);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_tokens_hash ON user_tokens (hash);
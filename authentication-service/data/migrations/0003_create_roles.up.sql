@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS permissions (
+    id   bigserial PRIMARY KEY,
+    name text NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_permissions_name ON permissions (name);
+
+CREATE TABLE IF NOT EXISTS roles (
+    id          bigserial PRIMARY KEY,
+    name        text NOT NULL,
+    description text,
+    created_at  timestamptz,
+    updated_at  timestamptz
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_roles_name ON roles (name);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role_id       bigint CONSTRAINT fk_role_permissions_role REFERENCES roles (id),
+    permission_id bigint CONSTRAINT fk_role_permissions_permission REFERENCES permissions (id),
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id bigint CONSTRAINT fk_user_roles_user REFERENCES users (id) ON DELETE CASCADE,
+    role_id bigint CONSTRAINT fk_user_roles_role REFERENCES roles (id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_roles_role_id ON user_roles (role_id);
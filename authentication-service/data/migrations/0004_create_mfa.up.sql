@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS user_mfa (
+    user_id        bigint PRIMARY KEY CONSTRAINT fk_user_mfa_user REFERENCES users (id) ON DELETE CASCADE,
+    secret         text NOT NULL,
+    enabled        boolean NOT NULL DEFAULT false,
+    last_used_step bigint NOT NULL DEFAULT 0,
+    created_at     timestamptz,
+    updated_at     timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id      bigserial PRIMARY KEY,
+    user_id bigint NOT NULL CONSTRAINT fk_recovery_codes_user REFERENCES users (id) ON DELETE CASCADE,
+    hash    text NOT NULL,
+    used_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_recovery_codes_hash ON recovery_codes (hash);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS oauth_signing_keys;
+DROP TABLE IF EXISTS oauth_revoked_tokens;
+DROP TABLE IF EXISTS oauth_codes;
+DROP TABLE IF EXISTS oauth_clients;
@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id            text PRIMARY KEY,
+    name          text NOT NULL,
+    secret_hash   text NOT NULL DEFAULT '',
+    redirect_uris jsonb NOT NULL DEFAULT '[]',
+    grant_types   jsonb NOT NULL DEFAULT '[]',
+    scopes        jsonb NOT NULL DEFAULT '[]',
+    created_at    timestamptz,
+    updated_at    timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS oauth_codes (
+    hash           text PRIMARY KEY,
+    client_id      text NOT NULL CONSTRAINT fk_oauth_codes_client REFERENCES oauth_clients (id) ON DELETE CASCADE,
+    user_id        bigint NOT NULL CONSTRAINT fk_oauth_codes_user REFERENCES users (id) ON DELETE CASCADE,
+    redirect_uri   text NOT NULL,
+    scope          text NOT NULL,
+    nonce          text NOT NULL DEFAULT '',
+    code_challenge text NOT NULL,
+    amr            jsonb NOT NULL DEFAULT '[]',
+    auth_time      timestamptz NOT NULL,
+    expires_at     timestamptz NOT NULL,
+    used_at        timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_oauth_codes_expires_at ON oauth_codes (expires_at);
+
+CREATE TABLE IF NOT EXISTS oauth_revoked_tokens (
+    jti        text PRIMARY KEY,
+    expires_at timestamptz NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_oauth_revoked_tokens_expires_at ON oauth_revoked_tokens (expires_at);
+
+CREATE TABLE IF NOT EXISTS oauth_signing_keys (
+    id          text PRIMARY KEY,
+    private_key text NOT NULL,
+    created_at  timestamptz NOT NULL
+);
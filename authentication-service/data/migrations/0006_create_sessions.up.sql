@@ -0,0 +1,21 @@
+-- Sessions outlive their users briefly: a deleted user's sessions are revoked, and are
+-- only purged once the access tokens issued for them have expired. So user_id has no
+-- foreign key.
+CREATE TABLE IF NOT EXISTS sessions (
+    id            text PRIMARY KEY,
+    user_id       bigint NOT NULL,
+    refresh_hash  text NOT NULL,
+    previous_hash text NOT NULL DEFAULT '',
+    device        text NOT NULL DEFAULT '',
+    ip            text NOT NULL DEFAULT '',
+    user_agent    text NOT NULL DEFAULT '',
+    amr           jsonb NOT NULL DEFAULT '[]',
+    created_at    timestamptz NOT NULL,
+    last_used_at  timestamptz NOT NULL,
+    expires_at    timestamptz NOT NULL,
+    revoked_at    timestamptz
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sessions_refresh_hash ON sessions (refresh_hash);
+CREATE INDEX IF NOT EXISTS idx_sessions_previous_hash ON sessions (previous_hash);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_revoked_at ON sessions (revoked_at);
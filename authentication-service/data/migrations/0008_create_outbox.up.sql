@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id           bigserial PRIMARY KEY,
+    exchange     text NOT NULL,
+    routing_key  text NOT NULL,
+    payload      jsonb NOT NULL,
+    attempts     integer NOT NULL DEFAULT 0,
+    last_error   text NOT NULL DEFAULT '',
+    created_at   timestamptz NOT NULL,
+    published_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox (id) WHERE published_at IS NULL;
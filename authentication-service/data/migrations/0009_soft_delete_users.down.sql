@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS erasures;
+
+-- Before soft deletes, deleted users were removed outright
+DELETE FROM users WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS uni_users_email;
+ALTER TABLE users ADD CONSTRAINT uni_users_email UNIQUE (email);
+
+DROP INDEX IF EXISTS idx_users_deleted_at;
+ALTER TABLE users DROP COLUMN IF EXISTS erased_at, DROP COLUMN IF EXISTS deleted_at;
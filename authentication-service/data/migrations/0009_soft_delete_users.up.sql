@@ -0,0 +1,19 @@
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS deleted_at timestamptz,
+    ADD COLUMN IF NOT EXISTS erased_at  timestamptz;
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+
+-- The email of a deleted user can be taken by a new one
+ALTER TABLE users DROP CONSTRAINT IF EXISTS uni_users_email;
+CREATE UNIQUE INDEX IF NOT EXISTS uni_users_email ON users (email) WHERE deleted_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS erasures (
+    id           bigserial PRIMARY KEY,
+    user_id      bigint NOT NULL,
+    requested_by text NOT NULL,
+    status       text NOT NULL,
+    steps        jsonb NOT NULL DEFAULT '[]',
+    started_at   timestamptz NOT NULL,
+    completed_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_erasures_user_id ON erasures (user_id);
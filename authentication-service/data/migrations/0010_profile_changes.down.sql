@@ -0,0 +1,4 @@
+ALTER TABLE sessions DROP COLUMN IF EXISTS authenticated_at;
+
+DELETE FROM user_tokens WHERE purpose = 'email_change';
+ALTER TABLE user_tokens DROP COLUMN IF EXISTS new_email;
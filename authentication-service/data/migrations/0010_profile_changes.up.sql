@@ -0,0 +1,8 @@
+-- The address an email change token confirms. Other tokens leave it empty.
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS new_email text NOT NULL DEFAULT '';
+
+-- When the user last proved who they are in a session, at login or on re-authenticating.
+-- Sensitive changes need a recent one.
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS authenticated_at timestamptz;
+UPDATE sessions SET authenticated_at = created_at WHERE authenticated_at IS NULL;
+ALTER TABLE sessions ALTER COLUMN authenticated_at SET NOT NULL;
@@ -0,0 +1,12 @@
+-- When a user verified their email address. Only users that never did can verify, so an
+-- old verification link can't reactivate a deactivated user.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verified_at timestamptz;
+
+-- Users that are active, or that used a verification link, are verified
+UPDATE users SET verified_at = created_at
+WHERE verified_at IS NULL
+  AND (active OR EXISTS (
+      SELECT 1 FROM user_tokens
+      WHERE user_tokens.user_id = users.id
+        AND user_tokens.purpose = 'email_verification'
+        AND user_tokens.used_at IS NOT NULL));
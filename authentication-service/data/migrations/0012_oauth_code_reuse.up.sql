@@ -0,0 +1,5 @@
+-- Whether the authorization request named the redirect URI, which the token request must
+-- then repeat
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS redirect_uri_given boolean NOT NULL DEFAULT false;
+-- The access token issued for the code, revoked if the code is used again
+ALTER TABLE oauth_codes ADD COLUMN IF NOT EXISTS token_id text NOT NULL DEFAULT '';
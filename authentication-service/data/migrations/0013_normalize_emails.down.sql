@@ -0,0 +1,2 @@
+-- The original case of the emails isn't kept, so there is nothing to revert
+SELECT 1;
@@ -0,0 +1,5 @@
+-- Logins look users up by their trimmed, lower-cased email, the way emails are stored now.
+-- Users stored before that are normalized too; two of them differing only in case have to
+-- be merged by hand first.
+UPDATE users SET email = lower(trim(email))
+WHERE email <> lower(trim(email));
@@ -1,25 +1,35 @@
 package data
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"log"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
-//const dbTimeout = time.Second * 3
+// dbTimeout bounds every query, on top of the deadline of the request it runs for
+const dbTimeout = time.Second * 3
 
-var db *gorm.DB
+// ImportBatchSize is how many users UserRepository.Import creates in one transaction, and
+// how many Each loads at once
+const ImportBatchSize = 500
 
 // New is the function used to create an instance of the data package. It returns the type
-// Model, which embeds all the types we want to be available to our application.
-func New(dbPool *gorm.DB) Models {
-	db = dbPool
-
+// Model, which embeds all the types we want to be available to our application, backed by
+// the given Postgres connection.
+func New(conn *gorm.DB) Models {
 	return Models{
-		User: User{},
+		User:    NewPostgresUserRepository(conn),
+		Token:   &TokenStore{db: conn},
+		Role:    &RoleStore{db: conn},
+		MFA:     &MFAStore{db: conn},
+		OAuth:   NewPostgresOAuthRepository(conn),
+		Session: NewPostgresSessionRepository(conn),
+		APIKey:  NewPostgresAPIKeyRepository(conn),
+		Outbox:  NewPostgresOutboxRepository(conn),
+		Erasure: NewPostgresErasureRepository(conn),
 	}
 }
 
@@ -27,7 +37,15 @@ func New(dbPool *gorm.DB) Models {
 // in this type is available to us throughout the application, anywhere that the
 // app variable is used, provided that the model is also added in the New function.
 type Models struct {
-	User User
+	User    UserRepository
+	Token   *TokenStore
+	Role    *RoleStore
+	MFA     *MFAStore
+	OAuth   OAuthRepository
+	Session SessionRepository
+	APIKey  APIKeyRepository
+	Outbox  OutboxRepository
+	Erasure ErasureRepository
 }
 
 // User is the structure which holds one user from the database.
@@ -40,87 +58,126 @@ type User struct {
 	Active    bool      `json:"active"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// VerifiedAt is when the user verified their email address, or when they were created
+	// if they were created active. Only users that were never verified can verify.
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	// DeletedAt is set when the user is deleted. Deleted users are left out of every lookup
+	// but GetWithDeleted, and can be restored until they are erased.
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deleted_at,omitempty"`
+	// ErasedAt is set when the personal data of the user was erased
+	ErasedAt *time.Time `json:"erased_at,omitempty"`
 }
 
-// GetAll returns a slice of all users, sorted by last name
-func (u *User) GetAll() ([]*User, error) {
-	var users []*User
-	if err := db.Order("last_name").Find(&users).Error; err != nil {
-		log.Println("Error querying users:", err)
-		return nil, err
+// verifiedIfActive marks user as verified when they are created active, since they won't
+// verify their email address
+func verifiedIfActive(user *User, now time.Time) {
+	if user.Active && user.VerifiedAt == nil {
+		user.VerifiedAt = &now
 	}
-	return users, nil
 }
 
-// GetByEmail returns one user by email
-func (u *User) GetByEmail(email string) (*User, error) {
-	var user User
-	if err := db.Where("email = ?", email).First(&user).Error; err != nil {
-		return nil, err
-	}
-	return &user, nil
-}
-
-// GetOne returns one user by id
-func (u *User) GetOne(id int) (*User, error) {
-	var user User
-	if err := db.First(&user, id).Error; err != nil {
-		return nil, err
-	}
-	return &user, nil
+// erasedEmail is the placeholder for the email of erased user id, which keeps the email
+// unique without telling anything about the user
+func erasedEmail(id int) string {
+	return fmt.Sprintf("erased-%d@erased.invalid", id)
 }
 
-// Update updates one user in the database, using the information stored in the receiver u
-func (u *User) Update() error {
-	if err := db.Save(u).Error; err != nil {
-		return err
-	}
-	return nil
+// UserRepository stores users. Lookups of users that don't exist fail with
+// gorm.ErrRecordNotFound, and saving a user with an email that is taken fails with
+// gorm.ErrDuplicatedKey, whatever the implementation. Deleted users are only found by
+// GetWithDeleted, and their emails are free for other users. Changes to a user's lifecycle
+// add a user event to the outbox along with them.
+type UserRepository interface {
+	// GetAll returns a slice of all users, sorted by last name
+	GetAll(ctx context.Context) ([]*User, error)
+	// GetPage returns one page of users, sorted by last name, along with the total number
+	// of matching users. When search is not empty, only users whose email, first name or
+	// last name contain it (case-insensitively) are returned. Pages are numbered from 1.
+	GetPage(ctx context.Context, search string, page, pageSize int) ([]*User, int64, error)
+	// GetByEmail returns one user by email
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	// GetOne returns one user by id
+	GetOne(ctx context.Context, id int) (*User, error)
+	// GetWithDeleted returns one user by id, even if it was deleted
+	GetWithDeleted(ctx context.Context, id int) (*User, error)
+	// Insert inserts a new user, hashing its plain text password, and returns its ID
+	Insert(ctx context.Context, user User) (int, error)
+	// Update saves every field of user except the password
+	Update(ctx context.Context, user *User) error
+	// Verify activates user after they verified their email address, unless they were
+	// verified before. Deactivated users stay inactive.
+	Verify(ctx context.Context, user *User) error
+	// ChangeEmail changes the email of user to email, which they confirmed. It fails with
+	// gorm.ErrDuplicatedKey if another user has the email.
+	ChangeEmail(ctx context.Context, user *User, email string) error
+	// Delete deletes user, by User.ID. The user is kept, with DeletedAt set, so that it can
+	// be restored.
+	Delete(ctx context.Context, user *User) error
+	// Restore undoes the deletion of user, unless it was erased. It does nothing if user is
+	// not deleted, and fails with gorm.ErrDuplicatedKey if its email was taken since.
+	Restore(ctx context.Context, user *User) error
+	// Erase replaces the email, names and password of user with placeholders and deletes
+	// it, for good. The UserErased event still carries the email the user had, so that
+	// other services can find their copies of the user's data. It does nothing if user was
+	// erased already.
+	Erase(ctx context.Context, user *User) error
+	// ResetPassword changes the password of user
+	ResetPassword(ctx context.Context, user *User, password string) error
+	// Import creates users whose Password already holds a hash, in transactions of up to
+	// ImportBatchSize users, and sets their IDs. Users whose email is taken, by a stored
+	// user or by one earlier in users, are not created; the returned map holds
+	// gorm.ErrDuplicatedKey for them, by index. With dryRun nothing is stored, and the
+	// emails are only checked. If a batch fails, none of its users are created and the
+	// error is returned; the batches before it stay created.
+	Import(ctx context.Context, users []User, dryRun bool) (map[int]error, error)
+	// Each calls fn with every user, ordered by id, loading them a batch at a time
+	Each(ctx context.Context, fn func(*User) error) error
+	// PasswordMatches compares a user supplied password with the hash stored for user. When
+	// the password matches a hash made with an older algorithm or weaker parameters than
+	// the configured ones, the stored hash is replaced with a new one.
+	PasswordMatches(ctx context.Context, user *User, plainText string) (bool, error)
 }
 
-// Delete deletes one user from the database, by User.ID
-func (u *User) Delete() error {
-	if err := db.Delete(u).Error; err != nil {
-		return err
+// passwordMatches checks plainText against user's hash, and calls rehash with a new hash
+// when the old one is outdated. rehash should only replace the hash that was checked, so
+// that a password changed in the meantime is kept, and report whether it did.
+func passwordMatches(user *User, plainText string, rehash func(hash string) (bool, error)) (bool, error) {
+	match, outdated, err := checkPassword(user.Password, plainText)
+	if err != nil || !match {
+		return false, err
 	}
-	return nil
-}
 
-// Insert inserts a new user into the database, and returns the ID of the newly inserted row
-func (u *User) Insert(user User) (int, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
-	if err != nil {
-		return 0, err
-	}
-	user.Password = string(hashedPassword)
-	if err := db.Create(&user).Error; err != nil {
-		return 0, err
+	if outdated {
+		hash, err := HashPassword(plainText)
+		if err == nil {
+			var replaced bool
+			if replaced, err = rehash(hash); replaced {
+				user.Password = hash
+			}
+		}
+		if err != nil {
+			// The old hash still works, so try again on the next login
+			log.Println("Error upgrading password hash:", err)
+		}
 	}
-	return user.ID, nil
+	return true, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
-func (u *User) ResetPassword(password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
-	if err != nil {
-		return err
-	}
-	if err := db.Model(u).Update("password", string(hashedPassword)).Error; err != nil {
-		return err
+// activeChange returns the event reporting that user was activated or deactivated, if
+// that changed from wasActive
+func activeChange(wasActive bool, user *User) []*OutboxMessage {
+	switch {
+	case user.Active && !wasActive:
+		return []*OutboxMessage{userEvent(UserActivated, user)}
+	case !user.Active && wasActive:
+		return []*OutboxMessage{userEvent(UserDeactivated, user)}
 	}
 	return nil
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
-func (u *User) PasswordMatches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plainText))
-	if err != nil {
-		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-			return false, nil
-		}
-		return false, err
-	}
-	return true, nil
+// withTimeout returns conn bound to ctx, limited to dbTimeout. The returned cancel func
+// must be called once the query is done.
+func withTimeout(ctx context.Context, conn *gorm.DB) (*gorm.DB, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	return conn.WithContext(ctx), cancel
 }
@@ -0,0 +1,330 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Grant types an OAuth client can be allowed to use
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+)
+
+// OAuthClient is an application registered to sign users in through this service, or to
+// get tokens for itself. Public clients, such as single page apps, can't keep a secret and
+// have none.
+type OAuthClient struct {
+	ID           string    `gorm:"primaryKey" json:"client_id"`
+	Name         string    `json:"name"`
+	SecretHash   string    `json:"-"`
+	RedirectURIs []string  `gorm:"serializer:json" json:"redirect_uris"`
+	GrantTypes   []string  `gorm:"serializer:json" json:"grant_types"`
+	Scopes       []string  `gorm:"serializer:json" json:"scopes"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+func (OAuthClient) TableName() string {
+	return "oauth_clients"
+}
+
+// NewOAuthClient returns a client with a new random ID. Unless it is public, it is given a
+// secret too, which is returned in plain text and must be handed to whoever registered it.
+func NewOAuthClient(public bool) (*OAuthClient, string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	client := &OAuthClient{ID: base64.RawURLEncoding.EncodeToString(b)}
+	if public {
+		return client, "", nil
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+	client.SecretHash = hashToken(secret)
+	return client, secret, nil
+}
+
+// Public reports whether the client has no secret
+func (c *OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// SecretMatches reports whether secret is the client's secret. It is always false for
+// public clients.
+func (c *OAuthClient) SecretMatches(secret string) bool {
+	if c.Public() {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.SecretHash)) == 1
+}
+
+// ErrAuthorizationCodeReused is returned by ConsumeCode for a code that was already used
+var ErrAuthorizationCodeReused = errors.New("authorization code was already used")
+
+// OAuthCode is an authorization code, handed to a client through the user's browser and
+// exchanged for tokens. Only a hash of the code is stored.
+type OAuthCode struct {
+	Hash        string `gorm:"primaryKey"`
+	ClientID    string
+	UserID      int
+	RedirectURI string
+	// RedirectURIGiven is whether the authorization request named RedirectURI, which the
+	// token request must then repeat
+	RedirectURIGiven bool
+	Scope            string
+	Nonce            string
+	// CodeChallenge is the PKCE S256 challenge the client sent along with the request
+	CodeChallenge string
+	// AMR and AuthTime describe the login the user authorized the client with
+	AMR       []string `gorm:"serializer:json"`
+	AuthTime  time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	// TokenID is the ID of the access token issued for the code, which is revoked if the
+	// code is used again
+	TokenID string
+}
+
+func (OAuthCode) TableName() string {
+	return "oauth_codes"
+}
+
+// RevokedToken records the ID of a revoked access token until the token would have
+// expired anyway
+type RevokedToken struct {
+	JTI       string `gorm:"primaryKey;column:jti"`
+	ExpiresAt time.Time
+}
+
+func (RevokedToken) TableName() string {
+	return "oauth_revoked_tokens"
+}
+
+// SigningKey is a key that ID and access tokens for OAuth clients are signed with. The
+// private key is stored encrypted.
+type SigningKey struct {
+	ID         string `gorm:"primaryKey"`
+	PrivateKey string
+	CreatedAt  time.Time
+}
+
+func (SigningKey) TableName() string {
+	return "oauth_signing_keys"
+}
+
+// OAuthRepository stores what the OAuth2 and OpenID Connect endpoints need: the registered
+// clients, authorization codes, revoked tokens and signing keys. Lookups of clients that
+// don't exist fail with gorm.ErrRecordNotFound, whatever the implementation.
+type OAuthRepository interface {
+	// GetClients returns every client, sorted by name
+	GetClients(ctx context.Context) ([]*OAuthClient, error)
+	// GetClient returns one client by ID
+	GetClient(ctx context.Context, id string) (*OAuthClient, error)
+	// InsertClient registers a new client
+	InsertClient(ctx context.Context, client *OAuthClient) error
+	// UpdateClient saves every field of client except its secret
+	UpdateClient(ctx context.Context, client *OAuthClient) error
+	// DeleteClient removes a client, along with its outstanding codes
+	DeleteClient(ctx context.Context, id string) error
+
+	// IssueCode stores code, expiring after ttl, and returns its plain text, which is
+	// never stored
+	IssueCode(ctx context.Context, code OAuthCode, ttl time.Duration) (string, error)
+	// FindCode returns the code matching plainText, used or not, without consuming it, so
+	// that the request redeeming it can be checked first. It fails with ErrInvalidToken if
+	// there is no such code.
+	FindCode(ctx context.Context, plainText string) (*OAuthCode, error)
+	// ConsumeCode marks the code matching plainText as used by the access token with ID
+	// tokenID and returns it. A code is consumed at most once: a used code is returned
+	// with ErrAuthorizationCodeReused, so that its token can be revoked, and a code that
+	// doesn't exist or has expired fails with ErrInvalidToken.
+	ConsumeCode(ctx context.Context, plainText, tokenID string) (*OAuthCode, error)
+
+	// RevokeToken records that the access token with ID jti, which expires at expiresAt,
+	// is revoked
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	// TokenRevoked reports whether the access token with ID jti was revoked
+	TokenRevoked(ctx context.Context, jti string) (bool, error)
+
+	// SigningKeys returns the signing keys created after since, newest first
+	SigningKeys(ctx context.Context, since time.Time) ([]SigningKey, error)
+	// InsertSigningKey stores a new signing key
+	InsertSigningKey(ctx context.Context, key *SigningKey) error
+
+	// PurgeExpired deletes the codes and revoked token records that expired before now,
+	// and the signing keys created before keysBefore
+	PurgeExpired(ctx context.Context, now, keysBefore time.Time) error
+}
+
+// postgresOAuth is the OAuthRepository backed by the oauth_* tables
+type postgresOAuth struct {
+	db *gorm.DB
+}
+
+// NewPostgresOAuthRepository returns an OAuthRepository that stores its data in Postgres
+func NewPostgresOAuthRepository(conn *gorm.DB) OAuthRepository {
+	return &postgresOAuth{db: conn}
+}
+
+func (r *postgresOAuth) GetClients(ctx context.Context) ([]*OAuthClient, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var clients []*OAuthClient
+	if err := db.Order("name").Order("id").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (r *postgresOAuth) GetClient(ctx context.Context, id string) (*OAuthClient, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var client OAuthClient
+	if err := db.Where("id = ?", id).First(&client).Error; err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (r *postgresOAuth) InsertClient(ctx context.Context, client *OAuthClient) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	return db.Create(client).Error
+}
+
+func (r *postgresOAuth) UpdateClient(ctx context.Context, client *OAuthClient) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	return db.Model(client).Select("*").Omit("id", "secret_hash", "created_at").Updates(client).Error
+}
+
+func (r *postgresOAuth) DeleteClient(ctx context.Context, id string) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	result := db.Where("id = ?", id).Delete(&OAuthClient{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+func (r *postgresOAuth) IssueCode(ctx context.Context, code OAuthCode, ttl time.Duration) (string, error) {
+	plainText, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	code.Hash = hashToken(plainText)
+	code.ExpiresAt = time.Now().Add(ttl)
+
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	if err := db.Create(&code).Error; err != nil {
+		return "", err
+	}
+	return plainText, nil
+}
+
+func (r *postgresOAuth) FindCode(ctx context.Context, plainText string) (*OAuthCode, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var code OAuthCode
+	err := db.Where("hash = ?", hashToken(plainText)).First(&code).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
+
+func (r *postgresOAuth) ConsumeCode(ctx context.Context, plainText, tokenID string) (*OAuthCode, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var code OAuthCode
+	now := time.Now()
+	hash := hashToken(plainText)
+	result := db.Model(&code).
+		Clauses(clause.Returning{}).
+		Where("hash = ? AND used_at IS NULL AND expires_at > ?", hash, now).
+		Updates(map[string]any{"used_at": now, "token_id": tokenID})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return &code, nil
+	}
+
+	var used OAuthCode
+	err := db.Where("hash = ? AND used_at IS NOT NULL", hash).First(&used).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	return &used, ErrAuthorizationCodeReused
+}
+
+func (r *postgresOAuth) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	return db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&RevokedToken{JTI: jti, ExpiresAt: expiresAt}).Error
+}
+
+func (r *postgresOAuth) TokenRevoked(ctx context.Context, jti string) (bool, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var count int64
+	err := db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+	return count > 0, err
+}
+
+func (r *postgresOAuth) SigningKeys(ctx context.Context, since time.Time) ([]SigningKey, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var keys []SigningKey
+	if err := db.Where("created_at > ?", since).Order("created_at DESC").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (r *postgresOAuth) InsertSigningKey(ctx context.Context, key *SigningKey) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	return db.Create(key).Error
+}
+
+func (r *postgresOAuth) PurgeExpired(ctx context.Context, now, keysBefore time.Time) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("expires_at < ?", now).Delete(&OAuthCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("expires_at < ?", now).Delete(&RevokedToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("created_at < ?", keysBefore).Delete(&SigningKey{}).Error
+	})
+}
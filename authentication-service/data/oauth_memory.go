@@ -0,0 +1,251 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MemoryOAuthRepository is an OAuthRepository that keeps everything in memory, for tests
+// and for running handlers without Postgres
+type MemoryOAuthRepository struct {
+	mu      sync.Mutex
+	clients map[string]OAuthClient
+	codes   map[string]OAuthCode
+	revoked map[string]time.Time
+	keys    []SigningKey
+}
+
+// NewMemoryOAuthRepository returns an empty MemoryOAuthRepository
+func NewMemoryOAuthRepository() *MemoryOAuthRepository {
+	return &MemoryOAuthRepository{
+		clients: map[string]OAuthClient{},
+		codes:   map[string]OAuthCode{},
+		revoked: map[string]time.Time{},
+	}
+}
+
+func (r *MemoryOAuthRepository) GetClients(ctx context.Context) ([]*OAuthClient, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients := make([]*OAuthClient, 0, len(r.clients))
+	for _, client := range r.clients {
+		c := client
+		clients = append(clients, &c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Name != clients[j].Name {
+			return clients[i].Name < clients[j].Name
+		}
+		return clients[i].ID < clients[j].ID
+	})
+	return clients, nil
+}
+
+func (r *MemoryOAuthRepository) GetClient(ctx context.Context, id string) (*OAuthClient, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, ok := r.clients[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &client, nil
+}
+
+func (r *MemoryOAuthRepository) InsertClient(ctx context.Context, client *OAuthClient) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[client.ID]; ok {
+		return gorm.ErrDuplicatedKey
+	}
+	client.CreatedAt, client.UpdatedAt = time.Now(), time.Now()
+	r.clients[client.ID] = *client
+	return nil
+}
+
+func (r *MemoryOAuthRepository) UpdateClient(ctx context.Context, client *OAuthClient) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.clients[client.ID]
+	if !ok {
+		return nil
+	}
+	secretHash, createdAt := stored.SecretHash, stored.CreatedAt
+	stored = *client
+	stored.SecretHash, stored.CreatedAt, stored.UpdatedAt = secretHash, createdAt, time.Now()
+	r.clients[client.ID] = stored
+	return nil
+}
+
+func (r *MemoryOAuthRepository) DeleteClient(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.clients[id]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	delete(r.clients, id)
+	for hash, code := range r.codes {
+		if code.ClientID == id {
+			delete(r.codes, hash)
+		}
+	}
+	return nil
+}
+
+func (r *MemoryOAuthRepository) IssueCode(ctx context.Context, code OAuthCode, ttl time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	plainText, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	code.Hash = hashToken(plainText)
+	code.ExpiresAt = time.Now().Add(ttl)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codes[code.Hash] = code
+	return plainText, nil
+}
+
+func (r *MemoryOAuthRepository) FindCode(ctx context.Context, plainText string) (*OAuthCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	code, ok := r.codes[hashToken(plainText)]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return &code, nil
+}
+
+func (r *MemoryOAuthRepository) ConsumeCode(ctx context.Context, plainText, tokenID string) (*OAuthCode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	code, ok := r.codes[hashToken(plainText)]
+	if ok && code.UsedAt != nil {
+		return &code, ErrAuthorizationCodeReused
+	}
+	if !ok || !code.ExpiresAt.After(now) {
+		return nil, ErrInvalidToken
+	}
+	code.UsedAt, code.TokenID = &now, tokenID
+	r.codes[code.Hash] = code
+	return &code, nil
+}
+
+func (r *MemoryOAuthRepository) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.revoked[jti]; !ok {
+		r.revoked[jti] = expiresAt
+	}
+	return nil
+}
+
+func (r *MemoryOAuthRepository) TokenRevoked(ctx context.Context, jti string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.revoked[jti]
+	return ok, nil
+}
+
+func (r *MemoryOAuthRepository) SigningKeys(ctx context.Context, since time.Time) ([]SigningKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var keys []SigningKey
+	for _, key := range r.keys {
+		if key.CreatedAt.After(since) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (r *MemoryOAuthRepository) InsertSigningKey(ctx context.Context, key *SigningKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, k := range r.keys {
+		if k.ID == key.ID {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+	r.keys = append(r.keys, *key)
+	return nil
+}
+
+func (r *MemoryOAuthRepository) PurgeExpired(ctx context.Context, now, keysBefore time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for hash, code := range r.codes {
+		if code.ExpiresAt.Before(now) {
+			delete(r.codes, hash)
+		}
+	}
+	for jti, expiresAt := range r.revoked {
+		if expiresAt.Before(now) {
+			delete(r.revoked, jti)
+		}
+	}
+	keys := r.keys[:0]
+	for _, key := range r.keys {
+		if !key.CreatedAt.Before(keysBefore) {
+			keys = append(keys, key)
+		}
+	}
+	r.keys = keys
+	return nil
+}
@@ -0,0 +1,187 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UsersExchange is the RabbitMQ topic exchange that user lifecycle events are published to
+const UsersExchange = "users_topic"
+
+// Routing keys of the user lifecycle events
+const (
+	UserCreated         = "user.created"
+	UserVerified        = "user.verified"
+	UserActivated       = "user.activated"
+	UserDeactivated     = "user.deactivated"
+	UserPasswordChanged = "user.password_changed"
+	UserEmailChanged    = "user.email_changed"
+	UserDeleted         = "user.deleted"
+	UserRestored        = "user.restored"
+	UserErased          = "user.erased"
+)
+
+// OutboxMessage is an event waiting to be published to RabbitMQ. It is written in the
+// same transaction as the change it reports, so that the event is published if, and only
+// if, the change was made, even when RabbitMQ is down at the time.
+type OutboxMessage struct {
+	ID         int             `gorm:"primaryKey" json:"id"`
+	Exchange   string          `json:"exchange"`
+	RoutingKey string          `json:"routing_key"`
+	Payload    json.RawMessage `gorm:"type:jsonb" json:"payload"`
+	// Attempts counts the failed attempts to publish the message, the last of which
+	// failed with LastError
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+}
+
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
+
+// UserEvent is the payload of a user lifecycle event
+type UserEvent struct {
+	Event  string `json:"event"`
+	UserID int    `json:"user_id"`
+	Email  string `json:"email"`
+	// PreviousEmail is the address the user had before a UserEmailChanged event
+	PreviousEmail string    `json:"previous_email,omitempty"`
+	OccurredAt    time.Time `json:"occurred_at"`
+}
+
+// userEvent returns the outbox message that reports event about user
+func userEvent(event string, user *User) *OutboxMessage {
+	payload, _ := json.Marshal(UserEvent{Event: event, UserID: user.ID, Email: user.Email, OccurredAt: time.Now().UTC()})
+	return &OutboxMessage{Exchange: UsersExchange, RoutingKey: event, Payload: payload}
+}
+
+// emailChangedEvent returns the outbox message that reports the change of the email of
+// user from previous
+func emailChangedEvent(user *User, previous string) *OutboxMessage {
+	payload, _ := json.Marshal(UserEvent{
+		Event:         UserEmailChanged,
+		UserID:        user.ID,
+		Email:         user.Email,
+		PreviousEmail: previous,
+		OccurredAt:    time.Now().UTC(),
+	})
+	return &OutboxMessage{Exchange: UsersExchange, RoutingKey: UserEmailChanged, Payload: payload}
+}
+
+// OutboxRepository holds the messages waiting to be published. Messages are added by the
+// other repositories, together with the changes they report. Lookups of messages that
+// don't exist fail with gorm.ErrRecordNotFound, whatever the implementation.
+type OutboxRepository interface {
+	// Relay calls publish with up to limit pending messages, oldest first, and marks those
+	// it succeeds for as published. It stops at the first failure, which is recorded on the
+	// message, so that messages are published in order. It returns how many were published.
+	// Messages another instance is relaying at the same time are skipped.
+	Relay(ctx context.Context, limit int, publish func(*OutboxMessage) error) (int, error)
+	// Pending returns up to limit messages that are not published yet, oldest first
+	Pending(ctx context.Context, limit int) ([]*OutboxMessage, error)
+	// Discard deletes pending message id, for a message that can never be published
+	Discard(ctx context.Context, id int) error
+	// PurgePublished deletes the messages published before before
+	PurgePublished(ctx context.Context, before time.Time) error
+	// ScrubUser replaces the email and previous email in the user events of user userID,
+	// published or not, with the placeholder of an erased user. It returns how many
+	// messages it changed.
+	ScrubUser(ctx context.Context, userID int) (int, error)
+}
+
+// postgresOutbox is the OutboxRepository backed by the outbox table
+type postgresOutbox struct {
+	db *gorm.DB
+}
+
+// NewPostgresOutboxRepository returns an OutboxRepository that keeps messages in Postgres
+func NewPostgresOutboxRepository(conn *gorm.DB) OutboxRepository {
+	return &postgresOutbox{db: conn}
+}
+
+func (r *postgresOutbox) Relay(ctx context.Context, limit int, publish func(*OutboxMessage) error) (int, error) {
+	// Publishing waits for RabbitMQ, so only ctx bounds the transaction, not dbTimeout
+	published := 0
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var messages []*OutboxMessage
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("published_at IS NULL").Order("id").Limit(limit).Find(&messages).Error
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range messages {
+			if err := publish(msg); err != nil {
+				return tx.Model(msg).Updates(map[string]any{
+					"attempts":   gorm.Expr("attempts + 1"),
+					"last_error": err.Error(),
+				}).Error
+			}
+			if err := tx.Model(msg).Update("published_at", time.Now()).Error; err != nil {
+				return err
+			}
+			published++
+		}
+		return nil
+	})
+	return published, err
+}
+
+func (r *postgresOutbox) Pending(ctx context.Context, limit int) ([]*OutboxMessage, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var messages []*OutboxMessage
+	if err := db.Where("published_at IS NULL").Order("id").Limit(limit).Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (r *postgresOutbox) Discard(ctx context.Context, id int) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	result := db.Where("id = ? AND published_at IS NULL", id).Delete(&OutboxMessage{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *postgresOutbox) PurgePublished(ctx context.Context, before time.Time) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	return db.Where("published_at < ?", before).Delete(&OutboxMessage{}).Error
+}
+
+func (r *postgresOutbox) ScrubUser(ctx context.Context, userID int) (int, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	placeholder := erasedEmail(userID)
+	result := db.Model(&OutboxMessage{}).
+		Where("exchange = ? AND payload->>'user_id' = ?", UsersExchange, strconv.Itoa(userID)).
+		Update("payload", gorm.Expr(`payload || jsonb_build_object('email', ?::text) ||
+			CASE WHEN payload->>'previous_email' IS NULL THEN '{}'::jsonb
+			ELSE jsonb_build_object('previous_email', ?::text) END`, placeholder, placeholder))
+	return int(result.RowsAffected), result.Error
+}
+
+// enqueue adds messages to the outbox in tx, the transaction of the change they report
+func enqueue(tx *gorm.DB, messages ...*OutboxMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	return tx.Create(messages).Error
+}
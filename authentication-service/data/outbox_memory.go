@@ -0,0 +1,140 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MemoryOutboxRepository is an OutboxRepository that keeps messages in memory, for tests
+// and for running handlers without Postgres. The memory repositories add their events to
+// it.
+type MemoryOutboxRepository struct {
+	mu       sync.Mutex
+	messages []OutboxMessage
+	nextID   int
+}
+
+// NewMemoryOutboxRepository returns an empty MemoryOutboxRepository
+func NewMemoryOutboxRepository() *MemoryOutboxRepository {
+	return &MemoryOutboxRepository{nextID: 1}
+}
+
+func (r *MemoryOutboxRepository) Relay(ctx context.Context, limit int, publish func(*OutboxMessage) error) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	published := 0
+	for i := range r.messages {
+		msg := &r.messages[i]
+		if msg.PublishedAt != nil {
+			continue
+		}
+		if published == limit {
+			break
+		}
+		m := *msg
+		if err := publish(&m); err != nil {
+			msg.Attempts++
+			msg.LastError = err.Error()
+			break
+		}
+		now := time.Now()
+		msg.PublishedAt = &now
+		published++
+	}
+	return published, nil
+}
+
+func (r *MemoryOutboxRepository) Pending(ctx context.Context, limit int) ([]*OutboxMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var messages []*OutboxMessage
+	for _, msg := range r.messages {
+		if msg.PublishedAt == nil && len(messages) < limit {
+			m := msg
+			messages = append(messages, &m)
+		}
+	}
+	return messages, nil
+}
+
+func (r *MemoryOutboxRepository) Discard(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, msg := range r.messages {
+		if msg.ID == id && msg.PublishedAt == nil {
+			r.messages = append(r.messages[:i], r.messages[i+1:]...)
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
+func (r *MemoryOutboxRepository) PurgePublished(ctx context.Context, before time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := r.messages[:0]
+	for _, msg := range r.messages {
+		if msg.PublishedAt == nil || !msg.PublishedAt.Before(before) {
+			kept = append(kept, msg)
+		}
+	}
+	r.messages = kept
+	return nil
+}
+
+func (r *MemoryOutboxRepository) ScrubUser(ctx context.Context, userID int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	scrubbed := 0
+	for i := range r.messages {
+		msg := &r.messages[i]
+		var payload map[string]any
+		if msg.Exchange != UsersExchange || json.Unmarshal(msg.Payload, &payload) != nil ||
+			payload["user_id"] != float64(userID) {
+			continue
+		}
+		payload["email"] = erasedEmail(userID)
+		if _, ok := payload["previous_email"]; ok {
+			payload["previous_email"] = erasedEmail(userID)
+		}
+		msg.Payload, _ = json.Marshal(payload)
+		scrubbed++
+	}
+	return scrubbed, nil
+}
+
+// add stores new messages, as enqueue does in Postgres
+func (r *MemoryOutboxRepository) add(messages ...*OutboxMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, msg := range messages {
+		msg.ID, msg.CreatedAt = r.nextID, time.Now()
+		r.nextID++
+		r.messages = append(r.messages, *msg)
+	}
+}
@@ -0,0 +1,163 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestPostgresInsertWritesOutboxInTransaction(t *testing.T) {
+	SetPasswordParams(PasswordParams{Algorithm: Bcrypt, BcryptCost: 4})
+	t.Cleanup(func() { SetPasswordParams(DefaultPasswordParams) })
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	conn, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewPostgresUserRepository(conn)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "users"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WithArgs(UsersExchange, UserCreated, sqlmock.AnyArg(), 0, "", sqlmock.AnyArg(), nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+	if id, err := repo.Insert(context.Background(), User{Email: "new@example.com", Password: "verysecret"}); err != nil || id != 7 {
+		t.Fatalf("Insert returned %d, %v", id, err)
+	}
+
+	// Without its event, the user isn't created either
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "users"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "outbox"`)).WillReturnError(errors.New("disk full"))
+	mock.ExpectRollback()
+	if _, err := repo.Insert(context.Background(), User{Email: "other@example.com", Password: "verysecret"}); err == nil {
+		t.Error("expected Insert to fail")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgresScrubUser(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	conn, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "outbox" SET "payload"=payload \|\| jsonb_build_object\('email', \$1::text\) .+ WHERE exchange = \$3 AND payload->>'user_id' = \$4`).
+		WithArgs("erased-7@erased.invalid", "erased-7@erased.invalid", UsersExchange, "7").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+	if n, err := NewPostgresOutboxRepository(conn).ScrubUser(context.Background(), 7); n != 3 || err != nil {
+		t.Fatalf("ScrubUser returned %d, %v", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryOutbox(t *testing.T) {
+	SetPasswordParams(PasswordParams{Algorithm: Bcrypt, BcryptCost: 4})
+	t.Cleanup(func() { SetPasswordParams(DefaultPasswordParams) })
+	ctx := context.Background()
+	users := NewMemoryUserRepository()
+	outbox := users.Outbox()
+
+	id, err := users.Insert(ctx, User{Email: "new@example.com", Password: "verysecret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := users.GetOne(ctx, id)
+	if err := users.Verify(ctx, user); err != nil || !user.Active {
+		t.Fatalf("Verify returned %v, active %v", err, user.Active)
+	}
+	// Verifying again, or saving without a change of status, reports nothing
+	if err := users.Verify(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	user.FirstName = "New"
+	if err := users.Update(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	user.Active = false
+	if err := users.Update(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ResetPassword(ctx, user, "evenmoresecret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Delete(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first failure stops the relay, so that the messages stay in order
+	var published []string
+	calls := 0
+	publish := func(msg *OutboxMessage) error {
+		if calls++; calls == 3 {
+			return errors.New("connection refused")
+		}
+		var event UserEvent
+		if err := json.Unmarshal(msg.Payload, &event); err != nil || event.UserID != id || event.Email != "new@example.com" {
+			t.Errorf("unexpected payload %s", msg.Payload)
+		}
+		published = append(published, msg.RoutingKey)
+		return nil
+	}
+	if n, err := outbox.Relay(ctx, 10, publish); n != 2 || err != nil {
+		t.Fatalf("Relay returned %d, %v", n, err)
+	}
+	pending, _ := outbox.Pending(ctx, 10)
+	if len(pending) != 3 || pending[0].Attempts != 1 || pending[0].LastError != "connection refused" {
+		t.Fatalf("expected the failed message to be recorded, got %+v", pending)
+	}
+
+	if n, err := outbox.Relay(ctx, 10, publish); n != 3 || err != nil {
+		t.Fatalf("Relay returned %d, %v", n, err)
+	}
+	want := []string{UserCreated, UserVerified, UserDeactivated, UserPasswordChanged, UserDeleted}
+	if len(published) != len(want) {
+		t.Fatalf("published %v, want %v", published, want)
+	}
+	for i := range want {
+		if published[i] != want[i] {
+			t.Fatalf("published %v, want %v", published, want)
+		}
+	}
+
+	if err := outbox.Discard(ctx, 1); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("expected a published message not to be discarded, got %v", err)
+	}
+	if err := outbox.PurgePublished(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := outbox.Relay(ctx, 10, publish); n != 0 || len(outbox.messages) != 0 {
+		t.Errorf("expected the outbox to be empty, got %+v", outbox.messages)
+	}
+}
@@ -0,0 +1,198 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// ErrUnknownHash is returned for a stored password hash in a format we can't check
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// PasswordParams says how new password hashes are made. Stored hashes made with another
+// algorithm or other parameters still verify, and are replaced on the next login.
+type PasswordParams struct {
+	Algorithm string
+	// BcryptCost is the bcrypt work factor
+	BcryptCost int
+	// Argon2Time is the number of passes over the memory
+	Argon2Time uint32
+	// Argon2Memory is the memory used, in KiB
+	Argon2Memory uint32
+	// Argon2Threads is the degree of parallelism
+	Argon2Threads uint8
+}
+
+// DefaultPasswordParams hashes with argon2id using the parameters recommended by RFC 9106
+// for memory-constrained environments
+var DefaultPasswordParams = PasswordParams{
+	Algorithm:     Argon2id,
+	BcryptCost:    12,
+	Argon2Time:    3,
+	Argon2Memory:  64 * 1024,
+	Argon2Threads: 4,
+}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+var (
+	passwordParams = DefaultPasswordParams
+
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// SetPasswordParams changes how new password hashes are made. It is meant to be called
+// once at startup, before any passwords are hashed or checked.
+func SetPasswordParams(p PasswordParams) error {
+	switch p.Algorithm {
+	case Argon2id:
+		if p.Argon2Time < 1 || p.Argon2Memory < 8*uint32(p.Argon2Threads) || p.Argon2Threads < 1 {
+			return fmt.Errorf("invalid argon2id parameters t=%d m=%d p=%d", p.Argon2Time, p.Argon2Memory, p.Argon2Threads)
+		}
+	case Bcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("invalid bcrypt cost %d", p.BcryptCost)
+		}
+	default:
+		return fmt.Errorf("unknown password hashing algorithm %q", p.Algorithm)
+	}
+
+	passwordParams = p
+	dummyHashOnce = sync.Once{}
+	return nil
+}
+
+// HashPassword hashes a password with the configured algorithm. Argon2id hashes are in the
+// PHC string format, $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>, and bcrypt hashes in
+// bcrypt's own $2a$ format.
+func HashPassword(plainText string) (string, error) {
+	return hashPassword(plainText, passwordParams)
+}
+
+func hashPassword(plainText string, p PasswordParams) (string, error) {
+	if p.Algorithm == Bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(plainText), p.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(plainText), salt, p.Argon2Time, p.Argon2Memory, p.Argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", Argon2id, argon2.Version,
+		p.Argon2Memory, p.Argon2Time, p.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPasswordHash returns ErrUnknownHash unless hash is an argon2id or bcrypt hash that
+// passwords can be checked against, such as one exported from another installation
+func CheckPasswordHash(hash string) error {
+	if strings.HasPrefix(hash, "$"+Argon2id+"$") {
+		_, err := parseArgon2id(hash)
+		return err
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return ErrUnknownHash
+	}
+	return nil
+}
+
+// checkPassword reports whether plainText matches hash, and whether hash should be
+// replaced because it wasn't made with the configured algorithm and parameters
+func checkPassword(hash, plainText string) (match, outdated bool, err error) {
+	if strings.HasPrefix(hash, "$"+Argon2id+"$") {
+		a, err := parseArgon2id(hash)
+		if err != nil {
+			return false, false, err
+		}
+		key := argon2.IDKey([]byte(plainText), a.salt, a.time, a.memory, a.threads, uint32(len(a.key)))
+		if subtle.ConstantTimeCompare(key, a.key) != 1 {
+			return false, false, nil
+		}
+		p := passwordParams
+		return true, p.Algorithm != Argon2id || a.time != p.Argon2Time || a.memory != p.Argon2Memory ||
+			a.threads != p.Argon2Threads || len(a.key) != argon2KeyLen, nil
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, false, ErrUnknownHash
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(plainText)); err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	return true, passwordParams.Algorithm != Bcrypt || cost != passwordParams.BcryptCost, nil
+}
+
+// argon2idHash is a parsed argon2id PHC string
+type argon2idHash struct {
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+func parseArgon2id(hash string) (*argon2idHash, error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=4", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrUnknownHash
+	}
+
+	var a argon2idHash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.memory, &a.time, &a.threads); err != nil {
+		return nil, ErrUnknownHash
+	}
+	if a.time < 1 || a.threads < 1 {
+		return nil, ErrUnknownHash
+	}
+
+	var err error
+	if a.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrUnknownHash
+	}
+	if a.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(a.key) == 0 {
+		return nil, ErrUnknownHash
+	}
+	return &a, nil
+}
+
+// SimulatePasswordCheck does the same work as PasswordMatches against a hash that matches
+// no password. Calling it when there is no user to check keeps the time taken to reject
+// an unknown email the same as for a wrong password.
+func SimulatePasswordCheck(plainText string) {
+	dummyHashOnce.Do(func() {
+		hash, err := HashPassword("dummy password")
+		if err != nil {
+			log.Panic(err)
+		}
+		dummyHash = hash
+	})
+	_, _, _ = checkPassword(dummyHash, plainText)
+}
@@ -0,0 +1,78 @@
+package data
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func setPasswordParams(t *testing.T, p PasswordParams) {
+	t.Helper()
+	if err := SetPasswordParams(p); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetPasswordParams(DefaultPasswordParams) })
+}
+
+func TestCheckPassword(t *testing.T) {
+	cheapArgon2id := PasswordParams{Algorithm: Argon2id, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 1}
+	setPasswordParams(t, cheapArgon2id)
+
+	argonHash, err := HashPassword("verysecret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(argonHash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("expected a PHC argon2id hash, got %q", argonHash)
+	}
+	bcryptHash, err := hashPassword("verysecret", PasswordParams{Algorithm: Bcrypt, BcryptCost: bcrypt.MinCost})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		hash, password  string
+		match, outdated bool
+	}{
+		{"current argon2id", argonHash, "verysecret", true, false},
+		{"wrong password", argonHash, "wrong", false, false},
+		{"bcrypt", bcryptHash, "verysecret", true, true},
+		{"wrong bcrypt password", bcryptHash, "wrong", false, false},
+	}
+	for _, tt := range tests {
+		match, outdated, err := checkPassword(tt.hash, tt.password)
+		if err != nil || match != tt.match || outdated != tt.outdated {
+			t.Errorf("%s: got match=%v outdated=%v err=%v", tt.name, match, outdated, err)
+		}
+	}
+
+	// Stronger parameters make the existing argon2id hash outdated too
+	stronger := cheapArgon2id
+	stronger.Argon2Time = 2
+	setPasswordParams(t, stronger)
+	if match, outdated, _ := checkPassword(argonHash, "verysecret"); !match || !outdated {
+		t.Errorf("expected the hash to be outdated, got match=%v outdated=%v", match, outdated)
+	}
+
+	if _, _, err := checkPassword("plaintext", "plaintext"); err != ErrUnknownHash {
+		t.Errorf("expected ErrUnknownHash, got %v", err)
+	}
+	if _, _, err := checkPassword("$argon2id$v=19$m=64,t=1,p=1$!!$!!", "x"); err != ErrUnknownHash {
+		t.Errorf("expected ErrUnknownHash for a malformed hash, got %v", err)
+	}
+}
+
+func TestSetPasswordParamsRejectsBadValues(t *testing.T) {
+	for _, p := range []PasswordParams{
+		{Algorithm: "md5"},
+		{Algorithm: Bcrypt, BcryptCost: 3},
+		{Algorithm: Argon2id, Argon2Time: 0, Argon2Memory: 64, Argon2Threads: 1},
+		{Algorithm: Argon2id, Argon2Time: 1, Argon2Memory: 4, Argon2Threads: 1},
+	} {
+		if err := SetPasswordParams(p); err == nil {
+			t.Errorf("expected %+v to be rejected", p)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AdminRole is created with every permission when the database is migrated
+const AdminRole = "admin"
+
+var (
+	// ErrUnknownPermission is returned when a role is given a permission that doesn't exist
+	ErrUnknownPermission = errors.New("unknown permission")
+	// ErrUnknownRole is returned when a user is assigned a role that doesn't exist
+	ErrUnknownRole = errors.New("unknown role")
+)
+
+// Permission is something a role allows, such as "logs:read". The permissions that exist
+// are the ones the services check for, and are created when the database is migrated.
+type Permission struct {
+	ID   int    `gorm:"primaryKey"`
+	Name string `gorm:"uniqueIndex;not null"`
+}
+
+// MarshalJSON encodes a permission as its name
+func (p Permission) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Name)
+}
+
+// Role is a named set of permissions that can be assigned to users
+type Role struct {
+	ID          int          `gorm:"primaryKey" json:"id"`
+	Name        string       `gorm:"uniqueIndex;not null" json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `gorm:"many2many:role_permissions" json:"permissions"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// UserRole assigns a role to a user
+type UserRole struct {
+	UserID int   `gorm:"primaryKey"`
+	RoleID int   `gorm:"primaryKey;index"`
+	User   *User `gorm:"constraint:OnDelete:CASCADE"`
+	Role   *Role `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// RoleStore stores roles, their permissions and the roles assigned to users
+type RoleStore struct {
+	db *gorm.DB
+}
+
+// GetAll returns every role with its permissions, sorted by name
+func (s *RoleStore) GetAll(ctx context.Context) ([]*Role, error) {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	var roles []*Role
+	if err := db.Preload("Permissions").Order("name").Find(&roles).Error; err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// GetByName returns one role with its permissions
+func (s *RoleStore) GetByName(ctx context.Context, name string) (*Role, error) {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	var role Role
+	if err := db.Preload("Permissions").Where("name = ?", name).First(&role).Error; err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// Insert creates role with the named permissions and returns its ID
+func (s *RoleStore) Insert(ctx context.Context, role Role, permissions []string) (int, error) {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		perms, err := findPermissions(tx, permissions)
+		if err != nil {
+			return err
+		}
+		role.Permissions = perms
+		return tx.Create(&role).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return role.ID, nil
+}
+
+// Update saves the description of r and replaces its permissions with the named ones
+func (s *RoleStore) Update(ctx context.Context, r *Role, permissions []string) error {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		perms, err := findPermissions(tx, permissions)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(r).Update("description", r.Description).Error; err != nil {
+			return err
+		}
+		return tx.Model(r).Association("Permissions").Replace(perms)
+	})
+}
+
+// Delete deletes r and takes it away from every user that had it
+func (s *RoleStore) Delete(ctx context.Context, r *Role) error {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("role_id = ?", r.ID).Delete(&UserRole{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(r).Association("Permissions").Clear(); err != nil {
+			return err
+		}
+		return tx.Delete(r).Error
+	})
+}
+
+// findPermissions loads the named permissions, failing with ErrUnknownPermission if any
+// of them doesn't exist
+func findPermissions(tx *gorm.DB, names []string) ([]Permission, error) {
+	perms := []Permission{}
+	if len(names) == 0 {
+		return perms, nil
+	}
+	if err := tx.Where("name IN ?", names).Find(&perms).Error; err != nil {
+		return nil, err
+	}
+	if len(perms) != len(unique(names)) {
+		return nil, ErrUnknownPermission
+	}
+	return perms, nil
+}
+
+// ForUser returns the roles assigned to userID, sorted by name
+func (s *RoleStore) ForUser(ctx context.Context, userID int) ([]*Role, error) {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	var roles []*Role
+	err := db.Preload("Permissions").
+		Joins("JOIN user_roles ON user_roles.role_id = roles.id").
+		Where("user_roles.user_id = ?", userID).
+		Order("roles.name").
+		Find(&roles).Error
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// SetForUser replaces the roles assigned to userID with the named ones
+func (s *RoleStore) SetForUser(ctx context.Context, userID int, names []string) error {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var roles []Role
+		if len(names) > 0 {
+			if err := tx.Where("name IN ?", names).Find(&roles).Error; err != nil {
+				return err
+			}
+			if len(roles) != len(unique(names)) {
+				return ErrUnknownRole
+			}
+		}
+
+		if err := tx.Where("user_id = ?", userID).Delete(&UserRole{}).Error; err != nil {
+			return err
+		}
+		if len(roles) == 0 {
+			return nil
+		}
+		assignments := make([]UserRole, len(roles))
+		for i, role := range roles {
+			assignments[i] = UserRole{UserID: userID, RoleID: role.ID}
+		}
+		return tx.Create(&assignments).Error
+	})
+}
+
+// Grants returns the names of the roles of userID and of every permission those roles
+// give, each sorted and without duplicates. They go in the user's access tokens.
+func (s *RoleStore) Grants(ctx context.Context, userID int) (roles []string, permissions []string, err error) {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	var rows []struct {
+		Role       string
+		Permission *string
+	}
+	err = db.Table("user_roles").
+		Select("roles.name AS role, permissions.name AS permission").
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Joins("LEFT JOIN role_permissions ON role_permissions.role_id = roles.id").
+		Joins("LEFT JOIN permissions ON permissions.id = role_permissions.permission_id").
+		Where("user_roles.user_id = ?", userID).
+		Order("roles.name, permissions.name").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, row := range rows {
+		roles = append(roles, row.Role)
+		if row.Permission != nil {
+			permissions = append(permissions, *row.Permission)
+		}
+	}
+	return unique(roles), unique(permissions), nil
+}
+
+// unique returns names without duplicates, sorted
+func unique(names []string) []string {
+	sorted := slices.Clone(names)
+	slices.Sort(sorted)
+	return slices.Compact(sorted)
+}
@@ -0,0 +1,81 @@
+package data
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SeedPermissions makes sure the given permissions and the admin role, which has all of
+// them, exist. It runs on every start, so permissions added to the code show up in the
+// database.
+func SeedPermissions(conn *gorm.DB, permissions []string) error {
+	return conn.Transaction(func(tx *gorm.DB) error {
+		return seedPermissions(tx, permissions)
+	})
+}
+
+// seedPermissions creates the given permissions and the admin role, which has all of them,
+// unless they already exist
+func seedPermissions(tx *gorm.DB, names []string) error {
+	permissions := make([]Permission, len(names))
+	for i, name := range names {
+		if err := tx.Where(Permission{Name: name}).FirstOrCreate(&permissions[i]).Error; err != nil {
+			return err
+		}
+	}
+
+	admin := Role{Name: AdminRole, Description: "Can do everything"}
+	if err := tx.Where(Role{Name: AdminRole}).Attrs(admin).FirstOrCreate(&admin).Error; err != nil {
+		return err
+	}
+	return tx.Model(&admin).Association("Permissions").Append(permissions)
+}
+
+// SeedAdmin makes sure user exists, is active and has the admin role. A new user is
+// created with user.Password; an existing user keeps their password. It reports whether
+// the user was created.
+func SeedAdmin(conn *gorm.DB, user User) (bool, error) {
+	created := false
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		var admin Role
+		if err := tx.Where("name = ?", AdminRole).First(&admin).Error; err != nil {
+			return err
+		}
+
+		var existing User
+		err := tx.Where("email = ?", user.Email).First(&existing).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			hash, err := HashPassword(user.Password)
+			if err != nil {
+				return err
+			}
+			user.Password = hash
+			user.Active = true
+			verifiedIfActive(&user, time.Now())
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			if err := enqueue(tx, userEvent(UserCreated, &user)); err != nil {
+				return err
+			}
+			existing, created = user, true
+		case err != nil:
+			return err
+		case !existing.Active:
+			if err := tx.Model(&existing).Update("active", true).Error; err != nil {
+				return err
+			}
+			if err := enqueue(tx, userEvent(UserActivated, &existing)); err != nil {
+				return err
+			}
+		}
+
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&UserRole{UserID: existing.ID, RoleID: admin.ID}).Error
+	})
+	return created, err
+}
@@ -0,0 +1,250 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrRefreshTokenReused is returned when a refresh token that was already exchanged is
+// presented again. Only the client and whoever stole the token could have it, and it is
+// impossible to tell which one is asking, so the session is revoked.
+var ErrRefreshTokenReused = errors.New("refresh token was already used")
+
+// Session is a login on one device. It holds a refresh token, which is exchanged for new
+// access tokens and replaced each time, until the session expires or is revoked. Only
+// hashes of the current and the previous refresh token are stored.
+type Session struct {
+	ID           string   `gorm:"primaryKey" json:"id"`
+	UserID       int      `json:"user_id"`
+	RefreshHash  string   `json:"-"`
+	PreviousHash string   `json:"-"`
+	Device       string   `json:"device"`
+	IP           string   `json:"ip"`
+	UserAgent    string   `json:"user_agent"`
+	AMR          []string `gorm:"serializer:json" json:"amr"`
+	// AuthenticatedAt is when the user last proved who they are in the session, at login
+	// or when they re-authenticated since
+	AuthenticatedAt time.Time  `json:"authenticated_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastUsedAt      time.Time  `json:"last_used_at"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	RevokedAt       *time.Time `json:"revoked_at,omitempty"`
+}
+
+// SessionRepository stores login sessions. Lookups of sessions that don't exist, have
+// expired or were revoked fail with gorm.ErrRecordNotFound, whatever the implementation.
+type SessionRepository interface {
+	// Create stores session with a new ID and refresh token, valid for ttl, and returns the
+	// plain text refresh token
+	Create(ctx context.Context, session *Session, ttl time.Duration) (string, error)
+	// Refresh replaces the refresh token plainText with a new one, which it returns with the
+	// session. The session is extended by ttl and records the ip and user agent it was used
+	// from. It returns ErrInvalidToken for unknown tokens and ErrRefreshTokenReused, after
+	// revoking the session, for a token that was replaced already.
+	Refresh(ctx context.Context, plainText, ip, userAgent string, ttl time.Duration) (*Session, string, error)
+	// GetForUser returns the active sessions of userID, most recently used first
+	GetForUser(ctx context.Context, userID int) ([]*Session, error)
+	// Revoke revokes the active session id of userID
+	Revoke(ctx context.Context, userID int, id string) error
+	// Reauthenticate records that the user of the active session id, userID, proved who
+	// they are again just now, and returns the session
+	Reauthenticate(ctx context.Context, userID int, id string) (*Session, error)
+	// RevokeAll revokes every active session of userID and returns their IDs
+	RevokeAll(ctx context.Context, userID int) ([]string, error)
+	// Anonymize clears the device, IP address and user agent recorded by every session of
+	// userID, revoked ones included, and returns how many there were
+	Anonymize(ctx context.Context, userID int) (int, error)
+	// RevokedSince returns the IDs of the sessions revoked after since
+	RevokedSince(ctx context.Context, since time.Time) ([]string, error)
+	// PurgeExpired deletes the sessions that expired or were revoked before before
+	PurgeExpired(ctx context.Context, before time.Time) error
+}
+
+// newSession fills in the ID, refresh token and times of a session that is about to be
+// stored, and returns the plain text refresh token
+func newSession(session *Session, ttl time.Duration) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	plainText, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	session.ID = base64.RawURLEncoding.EncodeToString(b)
+	session.RefreshHash, session.PreviousHash = hashToken(plainText), ""
+	session.CreatedAt, session.LastUsedAt, session.ExpiresAt = now, now, now.Add(ttl)
+	session.AuthenticatedAt = now
+	session.RevokedAt = nil
+	return plainText, nil
+}
+
+// postgresSessions is the SessionRepository backed by the sessions table
+type postgresSessions struct {
+	db *gorm.DB
+}
+
+// NewPostgresSessionRepository returns a SessionRepository that stores sessions in Postgres
+func NewPostgresSessionRepository(conn *gorm.DB) SessionRepository {
+	return &postgresSessions{db: conn}
+}
+
+func (r *postgresSessions) Create(ctx context.Context, session *Session, ttl time.Duration) (string, error) {
+	plainText, err := newSession(session, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	if err := db.Create(session).Error; err != nil {
+		return "", err
+	}
+	return plainText, nil
+}
+
+func (r *postgresSessions) Refresh(ctx context.Context, plainText, ip, userAgent string, ttl time.Duration) (*Session, string, error) {
+	next, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	// Checking and replacing the token in one statement lets it be exchanged only once
+	var session Session
+	hash, now := hashToken(plainText), time.Now()
+	result := db.Model(&session).
+		Clauses(clause.Returning{}).
+		Where("refresh_hash = ? AND revoked_at IS NULL AND expires_at > ?", hash, now).
+		Updates(map[string]any{
+			"previous_hash": gorm.Expr("refresh_hash"),
+			"refresh_hash":  hashToken(next),
+			"ip":            ip,
+			"user_agent":    userAgent,
+			"last_used_at":  now,
+			"expires_at":    now.Add(ttl),
+		})
+	if result.Error != nil {
+		return nil, "", result.Error
+	}
+	if result.RowsAffected == 1 {
+		return &session, next, nil
+	}
+
+	result = db.Model(&session).
+		Clauses(clause.Returning{}).
+		Where("previous_hash = ? AND revoked_at IS NULL", hash).
+		Update("revoked_at", now)
+	if result.Error != nil {
+		return nil, "", result.Error
+	}
+	if result.RowsAffected == 1 {
+		return &session, "", ErrRefreshTokenReused
+	}
+	return nil, "", ErrInvalidToken
+}
+
+func (r *postgresSessions) GetForUser(ctx context.Context, userID int) ([]*Session, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var sessions []*Session
+	err := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (r *postgresSessions) Revoke(ctx context.Context, userID int, id string) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	result := db.Model(&Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?", id, userID, time.Now()).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *postgresSessions) Reauthenticate(ctx context.Context, userID int, id string) (*Session, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var session Session
+	result := db.Model(&session).
+		Clauses(clause.Returning{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?", id, userID, time.Now()).
+		Update("authenticated_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &session, nil
+}
+
+func (r *postgresSessions) RevokeAll(ctx context.Context, userID int) ([]string, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var sessions []Session
+	err := db.Model(&sessions).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}}}).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Update("revoked_at", time.Now()).Error
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(sessions))
+	for i, session := range sessions {
+		ids[i] = session.ID
+	}
+	return ids, nil
+}
+
+func (r *postgresSessions) Anonymize(ctx context.Context, userID int) (int, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	result := db.Model(&Session{}).
+		Where("user_id = ?", userID).
+		Updates(map[string]any{"device": "", "ip": "", "user_agent": ""})
+	return int(result.RowsAffected), result.Error
+}
+
+func (r *postgresSessions) RevokedSince(ctx context.Context, since time.Time) ([]string, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	ids := []string{}
+	err := db.Model(&Session{}).Where("revoked_at > ?", since).Order("revoked_at").Pluck("id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (r *postgresSessions) PurgeExpired(ctx context.Context, before time.Time) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	return db.Where("expires_at < ? OR revoked_at < ?", before, before).Delete(&Session{}).Error
+}
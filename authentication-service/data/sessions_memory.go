@@ -0,0 +1,194 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MemorySessionRepository is a SessionRepository that keeps sessions in memory, for tests
+// and for running handlers without Postgres
+type MemorySessionRepository struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+// NewMemorySessionRepository returns an empty MemorySessionRepository
+func NewMemorySessionRepository() *MemorySessionRepository {
+	return &MemorySessionRepository{sessions: map[string]Session{}}
+}
+
+func (r *MemorySessionRepository) Create(ctx context.Context, session *Session, ttl time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	plainText, err := newSession(session, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[session.ID] = *session
+	return plainText, nil
+}
+
+func (r *MemorySessionRepository) Refresh(ctx context.Context, plainText, ip, userAgent string, ttl time.Duration) (*Session, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	next, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hash, now := hashToken(plainText), time.Now()
+	for id, session := range r.sessions {
+		if session.RevokedAt != nil {
+			continue
+		}
+		switch {
+		case session.RefreshHash == hash && session.ExpiresAt.After(now):
+			session.PreviousHash, session.RefreshHash = session.RefreshHash, hashToken(next)
+			session.IP, session.UserAgent = ip, userAgent
+			session.LastUsedAt, session.ExpiresAt = now, now.Add(ttl)
+			r.sessions[id] = session
+			return &session, next, nil
+		case session.PreviousHash == hash:
+			session.RevokedAt = &now
+			r.sessions[id] = session
+			return &session, "", ErrRefreshTokenReused
+		}
+	}
+	return nil, "", ErrInvalidToken
+}
+
+func (r *MemorySessionRepository) GetForUser(ctx context.Context, userID int) ([]*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var sessions []*Session
+	for _, session := range r.sessions {
+		if session.UserID == userID && r.active(session) {
+			s := session
+			sessions = append(sessions, &s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+func (r *MemorySessionRepository) Revoke(ctx context.Context, userID int, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.sessions[id]
+	if !ok || session.UserID != userID || !r.active(session) {
+		return gorm.ErrRecordNotFound
+	}
+	now := time.Now()
+	session.RevokedAt = &now
+	r.sessions[id] = session
+	return nil
+}
+
+func (r *MemorySessionRepository) Reauthenticate(ctx context.Context, userID int, id string) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session, ok := r.sessions[id]
+	if !ok || session.UserID != userID || !r.active(session) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	session.AuthenticatedAt = time.Now()
+	r.sessions[id] = session
+	return &session, nil
+}
+
+func (r *MemorySessionRepository) RevokeAll(ctx context.Context, userID int) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := []string{}
+	now := time.Now()
+	for id, session := range r.sessions {
+		if session.UserID == userID && r.active(session) {
+			session.RevokedAt = &now
+			r.sessions[id] = session
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (r *MemorySessionRepository) Anonymize(ctx context.Context, userID int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for id, session := range r.sessions {
+		if session.UserID == userID {
+			session.Device, session.IP, session.UserAgent = "", "", ""
+			r.sessions[id] = session
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *MemorySessionRepository) RevokedSince(ctx context.Context, since time.Time) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := []string{}
+	for id, session := range r.sessions {
+		if session.RevokedAt != nil && session.RevokedAt.After(since) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (r *MemorySessionRepository) PurgeExpired(ctx context.Context, before time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, session := range r.sessions {
+		if session.ExpiresAt.Before(before) || (session.RevokedAt != nil && session.RevokedAt.Before(before)) {
+			delete(r.sessions, id)
+		}
+	}
+	return nil
+}
+
+// active reports whether session is neither revoked nor expired
+func (r *MemorySessionRepository) active(session Session) bool {
+	return session.RevokedAt == nil && session.ExpiresAt.After(time.Now())
+}
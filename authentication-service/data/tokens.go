@@ -0,0 +1,184 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Purposes a Token can be issued for. A token is only ever accepted for the purpose it
+// was issued for.
+const (
+	TokenEmailVerification = "email_verification"
+	TokenPasswordReset     = "password_reset"
+	TokenMFAChallenge      = "mfa_challenge"
+	TokenMagicLink         = "magic_link"
+	TokenEmailChange       = "email_change"
+)
+
+// ErrInvalidToken is returned when a token does not exist, has expired or was already used
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Token is a single-use, expiring secret that is sent to a user, for example in a
+// verification link. Only a SHA-256 hash of the secret is stored.
+type Token struct {
+	ID      int    `gorm:"primaryKey" json:"id"`
+	UserID  int    `gorm:"index;not null" json:"user_id"`
+	Purpose string `gorm:"index;not null" json:"purpose"`
+	Hash    string `gorm:"uniqueIndex;not null" json:"-"`
+	// NewEmail is the address an email change token confirms
+	NewEmail  string     `json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// TableName keeps tokens apart from any other "tokens" concept in the database
+func (Token) TableName() string {
+	return "user_tokens"
+}
+
+// TokenStore stores the one-time tokens in the user_tokens table
+type TokenStore struct {
+	db *gorm.DB
+}
+
+// Issue creates a new token for userID and returns the plain text secret, which is never
+// stored and must be delivered to the user.
+func (s *TokenStore) Issue(ctx context.Context, userID int, purpose string, ttl time.Duration) (string, error) {
+	plainText, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	token := Token{
+		UserID:    userID,
+		Purpose:   purpose,
+		Hash:      hashToken(plainText),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+	if err := db.Create(&token).Error; err != nil {
+		return "", err
+	}
+	return plainText, nil
+}
+
+// IssueEmailChange creates a token that confirms changing the email of userID to newEmail,
+// and returns its plain text secret. The user's earlier email change tokens stop working,
+// so only the latest address asked for can be confirmed.
+func (s *TokenStore) IssueEmailChange(ctx context.Context, userID int, newEmail string, ttl time.Duration) (string, error) {
+	plainText, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	token := Token{
+		UserID:    userID,
+		Purpose:   TokenEmailChange,
+		Hash:      hashToken(plainText),
+		NewEmail:  newEmail,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Token{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, TokenEmailChange).
+			Update("used_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&token).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return plainText, nil
+}
+
+// Consume marks the token matching plainText and purpose as used and returns it. It returns
+// ErrInvalidToken unless the token exists, has not expired and has not been used before.
+// The check and the update happen in a single statement, so a token is consumed at most once.
+func (s *TokenStore) Consume(ctx context.Context, purpose, plainText string) (*Token, error) {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	var token Token
+	now := time.Now()
+	result := db.Model(&token).
+		Clauses(clause.Returning{}).
+		Where("hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", hashToken(plainText), purpose, now).
+		Update("used_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return nil, ErrInvalidToken
+	}
+	return &token, nil
+}
+
+// Find returns the token matching plainText and purpose without using it up. It returns
+// ErrInvalidToken unless the token exists, has not expired and has not been used.
+func (s *TokenStore) Find(ctx context.Context, purpose, plainText string) (*Token, error) {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	var token Token
+	err := db.Where("hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", hashToken(plainText), purpose, time.Now()).
+		First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RevokeAll marks every unused token of userID as used, whatever its purpose
+func (s *TokenStore) RevokeAll(ctx context.Context, userID int) error {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	return db.Model(&Token{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Update("used_at", time.Now()).Error
+}
+
+// Erase revokes every token of userID, like RevokeAll, and forgets the addresses its email
+// change tokens were for, for the erasure of the user
+func (s *TokenStore) Erase(ctx context.Context, userID int) error {
+	db, cancel := withTimeout(ctx, s.db)
+	defer cancel()
+
+	return db.Model(&Token{}).
+		Where("user_id = ?", userID).
+		Updates(map[string]any{
+			"used_at":   gorm.Expr("COALESCE(used_at, ?)", time.Now()),
+			"new_email": "",
+		}).Error
+}
+
+// randomToken returns a new random secret of 32 bytes, base64 encoded for use in URLs
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex encoded SHA-256 hash of a plain text token
+func hashToken(plainText string) string {
+	sum := sha256.Sum256([]byte(plainText))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,349 @@
+package data
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MemoryUserRepository is a UserRepository that keeps users in memory, for tests and for
+// running handlers without Postgres. Its events go to its own MemoryOutboxRepository.
+type MemoryUserRepository struct {
+	mu     sync.Mutex
+	users  map[int]User
+	nextID int
+	outbox *MemoryOutboxRepository
+}
+
+// NewMemoryUserRepository returns an empty MemoryUserRepository
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: map[int]User{}, nextID: 1, outbox: NewMemoryOutboxRepository()}
+}
+
+// Outbox returns the outbox that the repository adds its events to
+func (r *MemoryUserRepository) Outbox() *MemoryOutboxRepository {
+	return r.outbox
+}
+
+func (r *MemoryUserRepository) GetAll(ctx context.Context) ([]*User, error) {
+	users, _, err := r.GetPage(ctx, "", 1, math.MaxInt32)
+	return users, err
+}
+
+func (r *MemoryUserRepository) GetPage(ctx context.Context, search string, page, pageSize int) ([]*User, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	search = strings.ToLower(search)
+	var matches []*User
+	for _, user := range r.users {
+		if user.DeletedAt.Valid {
+			continue
+		}
+		if search == "" || strings.Contains(strings.ToLower(user.Email), search) ||
+			strings.Contains(strings.ToLower(user.FirstName), search) ||
+			strings.Contains(strings.ToLower(user.LastName), search) {
+			u := user
+			matches = append(matches, &u)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].LastName != matches[j].LastName {
+			return matches[i].LastName < matches[j].LastName
+		}
+		return matches[i].ID < matches[j].ID
+	})
+
+	total := int64(len(matches))
+	start := min((page-1)*pageSize, len(matches))
+	end := min(start+pageSize, len(matches))
+	return matches[start:end], total, nil
+}
+
+func (r *MemoryUserRepository) GetByEmail(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, user := range r.users {
+		if user.Email == email && !user.DeletedAt.Valid {
+			return &user, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *MemoryUserRepository) GetOne(ctx context.Context, id int) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt.Valid {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) GetWithDeleted(ctx context.Context, id int) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &user, nil
+}
+
+func (r *MemoryUserRepository) Insert(ctx context.Context, user User) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	hashedPassword, err := HashPassword(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.emailTaken(user.Email, 0) {
+		return 0, gorm.ErrDuplicatedKey
+	}
+	user.ID, user.Password = r.nextID, hashedPassword
+	user.CreatedAt, user.UpdatedAt = time.Now(), time.Now()
+	verifiedIfActive(&user, user.CreatedAt)
+	r.users[user.ID] = user
+	r.nextID++
+	r.outbox.add(userEvent(UserCreated, &user))
+	return user.ID, nil
+}
+
+func (r *MemoryUserRepository) Update(ctx context.Context, user *User) error {
+	return r.modify(ctx, user.ID, func(stored *User) error {
+		if r.emailTaken(user.Email, user.ID) {
+			return gorm.ErrDuplicatedKey
+		}
+		password, createdAt, wasActive := stored.Password, stored.CreatedAt, stored.Active
+		*stored = *user
+		stored.Password, stored.CreatedAt, stored.UpdatedAt = password, createdAt, time.Now()
+		r.outbox.add(activeChange(wasActive, stored)...)
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) Verify(ctx context.Context, user *User) error {
+	return r.modify(ctx, user.ID, func(stored *User) error {
+		if !stored.Active && stored.VerifiedAt == nil {
+			now := time.Now()
+			stored.Active, stored.VerifiedAt, stored.UpdatedAt = true, &now, now
+			user.Active, user.VerifiedAt = true, &now
+			r.outbox.add(userEvent(UserVerified, stored))
+		}
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) ChangeEmail(ctx context.Context, user *User, email string) error {
+	return r.modify(ctx, user.ID, func(stored *User) error {
+		if r.emailTaken(email, stored.ID) {
+			return gorm.ErrDuplicatedKey
+		}
+		previous := stored.Email
+		stored.Email, stored.UpdatedAt, user.Email = email, time.Now(), email
+		r.outbox.add(emailChangedEvent(stored, previous))
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) Delete(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stored, ok := r.users[user.ID]; ok && !stored.DeletedAt.Valid {
+		stored.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+		r.users[user.ID] = stored
+		r.outbox.add(userEvent(UserDeleted, &stored))
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) Restore(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[user.ID]
+	if !ok || !stored.DeletedAt.Valid || stored.ErasedAt != nil {
+		return nil
+	}
+	if r.emailTaken(stored.Email, stored.ID) {
+		return gorm.ErrDuplicatedKey
+	}
+	stored.DeletedAt, stored.UpdatedAt = gorm.DeletedAt{}, time.Now()
+	r.users[user.ID] = stored
+	user.DeletedAt = stored.DeletedAt
+	r.outbox.add(userEvent(UserRestored, &stored))
+	return nil
+}
+
+func (r *MemoryUserRepository) Erase(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[user.ID]
+	if !ok {
+		return nil
+	}
+	if stored.ErasedAt == nil {
+		r.outbox.add(userEvent(UserErased, &stored))
+
+		now := time.Now()
+		stored.Email, stored.FirstName, stored.LastName = erasedEmail(stored.ID), "", ""
+		stored.Password, stored.Active, stored.UpdatedAt, stored.ErasedAt = "", false, now, &now
+		if !stored.DeletedAt.Valid {
+			stored.DeletedAt = gorm.DeletedAt{Time: now, Valid: true}
+		}
+		r.users[user.ID] = stored
+	}
+	*user = stored
+	return nil
+}
+
+func (r *MemoryUserRepository) ResetPassword(ctx context.Context, user *User, password string) error {
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return r.modify(ctx, user.ID, func(stored *User) error {
+		stored.Password, stored.UpdatedAt = hashedPassword, time.Now()
+		r.outbox.add(userEvent(UserPasswordChanged, stored))
+		return nil
+	})
+}
+
+func (r *MemoryUserRepository) Import(ctx context.Context, users []User, dryRun bool) (map[int]error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	failed := map[int]error{}
+	taken := map[string]bool{}
+	for _, user := range r.users {
+		if !user.DeletedAt.Valid {
+			taken[user.Email] = true
+		}
+	}
+	for i := range users {
+		user := &users[i]
+		if taken[user.Email] {
+			failed[i] = gorm.ErrDuplicatedKey
+			continue
+		}
+		taken[user.Email] = true
+		if dryRun {
+			continue
+		}
+		user.ID = r.nextID
+		user.CreatedAt, user.UpdatedAt = time.Now(), time.Now()
+		verifiedIfActive(user, user.CreatedAt)
+		r.users[user.ID] = *user
+		r.nextID++
+		r.outbox.add(userEvent(UserCreated, user))
+	}
+	return failed, nil
+}
+
+func (r *MemoryUserRepository) Each(ctx context.Context, fn func(*User) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	users := make([]*User, 0, len(r.users))
+	for _, user := range r.users {
+		if !user.DeletedAt.Valid {
+			u := user
+			users = append(users, &u)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	for _, user := range users {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) PasswordMatches(ctx context.Context, user *User, plainText string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return passwordMatches(user, plainText, func(hash string) (bool, error) {
+		replaced := false
+		err := r.modify(ctx, user.ID, func(stored *User) error {
+			if stored.Password == user.Password {
+				stored.Password, stored.UpdatedAt, replaced = hash, time.Now(), true
+			}
+			return nil
+		})
+		return replaced, err
+	})
+}
+
+// modify calls fn with the stored user id, under the lock. Like an UPDATE, it does
+// nothing if there is no such user, or it was deleted.
+func (r *MemoryUserRepository) modify(ctx context.Context, id int, fn func(stored *User) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[id]
+	if !ok || stored.DeletedAt.Valid {
+		return nil
+	}
+	if err := fn(&stored); err != nil {
+		return err
+	}
+	r.users[id] = stored
+	return nil
+}
+
+// emailTaken reports whether a user other than id, that is not deleted, has email. The
+// lock must be held.
+func (r *MemoryUserRepository) emailTaken(email string, id int) bool {
+	for _, user := range r.users {
+		if user.Email == email && user.ID != id && !user.DeletedAt.Valid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,351 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// postgresUsers is the UserRepository backed by the users table
+type postgresUsers struct {
+	db *gorm.DB
+}
+
+// NewPostgresUserRepository returns a UserRepository that stores users in Postgres
+func NewPostgresUserRepository(conn *gorm.DB) UserRepository {
+	return &postgresUsers{db: conn}
+}
+
+func (r *postgresUsers) GetAll(ctx context.Context) ([]*User, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var users []*User
+	if err := db.Order("last_name").Find(&users).Error; err != nil {
+		log.Println("Error querying users:", err)
+		return nil, err
+	}
+	return users, nil
+}
+
+func (r *postgresUsers) GetPage(ctx context.Context, search string, page, pageSize int) ([]*User, int64, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	query := db.Model(&User{})
+	if search != "" {
+		pattern := "%" + escapeLike(search) + "%"
+		query = query.Where("email ILIKE ? OR first_name ILIKE ? OR last_name ILIKE ?", pattern, pattern, pattern)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		log.Println("Error counting users:", err)
+		return nil, 0, err
+	}
+
+	var users []*User
+	err := query.Order("last_name").Order("id").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&users).Error
+	if err != nil {
+		log.Println("Error querying users:", err)
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so that it is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (r *postgresUsers) GetByEmail(ctx context.Context, email string) (*User, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var user User
+	if err := db.Where("email = ?", email).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *postgresUsers) GetOne(ctx context.Context, id int) (*User, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var user User
+	if err := db.First(&user, id).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *postgresUsers) GetWithDeleted(ctx context.Context, id int) (*User, error) {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	var user User
+	if err := db.Unscoped().First(&user, id).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *postgresUsers) Insert(ctx context.Context, user User) (int, error) {
+	hashedPassword, err := HashPassword(user.Password)
+	if err != nil {
+		return 0, err
+	}
+	user.Password = hashedPassword
+	verifiedIfActive(&user, time.Now())
+
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return enqueue(tx, userEvent(UserCreated, &user))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return user.ID, nil
+}
+
+func (r *postgresUsers) Update(ctx context.Context, user *User) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var stored User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("active").First(&stored, user.ID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Like an UPDATE of a user that doesn't exist, this does nothing
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := tx.Model(user).Select("*").Omit("id", "password", "created_at").Updates(user).Error; err != nil {
+			return err
+		}
+		return enqueue(tx, activeChange(stored.Active, user)...)
+	})
+}
+
+func (r *postgresUsers) Verify(ctx context.Context, user *User) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&User{}).
+			Where("id = ? AND NOT active AND verified_at IS NULL", user.ID).
+			Updates(map[string]any{"active": true, "verified_at": now, "updated_at": now})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		user.Active, user.VerifiedAt = true, &now
+		return enqueue(tx, userEvent(UserVerified, user))
+	})
+}
+
+func (r *postgresUsers) ChangeEmail(ctx context.Context, user *User, email string) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	previous := user.Email
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// The unique index on email makes the update fail if the address was taken
+		result := tx.Model(&User{}).
+			Where("id = ?", user.ID).
+			Updates(map[string]any{"email": email, "updated_at": time.Now()})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		user.Email = email
+		return enqueue(tx, emailChangedEvent(user, previous))
+	})
+	if err != nil {
+		user.Email = previous
+	}
+	return err
+}
+
+func (r *postgresUsers) Delete(ctx context.Context, user *User) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(user)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return enqueue(tx, userEvent(UserDeleted, user))
+	})
+}
+
+func (r *postgresUsers) Restore(ctx context.Context, user *User) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Model(&User{}).
+			Where("id = ? AND deleted_at IS NOT NULL AND erased_at IS NULL", user.ID).
+			Updates(map[string]any{"deleted_at": nil, "updated_at": time.Now()})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		user.DeletedAt = gorm.DeletedAt{}
+		return enqueue(tx, userEvent(UserRestored, user))
+	})
+}
+
+func (r *postgresUsers) Erase(ctx context.Context, user *User) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Model(&User{}).
+			Where("id = ? AND erased_at IS NULL", user.ID).
+			Updates(map[string]any{
+				"email":      erasedEmail(user.ID),
+				"first_name": "",
+				"last_name":  "",
+				"password":   "",
+				"active":     false,
+				"updated_at": now,
+				"deleted_at": gorm.Expr("COALESCE(deleted_at, ?)", now),
+				"erased_at":  now,
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return enqueue(tx, userEvent(UserErased, user))
+	})
+	if err != nil {
+		return err
+	}
+	return db.Unscoped().First(user).Error
+}
+
+func (r *postgresUsers) ResetPassword(ctx context.Context, user *User, password string) error {
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(user).Update("password", hashedPassword)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return enqueue(tx, userEvent(UserPasswordChanged, user))
+	})
+}
+
+func (r *postgresUsers) Import(ctx context.Context, users []User, dryRun bool) (map[int]error, error) {
+	failed := map[int]error{}
+	taken := map[string]bool{}
+	for start := 0; start < len(users); start += ImportBatchSize {
+		end := min(start+ImportBatchSize, len(users))
+		if err := r.importBatch(ctx, users[start:end], start, dryRun, taken, failed); err != nil {
+			return failed, fmt.Errorf("importing users %d to %d: %w", start+1, end, err)
+		}
+	}
+	return failed, nil
+}
+
+// importBatch creates one batch of an import in a transaction. taken collects the emails
+// seen so far, and failed the users that are not created, by their index in the import.
+func (r *postgresUsers) importBatch(ctx context.Context, batch []User, offset int, dryRun bool, taken map[string]bool, failed map[int]error) error {
+	db, cancel := withTimeout(ctx, r.db)
+	defer cancel()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		emails := make([]string, len(batch))
+		for i := range batch {
+			emails[i] = batch[i].Email
+		}
+		var stored []string
+		if err := tx.Model(&User{}).Where("email IN ?", emails).Pluck("email", &stored).Error; err != nil {
+			return err
+		}
+		for _, email := range stored {
+			taken[email] = true
+		}
+
+		var create []*User
+		for i := range batch {
+			if taken[batch[i].Email] {
+				failed[offset+i] = gorm.ErrDuplicatedKey
+				continue
+			}
+			taken[batch[i].Email] = true
+			verifiedIfActive(&batch[i], time.Now())
+			create = append(create, &batch[i])
+		}
+		if dryRun || len(create) == 0 {
+			return nil
+		}
+
+		// A user created with one of the emails since the check fails the batch on the
+		// unique index, and with it the transaction
+		if err := tx.Create(create).Error; err != nil {
+			return err
+		}
+		events := make([]*OutboxMessage, len(create))
+		for i, user := range create {
+			events[i] = userEvent(UserCreated, user)
+		}
+		return enqueue(tx, events...)
+	})
+}
+
+func (r *postgresUsers) Each(ctx context.Context, fn func(*User) error) error {
+	lastID := 0
+	for {
+		db, cancel := withTimeout(ctx, r.db)
+		var users []*User
+		err := db.Where("id > ?", lastID).Order("id").Limit(ImportBatchSize).Find(&users).Error
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		if len(users) < ImportBatchSize {
+			return nil
+		}
+		lastID = users[len(users)-1].ID
+	}
+}
+
+func (r *postgresUsers) PasswordMatches(ctx context.Context, user *User, plainText string) (bool, error) {
+	return passwordMatches(user, plainText, func(hash string) (bool, error) {
+		db, cancel := withTimeout(ctx, r.db)
+		defer cancel()
+
+		result := db.Model(&User{}).
+			Where("id = ? AND password = ?", user.ID, user.Password).
+			Updates(map[string]any{"password": hash, "updated_at": time.Now()})
+		return result.RowsAffected == 1, result.Error
+	})
+}
@@ -0,0 +1,221 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestPostgresUsersCancelledQuery(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	conn, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The query takes longer than the request is willing to wait
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE email = $1`)).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email"}).AddRow(1, "admin@example.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = NewPostgresUserRepository(conn).GetByEmail(ctx, "admin@example.com")
+	if err == nil {
+		t.Fatal("expected the query to be aborted")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("query ran for %s after the request was cancelled", elapsed)
+	}
+}
+
+func TestMemoryUserRepository(t *testing.T) {
+	SetPasswordParams(PasswordParams{Algorithm: Bcrypt, BcryptCost: 4})
+	t.Cleanup(func() { SetPasswordParams(DefaultPasswordParams) })
+	ctx := context.Background()
+	repo := NewMemoryUserRepository()
+
+	for i := 1; i <= 3; i++ {
+		user := User{Email: fmt.Sprintf("user%d@example.com", i), LastName: fmt.Sprintf("Last %d", 4-i), Password: "verysecret"}
+		if id, err := repo.Insert(ctx, user); err != nil || id != i {
+			t.Fatalf("Insert returned %d, %v", id, err)
+		}
+	}
+	if _, err := repo.Insert(ctx, User{Email: "user1@example.com"}); !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Errorf("expected a duplicate email to fail, got %v", err)
+	}
+
+	users, total, err := repo.GetPage(ctx, "USER", 1, 2)
+	if err != nil || total != 3 || len(users) != 2 || users[0].ID != 3 {
+		t.Fatalf("unexpected page %+v, total %d, err %v", users, total, err)
+	}
+
+	user, err := repo.GetByEmail(ctx, "user2@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Email = "user3@example.com"
+	if err := repo.Update(ctx, user); !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Errorf("expected taking another user's email to fail, got %v", err)
+	}
+	user.Email, user.Active = "renamed@example.com", true
+	if err := repo.Update(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := repo.PasswordMatches(ctx, user, "verysecret"); !ok || err != nil {
+		t.Errorf("expected Update to keep the password, got %v, %v", ok, err)
+	}
+
+	if err := repo.Delete(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetOne(ctx, user.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("expected a deleted user to be gone, got %v", err)
+	}
+	if err := repo.Restore(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetOne(ctx, user.ID); err != nil {
+		t.Errorf("expected a restored user to be found, got %v", err)
+	}
+	if err := repo.Erase(ctx, user); err != nil || user.Email != erasedEmail(user.ID) || user.ErasedAt == nil {
+		t.Fatalf("expected the user to be erased, got %+v, %v", user, err)
+	}
+	if err := repo.Restore(ctx, user); err != nil || !user.DeletedAt.Valid {
+		t.Errorf("expected an erased user to stay deleted, got %+v, %v", user, err)
+	}
+
+	// Only a user that never verified is activated by verifying
+	unverified, _ := repo.GetOne(ctx, 1)
+	if err := repo.Verify(ctx, unverified); err != nil || !unverified.Active || unverified.VerifiedAt == nil {
+		t.Fatalf("expected the user to be verified, got %+v, %v", unverified, err)
+	}
+	unverified.Active = false
+	repo.Update(ctx, unverified)
+	if err := repo.Verify(ctx, unverified); err != nil || unverified.Active {
+		t.Errorf("expected a deactivated user to stay inactive, got %+v, %v", unverified, err)
+	}
+	id, _ := repo.Insert(ctx, User{Email: "created@example.com", Password: "verysecret", Active: true})
+	if created, _ := repo.GetOne(ctx, id); created.VerifiedAt == nil {
+		t.Errorf("expected a user created active to be verified, got %+v", created)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := repo.GetOne(cancelled, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled context to abort, got %v", err)
+	}
+}
+
+func TestPostgresUsersSoftDeleteAndErase(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	conn, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewPostgresUserRepository(conn)
+	ctx := context.Background()
+	user := &User{ID: 7, Email: "grace@example.com"}
+
+	// Deleting keeps the row, and lookups leave it out
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "users" SET "deleted_at"=$1 WHERE "users"."id" = $2 AND "users"."deleted_at" IS NULL`)).
+		WithArgs(sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WithArgs(UsersExchange, UserDeleted, sqlmock.AnyArg(), 0, "", sqlmock.AnyArg(), nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+	if err := repo.Delete(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	if _, err := repo.GetOne(ctx, 7); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("expected a deleted user not to be found, got %v", err)
+	}
+
+	// The erasure event carries the email the user had
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE "users" SET "active"=$1,"deleted_at"=COALESCE(deleted_at, $2),"email"=$3,"erased_at"=$4,"first_name"=$5,"last_name"=$6,"password"=$7,"updated_at"=$8 WHERE id = $9 AND erased_at IS NULL`)).
+		WithArgs(false, sqlmock.AnyArg(), "erased-7@erased.invalid", sqlmock.AnyArg(), "", "", "", sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WithArgs(UsersExchange, UserErased, sqlmock.AnyArg(), 0, "", sqlmock.AnyArg(), nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectCommit()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE "users"."id" = $1 ORDER BY`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email"}).AddRow(7, "erased-7@erased.invalid"))
+	if err := repo.Erase(ctx, user); err != nil || user.Email != "erased-7@erased.invalid" {
+		t.Fatalf("expected the user to be erased, got %+v, %v", user, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostgresUsersChangeEmail(t *testing.T) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	conn, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Silent),
+		TranslateError: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewPostgresUserRepository(conn)
+	ctx := context.Background()
+	user := &User{ID: 7, Email: "grace@example.com"}
+	update := regexp.QuoteMeta(`UPDATE "users" SET "email"=$1,"updated_at"=$2 WHERE id = $3 AND "users"."deleted_at" IS NULL`)
+
+	// The unique index turns away an email that was taken
+	mock.ExpectBegin()
+	mock.ExpectExec(update).WithArgs("ada@example.com", sqlmock.AnyArg(), 7).
+		WillReturnError(&pgconn.PgError{Code: "23505"})
+	mock.ExpectRollback()
+	if err := repo.ChangeEmail(ctx, user, "ada@example.com"); !errors.Is(err, gorm.ErrDuplicatedKey) || user.Email != "grace@example.com" {
+		t.Fatalf("expected a duplicate email to be refused, got %v, %+v", err, user)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(update).WithArgs("grace.new@example.com", sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "outbox"`)).
+		WithArgs(UsersExchange, UserEmailChanged, sqlmock.AnyArg(), 0, "", sqlmock.AnyArg(), nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+	if err := repo.ChangeEmail(ctx, user, "grace.new@example.com"); err != nil || user.Email != "grace.new@example.com" {
+		t.Fatalf("expected the email to change, got %v, %+v", err, user)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
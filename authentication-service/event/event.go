@@ -0,0 +1,149 @@
+// Package event publishes to RabbitMQ. Log entries go to the logs_topic exchange, where
+// the listener service picks them up and writes them to the logger service. Publishing
+// them never blocks the caller: entries are buffered in memory, spilled to disk while
+// RabbitMQ can't take them or no queue is bound for them, and only dropped, and counted,
+// when both are full.
+package event
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Routing keys of LogsExchange, which the listener service binds
+const (
+	Info    = "log.INFO"
+	Warning = "log.WARNING"
+	Error   = "log.ERROR"
+)
+
+// Entry is a log entry, in the form the listener service forwards to the logger service
+type Entry struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+// Sink delivers an encoded entry under a routing key. Send returns once the entry is safely
+// delivered, or with an error, in which case it is sent again later.
+type Sink interface {
+	Send(ctx context.Context, topic string, body []byte) error
+}
+
+// LogsExchange is the topic exchange that log entries are published to
+const LogsExchange = "logs_topic"
+
+// ErrUnroutable is returned by AMQPSink.Send when RabbitMQ returned the message because no
+// queue is bound for its routing key
+var ErrUnroutable = errors.New("no queue is bound for the message")
+
+// AMQPSink is the Sink that publishes to a topic exchange. It connects on first use and
+// again after the connection is lost, and waits for RabbitMQ to confirm each message.
+// Messages are published as mandatory, so that one no queue takes fails with
+// ErrUnroutable instead of being dropped by RabbitMQ.
+type AMQPSink struct {
+	url      string
+	exchange string
+
+	// AllowUnroutable lets RabbitMQ drop the messages no queue is bound for, for exchanges
+	// whose messages don't all have a subscriber
+	AllowUnroutable bool
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	ch      *amqp.Channel
+	returns chan amqp.Return
+}
+
+// NewAMQPSink returns an AMQPSink for exchange on the RabbitMQ server at url
+func NewAMQPSink(url, exchange string) *AMQPSink {
+	return &AMQPSink{url: url, exchange: exchange}
+}
+
+func (s *AMQPSink) Send(ctx context.Context, topic string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ch == nil || s.ch.IsClosed() {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+
+	confirmation, err := s.ch.PublishWithDeferredConfirmWithContext(ctx, s.exchange, topic, !s.AllowUnroutable, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	if err != nil {
+		s.close()
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		s.close()
+		return err
+	}
+	if !acked {
+		return errors.New("RabbitMQ did not accept the message")
+	}
+	// RabbitMQ returns an unroutable message before it confirms it, and only one message
+	// is in flight at a time
+	select {
+	case returned := <-s.returns:
+		return fmt.Errorf("%w: %s", ErrUnroutable, returned.ReplyText)
+	default:
+	}
+	return nil
+}
+
+// connect opens a connection and a channel in confirm mode, declaring the exchange
+func (s *AMQPSink) connect() error {
+	s.close()
+	conn, err := amqp.DialConfig(s.url, amqp.Config{
+		Heartbeat: 10 * time.Second,
+		Locale:    "en_US",
+		Dial:      amqp.DefaultDial(5 * time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = declareExchange(ch, s.exchange)
+	}
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn, s.ch = conn, ch
+	s.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	return nil
+}
+
+func (s *AMQPSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn, s.ch, s.returns = nil, nil, nil
+}
+
+func declareExchange(ch *amqp.Channel, name string) error {
+	return ch.ExchangeDeclare(
+		name,    // name
+		"topic", // type
+		true,    // durable?
+		false,   // auto-deleted?
+		false,   // internal?
+		false,   // no-wait?
+		nil,     // arguments?
+	)
+}
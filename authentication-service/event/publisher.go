@@ -0,0 +1,332 @@
+package event
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options tune a Publisher. Zero values get the defaults.
+type Options struct {
+	// BufferSize is how many entries wait in memory for the sink, 1000 by default
+	BufferSize int
+	// SpillFile holds the entries that don't fit in the buffer until the sink takes them.
+	// Entries left in it when the service stops are sent after the next start. Without a
+	// spill file, entries that don't fit are dropped.
+	SpillFile string
+	// MaxSpillBytes is how large the spill file may grow, 64 MiB by default
+	MaxSpillBytes int64
+	// RetryInterval is how long to wait before sending again after the sink failed, 5
+	// seconds by default
+	RetryInterval time.Duration
+	// SendTimeout is how long the sink gets for one entry, 10 seconds by default
+	SendTimeout time.Duration
+}
+
+// Stats counts what happened to the published entries
+type Stats struct {
+	// Published is how many entries the sink took
+	Published int64 `json:"published"`
+	// Buffered is how many entries wait in memory
+	Buffered int `json:"buffered"`
+	// Spilled is how many entries wait in the spill file
+	Spilled int64 `json:"spilled"`
+	// Returned is how many times the sink gave an entry back because no queue is bound for
+	// its topic. Returned entries are kept and sent again, like after any other failure.
+	Returned int64 `json:"returned"`
+	// Dropped is how many entries were lost, because the buffer and the spill file were
+	// full, or the spill file couldn't be written or read
+	Dropped int64 `json:"dropped"`
+}
+
+var errSpillFull = errors.New("buffer and spill file are full")
+
+// message is an entry waiting to be sent, as it is written to the spill file
+type message struct {
+	Topic string `json:"topic"`
+	Entry
+}
+
+// Publisher sends entries to a Sink in the order they were published, without ever making
+// the caller wait. Run does the sending.
+type Publisher struct {
+	sink  Sink
+	opts  Options
+	queue chan message
+
+	// mu guards the spill file. While it holds entries, new entries are appended to it
+	// rather than buffered, so that they are sent after the older ones.
+	mu           sync.Mutex
+	spillSize    int64 // bytes written to the spill file
+	replayed     int64 // bytes of the spill file already sent
+	spillPending int64 // entries in the spill file not sent yet
+
+	published atomic.Int64
+	returned  atomic.Int64
+	dropped   atomic.Int64
+	failing   bool // whether the last send failed, only used by Run
+}
+
+// NewPublisher returns a Publisher for sink. Entries left in opts.SpillFile by an earlier
+// run are queued to be sent first.
+func NewPublisher(sink Sink, opts Options) (*Publisher, error) {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 1000
+	}
+	if opts.MaxSpillBytes <= 0 {
+		opts.MaxSpillBytes = 64 << 20
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = 5 * time.Second
+	}
+	if opts.SendTimeout <= 0 {
+		opts.SendTimeout = 10 * time.Second
+	}
+
+	p := &Publisher{sink: sink, opts: opts, queue: make(chan message, opts.BufferSize)}
+	if opts.SpillFile == "" {
+		return p, nil
+	}
+
+	f, err := os.Open(opts.SpillFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return p, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("opening spill file: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		p.spillSize += int64(len(line))
+		if len(line) > 0 {
+			p.spillPending++
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading spill file: %w", err)
+		}
+	}
+	if p.spillPending > 0 {
+		log.Printf("%d events from an earlier run are waiting in %s", p.spillPending, opts.SpillFile)
+	}
+	return p, nil
+}
+
+// Publish queues e to be sent under topic, one of Info, Warning and Error. It never blocks
+// and never fails; entries that can't be kept are counted in Stats.Dropped.
+func (p *Publisher) Publish(topic string, e Entry) {
+	m := message{Topic: topic, Entry: e}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.spillSize == 0 {
+		select {
+		case p.queue <- m:
+			return
+		default:
+		}
+	}
+	if err := p.spill(m); err != nil {
+		p.drop(m, err)
+	}
+}
+
+// Stats returns what happened to the entries published so far
+func (p *Publisher) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return Stats{
+		Published: p.published.Load(),
+		Buffered:  len(p.queue),
+		Spilled:   p.spillPending,
+		Returned:  p.returned.Load(),
+		Dropped:   p.dropped.Load(),
+	}
+}
+
+// Run sends the published entries until stop is closed, retrying while the sink fails.
+// When it stops, the entries still in memory are written to the spill file.
+func (p *Publisher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.opts.RetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			p.flush()
+			return
+		case m := <-p.queue:
+			if !p.send(m, stop) {
+				p.mu.Lock()
+				if err := p.spill(m); err != nil {
+					p.drop(m, err)
+				}
+				p.mu.Unlock()
+				continue
+			}
+		case <-ticker.C:
+		}
+		// The buffer holds older entries than the spill file, so it goes first
+		if len(p.queue) == 0 {
+			p.replay(stop)
+		}
+	}
+}
+
+// send delivers m, retrying until it succeeds. It returns false if stop was closed first.
+func (p *Publisher) send(m message, stop <-chan struct{}) bool {
+	body, err := json.Marshal(m.Entry)
+	if err != nil {
+		p.drop(m, err)
+		return true
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), p.opts.SendTimeout)
+		err := p.sink.Send(ctx, m.Topic, body)
+		cancel()
+		if err == nil {
+			if p.failing {
+				log.Println("Publishing events again")
+				p.failing = false
+			}
+			p.published.Add(1)
+			return true
+		}
+		if errors.Is(err, ErrUnroutable) {
+			p.returned.Add(1)
+		}
+		if !p.failing {
+			log.Printf("Error publishing events, retrying every %s: %v", p.opts.RetryInterval, err)
+			p.failing = true
+		}
+
+		select {
+		case <-stop:
+			return false
+		case <-time.After(p.opts.RetryInterval):
+		}
+	}
+}
+
+// replay sends the entries in the spill file, and removes it once they are all sent
+func (p *Publisher) replay(stop <-chan struct{}) {
+	for {
+		p.mu.Lock()
+		offset, size := p.replayed, p.spillSize
+		if size > 0 && offset >= size {
+			// Publish can't append while the lock is held, so nothing is lost here
+			err := os.Remove(p.opts.SpillFile)
+			if err == nil || errors.Is(err, fs.ErrNotExist) {
+				p.spillSize, p.replayed, p.spillPending = 0, 0, 0
+			} else {
+				log.Println("Error removing spill file:", err)
+			}
+		}
+		p.mu.Unlock()
+
+		if offset >= size || !p.replayFrom(offset, size, stop) {
+			return
+		}
+	}
+}
+
+// replayFrom sends the entries in the spill file between the byte offsets from and to. It
+// returns false if it couldn't send them all.
+func (p *Publisher) replayFrom(from, to int64, stop <-chan struct{}) bool {
+	f, err := os.Open(p.opts.SpillFile)
+	if err != nil {
+		log.Println("Error opening spill file:", err)
+		return false
+	}
+	defer f.Close()
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		log.Println("Error reading spill file:", err)
+		return false
+	}
+
+	r := bufio.NewReader(io.LimitReader(f, to-from))
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			return true
+		} else if err != nil && err != io.EOF {
+			log.Println("Error reading spill file:", err)
+			return false
+		}
+
+		var m message
+		if err := json.Unmarshal(line, &m); err != nil {
+			p.drop(m, fmt.Errorf("corrupt entry in spill file: %w", err))
+		} else if !p.send(m, stop) {
+			return false
+		}
+
+		p.mu.Lock()
+		p.replayed += int64(len(line))
+		p.spillPending--
+		p.mu.Unlock()
+	}
+}
+
+// flush moves the entries in memory to the spill file
+func (p *Publisher) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		select {
+		case m := <-p.queue:
+			if err := p.spill(m); err != nil {
+				p.drop(m, err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// spill appends m to the spill file. p.mu must be held.
+func (p *Publisher) spill(m message) error {
+	if p.opts.SpillFile == "" {
+		return errors.New("buffer is full")
+	}
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if p.spillSize+int64(len(line)) > p.opts.MaxSpillBytes {
+		return errSpillFull
+	}
+
+	f, err := os.OpenFile(p.opts.SpillFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	n, err := f.Write(line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	p.spillSize += int64(n)
+	if n == len(line) {
+		p.spillPending++
+	}
+	return err
+}
+
+// drop counts an entry that is lost. Only every hundredth is logged, so that an outage
+// doesn't flood the service's own log.
+func (p *Publisher) drop(m message, err error) {
+	if n := p.dropped.Add(1); n == 1 || n%100 == 0 {
+		log.Printf("Dropped %s event %q, %d dropped so far: %v", m.Topic, m.Name, n, err)
+	}
+}
@@ -0,0 +1,223 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink records the entries it is sent, fails while down is set and returns them while
+// unroutable is set
+type fakeSink struct {
+	mu         sync.Mutex
+	down       bool
+	unroutable bool
+	entries    []string
+}
+
+func (s *fakeSink) Send(ctx context.Context, topic string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errors.New("connection refused")
+	}
+	if s.unroutable {
+		return fmt.Errorf("%w: NO_ROUTE", ErrUnroutable)
+	}
+	s.entries = append(s.entries, topic+" "+string(body))
+	return nil
+}
+
+func (s *fakeSink) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *fakeSink) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.entries...)
+}
+
+func entry(i int) Entry {
+	return Entry{Name: "audit", Data: fmt.Sprintf("event %d", i)}
+}
+
+func run(t *testing.T, p *Publisher) (stop func()) {
+	t.Helper()
+	ch, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		p.Run(ch)
+		close(done)
+	}()
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(ch)
+			<-done
+		})
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPublisherSpillsWhileSinkIsDown(t *testing.T) {
+	sink := &fakeSink{down: true}
+	p, err := NewPublisher(sink, Options{
+		BufferSize:    2,
+		SpillFile:     filepath.Join(t.TempDir(), "spill.jsonl"),
+		RetryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, p)
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		p.Publish(Info, entry(i))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("publishing took %s while the sink was down", elapsed)
+	}
+	if stats := p.Stats(); stats.Spilled == 0 || stats.Dropped != 0 {
+		t.Fatalf("expected entries in the spill file and none dropped, got %+v", stats)
+	}
+
+	sink.setDown(false)
+	waitFor(t, "all entries", func() bool { return len(sink.sent()) == 20 })
+	for i, got := range sink.sent() {
+		if want := fmt.Sprintf(`log.INFO {"name":"audit","data":"event %d"}`, i); got != want {
+			t.Fatalf("entry %d: expected %s, got %s", i, want, got)
+		}
+	}
+	waitFor(t, "the spill file to empty", func() bool { return p.Stats().Spilled == 0 })
+
+	// With the spill file empty, entries are buffered again
+	p.Publish(Warning, entry(20))
+	waitFor(t, "the new entry", func() bool { return len(sink.sent()) == 21 })
+	if stats := p.Stats(); stats.Published != 21 || stats.Dropped != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPublisherKeepsReturnedEntries(t *testing.T) {
+	sink := &fakeSink{unroutable: true}
+	p, err := NewPublisher(sink, Options{
+		BufferSize:    2,
+		SpillFile:     filepath.Join(t.TempDir(), "spill.jsonl"),
+		RetryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, p)
+
+	// Entries no queue takes yet are counted, and wait until one is bound
+	for i := 0; i < 5; i++ {
+		p.Publish(Info, entry(i))
+	}
+	waitFor(t, "returned entries", func() bool { return p.Stats().Returned > 0 })
+	if stats := p.Stats(); stats.Published != 0 || stats.Dropped != 0 {
+		t.Fatalf("expected returned entries to be kept, got %+v", stats)
+	}
+
+	sink.mu.Lock()
+	sink.unroutable = false
+	sink.mu.Unlock()
+	waitFor(t, "all entries", func() bool { return len(sink.sent()) == 5 })
+	if stats := p.Stats(); stats.Published != 5 || stats.Dropped != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPublisherCountsDroppedEntries(t *testing.T) {
+	sink := &fakeSink{down: true}
+	p, err := NewPublisher(sink, Options{
+		BufferSize:    2,
+		SpillFile:     filepath.Join(t.TempDir(), "spill.jsonl"),
+		MaxSpillBytes: 150,
+		RetryInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without Run, two entries fit in the buffer and two lines of about 55 bytes in the
+	// spill file
+	for i := 0; i < 10; i++ {
+		p.Publish(Info, entry(i))
+	}
+	stats := p.Stats()
+	if stats.Buffered != 2 || stats.Spilled != 2 || stats.Dropped != 6 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Without a spill file, whatever doesn't fit in the buffer is dropped
+	p, err = NewPublisher(sink, Options{BufferSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		p.Publish(Info, entry(i))
+	}
+	if stats := p.Stats(); stats.Buffered != 2 || stats.Dropped != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPublisherSendsSpilledEntriesAfterRestart(t *testing.T) {
+	sink := &fakeSink{down: true}
+	opts := Options{
+		BufferSize:    5,
+		SpillFile:     filepath.Join(t.TempDir(), "spill.jsonl"),
+		RetryInterval: 10 * time.Millisecond,
+	}
+	p, err := NewPublisher(sink, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := run(t, p)
+	for i := 0; i < 3; i++ {
+		p.Publish(Info, entry(i))
+	}
+	// The buffered entries are written to the spill file on the way out
+	stop()
+	if stats := p.Stats(); stats.Spilled != 3 || stats.Buffered != 0 {
+		t.Fatalf("expected every entry in the spill file, got %+v", stats)
+	}
+
+	sink.setDown(false)
+	p, err = NewPublisher(sink, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.Stats(); stats.Spilled != 3 {
+		t.Fatalf("expected the spilled entries to be found, got %+v", stats)
+	}
+	p.Publish(Info, entry(3))
+	run(t, p)
+
+	waitFor(t, "all entries", func() bool { return len(sink.sent()) == 4 })
+	for i, got := range sink.sent() {
+		if want := fmt.Sprintf(`log.INFO {"name":"audit","data":"event %d"}`, i); got != want {
+			t.Errorf("entry %d: expected %s, got %s", i, want, got)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Package authz issues and checks the signed access tokens that the services use to decide
+// what a caller may do. Tokens are JWTs, signed with EdDSA by the authentication service,
+// which alone holds the private key, and verified by the other services with the public
+// key. They carry the caller's roles and the permissions those roles grant.
+package authz
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Permissions a token can grant. Routes require one or more of them.
+const (
+	LogsRead   = "logs:read"
+	LogsWrite  = "logs:write"
+	LogsAdmin  = "logs:admin"
+	MailSend   = "mail:send"
+	UsersAdmin = "users:admin"
+)
+
+// Permissions lists every permission a role can be given
+var Permissions = []string{LogsRead, LogsWrite, LogsAdmin, MailSend, UsersAdmin}
+
+// Issuer is the iss claim of every token
+const Issuer = "authentication-service"
+
+// ServiceTokenTTL is how long the tokens of services' own calls are valid
+const ServiceTokenTTL = 5 * time.Minute
+
+// ErrInvalidToken is returned for tokens that are malformed, expired, not signed by the
+// authentication service, or service tokens granting more than their service may
+var ErrInvalidToken = errors.New("invalid or expired access token")
+
+// ErrRevokedToken is returned for tokens of a login session that has been revoked
+var ErrRevokedToken = errors.New("access token belongs to a revoked session")
+
+// Claims are the contents of an access token. The subject is a user's id, or
+// "service:<name>" for a token a service minted for itself.
+type Claims struct {
+	Email       string   `json:"email,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// AMR lists how the user proved who they are when logging in, for example "pwd" for a
+	// password and "mfa" when a second factor was used as well
+	AMR []string `json:"amr,omitempty"`
+	// AuthTime is when the user last proved who they are, which is earlier than the issue
+	// time of tokens issued for a refreshed session
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	// SessionID names the login session the token was issued for. Tokens of a revoked
+	// session are refused by services that check a RevocationList.
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Can reports whether the claims grant permission
+func (c *Claims) Can(permission string) bool {
+	return slices.Contains(c.Permissions, permission)
+}
+
+// IsService reports whether the claims belong to a token a service minted for itself
+func (c *Claims) IsService() bool {
+	return strings.HasPrefix(c.Subject, "service:")
+}
+
+// ErrCannotSign is returned when a service that only verifies tokens tries to sign one
+var ErrCannotSign = errors.New("only the authentication service can sign access tokens")
+
+// ErrUnknownService is returned for a service token of a service that has no permission set
+var ErrUnknownService = errors.New("unknown service")
+
+// ServicePermissions are the permissions of each service's own tokens. A service token
+// that grants more than its service's set is refused, whoever signed it.
+var ServicePermissions = map[string][]string{
+	"authentication-service": {MailSend},
+	"broker-service":         {LogsWrite},
+	"listener-service":       {LogsWrite},
+}
+
+// Tokens verifies access tokens with the authentication service's public key, and, in the
+// authentication service, signs them with its private key
+type Tokens struct {
+	private     ed25519.PrivateKey
+	public      ed25519.PublicKey
+	now         func() time.Time
+	revocations *RevocationList
+}
+
+// NewSigner returns Tokens that sign with key, for the authentication service
+func NewSigner(key ed25519.PrivateKey) *Tokens {
+	return &Tokens{private: key, public: key.Public().(ed25519.PublicKey), now: time.Now}
+}
+
+// NewVerifier returns Tokens that only verify, with the authentication service's public key
+func NewVerifier(key ed25519.PublicKey) *Tokens {
+	return &Tokens{public: key, now: time.Now}
+}
+
+// CheckRevocations makes Parse refuse tokens of the sessions in list. It must be called
+// before the tokens are used.
+func (t *Tokens) CheckRevocations(list *RevocationList) {
+	t.revocations = list
+}
+
+// PrivateKeyFromEnv returns the authentication service's signing key, a PEM encoded
+// Ed25519 private key in JWT_PRIVATE_KEY
+func PrivateKeyFromEnv() (ed25519.PrivateKey, error) {
+	value := os.Getenv("JWT_PRIVATE_KEY")
+	if value == "" {
+		return nil, errors.New("JWT_PRIVATE_KEY is not set")
+	}
+	key, err := jwt.ParseEdPrivateKeyFromPEM([]byte(value))
+	if err != nil {
+		return nil, errors.New("JWT_PRIVATE_KEY must be a PEM encoded Ed25519 private key")
+	}
+	return key.(ed25519.PrivateKey), nil
+}
+
+// PublicKeyFromEnv returns the key that access tokens are verified with, a PEM encoded
+// Ed25519 public key in JWT_PUBLIC_KEY
+func PublicKeyFromEnv() (ed25519.PublicKey, error) {
+	value := os.Getenv("JWT_PUBLIC_KEY")
+	if value == "" {
+		return nil, errors.New("JWT_PUBLIC_KEY is not set")
+	}
+	key, err := jwt.ParseEdPublicKeyFromPEM([]byte(value))
+	if err != nil {
+		return nil, errors.New("JWT_PUBLIC_KEY must be a PEM encoded Ed25519 public key")
+	}
+	return key.(ed25519.PublicKey), nil
+}
+
+// Sign returns a token for claims that expires after ttl. The issuer, issue time and
+// expiry are filled in.
+func (t *Tokens) Sign(claims Claims, ttl time.Duration) (string, error) {
+	if t.private == nil {
+		return "", ErrCannotSign
+	}
+	now := t.now()
+	claims.Issuer = Issuer
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	return jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(t.private)
+}
+
+// ServiceToken returns a short-lived token for a service's own calls to other services,
+// granting the permissions in ServicePermissions
+func (t *Tokens) ServiceToken(service string) (string, error) {
+	permissions, ok := ServicePermissions[service]
+	if !ok {
+		return "", ErrUnknownService
+	}
+	return t.Sign(Claims{
+		Permissions:      permissions,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "service:" + service},
+	}, ServiceTokenTTL)
+}
+
+// Parse verifies token and returns its claims
+func (t *Tokens) Parse(token string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return t.public, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(t.now),
+	)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if service, ok := strings.CutPrefix(claims.Subject, "service:"); ok {
+		allowed, known := ServicePermissions[service]
+		if !known {
+			return nil, ErrInvalidToken
+		}
+		for _, p := range claims.Permissions {
+			if !slices.Contains(allowed, p) {
+				return nil, ErrInvalidToken
+			}
+		}
+	}
+	if claims.SessionID != "" && t.revocations != nil && t.revocations.Revoked(claims.SessionID) {
+		return nil, ErrRevokedToken
+	}
+	return &claims, nil
+}
@@ -0,0 +1,221 @@
+package authz
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newSigner returns Tokens that sign with a new key
+func newSigner(t *testing.T) *Tokens {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSigner(key)
+}
+
+func TestSignAndParse(t *testing.T) {
+	tokens := newSigner(t)
+	token, err := tokens.Sign(Claims{
+		Email:            "admin@example.com",
+		Roles:            []string{"admin"},
+		Permissions:      []string{UsersAdmin},
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "1"},
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := tokens.Parse(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "1" || claims.Email != "admin@example.com" || !claims.Can(UsersAdmin) || claims.Can(MailSend) {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	// The other services verify with the public key, and can't sign
+	verifier := NewVerifier(tokens.public)
+	if _, err := verifier.Parse(token); err != nil {
+		t.Errorf("verifier: %v", err)
+	}
+	if _, err := verifier.Sign(Claims{}, time.Minute); err != ErrCannotSign {
+		t.Errorf("verifier signed a token: got %v", err)
+	}
+	if _, err := newSigner(t).Parse(token); err != ErrInvalidToken {
+		t.Errorf("token signed with another key: got %v", err)
+	}
+	hs256, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Issuer: Issuer, ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+	}).SignedString([]byte("secret"))
+	if _, err := verifier.Parse(hs256); err != ErrInvalidToken {
+		t.Errorf("HS256 token: got %v", err)
+	}
+
+	tokens.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, err := tokens.Parse(token); err != ErrInvalidToken {
+		t.Errorf("expired token: got %v", err)
+	}
+}
+
+func TestServiceToken(t *testing.T) {
+	tokens := newSigner(t)
+
+	token, err := tokens.ServiceToken("broker-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokens.Parse(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claims.IsService() || !claims.Can(LogsWrite) || claims.Can(MailSend) {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	if _, err := tokens.ServiceToken("unknown"); err != ErrUnknownService {
+		t.Errorf("unknown service: got %v", err)
+	}
+
+	// A service token granting more than its service's set is refused
+	for _, claims := range []Claims{
+		{Permissions: []string{UsersAdmin}, RegisteredClaims: jwt.RegisteredClaims{Subject: "service:broker-service"}},
+		{Permissions: []string{LogsWrite}, RegisteredClaims: jwt.RegisteredClaims{Subject: "service:unknown"}},
+	} {
+		token, _ := tokens.Sign(claims, time.Minute)
+		if _, err := tokens.Parse(token); err != ErrInvalidToken {
+			t.Errorf("%s with %v: got %v", claims.Subject, claims.Permissions, err)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := newSigner(t)
+
+	r := gin.New()
+	r.POST("/send", tokens.Require(MailSend), func(c *gin.Context) {
+		claims, _ := FromContext(c)
+		c.String(http.StatusAccepted, claims.Subject)
+	})
+
+	mailer, _ := tokens.ServiceToken("authentication-service")
+	logger, _ := tokens.ServiceToken("broker-service")
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer not-a-token", http.StatusUnauthorized},
+		{"Bearer " + logger, http.StatusForbidden},
+		{"Bearer " + mailer, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/send", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%q: got %d, want %d", tt.header, rec.Code, tt.status)
+		}
+		if tt.status == http.StatusAccepted && rec.Body.String() != "service:authentication-service" {
+			t.Errorf("handler saw subject %q", rec.Body.String())
+		}
+	}
+}
+
+func TestRevokedSessions(t *testing.T) {
+	tokens := newSigner(t)
+	session, _ := tokens.Sign(Claims{SessionID: "s1", RegisteredClaims: jwt.RegisteredClaims{Subject: "1"}}, time.Minute)
+	other, _ := tokens.Sign(Claims{SessionID: "s2", RegisteredClaims: jwt.RegisteredClaims{Subject: "1"}}, time.Minute)
+
+	// The authentication service's feed of revoked sessions
+	revoked := []string{}
+	r := gin.New()
+	r.GET("/sessions/revoked", tokens.Require(), func(c *gin.Context) {
+		if claims, _ := FromContext(c); !claims.IsService() {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"error": false, "data": gin.H{"session_ids": revoked}})
+	})
+	auth := httptest.NewServer(r)
+	defer auth.Close()
+
+	list := NewRevocationList(RevocationsFromURL(auth.URL+"/sessions/revoked", tokens.ServiceTokens("broker-service")))
+	tokens.CheckRevocations(list)
+	if err := list.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Parse(session); err != nil {
+		t.Fatalf("active session: %v", err)
+	}
+
+	revoked = []string{"s1"}
+	if err := list.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Parse(session); err != ErrRevokedToken {
+		t.Errorf("revoked session: got %v", err)
+	}
+	if _, err := tokens.Parse(other); err != nil {
+		t.Errorf("other session: %v", err)
+	}
+
+	// A failed refresh keeps the sessions known to be revoked
+	auth.Close()
+	if err := list.Refresh(context.Background()); err == nil {
+		t.Error("refresh from a stopped service succeeded")
+	}
+	if !list.Revoked("s1") {
+		t.Error("failed refresh forgot a revoked session")
+	}
+}
+
+func TestServiceTokensFromURL(t *testing.T) {
+	tokens := newSigner(t)
+
+	// The authentication service's service token endpoint
+	var issued int
+	r := gin.New()
+	r.POST("/service-tokens", func(c *gin.Context) {
+		service, secret, ok := c.Request.BasicAuth()
+		if !ok || secret != "broker-secret" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		token, _ := tokens.ServiceToken(service)
+		issued++
+		c.JSON(http.StatusOK, gin.H{"error": false, "data": gin.H{"access_token": token, "expires_in": int(ServiceTokenTTL.Seconds())}})
+	})
+	auth := httptest.NewServer(r)
+	defer auth.Close()
+
+	source := ServiceTokensFromURL(auth.URL+"/service-tokens", "broker-service", "broker-secret")
+	for range 2 {
+		token, err := source(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims, err := tokens.Parse(token); err != nil || claims.Subject != "service:broker-service" {
+			t.Fatalf("unexpected token %+v (%v)", claims, err)
+		}
+	}
+	if issued != 1 {
+		t.Errorf("expected the token to be reused, %d were issued", issued)
+	}
+
+	if _, err := ServiceTokensFromURL(auth.URL+"/service-tokens", "broker-service", "wrong")(context.Background()); err == nil {
+		t.Error("expected a wrong secret to fail")
+	}
+}
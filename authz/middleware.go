@@ -0,0 +1,78 @@
+package authz
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const claimsKey = "authz.claims"
+
+// Require returns middleware that only lets a request through if it carries a valid
+// access token granting every one of permissions. Other requests get a 401, or a 403 if
+// the token is valid but lacks a permission.
+func (t *Tokens) Require(permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !t.Authorize(c, permissions...) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// Authorize does the same checks as Require, for handlers that decide which permissions
+// a request needs only after reading it. When the request is refused, the error response
+// has been written and the context aborted.
+func (t *Tokens) Authorize(c *gin.Context, permissions ...string) bool {
+	claims, ok := FromContext(c)
+	if !ok {
+		token, found := BearerToken(c)
+		if !found {
+			abort(c, http.StatusUnauthorized, "missing access token")
+			return false
+		}
+		var err error
+		if claims, err = t.Parse(token); err != nil {
+			abort(c, http.StatusUnauthorized, err.Error())
+			return false
+		}
+		c.Set(claimsKey, claims)
+	}
+
+	for _, p := range permissions {
+		if !claims.Can(p) {
+			abort(c, http.StatusForbidden, "missing permission "+p)
+			return false
+		}
+	}
+	return true
+}
+
+// FromContext returns the claims of a request that was let through by Require or Authorize
+func FromContext(c *gin.Context) (*Claims, bool) {
+	v, ok := c.Get(claimsKey)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := v.(*Claims)
+	return claims, ok
+}
+
+// BearerToken returns the token from a request's "Authorization: Bearer" header
+func BearerToken(c *gin.Context) (string, bool) {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// abort writes an error in the same shape as the services' own JSON responses
+func abort(c *gin.Context, status int, message string) {
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", "Bearer")
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": true, "message": message})
+}
@@ -0,0 +1,121 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RevocationRefreshInterval is how often services read the revoked sessions again, and so
+// about how long a revoked session's access tokens keep working
+const RevocationRefreshInterval = 5 * time.Second
+
+// RevocationSource returns the IDs of the revoked sessions whose access tokens may not
+// have expired yet
+type RevocationSource func(ctx context.Context) ([]string, error)
+
+// RevocationList keeps the revoked sessions in memory, so that checking a token doesn't
+// need a call to the authentication service. Run keeps it up to date.
+type RevocationList struct {
+	source RevocationSource
+
+	mu      sync.RWMutex
+	revoked map[string]bool
+}
+
+// NewRevocationList returns an empty list that is filled from source
+func NewRevocationList(source RevocationSource) *RevocationList {
+	return &RevocationList{source: source, revoked: map[string]bool{}}
+}
+
+// Revoked reports whether the session with id sessionID is revoked
+func (l *RevocationList) Revoked(sessionID string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.revoked[sessionID]
+}
+
+// Add marks sessions as revoked until the next refresh, for the service that revoked them
+func (l *RevocationList) Add(sessionIDs ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range sessionIDs {
+		l.revoked[id] = true
+	}
+}
+
+// Refresh replaces the list with the one from the source. When that fails the old list
+// is kept.
+func (l *RevocationList) Refresh(ctx context.Context) error {
+	ids, err := l.source(ctx)
+	if err != nil {
+		return err
+	}
+
+	revoked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		revoked[id] = true
+	}
+	l.mu.Lock()
+	l.revoked = revoked
+	l.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the list every interval, until stop is closed
+func (l *RevocationList) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := l.Refresh(ctx); err != nil {
+			log.Println("Error refreshing revoked sessions:", err)
+		}
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RevocationsFromURL returns a source that reads the revoked sessions from the
+// authentication service at url, authorized with a token from tokens
+func RevocationsFromURL(url string, tokens ServiceTokenSource) RevocationSource {
+	return func(ctx context.Context) ([]string, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		token, err := tokens(ctx)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("revoked sessions: status code %d", response.StatusCode)
+		}
+
+		var payload struct {
+			Data struct {
+				SessionIDs []string `json:"session_ids"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&payload); err != nil {
+			return nil, err
+		}
+		return payload.Data.SessionIDs, nil
+	}
+}
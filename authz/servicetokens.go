@@ -0,0 +1,82 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// serviceTokenMargin is how long before it expires a service token is replaced
+const serviceTokenMargin = time.Minute
+
+// ServiceTokenSource returns a token of a service's own, for its calls to other services
+type ServiceTokenSource func(ctx context.Context) (string, error)
+
+// ServiceTokens returns a source that signs the tokens of service itself, for the
+// authentication service
+func (t *Tokens) ServiceTokens(service string) ServiceTokenSource {
+	return func(context.Context) (string, error) {
+		return t.ServiceToken(service)
+	}
+}
+
+// ServiceTokensFromURL returns a source that gets the tokens of service from the
+// authentication service at url, proving who it is with secret. A token is reused until
+// a minute before it expires.
+func ServiceTokensFromURL(url, service, secret string) ServiceTokenSource {
+	var (
+		mu      sync.Mutex
+		token   string
+		expires time.Time
+	)
+	return func(ctx context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if token != "" && time.Until(expires) > serviceTokenMargin {
+			return token, nil
+		}
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+		if err != nil {
+			return "", err
+		}
+		request.SetBasicAuth(service, secret)
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("service token: status code %d", response.StatusCode)
+		}
+
+		var payload struct {
+			Data struct {
+				AccessToken string `json:"access_token"`
+				ExpiresIn   int    `json:"expires_in"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(response.Body).Decode(&payload); err != nil {
+			return "", err
+		}
+		token = payload.Data.AccessToken
+		expires = time.Now().Add(time.Duration(payload.Data.ExpiresIn) * time.Second)
+		return token, nil
+	}
+}
+
+// ServiceSecretFromEnv returns the secret in SERVICE_SECRET, with which a service gets its
+// tokens from the authentication service
+func ServiceSecretFromEnv() (string, error) {
+	secret := os.Getenv("SERVICE_SECRET")
+	if secret == "" {
+		return "", errors.New("SERVICE_SECRET is not set")
+	}
+	return secret, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyCacheTTL is how long a checked API key is trusted without asking the
+// authentication service again, and so about how long a revoked key keeps working. It is
+// well within the life of the access token the key is swapped for.
+const apiKeyCacheTTL = 30 * time.Second
+
+var errInvalidAPIKey = errors.New("invalid or expired API key")
+
+// apiKeyIdentity is who an API key belongs to and what it may do, as the authentication
+// service reports it, with an access token it signed for them
+type apiKeyIdentity struct {
+	AccessToken string     `json:"access_token"`
+	Prefix      string     `json:"prefix"`
+	UserID      int        `json:"user_id"`
+	Email       string     `json:"email"`
+	Permissions []string   `json:"permissions"`
+	AMR         []string   `json:"amr"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+// apiKeyCache remembers the API keys that the authentication service accepted, by hash
+type apiKeyCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cachedAPIKey
+}
+
+type cachedAPIKey struct {
+	identity apiKeyIdentity
+	until    time.Time
+}
+
+func newAPIKeyCache(ttl time.Duration) *apiKeyCache {
+	return &apiKeyCache{ttl: ttl, now: time.Now, entries: map[string]cachedAPIKey{}}
+}
+
+func (c *apiKeyCache) get(key string) (apiKeyIdentity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[hashAPIKey(key)]
+	if !ok || !c.now().Before(entry.until) {
+		return apiKeyIdentity{}, false
+	}
+	return entry.identity, true
+}
+
+// put caches identity for key, but not past the key's expiry. Entries that ran out are
+// dropped at the same time.
+func (c *apiKeyCache) put(key string, identity apiKeyIdentity) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for hash, entry := range c.entries {
+		if !now.Before(entry.until) {
+			delete(c.entries, hash)
+		}
+	}
+	until := now.Add(c.ttl)
+	if identity.ExpiresAt != nil && identity.ExpiresAt.Before(until) {
+		until = *identity.ExpiresAt
+	}
+	c.entries[hashAPIKey(key)] = cachedAPIKey{identity: identity, until: until}
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyAuth lets scripts call the broker with "Authorization: ApiKey <key>". The key is
+// checked with the authentication service and swapped for the short-lived access token of
+// the key's user that it issues, carrying just the key's permissions, so the handlers and
+// the services the request is forwarded to see an ordinary bearer token. Other requests
+// pass through unchanged.
+func (app *Config) apiKeyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scheme, key, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "ApiKey") {
+			c.Next()
+			return
+		}
+
+		identity, err := app.checkAPIKey(c.Request.Context(), strings.TrimSpace(key))
+		if errors.Is(err, errInvalidAPIKey) {
+			c.Header("WWW-Authenticate", "ApiKey")
+			app.errorJSON(c, err, http.StatusUnauthorized)
+			c.Abort()
+			return
+		} else if err != nil {
+			log.Println("Error checking API key:", err)
+			app.errorJSON(c, errors.New("could not check API key"), http.StatusBadGateway)
+			c.Abort()
+			return
+		}
+
+		c.Request.Header.Set("Authorization", "Bearer "+identity.AccessToken)
+
+		msg := fmt.Sprintf("API key %s of %s used for %s %s", identity.Prefix, identity.Email, c.Request.Method, c.Request.URL.Path)
+		go func() {
+			if err := app.logEvent("api-key", msg); err != nil {
+				log.Println("Error logging API key use:", err)
+			}
+		}()
+		c.Next()
+	}
+}
+
+// checkAPIKey returns the identity of key, from the cache or the authentication service
+func (app *Config) checkAPIKey(ctx context.Context, key string) (apiKeyIdentity, error) {
+	if key == "" {
+		return apiKeyIdentity{}, errInvalidAPIKey
+	}
+	if identity, ok := app.APIKeys.get(key); ok {
+		return identity, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"key": key})
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, app.AuthServiceURL+"/api-keys/verify", bytes.NewReader(body))
+	if err != nil {
+		return apiKeyIdentity{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if err := app.setServiceToken(request); err != nil {
+		return apiKeyIdentity{}, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return apiKeyIdentity{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusUnauthorized {
+		return apiKeyIdentity{}, errInvalidAPIKey
+	} else if response.StatusCode != http.StatusOK {
+		return apiKeyIdentity{}, fmt.Errorf("verifying API key: status code %d", response.StatusCode)
+	}
+
+	var payload struct {
+		Data apiKeyIdentity `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&payload); err != nil {
+		return apiKeyIdentity{}, err
+	}
+	app.APIKeys.put(key, payload.Data)
+	return payload.Data, nil
+}
+
+// logEvent writes an entry to the logger service on the broker's own behalf
+func (app *Config) logEvent(name, data string) error {
+	body, _ := json.Marshal(LogPayload{Name: name, Data: data})
+	request, err := http.NewRequest(http.MethodPost, app.LogServiceURL+"/log", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if err := app.setServiceToken(request); err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("error logging event: status code %d", response.StatusCode)
+	}
+	return nil
+}
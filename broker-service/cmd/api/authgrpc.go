@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"broker/auth"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// authGRPCTimeout bounds a call to the AuthService, which hashes passwords on login
+const authGRPCTimeout = 5 * time.Second
+
+// userResponse is a user as the authentication service's HTTP API writes it
+type userResponse struct {
+	ID        int64     `json:"id"`
+	Email     string    `json:"email"`
+	FirstName string    `json:"first_name,omitempty"`
+	LastName  string    `json:"last_name,omitempty"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newUserResponse(user *auth.User) userResponse {
+	return userResponse{
+		ID:        user.GetId(),
+		Email:     user.GetEmail(),
+		FirstName: user.GetFirstName(),
+		LastName:  user.GetLastName(),
+		Active:    user.GetActive(),
+		CreatedAt: user.GetCreatedAt().AsTime(),
+		UpdatedAt: user.GetUpdatedAt().AsTime(),
+	}
+}
+
+// newAuthClient connects to the authentication service's AuthService. The connection is
+// made on the first call.
+func newAuthClient(address string) (auth.AuthServiceClient, error) {
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewAuthServiceClient(conn), nil
+}
+
+// authenticateViaGRPC logs a user in with the AuthService, and answers like authenticate
+func (app *Config) authenticateViaGRPC(c *gin.Context, a AuthPayload) {
+	// As over HTTP, the auth service limits failed logins per client IP, so pass on the caller's
+	ctx, cancel := context.WithTimeout(metadata.AppendToOutgoingContext(c.Request.Context(),
+		"x-forwarded-for", c.ClientIP(),
+		"x-forwarded-user-agent", c.Request.UserAgent(),
+	), authGRPCTimeout)
+	defer cancel()
+
+	resp, err := app.AuthClient.Authenticate(ctx, &auth.AuthenticateRequest{Email: a.Email, Password: a.Password})
+	if err != nil {
+		app.grpcErrorJSON(c, err)
+		return
+	}
+
+	data := gin.H{
+		"user":       newUserResponse(resp.GetUser()),
+		"expires_in": resp.GetExpiresIn(),
+	}
+	if resp.GetMfaRequired() {
+		data["mfa_required"] = true
+		data["mfa_token"] = resp.GetMfaToken()
+	} else {
+		data["access_token"] = resp.GetAccessToken()
+		data["token_type"] = resp.GetTokenType()
+		data["refresh_token"] = resp.GetRefreshToken()
+	}
+
+	app.writeJSON(c, http.StatusAccepted, jsonResponse{
+		Error:   false,
+		Message: "Authenticated!",
+		Data:    data,
+	})
+}
+
+// manageUserViaGRPC answers "user.get" and "user.list" from the AuthService, with the same
+// responses as the user management API
+func (app *Config) manageUserViaGRPC(c *gin.Context, action string, u UserPayload) {
+	ctx := c.Request.Context()
+	if authorization := c.GetHeader("Authorization"); authorization != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", authorization)
+	}
+	ctx, cancel := context.WithTimeout(ctx, authGRPCTimeout)
+	defer cancel()
+
+	if action == "user.get" {
+		if u.ID <= 0 {
+			app.errorJSON(c, errors.New("user id is required"))
+			return
+		}
+		user, err := app.AuthClient.GetUser(ctx, &auth.GetUserRequest{Id: int64(u.ID)})
+		if err != nil {
+			app.grpcErrorJSON(c, err)
+			return
+		}
+		app.writeJSON(c, http.StatusOK, jsonResponse{
+			Error:   false,
+			Message: "user " + user.GetEmail(),
+			Data:    newUserResponse(user),
+		})
+		return
+	}
+
+	page, err := app.AuthClient.ListUsers(ctx, &auth.ListUsersRequest{
+		Page:     int32(min(u.Page, math.MaxInt32)),
+		PageSize: int32(min(u.PageSize, math.MaxInt32)),
+		Search:   u.Search,
+	})
+	if err != nil {
+		app.grpcErrorJSON(c, err)
+		return
+	}
+	users := make([]userResponse, len(page.GetUsers()))
+	for i, user := range page.GetUsers() {
+		users[i] = newUserResponse(user)
+	}
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d users", page.GetTotal()),
+		Data: gin.H{
+			"users":     users,
+			"total":     page.GetTotal(),
+			"page":      page.GetPage(),
+			"page_size": page.GetPageSize(),
+		},
+	})
+}
+
+// grpcErrorJSON sends the HTTP equivalent of an error from the AuthService
+func (app *Config) grpcErrorJSON(c *gin.Context, err error) {
+	st := status.Convert(err)
+
+	switch st.Code() {
+	case codes.InvalidArgument:
+		app.errorJSON(c, errors.New(st.Message()))
+	case codes.Unauthenticated:
+		app.errorJSON(c, errors.New(st.Message()), http.StatusUnauthorized)
+	case codes.PermissionDenied:
+		app.errorJSON(c, errors.New(st.Message()), http.StatusForbidden)
+	case codes.NotFound:
+		app.errorJSON(c, errors.New(st.Message()), http.StatusNotFound)
+	case codes.ResourceExhausted:
+		for _, detail := range st.Details() {
+			if retry, ok := detail.(*errdetails.RetryInfo); ok {
+				wait := retry.GetRetryDelay().AsDuration()
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			}
+		}
+		app.errorJSON(c, errors.New("too many failed login attempts, try again later"), http.StatusTooManyRequests)
+	default:
+		app.errorJSON(c, errors.New("error calling auth service"), http.StatusBadGateway)
+	}
+}
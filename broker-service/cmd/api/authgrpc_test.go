@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"authz"
+	"broker/auth"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcAuthServer is a stand-in for the authentication service's AuthService
+type grpcAuthServer struct {
+	auth.UnimplementedAuthServiceServer
+	h *harness
+
+	mu       sync.Mutex
+	metadata []metadata.MD
+}
+
+func (s *grpcAuthServer) record(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadata = append(s.metadata, md)
+}
+
+func (s *grpcAuthServer) calls() []metadata.MD {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]metadata.MD(nil), s.metadata...)
+}
+
+func (s *grpcAuthServer) Authenticate(ctx context.Context, req *auth.AuthenticateRequest) (*auth.AuthenticateResponse, error) {
+	s.record(ctx)
+	user := &auth.User{Id: 1, Email: req.GetEmail(), Active: true, CreatedAt: timestamppb.Now(), UpdatedAt: timestamppb.Now()}
+
+	switch {
+	case req.GetEmail() == "locked@example.com":
+		st, _ := status.New(codes.ResourceExhausted, "too many failed login attempts").
+			WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(41500 * time.Millisecond)})
+		return nil, st.Err()
+	case req.GetEmail() == "inactive@example.com":
+		return nil, status.Error(codes.PermissionDenied, "account is not active")
+	case req.GetEmail() == "mfa@example.com":
+		return &auth.AuthenticateResponse{User: user, MfaRequired: true, MfaToken: "challenge", ExpiresIn: 300}, nil
+	case req.GetPassword() != "verysecret":
+		return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+	}
+	return &auth.AuthenticateResponse{User: user, AccessToken: "token", TokenType: "Bearer", ExpiresIn: 900, RefreshToken: "refresh"}, nil
+}
+
+// admin checks the bearer token the broker forwarded, like the AuthService does
+func (s *grpcAuthServer) admin(ctx context.Context) error {
+	s.record(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	var authorization string
+	if values := md.Get("authorization"); len(values) > 0 {
+		authorization = values[0]
+	}
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing access token")
+	}
+	claims, err := s.h.tokens.Parse(token)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	if !claims.Can(authz.UsersAdmin) {
+		return status.Error(codes.PermissionDenied, "missing permission "+authz.UsersAdmin)
+	}
+	return nil
+}
+
+func (s *grpcAuthServer) GetUser(ctx context.Context, req *auth.GetUserRequest) (*auth.User, error) {
+	if err := s.admin(ctx); err != nil {
+		return nil, err
+	}
+	if req.GetId() != 7 {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	return &auth.User{Id: 7, Email: "grace@example.com", FirstName: "Grace", Active: true, CreatedAt: timestamppb.Now()}, nil
+}
+
+func (s *grpcAuthServer) ListUsers(ctx context.Context, req *auth.ListUsersRequest) (*auth.ListUsersResponse, error) {
+	if err := s.admin(ctx); err != nil {
+		return nil, err
+	}
+	return &auth.ListUsersResponse{
+		Users:    []*auth.User{{Id: 7, Email: "grace@example.com"}},
+		Total:    11,
+		Page:     req.GetPage(),
+		PageSize: req.GetPageSize(),
+	}, nil
+}
+
+// useAuthGRPC points the harness's broker at a fake AuthService
+func (h *harness) useAuthGRPC(t *testing.T) *grpcAuthServer {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl := &grpcAuthServer{h: h}
+	s := grpc.NewServer()
+	auth.RegisterAuthServiceServer(s, impl)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	h.app.AuthClient, err = newAuthClient(lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return impl
+}
+
+func TestHandleAuthViaGRPC(t *testing.T) {
+	h := newHarness(t)
+	fake := h.useAuthGRPC(t)
+
+	status, resp := h.post(t, "/handle", RequestPayload{
+		Action: "auth",
+		Auth:   AuthPayload{Email: "admin@example.com", Password: "verysecret"},
+	}, "User-Agent", "test-agent")
+	data, _ := resp.Data.(map[string]any)
+	user, _ := data["user"].(map[string]any)
+	if status != http.StatusAccepted || resp.Message != "Authenticated!" || data["access_token"] != "token" ||
+		data["refresh_token"] != "refresh" || user["email"] != "admin@example.com" {
+		t.Fatalf("expected a login, got %d %+v", status, resp)
+	}
+	md := fake.calls()[0]
+	if got := md.Get("x-forwarded-for"); len(got) != 1 || got[0] != "127.0.0.1" {
+		t.Errorf("expected the client IP to be forwarded, got %v", got)
+	}
+	if got := md.Get("x-forwarded-user-agent"); len(got) != 1 || got[0] != "test-agent" {
+		t.Errorf("expected the user agent to be forwarded, got %v", got)
+	}
+	if got := h.authRequests(); len(got) != 0 {
+		t.Errorf("expected no calls over HTTP, got %+v", got)
+	}
+
+	status, resp = h.post(t, "/handle", RequestPayload{Action: "auth", Auth: AuthPayload{Email: "mfa@example.com"}})
+	data, _ = resp.Data.(map[string]any)
+	if status != http.StatusAccepted || data["mfa_required"] != true || data["mfa_token"] != "challenge" || data["access_token"] != nil {
+		t.Fatalf("expected an MFA challenge, got %d %+v", status, resp)
+	}
+
+	tests := map[string]struct {
+		email   string
+		status  int
+		message string
+	}{
+		"wrong password":   {"admin@example.com", http.StatusUnauthorized, "invalid credentials"},
+		"inactive account": {"inactive@example.com", http.StatusForbidden, "account is not active"},
+		"locked account":   {"locked@example.com", http.StatusTooManyRequests, "too many failed login attempts, try again later"},
+	}
+	for name, tt := range tests {
+		status, resp := h.post(t, "/handle", RequestPayload{Action: "auth", Auth: AuthPayload{Email: tt.email, Password: "wrong"}})
+		if status != tt.status || !resp.Error || resp.Message != tt.message {
+			t.Errorf("%s: expected %d %q, got %d %+v", name, tt.status, tt.message, status, resp)
+		}
+	}
+}
+
+func TestHandleAuthViaGRPCRelaysRetryAfter(t *testing.T) {
+	h := newHarness(t)
+	h.useAuthGRPC(t)
+
+	req, _ := http.NewRequest(http.MethodPost, h.broker.URL+"/handle",
+		strings.NewReader(`{"action":"auth","auth":{"email":"locked@example.com","password":"verysecret"}}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "42" {
+		t.Fatalf("expected Retry-After 42, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestHandleUserActionsViaGRPC(t *testing.T) {
+	h := newHarness(t)
+	fake := h.useAuthGRPC(t)
+	bearer := "Bearer " + h.adminToken(t)
+
+	status, resp := h.post(t, "/handle", RequestPayload{Action: "user.get", User: UserPayload{ID: 7}}, "Authorization", bearer)
+	user, _ := resp.Data.(map[string]any)
+	if status != http.StatusOK || resp.Message != "user grace@example.com" || user["first_name"] != "Grace" || user["id"] != float64(7) {
+		t.Fatalf("unexpected user %d %+v", status, resp)
+	}
+	if got := fake.calls()[0].Get("authorization"); len(got) != 1 || got[0] != bearer {
+		t.Errorf("expected the caller's token to be forwarded, got %v", got)
+	}
+
+	status, resp = h.post(t, "/handle", RequestPayload{Action: "user.list", User: UserPayload{Page: 2, PageSize: 10}}, "Authorization", bearer)
+	page, _ := resp.Data.(map[string]any)
+	if users, _ := page["users"].([]any); status != http.StatusOK || resp.Message != "11 users" || len(users) != 1 ||
+		page["page"] != float64(2) || page["page_size"] != float64(10) {
+		t.Fatalf("unexpected page %d %+v", status, resp)
+	}
+
+	status, resp = h.post(t, "/handle", RequestPayload{Action: "user.get", User: UserPayload{ID: 8}}, "Authorization", bearer)
+	if status != http.StatusNotFound || resp.Message != "user not found" {
+		t.Errorf("expected an unknown user not to be found, got %d %+v", status, resp)
+	}
+
+	// Other user actions still go over HTTP
+	status, _ = h.post(t, "/handle", RequestPayload{Action: "user.deactivate", User: UserPayload{ID: 7}}, "Authorization", bearer)
+	if got := h.userRequests(); status != http.StatusOK || len(got) != 1 || got[0].Path != "/users/7/deactivate" {
+		t.Errorf("expected user.deactivate over HTTP, got %d %+v", status, got)
+	}
+}
@@ -12,7 +12,9 @@ import (
 	"github.com/gin-gonic/gin"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 
+	"authz"
 	"broker/event"
 	"broker/logs"
 )
@@ -21,8 +23,17 @@ import (
 type RequestPayload struct {
 	Action string      `json:"action"`
 	Auth   AuthPayload `json:"auth,omitempty"`
-	Log    LogPayload  `json:"log,omitempty"`
-	Mail   MailPayload `json:"mail,omitempty"`
+	MFA    MFAPayload  `json:"mfa,omitempty"`
+	// Refresh is used by "auth.refresh"
+	Refresh RefreshPayload `json:"refresh,omitempty"`
+	Session SessionPayload `json:"session,omitempty"`
+	// Reauth is used by "auth.reauthenticate"
+	Reauth  ReauthPayload  `json:"reauth,omitempty"`
+	Profile ProfilePayload `json:"profile,omitempty"`
+	Log     LogPayload     `json:"log,omitempty"`
+	Mail    MailPayload    `json:"mail,omitempty"`
+	User    UserPayload    `json:"user,omitempty"`
+	Role    RolePayload    `json:"role,omitempty"`
 }
 
 // MailPayload is the embedded type (in RequestPayload) that describes an email message to be sent
@@ -39,6 +50,67 @@ type AuthPayload struct {
 	Password string `json:"password"`
 }
 
+// MFAPayload is the embedded type (in RequestPayload) that completes a login for a user with
+// MFA enabled, using the mfa_token from the "auth" response and either a TOTP code or a
+// recovery code
+type MFAPayload struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// RefreshPayload is the embedded type (in RequestPayload) that exchanges the refresh_token
+// from a login for new tokens
+type RefreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// ReauthPayload is the embedded type (in RequestPayload) with which logged in users prove who
+// they are again, before sensitive changes. Users with MFA enabled send a code as well.
+type ReauthPayload struct {
+	Password     string `json:"password"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// ProfilePayload is the embedded type (in RequestPayload) for the "profile.*" actions on
+// the caller's own account
+type ProfilePayload struct {
+	FirstName *string `json:"first_name,omitempty"`
+	LastName  *string `json:"last_name,omitempty"`
+	// Email is the new address, for profile.email
+	Email string `json:"email,omitempty"`
+}
+
+// SessionPayload is the embedded type (in RequestPayload) that names one of the caller's
+// sessions, for session.revoke
+type SessionPayload struct {
+	ID string `json:"id,omitempty"`
+}
+
+// UserPayload is the embedded type (in RequestPayload) that describes a user management request.
+// Which fields are used depends on the "user.*" action.
+type UserPayload struct {
+	ID        int    `json:"id,omitempty"`
+	Email     string `json:"email,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	Password  string `json:"password,omitempty"`
+	Active    *bool  `json:"active,omitempty"`
+	Page      int    `json:"page,omitempty"`
+	PageSize  int    `json:"page_size,omitempty"`
+	Search    string `json:"search,omitempty"`
+	// Roles replaces the user's roles, for user.set_roles
+	Roles []string `json:"roles,omitempty"`
+}
+
+// RolePayload is the embedded type (in RequestPayload) for the "role.*" actions
+type RolePayload struct {
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
 // LogPayload is the embedded type (in RequestPayload) that describes a request to log something
 type LogPayload struct {
 	Name string `json:"name"`
@@ -68,21 +140,51 @@ func (app *Config) HandleSubmission(c *gin.Context) {
 
 	switch requestPayload.Action {
 	case "auth":
-		app.authenticate(c, requestPayload.Auth)
+		if app.AuthClient != nil {
+			app.authenticateViaGRPC(c, requestPayload.Auth)
+		} else {
+			app.authenticate(c, "/authenticate", requestPayload.Auth)
+		}
+	case "auth.mfa":
+		app.authenticate(c, "/mfa/verify", requestPayload.MFA)
+	case "auth.refresh":
+		app.authenticate(c, "/refresh", requestPayload.Refresh)
+	case "auth.logout", "session.list", "session.revoke":
+		if app.Tokens.Authorize(c) {
+			app.manageSession(c, requestPayload.Action, requestPayload.Session)
+		}
+	case "auth.reauthenticate", "profile.get", "profile.update", "profile.email":
+		if app.Tokens.Authorize(c) {
+			app.manageProfile(c, requestPayload.Action, requestPayload.Reauth, requestPayload.Profile)
+		}
 	case "log":
-		app.logItemViaRPC(c, requestPayload.Log)
+		if app.Tokens.Authorize(c, authz.LogsWrite) {
+			app.logItemViaRPC(c, requestPayload.Log)
+		}
 	case "mail":
-		app.sendMail(c, requestPayload.Mail)
+		if app.Tokens.Authorize(c, authz.MailSend) {
+			app.sendMail(c, requestPayload.Mail)
+		}
+	case "user.list", "user.get", "user.create", "user.update", "user.deactivate", "user.reactivate", "user.delete",
+		"user.restore", "user.erase", "user.reset_password", "user.roles", "user.set_roles", "user.revoke_sessions":
+		if app.Tokens.Authorize(c, authz.UsersAdmin) {
+			app.manageUser(c, requestPayload.Action, requestPayload.User)
+		}
+	case "role.list", "role.get", "role.create", "role.update", "role.delete":
+		if app.Tokens.Authorize(c, authz.UsersAdmin) {
+			app.manageRole(c, requestPayload.Action, requestPayload.Role)
+		}
 	default:
 		app.errorJSON(c, errors.New("unknown action"))
 	}
 }
 
-// logItem logs an item by making an HTTP Post request with a JSON payload, to the logger microservice
+// logItem logs an item by making an HTTP Post request with a JSON payload, to the logger
+// microservice. The caller must have been authorized for logs:write.
 func (app *Config) LogItem(c *gin.Context, entry LogPayload) {
 	jsonData, _ := json.MarshalIndent(entry, "", "\t")
 
-	logServiceURL := "http://logger-service/log"
+	logServiceURL := app.LogServiceURL + "/log"
 
 	request, err := http.NewRequest("POST", logServiceURL, bytes.NewBuffer(jsonData))
 	if err != nil {
@@ -91,6 +193,8 @@ func (app *Config) LogItem(c *gin.Context, entry LogPayload) {
 	}
 
 	request.Header.Set("Content-Type", "application/json")
+	// The entry is written on the caller's behalf, with their token
+	request.Header.Set("Authorization", c.GetHeader("Authorization"))
 
 	client := &http.Client{}
 
@@ -113,15 +217,20 @@ func (app *Config) LogItem(c *gin.Context, entry LogPayload) {
 	app.writeJSON(c, http.StatusAccepted, payload)
 }
 
-// authenticate calls the authentication microservice and sends back the appropriate response
-func (app *Config) authenticate(c *gin.Context, a AuthPayload) {
-	jsonData, _ := json.MarshalIndent(a, "", "\t")
+// authenticate posts a login step to path on the authentication microservice and sends back
+// the appropriate response
+func (app *Config) authenticate(c *gin.Context, path string, body any) {
+	jsonData, _ := json.MarshalIndent(body, "", "\t")
 
-	request, err := http.NewRequest("POST", "http://authentication-service/authenticate", bytes.NewBuffer(jsonData))
+	request, err := http.NewRequest("POST", app.AuthServiceURL+path, bytes.NewBuffer(jsonData))
 	if err != nil {
 		app.errorJSON(c, err)
 		return
 	}
+	// The auth service limits failed logins per client IP, so pass on the caller's. Sessions
+	// record both, for users to recognize them by.
+	request.Header.Set("X-Forwarded-For", c.ClientIP())
+	request.Header.Set("User-Agent", c.Request.UserAgent())
 
 	client := &http.Client{}
 	response, err := client.Do(request)
@@ -134,15 +243,23 @@ func (app *Config) authenticate(c *gin.Context, a AuthPayload) {
 	if response.StatusCode == http.StatusUnauthorized {
 		app.errorJSON(c, errors.New("invalid credentials"))
 		return
-	} else if response.StatusCode != http.StatusAccepted {
-		app.errorJSON(c, errors.New("error calling auth service"))
+	} else if response.StatusCode == http.StatusTooManyRequests {
+		c.Header("Retry-After", response.Header.Get("Retry-After"))
+		app.errorJSON(c, errors.New("too many failed login attempts, try again later"), http.StatusTooManyRequests)
 		return
 	}
 
 	var jsonFromService jsonResponse
 
 	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
-	if err != nil {
+	if response.StatusCode == http.StatusBadRequest && err == nil && jsonFromService.Message != "" {
+		// Such as a wrong password or MFA code
+		app.errorJSON(c, errors.New(jsonFromService.Message))
+		return
+	} else if response.StatusCode != http.StatusAccepted {
+		app.errorJSON(c, errors.New("error calling auth service"))
+		return
+	} else if err != nil {
 		app.errorJSON(c, err)
 		return
 	}
@@ -160,11 +277,12 @@ func (app *Config) authenticate(c *gin.Context, a AuthPayload) {
 	app.writeJSON(c, http.StatusAccepted, payload)
 }
 
-// sendMail sends email by calling the mail microservice
+// sendMail sends email by calling the mail microservice. The caller must have been
+// authorized for mail:send.
 func (app *Config) sendMail(c *gin.Context, msg MailPayload) {
 	jsonData, _ := json.MarshalIndent(msg, "", "\t")
 
-	mailServiceURL := "http://mailer-service/send"
+	mailServiceURL := app.MailServiceURL + "/send"
 
 	request, err := http.NewRequest("POST", mailServiceURL, bytes.NewBuffer(jsonData))
 	if err != nil {
@@ -173,6 +291,8 @@ func (app *Config) sendMail(c *gin.Context, msg MailPayload) {
 	}
 
 	request.Header.Set("Content-Type", "application/json")
+	// The mail is sent on the caller's behalf, with their token
+	request.Header.Set("Authorization", c.GetHeader("Authorization"))
 
 	client := &http.Client{}
 	response, err := client.Do(request)
@@ -241,7 +361,7 @@ type RPCPayload struct {
 
 // logItemViaRPC logs an item by making an RPC call to the logger microservice
 func (app *Config) logItemViaRPC(c *gin.Context, l LogPayload) {
-	client, err := rpc.Dial("tcp", "logger-service:5001")
+	client, err := rpc.Dial("tcp", app.LogRPCAddress)
 	if err != nil {
 		app.errorJSON(c, err)
 		return
@@ -274,7 +394,8 @@ func ConvertLogPayloadToRPCPayload(logPayload LogPayload) RPCPayload {
 	}
 }
 
-// LogViaGRPC handles the gRPC call to write logs
+// LogViaGRPC handles the gRPC call to write logs. Routes require logs:write for it, and
+// the caller's token is passed on to the logger.
 func (app *Config) LogViaGRPC(c *gin.Context) {
 	var requestPayload RequestPayload
 
@@ -288,8 +409,18 @@ func (app *Config) LogViaGRPC(c *gin.Context) {
 	// Convert LogPayload to RPCPayload using the conversion function
 	rpcPayload := ConvertLogPayloadToRPCPayload(requestPayload.Log)
 
+	if app.LogStream != nil {
+		err = app.LogStream.Send(&logs.Log{Name: rpcPayload.Name, Data: rpcPayload.Data})
+		if err != nil {
+			app.errorJSON(c, err)
+			return
+		}
+		app.writeJSON(c, http.StatusAccepted, jsonResponse{Error: false, Message: "logged"})
+		return
+	}
+
 	// Create a new gRPC client connection using NewClient
-	conn, err := grpc.NewClient("logger-service:50001", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(app.LogGRPCAddress, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		app.errorJSON(c, err)
 		return
@@ -298,7 +429,8 @@ func (app *Config) LogViaGRPC(c *gin.Context) {
 
 	// Create a new gRPC client
 	logClient := logs.NewLogServiceClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", c.GetHeader("Authorization"))
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
 
 	// Make the gRPC call to WriteLog
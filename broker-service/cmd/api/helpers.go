@@ -69,3 +69,14 @@ func (app *Config) errorJSON(c *gin.Context, err error, status ...int) {
 
 	c.JSON(statusCode, payload)
 }
+
+// setServiceToken authorizes a request the broker makes on its own behalf with a token
+// the authentication service issued to it
+func (app *Config) setServiceToken(r *http.Request) error {
+	token, err := app.ServiceTokens(r.Context())
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
@@ -0,0 +1,908 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"authz"
+	"broker/logs"
+)
+
+// logStore is an in-memory stand-in for the logger service's Mongo collection
+type logStore struct {
+	mu      sync.Mutex
+	entries []LogPayload
+}
+
+func (s *logStore) add(name, data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, LogPayload{Name: name, Data: data})
+}
+
+func (s *logStore) all() []LogPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]LogPayload(nil), s.entries...)
+}
+
+// RPCServer mirrors the logger service's net/rpc receiver so the broker's calls resolve
+type RPCServer struct {
+	store *logStore
+}
+
+func (r *RPCServer) LogInfo(payload RPCPayload, resp *string) error {
+	r.store.add(payload.Name, payload.Data)
+	*resp = "Processed payload via RPC:" + payload.Name
+	return nil
+}
+
+type grpcLogServer struct {
+	logs.UnimplementedLogServiceServer
+	h     *harness
+	store *logStore
+	// streams counts the WriteLogs streams
+	streams atomic.Int64
+}
+
+func (l *grpcLogServer) WriteLog(ctx context.Context, req *logs.LogRequest) (*logs.LogResponse, error) {
+	input := req.GetLogEntry()
+	l.store.add(input.GetName(), input.GetData())
+	return &logs.LogResponse{Result: "logged!"}, nil
+}
+
+func (l *grpcLogServer) WriteLogs(stream logs.LogService_WriteLogsServer) error {
+	// Like the logger, the streams need a token that can write logs
+	var header string
+	if values := metadata.ValueFromIncomingContext(stream.Context(), "authorization"); len(values) > 0 {
+		header = values[0]
+	}
+	token, _ := strings.CutPrefix(header, "Bearer ")
+	if claims, err := l.h.tokens.Parse(token); err != nil || !claims.Can(authz.LogsWrite) {
+		return status.Error(codes.Unauthenticated, "missing access token")
+	}
+	l.streams.Add(1)
+	var accepted int64
+	for {
+		input, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&logs.WriteLogsResponse{Accepted: accepted})
+		}
+		if err != nil {
+			return err
+		}
+		l.store.add(input.GetName(), input.GetData())
+		accepted++
+	}
+}
+
+// forwardedRequest is a request the broker made to the user management API
+type forwardedRequest struct {
+	Method        string
+	Path          string
+	Authorization string
+	Body          map[string]any
+}
+
+// harness wires the broker router to in-process fakes of every downstream service
+type harness struct {
+	broker *httptest.Server
+	app    *Config
+
+	mu       sync.Mutex
+	authReqs []AuthPayload
+	authIPs  []string
+	mailReqs []MailPayload
+	// mailSenders are the subjects of the tokens the mail requests carried
+	mailSenders []string
+	userReqs    []forwardedRequest
+
+	rpcLogs  *logStore
+	grpcLogs *logStore
+	// grpcLogger serves the logger service's gRPC API, and writes to grpcLogs
+	grpcLogger *grpcLogServer
+	httpLogs   *logStore
+
+	apiKeyChecks int
+
+	tokens *authz.Tokens
+}
+
+// authorized reports whether a request to a fake service carries a token granting permission
+func (h *harness) authorized(r *http.Request, permission string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	claims, err := h.tokens.Parse(token)
+	return err == nil && (permission == "" || claims.Can(permission))
+}
+
+// adminToken returns an access token granting users:admin
+func (h *harness) adminToken(t *testing.T) string {
+	t.Helper()
+	return h.userToken(t, authz.UsersAdmin)
+}
+
+// userToken returns an access token of user 1 granting permissions
+func (h *harness) userToken(t *testing.T, permissions ...string) string {
+	t.Helper()
+	token, err := h.tokens.Sign(authz.Claims{
+		Permissions:      permissions,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "1"},
+	}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	// The harness signs tokens like the authentication service, and the broker only
+	// verifies them
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &harness{
+		tokens:   authz.NewSigner(private),
+		rpcLogs:  &logStore{},
+		grpcLogs: &logStore{},
+		httpLogs: &logStore{},
+	}
+
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/service-tokens" {
+			service, secret, _ := r.BasicAuth()
+			if service != "broker-service" || secret != "broker-secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			token, _ := h.tokens.ServiceToken(service)
+			json.NewEncoder(w).Encode(jsonResponse{Data: map[string]any{"access_token": token, "expires_in": 300}})
+			return
+		}
+		if r.URL.Path == "/sessions/revoked" {
+			if !h.authorized(r, "") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(jsonResponse{Data: map[string]any{"session_ids": []string{"revoked-session"}}})
+			return
+		}
+		if r.URL.Path == "/api-keys/verify" {
+			var req struct{ Key string }
+			json.NewDecoder(r.Body).Decode(&req)
+			h.mu.Lock()
+			h.apiKeyChecks++
+			h.mu.Unlock()
+			identities := map[string]apiKeyIdentity{
+				"ak_admin_secret":   {Prefix: "ak_admin", UserID: 5, Email: "ops@example.com", Permissions: []string{authz.UsersAdmin}, AMR: []string{"apikey"}},
+				"ak_auditor_secret": {Prefix: "ak_auditor", UserID: 6, Email: "audit@example.com", Permissions: []string{authz.LogsRead}, AMR: []string{"apikey"}},
+			}
+			identity, ok := identities[req.Key]
+			if !h.authorized(r, "") || !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(jsonResponse{Error: true, Message: "invalid or expired API key"})
+				return
+			}
+			identity.AccessToken, _ = h.tokens.Sign(authz.Claims{
+				Email:            identity.Email,
+				Permissions:      identity.Permissions,
+				AMR:              identity.AMR,
+				RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.Itoa(identity.UserID)},
+			}, authz.ServiceTokenTTL)
+			json.NewEncoder(w).Encode(jsonResponse{Message: "valid API key", Data: identity})
+			return
+		}
+		if r.URL.Path == "/refresh" {
+			var p RefreshPayload
+			json.NewDecoder(r.Body).Decode(&p)
+			if p.RefreshToken != "refresh" {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(jsonResponse{Error: true, Message: "invalid or expired token"})
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(jsonResponse{Message: "Refreshed session", Data: map[string]any{"refresh_token": "next"}})
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/users") || strings.HasPrefix(r.URL.Path, "/roles") ||
+			strings.HasPrefix(r.URL.Path, "/sessions") || strings.HasPrefix(r.URL.Path, "/profile") ||
+			r.URL.Path == "/logout" || r.URL.Path == "/reauthenticate" {
+			fwd := forwardedRequest{Method: r.Method, Path: r.URL.RequestURI(), Authorization: r.Header.Get("Authorization")}
+			json.NewDecoder(r.Body).Decode(&fwd.Body)
+			h.mu.Lock()
+			h.userReqs = append(h.userReqs, fwd)
+			h.mu.Unlock()
+
+			// A user's own sessions and profile only need a valid token
+			permission := authz.UsersAdmin
+			if !strings.HasPrefix(r.URL.Path, "/users") && !strings.HasPrefix(r.URL.Path, "/roles") {
+				permission = ""
+			}
+			if !h.authorized(r, permission) {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(jsonResponse{Error: true, Message: "unauthorized"})
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(jsonResponse{Message: "ok"})
+			return
+		}
+
+		if r.URL.Path == "/mfa/verify" {
+			var m MFAPayload
+			json.NewDecoder(r.Body).Decode(&m)
+			if m.MFAToken != "challenge" || m.Code != "123456" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(jsonResponse{Error: true, Message: "invalid code"})
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(jsonResponse{Message: "Logged in user mfa@example.com", Data: map[string]any{"access_token": "token"}})
+			return
+		}
+
+		var a AuthPayload
+		if r.URL.Path != "/authenticate" || json.NewDecoder(r.Body).Decode(&a) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		h.mu.Lock()
+		h.authReqs = append(h.authReqs, a)
+		h.authIPs = append(h.authIPs, r.Header.Get("X-Forwarded-For"))
+		h.mu.Unlock()
+
+		if a.Email == "locked@example.com" {
+			w.Header().Set("Retry-After", "42")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(jsonResponse{Error: true, Message: "too many failed login attempts, try again later"})
+			return
+		}
+		if a.Email == "mfa@example.com" {
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(jsonResponse{Message: "MFA required", Data: map[string]any{"mfa_required": true, "mfa_token": "challenge"}})
+			return
+		}
+		if a.Password != "verysecret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(jsonResponse{Error: true, Message: "invalid credentials"})
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(jsonResponse{
+			Message: "Logged in user " + a.Email,
+			Data:    map[string]any{"email": a.Email},
+		})
+	}))
+	t.Cleanup(auth.Close)
+
+	mailer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m MailPayload
+		if !h.authorized(r, authz.MailSend) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/send" || json.NewDecoder(r.Body).Decode(&m) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		claims, _ := h.tokens.Parse(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		h.mu.Lock()
+		h.mailReqs = append(h.mailReqs, m)
+		h.mailSenders = append(h.mailSenders, claims.Subject)
+		h.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(jsonResponse{Message: "sent to " + m.To})
+	}))
+	t.Cleanup(mailer.Close)
+
+	logger := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entry LogPayload
+		if !h.authorized(r, authz.LogsWrite) || r.URL.Path != "/log" || json.NewDecoder(r.Body).Decode(&entry) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		h.httpLogs.add(entry.Name, entry.Data)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(logger.Close)
+
+	rpcAddr := serveRPC(t, &RPCServer{store: h.rpcLogs})
+	h.grpcLogger = &grpcLogServer{h: h, store: h.grpcLogs}
+	grpcAddr := serveGRPC(t, h.grpcLogger)
+
+	app := &Config{
+		AuthServiceURL: auth.URL,
+		MailServiceURL: mailer.URL,
+		LogServiceURL:  logger.URL,
+		LogRPCAddress:  rpcAddr,
+		LogGRPCAddress: grpcAddr,
+		Tokens:         authz.NewVerifier(public),
+		ServiceTokens:  authz.ServiceTokensFromURL(auth.URL+"/service-tokens", "broker-service", "broker-secret"),
+		APIKeys:        newAPIKeyCache(apiKeyCacheTTL),
+	}
+	app.Revocations = authz.NewRevocationList(authz.RevocationsFromURL(auth.URL+"/sessions/revoked", app.ServiceTokens))
+	app.Tokens.CheckRevocations(app.Revocations)
+	if err := app.Revocations.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h.app = app
+	h.broker = httptest.NewServer(app.routes())
+	t.Cleanup(h.broker.Close)
+
+	return h
+}
+
+func serveRPC(t *testing.T, receiver *RPCServer) string {
+	t.Helper()
+	srv := rpc.NewServer()
+	if err := srv.Register(receiver); err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go srv.Accept(lis)
+	return lis.Addr().String()
+}
+
+func serveGRPC(t *testing.T, impl logs.LogServiceServer) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	logs.RegisterLogServiceServer(s, impl)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+func (h *harness) authRequests() []AuthPayload {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]AuthPayload(nil), h.authReqs...)
+}
+
+func (h *harness) authClientIPs() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.authIPs...)
+}
+
+func (h *harness) mailRequests() []MailPayload {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]MailPayload(nil), h.mailReqs...)
+}
+
+func (h *harness) userRequests() []forwardedRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]forwardedRequest(nil), h.userReqs...)
+}
+
+// post sends payload to the broker and decodes its JSON response
+func (h *harness) post(t *testing.T, path string, payload any, headers ...string) (int, jsonResponse) {
+	t.Helper()
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest(http.MethodPost, h.broker.URL+path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out jsonResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decoding response from %s: %v", path, err)
+	}
+	return resp.StatusCode, out
+}
+
+func TestHandleAuth(t *testing.T) {
+	h := newHarness(t)
+
+	status, resp := h.post(t, "/handle", RequestPayload{
+		Action: "auth",
+		Auth:   AuthPayload{Email: "admin@example.com", Password: "verysecret"},
+	})
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("expected 202 without error, got %d %+v", status, resp)
+	}
+	if got := h.authRequests(); len(got) != 1 || got[0].Email != "admin@example.com" {
+		t.Fatalf("auth service received %+v", got)
+	}
+	if data, _ := resp.Data.(map[string]any); data["email"] != "admin@example.com" {
+		t.Errorf("expected user data to be passed through, got %+v", resp.Data)
+	}
+
+	status, resp = h.post(t, "/handle", RequestPayload{
+		Action: "auth",
+		Auth:   AuthPayload{Email: "admin@example.com", Password: "wrong"},
+	})
+	if status == http.StatusAccepted || !resp.Error {
+		t.Fatalf("expected bad credentials to be rejected, got %d %+v", status, resp)
+	}
+}
+
+func TestHandleAuthRelaysLockout(t *testing.T) {
+	h := newHarness(t)
+
+	body, _ := json.Marshal(RequestPayload{
+		Action: "auth",
+		Auth:   AuthPayload{Email: "locked@example.com", Password: "verysecret"},
+	})
+	req, _ := http.NewRequest(http.MethodPost, h.broker.URL+"/handle", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	// A client can't pick the IP whose failures are counted
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "42" {
+		t.Fatalf("expected 429 with Retry-After 42, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if ips := h.authClientIPs(); len(ips) != 1 || ips[0] != "127.0.0.1" {
+		t.Errorf("expected the client IP to be forwarded, got %q", ips)
+	}
+}
+
+func TestHandleAuthWithMFA(t *testing.T) {
+	h := newHarness(t)
+
+	status, resp := h.post(t, "/handle", RequestPayload{
+		Action: "auth",
+		Auth:   AuthPayload{Email: "mfa@example.com", Password: "verysecret"},
+	})
+	challenge, _ := resp.Data.(map[string]any)
+	if status != http.StatusAccepted || challenge["mfa_required"] != true {
+		t.Fatalf("expected the MFA challenge to be passed through, got %d %+v", status, resp)
+	}
+
+	status, resp = h.post(t, "/handle", RequestPayload{
+		Action: "auth.mfa",
+		MFA:    MFAPayload{MFAToken: challenge["mfa_token"].(string), Code: "000000"},
+	})
+	if status != http.StatusBadRequest || resp.Message != "invalid code" {
+		t.Fatalf("expected a wrong code to be rejected, got %d %+v", status, resp)
+	}
+
+	status, resp = h.post(t, "/handle", RequestPayload{
+		Action: "auth.mfa",
+		MFA:    MFAPayload{MFAToken: challenge["mfa_token"].(string), Code: "123456"},
+	})
+	if data, _ := resp.Data.(map[string]any); status != http.StatusAccepted || data["access_token"] != "token" {
+		t.Fatalf("expected the login to complete, got %d %+v", status, resp)
+	}
+}
+
+func TestHandleMail(t *testing.T) {
+	h := newHarness(t)
+
+	msg := MailPayload{From: "me@example.com", To: "you@there.com", Subject: "Test email", Message: "Hello world!"}
+	status, resp := h.post(t, "/handle", RequestPayload{Action: "mail", Mail: msg}, "Authorization", "Bearer "+h.userToken(t, authz.MailSend))
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("expected 202 without error, got %d %+v", status, resp)
+	}
+	if got := h.mailRequests(); len(got) != 1 || got[0] != msg {
+		t.Fatalf("mail service received %+v", got)
+	}
+	// The mail is sent with the caller's token, not one of the broker's
+	h.mu.Lock()
+	senders := append([]string(nil), h.mailSenders...)
+	h.mu.Unlock()
+	if len(senders) != 1 || senders[0] != "1" {
+		t.Errorf("expected the caller's token to be forwarded, got %q", senders)
+	}
+}
+
+// TestBrokerIsNotAnOpenRelay checks that mailing and logging through the broker need the
+// caller's own permissions
+func TestBrokerIsNotAnOpenRelay(t *testing.T) {
+	h := newHarness(t)
+	reader := "Bearer " + h.userToken(t, authz.LogsRead)
+
+	tests := []struct {
+		path    string
+		payload RequestPayload
+	}{
+		{"/handle", RequestPayload{Action: "mail", Mail: MailPayload{From: "me@example.com", To: "you@there.com", Message: "spam"}}},
+		{"/handle", RequestPayload{Action: "log", Log: LogPayload{Name: "event", Data: "noise"}}},
+		{"/log-grpc", RequestPayload{Action: "log", Log: LogPayload{Name: "event", Data: "noise"}}},
+	}
+	for _, tt := range tests {
+		if status, _ := h.post(t, tt.path, tt.payload); status != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected 401 without a token, got %d", tt.path, tt.payload.Action, status)
+		}
+		if status, _ := h.post(t, tt.path, tt.payload, "Authorization", reader); status != http.StatusForbidden {
+			t.Errorf("%s %s: expected 403 without the permission, got %d", tt.path, tt.payload.Action, status)
+		}
+	}
+	if len(h.mailRequests()) != 0 || len(h.rpcLogs.all()) != 0 || len(h.grpcLogs.all()) != 0 {
+		t.Errorf("unauthorized requests reached the services")
+	}
+}
+
+func TestHandleLogViaRPC(t *testing.T) {
+	h := newHarness(t)
+
+	status, resp := h.post(t, "/handle", RequestPayload{
+		Action: "log",
+		Log:    LogPayload{Name: "event", Data: "Some kind of data"},
+	}, "Authorization", "Bearer "+h.userToken(t, authz.LogsWrite))
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("expected 202 without error, got %d %+v", status, resp)
+	}
+
+	got := h.rpcLogs.all()
+	if len(got) != 1 || got[0] != (LogPayload{Name: "event", Data: "Some kind of data"}) {
+		t.Fatalf("RPC logger persisted %+v", got)
+	}
+	if len(h.grpcLogs.all()) != 0 {
+		t.Errorf("log action should not use gRPC")
+	}
+}
+
+func TestLogViaGRPC(t *testing.T) {
+	h := newHarness(t)
+
+	status, resp := h.post(t, "/log-grpc", RequestPayload{
+		Action: "log",
+		Log:    LogPayload{Name: "event", Data: "Some kind of gRPC data"},
+	}, "Authorization", "Bearer "+h.userToken(t, authz.LogsWrite))
+	if status != http.StatusAccepted || resp.Error {
+		t.Fatalf("expected 202 without error, got %d %+v", status, resp)
+	}
+
+	got := h.grpcLogs.all()
+	if len(got) != 1 || got[0] != (LogPayload{Name: "event", Data: "Some kind of gRPC data"}) {
+		t.Fatalf("gRPC logger persisted %+v", got)
+	}
+}
+
+func TestLogViaGRPCStream(t *testing.T) {
+	h := newHarness(t)
+	stream, err := newLogStream(h.app.LogGRPCAddress, h.app.ServiceTokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.app.LogStream = stream
+	defer stream.Close()
+
+	writer := "Bearer " + h.userToken(t, authz.LogsWrite)
+	for _, data := range []string{"first", "second", "third"} {
+		status, resp := h.post(t, "/log-grpc", RequestPayload{
+			Action: "log",
+			Log:    LogPayload{Name: "event", Data: data},
+		}, "Authorization", writer)
+		if status != http.StatusAccepted || resp.Error {
+			t.Fatalf("expected 202 without error, got %d %+v", status, resp)
+		}
+	}
+	if err := stream.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := h.grpcLogs.all()
+	if len(got) != 3 || got[0].Data != "first" || got[2].Data != "third" {
+		t.Fatalf("gRPC logger persisted %+v", got)
+	}
+	// The interval may close a stream between entries, but they mostly share one
+	if n := h.grpcLogger.streams.Load(); n == 0 || n > 2 {
+		t.Errorf("expected the entries to share a stream, got %d streams", n)
+	}
+}
+
+func TestHandleUnknownAction(t *testing.T) {
+	h := newHarness(t)
+
+	status, resp := h.post(t, "/handle", RequestPayload{Action: "nope"})
+	if status != http.StatusBadRequest || resp.Message != "unknown action" {
+		t.Fatalf("expected unknown action error, got %d %+v", status, resp)
+	}
+}
+
+func TestHandleUserActions(t *testing.T) {
+	h := newHarness(t)
+	active := false
+
+	tests := []struct {
+		payload UserPayload
+		action  string
+		method  string
+		path    string
+		body    map[string]any
+	}{
+		{action: "user.list", payload: UserPayload{Page: 2, PageSize: 10, Search: "smith"},
+			method: "GET", path: "/users?page=2&page_size=10&search=smith"},
+		{action: "user.get", payload: UserPayload{ID: 7}, method: "GET", path: "/users/7"},
+		{action: "user.create", payload: UserPayload{Email: "a@b.com", FirstName: "A", LastName: "B", Password: "secret123"},
+			method: "POST", path: "/users",
+			body: map[string]any{"email": "a@b.com", "first_name": "A", "last_name": "B", "password": "secret123"}},
+		{action: "user.update", payload: UserPayload{ID: 7, LastName: "C", Active: &active},
+			method: "PUT", path: "/users/7", body: map[string]any{"last_name": "C", "active": false}},
+		{action: "user.deactivate", payload: UserPayload{ID: 7}, method: "POST", path: "/users/7/deactivate"},
+		{action: "user.reactivate", payload: UserPayload{ID: 7}, method: "POST", path: "/users/7/reactivate"},
+		{action: "user.delete", payload: UserPayload{ID: 7}, method: "DELETE", path: "/users/7"},
+		{action: "user.restore", payload: UserPayload{ID: 7}, method: "POST", path: "/users/7/restore"},
+		{action: "user.erase", payload: UserPayload{ID: 7}, method: "POST", path: "/users/7/erase"},
+		{action: "user.reset_password", payload: UserPayload{ID: 7, Password: "newsecret1"},
+			method: "POST", path: "/users/7/reset-password", body: map[string]any{"password": "newsecret1"}},
+		{action: "user.roles", payload: UserPayload{ID: 7}, method: "GET", path: "/users/7/roles"},
+		{action: "user.revoke_sessions", payload: UserPayload{ID: 7}, method: "DELETE", path: "/users/7/sessions"},
+	}
+
+	bearer := "Bearer " + h.adminToken(t)
+	for i, tt := range tests {
+		status, resp := h.post(t, "/handle", RequestPayload{Action: tt.action, User: tt.payload}, "Authorization", bearer)
+		if status != http.StatusOK || resp.Error {
+			t.Fatalf("%s: expected 200 without error, got %d %+v", tt.action, status, resp)
+		}
+
+		got := h.userRequests()[i]
+		if got.Method != tt.method || got.Path != tt.path || got.Authorization != bearer {
+			t.Errorf("%s: forwarded %s %s (auth %q)", tt.action, got.Method, got.Path, got.Authorization)
+		}
+		for k, v := range tt.body {
+			if got.Body[k] != v {
+				t.Errorf("%s: forwarded body %v, want %s=%v", tt.action, got.Body, k, v)
+			}
+		}
+	}
+}
+
+func TestHandleUserActionsRequireAdmin(t *testing.T) {
+	h := newHarness(t)
+
+	status, resp := h.post(t, "/handle", RequestPayload{Action: "user.list"})
+	if status != http.StatusUnauthorized || !resp.Error {
+		t.Fatalf("expected a request without a token to be rejected, got %d %+v", status, resp)
+	}
+
+	mailer := h.userToken(t, authz.MailSend)
+	status, resp = h.post(t, "/handle", RequestPayload{Action: "role.list"}, "Authorization", "Bearer "+mailer)
+	if status != http.StatusForbidden || resp.Message != "missing permission users:admin" {
+		t.Fatalf("expected a token without users:admin to be rejected, got %d %+v", status, resp)
+	}
+	if got := h.userRequests(); len(got) != 0 {
+		t.Errorf("rejected requests were forwarded: %+v", got)
+	}
+
+	status, resp = h.post(t, "/handle", RequestPayload{Action: "user.get"}, "Authorization", "Bearer "+h.adminToken(t))
+	if status != http.StatusBadRequest || resp.Message != "user id is required" {
+		t.Fatalf("expected missing id to be rejected, got %d %+v", status, resp)
+	}
+}
+
+func TestHandleRoleActions(t *testing.T) {
+	h := newHarness(t)
+	bearer := "Bearer " + h.adminToken(t)
+
+	tests := []struct {
+		action string
+		user   UserPayload
+		role   RolePayload
+		method string
+		path   string
+		body   map[string]any
+	}{
+		{action: "role.list", method: "GET", path: "/roles"},
+		{action: "role.create", role: RolePayload{Name: "auditor", Permissions: []string{authz.LogsRead}},
+			method: "POST", path: "/roles", body: map[string]any{"name": "auditor"}},
+		{action: "role.update", role: RolePayload{Name: "auditor", Description: "Reads logs"},
+			method: "PUT", path: "/roles/auditor", body: map[string]any{"description": "Reads logs"}},
+		{action: "role.delete", role: RolePayload{Name: "auditor"}, method: "DELETE", path: "/roles/auditor"},
+		{action: "user.set_roles", user: UserPayload{ID: 7, Roles: []string{"auditor"}}, method: "PUT", path: "/users/7/roles"},
+	}
+
+	for i, tt := range tests {
+		status, resp := h.post(t, "/handle", RequestPayload{Action: tt.action, User: tt.user, Role: tt.role}, "Authorization", bearer)
+		if status != http.StatusOK || resp.Error {
+			t.Fatalf("%s: expected 200 without error, got %d %+v", tt.action, status, resp)
+		}
+
+		got := h.userRequests()[i]
+		if got.Method != tt.method || got.Path != tt.path {
+			t.Errorf("%s: forwarded %s %s", tt.action, got.Method, got.Path)
+		}
+		for k, v := range tt.body {
+			if got.Body[k] != v {
+				t.Errorf("%s: forwarded body %v, want %s=%v", tt.action, got.Body, k, v)
+			}
+		}
+	}
+	if roles, _ := h.userRequests()[4].Body["roles"].([]any); len(roles) != 1 || roles[0] != "auditor" {
+		t.Errorf("user.set_roles forwarded %v", h.userRequests()[4].Body)
+	}
+}
+
+// sessionToken returns a user's access token for the session with id
+func (h *harness) sessionToken(t *testing.T, id string) string {
+	t.Helper()
+	claims := authz.Claims{SessionID: id}
+	claims.Subject = "1"
+	token, err := h.tokens.Sign(claims, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestHandleAuthRefresh(t *testing.T) {
+	h := newHarness(t)
+
+	status, resp := h.post(t, "/handle", RequestPayload{Action: "auth.refresh", Refresh: RefreshPayload{RefreshToken: "refresh"}})
+	if data, _ := resp.Data.(map[string]any); status != http.StatusAccepted || data["refresh_token"] != "next" {
+		t.Fatalf("expected the new tokens, got %d %+v", status, resp)
+	}
+
+	status, resp = h.post(t, "/handle", RequestPayload{Action: "auth.refresh", Refresh: RefreshPayload{RefreshToken: "stolen"}})
+	if status != http.StatusBadRequest || !resp.Error {
+		t.Fatalf("expected an unknown refresh token to be rejected, got %d %+v", status, resp)
+	}
+}
+
+func TestHandleSessionActions(t *testing.T) {
+	h := newHarness(t)
+	bearer := "Bearer " + h.sessionToken(t, "active-session")
+
+	tests := []struct {
+		action  string
+		session SessionPayload
+		method  string
+		path    string
+	}{
+		{action: "session.list", method: "GET", path: "/sessions"},
+		{action: "session.revoke", session: SessionPayload{ID: "other-session"}, method: "DELETE", path: "/sessions/other-session"},
+		{action: "auth.logout", method: "POST", path: "/logout"},
+	}
+	for i, tt := range tests {
+		status, resp := h.post(t, "/handle", RequestPayload{Action: tt.action, Session: tt.session}, "Authorization", bearer)
+		if status != http.StatusOK || resp.Error {
+			t.Fatalf("%s: expected 200 without error, got %d %+v", tt.action, status, resp)
+		}
+		got := h.userRequests()[i]
+		if got.Method != tt.method || got.Path != tt.path || got.Authorization != bearer {
+			t.Errorf("%s: forwarded %s %s (auth %q)", tt.action, got.Method, got.Path, got.Authorization)
+		}
+	}
+
+	// Tokens of revoked sessions are refused without asking the authentication service
+	revoked := "Bearer " + h.sessionToken(t, "revoked-session")
+	status, resp := h.post(t, "/handle", RequestPayload{Action: "session.list"}, "Authorization", revoked)
+	if status != http.StatusUnauthorized || resp.Message != authz.ErrRevokedToken.Error() {
+		t.Fatalf("expected the revoked session's token to be rejected, got %d %+v", status, resp)
+	}
+	if got := h.userRequests(); len(got) != len(tests) {
+		t.Errorf("rejected request was forwarded: %+v", got[len(tests):])
+	}
+}
+
+func TestHandleProfileActions(t *testing.T) {
+	h := newHarness(t)
+	bearer := "Bearer " + h.sessionToken(t, "active-session")
+	name := "Grace"
+
+	tests := []struct {
+		payload RequestPayload
+		method  string
+		path    string
+		body    map[string]any
+	}{
+		{payload: RequestPayload{Action: "profile.get"}, method: "GET", path: "/profile"},
+		{payload: RequestPayload{Action: "profile.update", Profile: ProfilePayload{FirstName: &name}},
+			method: "PUT", path: "/profile", body: map[string]any{"first_name": "Grace"}},
+		{payload: RequestPayload{Action: "auth.reauthenticate", Reauth: ReauthPayload{Password: "verysecret", Code: "123456"}},
+			method: "POST", path: "/reauthenticate", body: map[string]any{"password": "verysecret", "code": "123456"}},
+		{payload: RequestPayload{Action: "profile.email", Profile: ProfilePayload{Email: "grace@example.com"}},
+			method: "POST", path: "/profile/email", body: map[string]any{"email": "grace@example.com"}},
+	}
+	for i, tt := range tests {
+		status, resp := h.post(t, "/handle", tt.payload, "Authorization", bearer)
+		if status != http.StatusOK || resp.Error {
+			t.Fatalf("%s: expected 200 without error, got %d %+v", tt.payload.Action, status, resp)
+		}
+		got := h.userRequests()[i]
+		if got.Method != tt.method || got.Path != tt.path || got.Authorization != bearer {
+			t.Errorf("%s: forwarded %s %s (auth %q)", tt.payload.Action, got.Method, got.Path, got.Authorization)
+		}
+		if len(got.Body) != len(tt.body) {
+			t.Errorf("%s: forwarded body %v, want %v", tt.payload.Action, got.Body, tt.body)
+		}
+		for k, v := range tt.body {
+			if got.Body[k] != v {
+				t.Errorf("%s: forwarded body %v, want %s=%v", tt.payload.Action, got.Body, k, v)
+			}
+		}
+	}
+
+	if status, _ := h.post(t, "/handle", RequestPayload{Action: "profile.get"}); status != http.StatusUnauthorized {
+		t.Errorf("expected the profile to need a login, got %d", status)
+	}
+}
+
+func TestHandleWithAPIKey(t *testing.T) {
+	h := newHarness(t)
+
+	// The key is swapped for an access token of its user
+	for i := 0; i < 2; i++ {
+		status, resp := h.post(t, "/handle", RequestPayload{Action: "user.list"}, "Authorization", "ApiKey ak_admin_secret")
+		if status != http.StatusOK || resp.Error {
+			t.Fatalf("expected 200 without error, got %d %+v", status, resp)
+		}
+	}
+	forwarded := h.userRequests()
+	token, _ := strings.CutPrefix(forwarded[0].Authorization, "Bearer ")
+	claims, err := h.tokens.Parse(token)
+	if err != nil || claims.Subject != "5" || claims.Email != "ops@example.com" || !claims.Can(authz.UsersAdmin) {
+		t.Fatalf("forwarded token %q: %+v, %v", forwarded[0].Authorization, claims, err)
+	}
+
+	// The second call was answered from the cache
+	h.mu.Lock()
+	checks := h.apiKeyChecks
+	h.mu.Unlock()
+	if checks != 1 {
+		t.Errorf("API key checked %d times, want 1", checks)
+	}
+
+	// Each use is logged
+	deadline := time.Now().Add(2 * time.Second)
+	for len(h.httpLogs.all()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	logs := h.httpLogs.all()
+	want := LogPayload{Name: "api-key", Data: "API key ak_admin of ops@example.com used for POST /handle"}
+	if len(logs) != 2 || logs[0] != want {
+		t.Errorf("logged %+v, want two of %+v", logs, want)
+	}
+
+	status, resp := h.post(t, "/handle", RequestPayload{Action: "user.list"}, "Authorization", "ApiKey ak_unknown")
+	if status != http.StatusUnauthorized || resp.Message != errInvalidAPIKey.Error() {
+		t.Errorf("unknown key: got %d %+v", status, resp)
+	}
+
+	// Keys only grant their own permissions
+	status, resp = h.post(t, "/handle", RequestPayload{Action: "user.list"}, "Authorization", "ApiKey ak_auditor_secret")
+	if status != http.StatusForbidden || resp.Message != "missing permission users:admin" {
+		t.Errorf("key without users:admin: got %d %+v", status, resp)
+	}
+	if got := h.userRequests(); len(got) != 2 {
+		t.Errorf("rejected requests were forwarded: %+v", got[2:])
+	}
+}
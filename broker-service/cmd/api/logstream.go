@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"authz"
+	"broker/logs"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// logStreamBatch is how many entries a WriteLogs stream carries before it is closed,
+	// which is when the logger acknowledges them
+	logStreamBatch = 500
+	// logStreamInterval is the longest an entry waits on an open stream to be acknowledged
+	logStreamInterval = time.Second
+	// logStreamTimeout bounds a stream, from its first entry to the logger's response
+	logStreamTimeout = 30 * time.Second
+)
+
+// logStream sends entries to the logger service over WriteLogs streams rather than a
+// WriteLog call each. A stream is opened for the first entry and closed after
+// logStreamBatch entries or logStreamInterval, and the next entry opens a new one. The
+// streams carry entries of many callers, so they are authorized with the broker's own
+// token, once the broker has checked each caller's.
+type logStream struct {
+	client logs.LogServiceClient
+	tokens authz.ServiceTokenSource
+
+	mu     sync.Mutex
+	stream logs.LogService_WriteLogsClient
+	cancel context.CancelFunc
+	sent   int
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// newLogStream connects to the logger service's gRPC API at address, authorizing the
+// streams with tokens
+func newLogStream(address string, tokens authz.ServiceTokenSource) (*logStream, error) {
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	return newLogStreamClient(logs.NewLogServiceClient(conn), tokens), nil
+}
+
+// newLogStreamClient starts a logStream that writes with client. Close it to send what is
+// still on the open stream.
+func newLogStreamClient(client logs.LogServiceClient, tokens authz.ServiceTokenSource) *logStream {
+	s := &logStream{
+		client:  client,
+		tokens:  tokens,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Send writes entry on the open stream. It returns once the entry is sent, not stored; a
+// failure to store the stream's entries is logged, and returned only to the Send or Flush
+// that closes it.
+func (s *logStream) Send(entry *logs.Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stream == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), logStreamTimeout)
+		token, err := s.tokens(ctx)
+		if err != nil {
+			cancel()
+			return err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		stream, err := s.client.WriteLogs(ctx)
+		if err != nil {
+			cancel()
+			return err
+		}
+		s.stream, s.cancel = stream, cancel
+	}
+
+	if err := s.stream.Send(entry); err != nil {
+		// The stream is broken, and CloseAndRecv says why
+		if closeErr := s.finish(); closeErr != nil {
+			return closeErr
+		}
+		return err
+	}
+	s.sent++
+	if s.sent == logStreamBatch {
+		return s.finish()
+	}
+	return nil
+}
+
+// Flush closes the open stream, and returns once the logger has acknowledged its entries
+func (s *logStream) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.finish()
+}
+
+// Close stops the stream rotation and flushes the open stream
+func (s *logStream) Close() error {
+	close(s.stop)
+	<-s.stopped
+	return s.Flush()
+}
+
+func (s *logStream) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(logStreamInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// finish closes the open stream, if any, and waits for the logger's response. The caller
+// holds mu.
+func (s *logStream) finish() error {
+	if s.stream == nil {
+		return nil
+	}
+	stream, cancel, sent := s.stream, s.cancel, s.sent
+	s.stream, s.cancel, s.sent = nil, nil, 0
+	defer cancel()
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		log.Printf("Error writing %d log entries over gRPC: %v", sent, err)
+		return err
+	}
+	if resp.GetRejected() > 0 {
+		log.Printf("The logger service rejected %d of %d log entries", resp.GetRejected(), sent)
+	}
+	return nil
+}
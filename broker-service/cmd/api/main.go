@@ -6,8 +6,12 @@ import (
 	"math"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"authz"
+	"broker/auth"
+
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -16,6 +20,37 @@ const webPort = "80"
 // Config holds application configurations
 type Config struct {
 	Rabbit *amqp.Connection
+
+	// Addresses of the services the broker talks to
+	AuthServiceURL string
+	MailServiceURL string
+	LogServiceURL  string
+	LogRPCAddress  string
+	LogGRPCAddress string
+
+	// LogStream, when set, sends the "log-grpc" entries over WriteLogs streams instead of
+	// a WriteLog call each
+	LogStream *logStream
+
+	// AuthClient, when set, serves the "auth", "user.get" and "user.list" actions over the
+	// authentication service's gRPC API instead of its HTTP routes
+	AuthClient auth.AuthServiceClient
+
+	// Tokens checks the permissions of callers, with the authentication service's public key
+	Tokens *authz.Tokens
+	// ServiceTokens gets the broker's own tokens from the authentication service, for its
+	// calls on its own behalf
+	ServiceTokens authz.ServiceTokenSource
+	// Revocations holds the sessions revoked at the authentication service, whose access
+	// tokens Tokens refuses
+	Revocations *authz.RevocationList
+	// APIKeys caches the API keys the authentication service accepted
+	APIKeys *apiKeyCache
+
+	// TrustedProxies may set X-Forwarded-For. The broker passes the client IP on to the
+	// authentication service, whose login lockout counts failures per IP, so by default it
+	// trusts nobody and uses the connection's address
+	TrustedProxies []string
 }
 
 func main() {
@@ -27,9 +62,44 @@ func main() {
 	}
 	defer rabbitConn.Close()
 
+	key, err := authz.PublicKeyFromEnv()
+	if err != nil {
+		log.Panic(err)
+	}
+	serviceSecret, err := authz.ServiceSecretFromEnv()
+	if err != nil {
+		log.Panic(err)
+	}
+
 	app := &Config{
-		Rabbit: rabbitConn,
+		Rabbit:         rabbitConn,
+		AuthServiceURL: envOrDefault("AUTH_SERVICE_URL", "http://authentication-service"),
+		MailServiceURL: envOrDefault("MAIL_SERVICE_URL", "http://mailer-service"),
+		LogServiceURL:  envOrDefault("LOG_SERVICE_URL", "http://logger-service"),
+		LogRPCAddress:  envOrDefault("LOG_RPC_ADDRESS", "logger-service:5001"),
+		LogGRPCAddress: envOrDefault("LOG_GRPC_ADDRESS", "logger-service:50001"),
+		Tokens:         authz.NewVerifier(key),
+		APIKeys:        newAPIKeyCache(apiKeyCacheTTL),
+		TrustedProxies: splitList(os.Getenv("TRUSTED_PROXIES")),
 	}
+	app.ServiceTokens = authz.ServiceTokensFromURL(app.AuthServiceURL+"/service-tokens", "broker-service", serviceSecret)
+	if os.Getenv("AUTH_USE_GRPC") == "true" {
+		app.AuthClient, err = newAuthClient(envOrDefault("AUTH_GRPC_ADDRESS", "authentication-service:50001"))
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	if os.Getenv("LOG_GRPC_STREAM") == "true" {
+		app.LogStream, err = newLogStream(app.LogGRPCAddress, app.ServiceTokens)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer app.LogStream.Close()
+	}
+	app.Revocations = authz.NewRevocationList(
+		authz.RevocationsFromURL(app.AuthServiceURL+"/sessions/revoked", app.ServiceTokens))
+	app.Tokens.CheckRevocations(app.Revocations)
+	go app.Revocations.Run(authz.RevocationRefreshInterval, nil)
 
 	// Get the router
 	router := app.routes()
@@ -77,3 +147,22 @@ func connect() (*amqp.Connection, error) {
 
 	return connection, nil
 }
+
+// envOrDefault returns the value of the environment variable key, or fallback when it is unset
+func envOrDefault(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// splitList splits a comma separated list, skipping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"log"
 	"net/http"
 
+	"authz"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -11,6 +14,11 @@ import (
 func (app *Config) routes() *gin.Engine {
 	router := gin.Default()
 
+	// Only trust X-Forwarded-For from the configured proxies
+	if err := router.SetTrustedProxies(app.TrustedProxies); err != nil {
+		log.Panic(err)
+	}
+
 	// Set up CORS middleware
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"}, // Update with your allowed origins in production
@@ -21,6 +29,9 @@ func (app *Config) routes() *gin.Engine {
 		MaxAge:           300,
 	}))
 
+	// Scripts authenticate with API keys, which are swapped for access tokens
+	router.Use(app.apiKeyAuth())
+
 	// Heartbeat endpoint
 	router.GET("/ping", func(c *gin.Context) {
 		c.String(http.StatusOK, "pong")
@@ -28,7 +39,7 @@ func (app *Config) routes() *gin.Engine {
 
 	// Define routes
 	router.POST("/", app.Broker)
-	router.POST("/log-grpc", app.LogViaGRPC)
+	router.POST("/log-grpc", app.Tokens.Require(authz.LogsWrite), app.LogViaGRPC)
 	router.POST("/handle", app.HandleSubmission)
 
 	return router
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// manageUser forwards a "user.*" action to the user management API of the authentication
+// service. The caller's Authorization header is passed along, so the authentication service
+// checks the caller's permissions again; its response is relayed as is.
+func (app *Config) manageUser(c *gin.Context, action string, u UserPayload) {
+	if app.AuthClient != nil && (action == "user.get" || action == "user.list") {
+		app.manageUserViaGRPC(c, action, u)
+		return
+	}
+
+	var method, path string
+	var body any
+
+	switch action {
+	case "user.list":
+		query := url.Values{}
+		if u.Page > 0 {
+			query.Set("page", strconv.Itoa(u.Page))
+		}
+		if u.PageSize > 0 {
+			query.Set("page_size", strconv.Itoa(u.PageSize))
+		}
+		if u.Search != "" {
+			query.Set("search", u.Search)
+		}
+		method, path = http.MethodGet, "/users"
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+	case "user.create":
+		method, path = http.MethodPost, "/users"
+		body = struct {
+			Email     string `json:"email"`
+			FirstName string `json:"first_name"`
+			LastName  string `json:"last_name"`
+			Password  string `json:"password"`
+			Active    *bool  `json:"active,omitempty"`
+		}{u.Email, u.FirstName, u.LastName, u.Password, u.Active}
+	default:
+		if u.ID <= 0 {
+			app.errorJSON(c, errors.New("user id is required"))
+			return
+		}
+		path = fmt.Sprintf("/users/%d", u.ID)
+
+		switch action {
+		case "user.get":
+			method = http.MethodGet
+		case "user.update":
+			method = http.MethodPut
+			body = struct {
+				Email     string `json:"email,omitempty"`
+				FirstName string `json:"first_name,omitempty"`
+				LastName  string `json:"last_name,omitempty"`
+				Active    *bool  `json:"active,omitempty"`
+			}{u.Email, u.FirstName, u.LastName, u.Active}
+		case "user.deactivate":
+			method, path = http.MethodPost, path+"/deactivate"
+		case "user.reactivate":
+			method, path = http.MethodPost, path+"/reactivate"
+		case "user.delete":
+			method = http.MethodDelete
+		case "user.restore":
+			method, path = http.MethodPost, path+"/restore"
+		case "user.erase":
+			method, path = http.MethodPost, path+"/erase"
+		case "user.reset_password":
+			method, path = http.MethodPost, path+"/reset-password"
+			body = struct {
+				Password string `json:"password"`
+			}{u.Password}
+		case "user.roles":
+			method, path = http.MethodGet, path+"/roles"
+		case "user.revoke_sessions":
+			method, path = http.MethodDelete, path+"/sessions"
+		case "user.set_roles":
+			method, path = http.MethodPut, path+"/roles"
+			roles := u.Roles
+			if roles == nil {
+				roles = []string{}
+			}
+			body = struct {
+				Roles []string `json:"roles"`
+			}{roles}
+		default:
+			app.errorJSON(c, errors.New("unknown action"))
+			return
+		}
+	}
+
+	app.forwardToAuth(c, method, path, body)
+}
+
+// manageRole forwards a "role.*" action to the role management API of the authentication
+// service, in the same way as manageUser
+func (app *Config) manageRole(c *gin.Context, action string, r RolePayload) {
+	var method, path string
+	var body any
+
+	switch action {
+	case "role.list":
+		method, path = http.MethodGet, "/roles"
+	case "role.create":
+		method, path = http.MethodPost, "/roles"
+		body = struct {
+			Name        string   `json:"name"`
+			Description string   `json:"description,omitempty"`
+			Permissions []string `json:"permissions"`
+		}{r.Name, r.Description, r.Permissions}
+	default:
+		if r.Name == "" {
+			app.errorJSON(c, errors.New("role name is required"))
+			return
+		}
+		path = "/roles/" + url.PathEscape(r.Name)
+
+		switch action {
+		case "role.get":
+			method = http.MethodGet
+		case "role.update":
+			method = http.MethodPut
+			permissions := r.Permissions
+			if permissions == nil {
+				permissions = []string{}
+			}
+			body = struct {
+				Description *string  `json:"description,omitempty"`
+				Permissions []string `json:"permissions"`
+			}{&r.Description, permissions}
+		case "role.delete":
+			method = http.MethodDelete
+		default:
+			app.errorJSON(c, errors.New("unknown action"))
+			return
+		}
+	}
+
+	app.forwardToAuth(c, method, path, body)
+}
+
+// manageSession forwards an "auth.logout" or "session.*" action to the authentication
+// service, which acts on the sessions of the user the caller's access token belongs to
+func (app *Config) manageSession(c *gin.Context, action string, s SessionPayload) {
+	switch action {
+	case "auth.logout":
+		app.forwardToAuth(c, http.MethodPost, "/logout", nil)
+	case "session.list":
+		app.forwardToAuth(c, http.MethodGet, "/sessions", nil)
+	case "session.revoke":
+		if s.ID == "" {
+			app.errorJSON(c, errors.New("session id is required"))
+			return
+		}
+		app.forwardToAuth(c, http.MethodDelete, "/sessions/"+url.PathEscape(s.ID), nil)
+	default:
+		app.errorJSON(c, errors.New("unknown action"))
+	}
+}
+
+// manageProfile forwards an action on the caller's own account to the authentication
+// service. Changing the email needs a recent login, which auth.reauthenticate renews.
+func (app *Config) manageProfile(c *gin.Context, action string, r ReauthPayload, p ProfilePayload) {
+	switch action {
+	case "auth.reauthenticate":
+		app.forwardToAuth(c, http.MethodPost, "/reauthenticate", r)
+	case "profile.get":
+		app.forwardToAuth(c, http.MethodGet, "/profile", nil)
+	case "profile.update":
+		app.forwardToAuth(c, http.MethodPut, "/profile", struct {
+			FirstName *string `json:"first_name,omitempty"`
+			LastName  *string `json:"last_name,omitempty"`
+		}{p.FirstName, p.LastName})
+	case "profile.email":
+		app.forwardToAuth(c, http.MethodPost, "/profile/email", struct {
+			Email string `json:"email"`
+		}{p.Email})
+	default:
+		app.errorJSON(c, errors.New("unknown action"))
+	}
+}
+
+// forwardToAuth sends a request to the authentication service with the caller's
+// Authorization header and relays the response
+func (app *Config) forwardToAuth(c *gin.Context, method, path string, body any) {
+	var reqBody io.Reader
+	if body != nil {
+		jsonData, _ := json.Marshal(body)
+		reqBody = bytes.NewReader(jsonData)
+	}
+
+	request, err := http.NewRequest(method, app.AuthServiceURL+path, reqBody)
+	if err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if authorization := c.GetHeader("Authorization"); authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+	defer response.Body.Close()
+
+	var jsonFromService jsonResponse
+	if err := json.NewDecoder(response.Body).Decode(&jsonFromService); err != nil {
+		app.errorJSON(c, errors.New("error calling auth service"))
+		return
+	}
+
+	app.writeJSON(c, response.StatusCode, jsonFromService)
+}
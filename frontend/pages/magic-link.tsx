@@ -0,0 +1,154 @@
+import { FormEvent, useEffect, useRef, useState } from "react";
+import { useRouter } from "next/router";
+
+const authServiceURL = process.env.NEXT_PUBLIC_AUTH_URL ?? "http://localhost:8081";
+
+// The device token from requesting a link is kept here, as the link only works with it
+const deviceTokenKey = "magic-link-device-token";
+
+interface AuthResponse {
+  message: string;
+  error?: boolean;
+  data?: {
+    device_token?: string;
+    access_token?: string;
+    mfa_required?: boolean;
+    mfa_token?: string;
+  };
+}
+
+const postJSON = async (path: string, body: object): Promise<AuthResponse> => {
+  const response = await fetch(`${authServiceURL}${path}`, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify(body),
+  });
+  return response.json();
+};
+
+// Users ask for a login link here, and the emailed link opens this page again with its
+// token in the query string, which logs them in on the same browser
+export default function MagicLink() {
+  const router = useRouter();
+  const token = typeof router.query.token === "string" ? router.query.token : "";
+
+  const [email, setEmail] = useState<string>("");
+  const [code, setCode] = useState<string>("");
+  const [mfaToken, setMFAToken] = useState<string>("");
+  const [result, setResult] = useState<AuthResponse | null>(null);
+  const [submitting, setSubmitting] = useState<boolean>(false);
+  const started = useRef<boolean>(false);
+
+  const run = async (step: () => Promise<AuthResponse>) => {
+    setSubmitting(true);
+    try {
+      const data = await step();
+      if (!data.error && data.data?.mfa_required && data.data.mfa_token) {
+        setMFAToken(data.data.mfa_token);
+        setResult(null);
+      } else {
+        setResult(data);
+      }
+    } catch (error) {
+      setResult({ error: true, message: error instanceof Error ? error.message : "Unknown error occurred." });
+    } finally {
+      setSubmitting(false);
+    }
+  };
+
+  useEffect(() => {
+    if (!router.isReady || !token || started.current) {
+      return;
+    }
+    started.current = true;
+
+    const deviceToken = window.localStorage.getItem(deviceTokenKey);
+    if (!deviceToken) {
+      setResult({ error: true, message: "Open the link in the browser you asked for it from." });
+      return;
+    }
+    run(async () => {
+      const data = await postJSON("/magic-link/login", { token, device_token: deviceToken });
+      if (!data.error) {
+        window.localStorage.removeItem(deviceTokenKey);
+      }
+      return data;
+    });
+  }, [router.isReady, token]);
+
+  const handleRequest = (e: FormEvent) => {
+    e.preventDefault();
+    run(async () => {
+      const data = await postJSON("/magic-link", { email });
+      if (!data.error && data.data?.device_token) {
+        window.localStorage.setItem(deviceTokenKey, data.data.device_token);
+      }
+      return data;
+    });
+  };
+
+  const handleVerify = (e: FormEvent) => {
+    e.preventDefault();
+    run(() => postJSON("/mfa/verify", { mfa_token: mfaToken, code }));
+  };
+
+  const loggedIn = !!result?.data?.access_token;
+
+  return (
+    <div className="container mx-auto p-6 max-w-md">
+      <h1 className="text-4xl font-bold mt-10 mb-5 text-gray-800 text-center">Log In With Email</h1>
+      <hr className="mb-10 border-gray-300" />
+
+      {loggedIn ? (
+        <p className="p-5 border border-gray-300 rounded-lg bg-gray-50 text-gray-700">You are logged in.</p>
+      ) : mfaToken ? (
+        <form onSubmit={handleVerify} className="flex flex-col gap-4">
+          <input
+            type="text"
+            placeholder="Code from your authenticator app"
+            autoComplete="one-time-code"
+            inputMode="numeric"
+            required
+            value={code}
+            onChange={(e) => setCode(e.target.value)}
+            className="px-4 py-2 border border-gray-300 rounded"
+          />
+          <button
+            type="submit"
+            disabled={submitting}
+            className="px-6 py-3 bg-gray-800 text-white font-semibold rounded hover:bg-gray-700 disabled:opacity-50"
+          >
+            Verify
+          </button>
+        </form>
+      ) : token ? (
+        submitting && <p className="text-gray-700 text-center">Logging you in...</p>
+      ) : result && !result.error ? (
+        <p className="p-5 border border-gray-300 rounded-lg bg-gray-50 text-gray-700">{result.message}</p>
+      ) : (
+        <form onSubmit={handleRequest} className="flex flex-col gap-4">
+          <p className="text-gray-700">We'll email you a link that logs you in on this browser.</p>
+          <input
+            type="email"
+            placeholder="Email"
+            autoComplete="email"
+            required
+            value={email}
+            onChange={(e) => setEmail(e.target.value)}
+            className="px-4 py-2 border border-gray-300 rounded"
+          />
+          <button
+            type="submit"
+            disabled={submitting}
+            className="px-6 py-3 bg-gray-800 text-white font-semibold rounded hover:bg-gray-700 disabled:opacity-50"
+          >
+            Email Me A Link
+          </button>
+        </form>
+      )}
+      {result?.error && <p className="mt-4 text-red-700">{result.message}</p>}
+    </div>
+  );
+}
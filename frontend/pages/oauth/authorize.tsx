@@ -0,0 +1,178 @@
+import { FormEvent, useState } from "react";
+import { useRouter } from "next/router";
+
+const authServiceURL = process.env.NEXT_PUBLIC_AUTH_URL ?? "http://localhost:8081";
+
+interface AuthResponse {
+  message: string;
+  error?: boolean;
+  data?: {
+    access_token?: string;
+    mfa_required?: boolean;
+    mfa_token?: string;
+    redirect_to?: string;
+  };
+}
+
+const postJSON = async (path: string, body: object, token?: string): Promise<AuthResponse> => {
+  const headers: Record<string, string> = { "Content-Type": "application/json" };
+  if (token) {
+    headers["Authorization"] = `Bearer ${token}`;
+  }
+  const response = await fetch(`${authServiceURL}${path}`, {
+    method: "POST",
+    headers,
+    body: JSON.stringify(body),
+  });
+  return response.json();
+};
+
+// The authentication service sends users here when an app asks to sign them in. They log
+// in, then allow or deny the app, and are sent back to it.
+export default function Authorize() {
+  const router = useRouter();
+  const query = Object.fromEntries(
+    Object.entries(router.query).filter((entry): entry is [string, string] => typeof entry[1] === "string"),
+  );
+  const clientName = query.client_name || "An application";
+  const scopes = (query.scope ?? "").split(" ").filter(Boolean);
+
+  const [email, setEmail] = useState<string>("");
+  const [password, setPassword] = useState<string>("");
+  const [code, setCode] = useState<string>("");
+  const [mfaToken, setMFAToken] = useState<string>("");
+  const [accessToken, setAccessToken] = useState<string>("");
+  const [error, setError] = useState<string>("");
+  const [submitting, setSubmitting] = useState<boolean>(false);
+
+  const run = async (step: () => Promise<void>) => {
+    setSubmitting(true);
+    setError("");
+    try {
+      await step();
+    } catch (e) {
+      setError(e instanceof Error ? e.message : "Unknown error occurred.");
+    } finally {
+      setSubmitting(false);
+    }
+  };
+
+  const handleLogin = (e: FormEvent) => {
+    e.preventDefault();
+    run(async () => {
+      const result = mfaToken
+        ? await postJSON("/mfa/verify", { mfa_token: mfaToken, code })
+        : await postJSON("/authenticate", { email, password });
+      if (result.error) {
+        setError(result.message);
+      } else if (result.data?.mfa_required && result.data.mfa_token) {
+        setMFAToken(result.data.mfa_token);
+      } else if (result.data?.access_token) {
+        setAccessToken(result.data.access_token);
+      }
+    });
+  };
+
+  const handleDecision = (deny: boolean) => {
+    run(async () => {
+      const request: Record<string, string | boolean> = { ...query, deny };
+      delete request.client_name;
+      const result = await postJSON("/oauth/authorize", request, accessToken);
+      if (result.error || !result.data?.redirect_to) {
+        setError(result.message);
+        return;
+      }
+      window.location.assign(result.data.redirect_to);
+    });
+  };
+
+  if (router.isReady && !query.client_id) {
+    return (
+      <div className="container mx-auto p-6 text-center">
+        <h1 className="text-4xl font-bold mt-10 mb-5 text-gray-800">Sign In</h1>
+        <p className="text-gray-700">This page is opened by applications that sign you in with your account.</p>
+      </div>
+    );
+  }
+
+  return (
+    <div className="container mx-auto p-6 max-w-md">
+      <h1 className="text-4xl font-bold mt-10 mb-5 text-gray-800 text-center">Sign In</h1>
+      <hr className="mb-10 border-gray-300" />
+
+      {accessToken ? (
+        <div className="flex flex-col gap-4">
+          <p className="text-gray-700">
+            <strong>{clientName}</strong> would like to sign you in
+            {scopes.includes("email") && " and see your email address"}
+            {scopes.includes("profile") && " and your name"}.
+          </p>
+          <div className="flex gap-4">
+            <button
+              onClick={() => handleDecision(false)}
+              disabled={submitting}
+              className="flex-1 px-6 py-3 bg-gray-800 text-white font-semibold rounded hover:bg-gray-700 disabled:opacity-50"
+            >
+              Allow
+            </button>
+            <button
+              onClick={() => handleDecision(true)}
+              disabled={submitting}
+              className="flex-1 px-6 py-3 border border-gray-300 text-gray-800 font-semibold rounded hover:bg-gray-50 disabled:opacity-50"
+            >
+              Deny
+            </button>
+          </div>
+          {error && <p className="text-red-700">{error}</p>}
+        </div>
+      ) : (
+        <form onSubmit={handleLogin} className="flex flex-col gap-4">
+          <p className="text-gray-700">
+            Log in to continue to <strong>{clientName}</strong>.
+          </p>
+          {mfaToken ? (
+            <input
+              type="text"
+              placeholder="Code from your authenticator app"
+              autoComplete="one-time-code"
+              inputMode="numeric"
+              required
+              value={code}
+              onChange={(e) => setCode(e.target.value)}
+              className="px-4 py-2 border border-gray-300 rounded"
+            />
+          ) : (
+            <>
+              <input
+                type="email"
+                placeholder="Email"
+                autoComplete="email"
+                required
+                value={email}
+                onChange={(e) => setEmail(e.target.value)}
+                className="px-4 py-2 border border-gray-300 rounded"
+              />
+              <input
+                type="password"
+                placeholder="Password"
+                autoComplete="current-password"
+                required
+                value={password}
+                onChange={(e) => setPassword(e.target.value)}
+                className="px-4 py-2 border border-gray-300 rounded"
+              />
+            </>
+          )}
+          <button
+            type="submit"
+            disabled={submitting}
+            className="px-6 py-3 bg-gray-800 text-white font-semibold rounded hover:bg-gray-700 focus:outline-none focus:ring-2 focus:ring-gray-500 focus:ring-opacity-50 disabled:opacity-50"
+          >
+            {mfaToken ? "Verify" : "Log In"}
+          </button>
+          {error && <p className="text-red-700">{error}</p>}
+        </form>
+      )}
+    </div>
+  );
+}
@@ -0,0 +1,96 @@
+import { FormEvent, useState } from "react";
+import { useRouter } from "next/router";
+
+const authServiceURL = process.env.NEXT_PUBLIC_AUTH_URL ?? "http://localhost:8081";
+
+interface AuthResponse {
+  message: string;
+  error?: boolean;
+}
+
+// The password reset email links here with the signed reset token in the query string
+export default function ResetPassword() {
+  const router = useRouter();
+  const token = typeof router.query.token === "string" ? router.query.token : "";
+
+  const [password, setPassword] = useState<string>("");
+  const [confirm, setConfirm] = useState<string>("");
+  const [result, setResult] = useState<AuthResponse | null>(null);
+  const [submitting, setSubmitting] = useState<boolean>(false);
+
+  const handleSubmit = async (e: FormEvent) => {
+    e.preventDefault();
+    if (password !== confirm) {
+      setResult({ error: true, message: "Passwords don't match." });
+      return;
+    }
+
+    setSubmitting(true);
+    try {
+      const response = await fetch(`${authServiceURL}/reset-password`, {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+        },
+        body: JSON.stringify({ token, password }),
+      });
+      const data: AuthResponse = await response.json();
+      setResult(data);
+    } catch (error) {
+      setResult({ error: true, message: error instanceof Error ? error.message : "Unknown error occurred." });
+    } finally {
+      setSubmitting(false);
+    }
+  };
+
+  if (router.isReady && !token) {
+    return (
+      <div className="container mx-auto p-6 text-center">
+        <h1 className="text-4xl font-bold mt-10 mb-5 text-gray-800">Reset Password</h1>
+        <p className="text-gray-700">This link is missing its reset token. Please use the link from your email.</p>
+      </div>
+    );
+  }
+
+  return (
+    <div className="container mx-auto p-6 max-w-md">
+      <h1 className="text-4xl font-bold mt-10 mb-5 text-gray-800 text-center">Reset Password</h1>
+      <hr className="mb-10 border-gray-300" />
+
+      {result && !result.error ? (
+        <p className="p-5 border border-gray-300 rounded-lg bg-gray-50 text-gray-700">{result.message}</p>
+      ) : (
+        <form onSubmit={handleSubmit} className="flex flex-col gap-4">
+          <input
+            type="password"
+            placeholder="New password"
+            autoComplete="new-password"
+            minLength={8}
+            required
+            value={password}
+            onChange={(e) => setPassword(e.target.value)}
+            className="px-4 py-2 border border-gray-300 rounded"
+          />
+          <input
+            type="password"
+            placeholder="Confirm new password"
+            autoComplete="new-password"
+            minLength={8}
+            required
+            value={confirm}
+            onChange={(e) => setConfirm(e.target.value)}
+            className="px-4 py-2 border border-gray-300 rounded"
+          />
+          <button
+            type="submit"
+            disabled={submitting}
+            className="px-6 py-3 bg-gray-800 text-white font-semibold rounded hover:bg-gray-700 focus:outline-none focus:ring-2 focus:ring-gray-500 focus:ring-opacity-50 disabled:opacity-50"
+          >
+            Set New Password
+          </button>
+          {result?.error && <p className="text-red-700">{result.message}</p>}
+        </form>
+      )}
+    </div>
+  );
+}
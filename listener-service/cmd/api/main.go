@@ -1,6 +1,7 @@
 package main
 
 import (
+	"authz"
 	"fmt"
 	"listener/event"
 	"log"
@@ -23,13 +24,32 @@ func main() {
 	// start listening for messages
 	log.Println("Listening for and consuming RabbitMQ messages...")
 
+	secret, err := authz.ServiceSecretFromEnv()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	authServiceURL := envOrDefault("AUTH_SERVICE_URL", "http://authentication-service")
+
 	// create consumer
-	consumer, err := event.NewConsumer(rabbitConn)
+	consumer, err := event.NewConsumer(rabbitConn, event.Services{
+		LoggerURL: envOrDefault("LOG_SERVICE_URL", "http://logger-service"),
+		AuthURL:   authServiceURL,
+		Tokens:    authz.ServiceTokensFromURL(authServiceURL+"/service-tokens", "listener-service", secret),
+	})
 	if err != nil {
 		log.Println("Failed to create consumer:", err)
 		os.Exit(1)
 	}
 
+	// redact the logs of erased users
+	go func() {
+		if err := consumer.ListenErasures(); err != nil {
+			log.Println("Failed to listen for erasures:", err)
+			os.Exit(1)
+		}
+	}()
+
 	// watch the queue and consume events
 	err = consumer.Listen([]string{"log.INFO", "log.WARNING", "log.ERROR"})
 	if err != nil {
@@ -70,3 +90,11 @@ func connect() (*amqp.Connection, error) {
 
 	return connection, nil
 }
+
+// envOrDefault returns the value of the environment variable key, or fallback when it is unset
+func envOrDefault(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
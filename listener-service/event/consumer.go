@@ -2,21 +2,37 @@ package event
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 
+	"authz"
+
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// Services are the addresses of the services the consumer calls, and how it authorizes
+// its calls
+type Services struct {
+	// LoggerURL is the address of the logger service, such as http://logger-service
+	LoggerURL string
+	// AuthURL is the address of the authentication service
+	AuthURL string
+	// Tokens gets the listener's own tokens for its calls
+	Tokens authz.ServiceTokenSource
+}
+
 type Consumer struct {
-	conn *amqp.Connection
+	conn     *amqp.Connection
+	services Services
 }
 
-func NewConsumer(conn *amqp.Connection) (*Consumer, error) {
+func NewConsumer(conn *amqp.Connection, services Services) (*Consumer, error) {
 	consumer := &Consumer{
-		conn: conn,
+		conn:     conn,
+		services: services,
 	}
 
 	err := consumer.setup()
@@ -75,7 +91,7 @@ func (consumer *Consumer) Listen(topics []string) error {
 				continue
 			}
 
-			go handlePayload(payload)
+			go consumer.handlePayload(payload)
 		}
 	}()
 
@@ -85,10 +101,10 @@ func (consumer *Consumer) Listen(topics []string) error {
 	return nil
 }
 
-func handlePayload(payload Payload) {
+func (consumer *Consumer) handlePayload(payload Payload) {
 	switch payload.Name {
 	case "log", "event":
-		err := logEvent(payload)
+		err := consumer.logEvent(payload)
 		if err != nil {
 			log.Println(err)
 		}
@@ -97,25 +113,29 @@ func handlePayload(payload Payload) {
 		// Authentication logic here
 
 	default:
-		err := logEvent(payload)
+		err := consumer.logEvent(payload)
 		if err != nil {
 			log.Println(err)
 		}
 	}
 }
 
-func logEvent(entry Payload) error {
+func (consumer *Consumer) logEvent(entry Payload) error {
 	jsonData, _ := json.MarshalIndent(entry, "", "\t")
 
-	logServiceURL := "http://logger-service/log"
-
-	request, err := http.NewRequest("POST", logServiceURL, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequest("POST", consumer.services.LoggerURL+"/log", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
 
 	request.Header.Set("Content-Type", "application/json")
 
+	token, err := consumer.services.Tokens(context.Background())
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
 	client := &http.Client{}
 
 	response, err := client.Do(request)
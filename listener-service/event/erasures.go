@@ -0,0 +1,260 @@
+package event
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// usersExchange is where the authentication service publishes user lifecycle events
+	usersExchange = "users_topic"
+	// erasuresQueue holds the user.erased events until the logger has redacted the user
+	erasuresQueue = "listener.user_erasures"
+	// erasuresDeadQueue holds the user.erased events whose redaction failed
+	// redactAttempts times, for an operator to look into and move back
+	erasuresDeadQueue = "listener.user_erasures.dead"
+	// redactAttempts is how many times an erasure is tried before it is dead-lettered
+	redactAttempts = 10
+	// redactRetryDelay is how long a failed redaction waits before it is retried. The wait
+	// doubles with each attempt, up to maxRedactRetryDelay.
+	redactRetryDelay    = 5 * time.Second
+	maxRedactRetryDelay = 5 * time.Minute
+	// erasuresRetryQueue is the prefix of the queues the failed erasures wait in, one per
+	// delay, until their TTL sends them back to erasuresQueue
+	erasuresRetryQueue = "listener.user_erasures.retry."
+
+	// attemptsHeader counts the failed attempts of a requeued erasure, and redactedHeader
+	// holds how many entries were redacted when only completing the erasure failed
+	attemptsHeader = "x-redact-attempts"
+	redactedHeader = "x-redacted"
+)
+
+// UserEvent is a user lifecycle event published by the authentication service
+type UserEvent struct {
+	Event  string `json:"event"`
+	UserID int    `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// ListenErasures consumes the user.erased events, has the logger service redact the
+// emails of erased users from its entries, and then tells the authentication service so,
+// which completes the erasure. The queue is durable and each event is acknowledged only
+// once both are done, so none are lost while the services are down. A failed erasure
+// waits in a retry queue for a growing delay, and after redactAttempts it is moved to
+// erasuresDeadQueue. It only returns with an error, when the channel can't be set up or
+// is closed, so the listener can be restarted.
+func (consumer *Consumer) ListenErasures() error {
+	ch, err := consumer.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	err = ch.ExchangeDeclare(usersExchange, "topic", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	q, err := ch.QueueDeclare(erasuresQueue, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := ch.QueueDeclare(erasuresDeadQueue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := declareRetryQueues(ch); err != nil {
+		return err
+	}
+	if err := ch.QueueBind(q.Name, "user.erased", usersExchange, false, nil); err != nil {
+		return err
+	}
+
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	messages, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Waiting for erasures [Exchange, Queue] [%s, %s]\n", usersExchange, q.Name)
+	for d := range messages {
+		var user UserEvent
+		if err := json.Unmarshal(d.Body, &user); err != nil || user.Email == "" {
+			log.Println("Dropping malformed user.erased event:", string(d.Body))
+			d.Nack(false, false)
+			continue
+		}
+
+		var err error
+		redacted, done := headerInt(d.Headers, redactedHeader)
+		if !done {
+			redacted, err = consumer.redact(user)
+		}
+		if err == nil {
+			done = true
+			err = consumer.completeErasure(user, redacted)
+		}
+		if err == nil {
+			d.Ack(false)
+			continue
+		}
+
+		attempts, _ := headerInt(d.Headers, attemptsHeader)
+		attempts++
+		log.Printf("Error erasing the logs of user %d, attempt %d of %d: %v", user.UserID, attempts, redactAttempts, err)
+		headers := amqp.Table{attemptsHeader: int64(attempts)}
+		if done {
+			headers[redactedHeader] = int64(redacted)
+		}
+		if err := consumer.retryErasure(ch, d, headers, attempts); err != nil {
+			log.Printf("Error requeueing the erasure of user %d: %v", user.UserID, err)
+			d.Nack(false, true)
+			continue
+		}
+		d.Ack(false)
+	}
+
+	if err := <-closed; err != nil {
+		return fmt.Errorf("erasure channel closed: %w", err)
+	}
+	return errors.New("erasure channel closed")
+}
+
+// retryDelay is how long an erasure waits after its attempts-th failure
+func retryDelay(attempts int) time.Duration {
+	delay := redactRetryDelay << (attempts - 1)
+	if delay > maxRedactRetryDelay || delay <= 0 {
+		delay = maxRedactRetryDelay
+	}
+	return delay
+}
+
+// retryQueue names the queue in which erasures wait for delay
+func retryQueue(delay time.Duration) string {
+	return erasuresRetryQueue + delay.String()
+}
+
+// declareRetryQueues declares a queue for each retry delay, whose messages expire after
+// that delay and are then dead-lettered back to erasuresQueue. A queue per delay, rather
+// than a TTL per message, keeps an erasure from waiting behind one with a longer delay.
+func declareRetryQueues(ch *amqp.Channel) error {
+	for attempts := 1; attempts < redactAttempts; attempts++ {
+		delay := retryDelay(attempts)
+		_, err := ch.QueueDeclare(retryQueue(delay), true, false, false, false, amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": erasuresQueue,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryErasure publishes the erasure in d again with headers to the retry queue of its
+// delay, or to the dead-letter queue once it has failed redactAttempts times
+func (consumer *Consumer) retryErasure(ch *amqp.Channel, d amqp.Delivery, headers amqp.Table, attempts int) error {
+	queue := retryQueue(retryDelay(attempts))
+	if attempts >= redactAttempts {
+		queue = erasuresDeadQueue
+		log.Printf("Giving up on an erasure after %d attempts, moving it to %s", attempts, queue)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return ch.PublishWithContext(ctx, "", queue, false, false, amqp.Publishing{
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+		Body:         d.Body,
+	})
+}
+
+// headerInt returns the number in header key, and whether there is one
+func headerInt(headers amqp.Table, key string) (int, bool) {
+	switch n := headers[key].(type) {
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case int:
+		return n, true
+	}
+	return 0, false
+}
+
+// redact asks the logger service to replace the email of an erased user in its entries,
+// and returns how many it changed
+func (consumer *Consumer) redact(user UserEvent) (int, error) {
+	var result struct {
+		Data struct {
+			Redacted int `json:"redacted"`
+		} `json:"data"`
+	}
+	status, err := consumer.post(consumer.services.LoggerURL+"/redact",
+		map[string]any{"user_id": user.UserID, "email": user.Email}, &result)
+	if err != nil {
+		return 0, err
+	}
+	if status != http.StatusOK {
+		return 0, fmt.Errorf("failed to redact logs, status code: %d", status)
+	}
+	return result.Data.Redacted, nil
+}
+
+// completeErasure tells the authentication service that the logs of an erased user are
+// redacted, which completes its erasure
+func (consumer *Consumer) completeErasure(user UserEvent, redacted int) error {
+	status, err := consumer.post(consumer.services.AuthURL+"/erasures/redacted",
+		map[string]any{"user_id": user.UserID, "redacted": redacted}, nil)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		// Completed already, by an earlier attempt whose answer was lost
+		log.Printf("No pending erasure of user %d to complete", user.UserID)
+		return nil
+	default:
+		return fmt.Errorf("failed to complete erasure, status code: %d", status)
+	}
+}
+
+// post sends payload as JSON to url with a token of the listener's own, and decodes the
+// response into out, if any
+func (consumer *Consumer) post(url string, payload, out any) (int, error) {
+	jsonData, _ := json.Marshal(payload)
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	token, err := consumer.services.Tokens(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if out != nil && response.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+			return response.StatusCode, err
+		}
+	}
+	return response.StatusCode, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"authz"
+	"logservice/data"
+	"logservice/logs"
+)
+
+// structured is the entry that TestWriteStructuredLog writes by every path
+var structured = data.LogEntry{
+	Name:     "payment",
+	Data:     "card declined",
+	Severity: "warning",
+	Service:  "broker-service",
+	Host:     "broker-1",
+	TraceID:  "4bf92f3577b34da6",
+	Fields:   map[string]string{"order": "1042", "reason": "insufficient funds"},
+}
+
+// assertStructured checks that the only entry in store is structured
+func assertStructured(t *testing.T, store *memoryStore) {
+	t.Helper()
+	entries, _ := store.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 persisted entry, got %d", len(entries))
+	}
+	got := entries[0]
+	if got.Name != structured.Name || got.Severity != structured.Severity || got.Service != structured.Service ||
+		got.Host != structured.Host || got.TraceID != structured.TraceID || !maps.Equal(got.Fields, structured.Fields) {
+		t.Errorf("persisted %+v, want %+v", got, structured)
+	}
+}
+
+func TestWriteStructuredLog(t *testing.T) {
+	t.Run("http", func(t *testing.T) {
+		app, store := newTestApp(t)
+		srv := httptest.NewServer(app.routes())
+		defer srv.Close()
+
+		token := testToken(authz.LogsWrite)
+		resp := postLog(t, srv, JSONPayload{
+			Name: structured.Name, Data: structured.Data, Severity: "WARNING", Service: structured.Service,
+			Host: structured.Host, TraceID: structured.TraceID, Fields: structured.Fields,
+		}, token)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d", resp.StatusCode)
+		}
+		assertStructured(t, store)
+	})
+
+	t.Run("rpc", func(t *testing.T) {
+		app, store := newTestApp(t)
+		lis := bufconn.Listen(1 << 16)
+		defer lis.Close()
+		go app.rpcServe(lis)
+
+		conn, err := lis.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := rpc.NewClient(conn)
+		defer client.Close()
+
+		var result string
+		err = client.Call("RPCServer.LogInfo", RPCPayload{
+			Name: structured.Name, Data: structured.Data, Severity: structured.Severity, Service: structured.Service,
+			Host: structured.Host, TraceID: structured.TraceID, Fields: structured.Fields,
+		}, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStructured(t, store)
+	})
+
+	t.Run("grpc", func(t *testing.T) {
+		app, store := newTestApp(t)
+		client := grpcClient(t, app)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_, err := client.WriteLog(ctx, &logs.LogRequest{LogEntry: &logs.Log{
+			Name: structured.Name, Data: structured.Data, Severity: structured.Severity, Service: structured.Service,
+			Host: structured.Host, TraceId: structured.TraceID, Fields: structured.Fields,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStructured(t, store)
+
+		entry, err := client.GetLog(ctx, &logs.GetLogRequest{Id: "1"})
+		if err != nil || entry.GetTraceId() != structured.TraceID || entry.GetFields()["order"] != "1042" {
+			t.Errorf("unexpected entry %+v (%v)", entry, err)
+		}
+	})
+}
+
+func TestWriteLogDefaultsSeverity(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	token := testToken(authz.LogsWrite)
+	resp := postLog(t, srv, JSONPayload{Name: "event", Data: "from an old client"}, token)
+	resp.Body.Close()
+
+	entries, _ := store.All()
+	if resp.StatusCode != http.StatusAccepted || len(entries) != 1 || entries[0].Severity != data.SeverityInfo {
+		t.Fatalf("expected an info entry, got %d %+v", resp.StatusCode, entries)
+	}
+}
+
+func TestWriteLogRejectsInvalidEntries(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+	client := grpcClient(t, app)
+
+	token := testToken(authz.LogsWrite)
+	for _, payload := range []JSONPayload{
+		{Name: "event", Severity: "fatal"},
+		{Name: "event", Fields: map[string]string{"a.b": "dotted"}},
+		{Name: "event", Fields: map[string]string{"$where": "operator"}},
+	} {
+		resp := postLog(t, srv, payload, token)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%+v: got %d, want 400", payload, resp.StatusCode)
+		}
+
+		_, err := client.WriteLog(context.Background(), &logs.LogRequest{LogEntry: &logs.Log{
+			Name: payload.Name, Severity: payload.Severity, Fields: payload.Fields,
+		}})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%+v: got %v over gRPC, want InvalidArgument", payload, err)
+		}
+	}
+	if entries, _ := store.All(); len(entries) != 0 {
+		t.Errorf("invalid entries were written: %+v", entries)
+	}
+}
+
+func TestListLogsByStructuredFields(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	store.Insert(structured)
+	store.Insert(data.LogEntry{Name: "payment", Data: "card accepted", Severity: "info", Service: "broker-service",
+		TraceID: "4bf92f3577b34da6", Fields: map[string]string{"order": "1043"}})
+	store.Insert(data.LogEntry{Name: "mail", Data: "receipt sent", Severity: "info", Service: "mail-service",
+		TraceID: "00f067aa0ba902b7", Fields: map[string]string{"order": "1043"}})
+
+	tests := map[string][]string{
+		"?severity=warning":                          {"card declined"},
+		"?service=broker-service":                    {"card accepted", "card declined"},
+		"?trace_id=00f067aa0ba902b7":                 {"receipt sent"},
+		"?fields[order]=1043":                        {"receipt sent", "card accepted"},
+		"?fields[order]=1043&service=broker-service": {"card accepted"},
+		"?fields[reason]=insufficient%20funds":       {"card declined"},
+	}
+	for query, want := range tests {
+		status, page := listLogs(t, srv, "/logs"+query)
+		if got := entryData(page.Entries); status != http.StatusOK || !slices.Equal(got, want) {
+			t.Errorf("%q: got %d %q, want %q", query, status, got, want)
+		}
+	}
+
+	for _, query := range []string{"?severity=fatal", "?fields[a.b]=1"} {
+		if status, _ := listLogs(t, srv, "/logs"+query); status != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want 400", query, status)
+		}
+	}
+
+	// The entry is returned with all it was written with
+	token := testToken(authz.LogsRead)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/logs/1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Data data.LogEntry `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	if out.Data.Host != "broker-1" || out.Data.Fields["reason"] != "insufficient funds" {
+		t.Errorf("unexpected entry %+v", out.Data)
+	}
+}
@@ -2,48 +2,256 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strings"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	"authz"
 	"logservice/data"
 	"logservice/logs"
 )
 
+const (
+	// writeLogsChunk is how many entries of a WriteLogs stream are stored at once
+	writeLogsChunk = 500
+	// tailBuffer is how many entries TailLogs holds for a client that reads them slower
+	// than they are written
+	tailBuffer = 1000
+)
+
+// grpcPermissions are the permissions of the HTTP API's matching routes that each call
+// needs, by method. Calls that aren't listed are refused.
+var grpcPermissions = map[string]string{
+	"/logs.LogService/WriteLog":  authz.LogsWrite,
+	"/logs.LogService/WriteLogs": authz.LogsWrite,
+	"/logs.LogService/TailLogs":  authz.LogsRead,
+	"/logs.LogService/ListLogs":  authz.LogsRead,
+	"/logs.LogService/GetLog":    authz.LogsRead,
+}
+
 type LogServer struct {
 	logs.UnimplementedLogServiceServer
 	Models data.Models
+	Writer *data.BatchWriter
+	// Feed is sent the entries Writer stores, for TailLogs
+	Feed *data.Feed
 }
 
 func (l *LogServer) WriteLog(ctx context.Context, req *logs.LogRequest) (*logs.LogResponse, error) {
-	input := req.GetLogEntry()
-
 	// Write the log
-	logEntry := data.LogEntry{
-		Name: input.Name,
-		Data: input.Data,
+	logEntry := logEntryFromMessage(req.GetLogEntry())
+	if err := logEntry.Normalize(); err != nil {
+		return &logs.LogResponse{Result: "failed"}, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	err := l.Models.LogEntry.Insert(logEntry)
+	var err error
+	if req.GetSync() {
+		err = l.Writer.WriteSync(ctx, logEntry)
+	} else {
+		err = l.Writer.Write(ctx, logEntry)
+	}
 	if err != nil {
-		return &logs.LogResponse{Result: "failed"}, err
+		return &logs.LogResponse{Result: "failed"}, writeError(err)
 	}
 
 	// Return response
 	return &logs.LogResponse{Result: "logged!"}, nil
 }
 
+// WriteLogs stores a stream of entries, writeLogsChunk at a time, and acknowledges them
+// once they are all stored. Invalid entries are counted as rejected rather than ending the
+// stream. If storing fails, the stream ends with an error, and the entries sent before the
+// chunk that failed are stored.
+func (l *LogServer) WriteLogs(stream logs.LogService_WriteLogsServer) error {
+	ctx := stream.Context()
+	resp := &logs.WriteLogsResponse{}
+
+	chunk := make([]data.LogEntry, 0, writeLogsChunk)
+	store := func() error {
+		err := l.Writer.WriteAll(ctx, chunk)
+		chunk = chunk[:0]
+		if err != nil {
+			return writeError(err)
+		}
+		return nil
+	}
+
+	for {
+		input, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			if err := store(); err != nil {
+				return err
+			}
+			return stream.SendAndClose(resp)
+		} else if err != nil {
+			return err
+		}
+
+		entry := logEntryFromMessage(input)
+		if err := entry.Normalize(); err != nil {
+			resp.Rejected++
+			continue
+		}
+		chunk = append(chunk, entry)
+		resp.Accepted++
+
+		if len(chunk) == writeLogsChunk {
+			if err := store(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// TailLogs pushes the entries that match the filter of req as they are stored, until the
+// client goes away. A client that falls more than tailBuffer entries behind is cut off
+// with RESOURCE_EXHAUSTED.
+func (l *LogServer) TailLogs(req *logs.TailLogsRequest, stream logs.LogService_TailLogsServer) error {
+	filter := data.LogFilter{
+		Name:     req.GetName(),
+		Text:     req.GetText(),
+		Severity: req.GetSeverity(),
+		Service:  req.GetService(),
+		TraceID:  req.GetTraceId(),
+		Fields:   req.GetFields(),
+	}
+	if err := filter.Check(); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	sub := l.Feed.Subscribe(filter, tailBuffer)
+	defer l.Feed.Unsubscribe(sub)
+
+	for {
+		select {
+		case entry, ok := <-sub.Entries:
+			if !ok && sub.Lagged() {
+				return status.Error(codes.ResourceExhausted, "fell too far behind the logs, tail again to resume")
+			} else if !ok {
+				return nil
+			}
+			if err := stream.Send(logEntryMessage(entry)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// ListLogs returns a page of log entries, like GET /logs
+func (l *LogServer) ListLogs(ctx context.Context, req *logs.ListLogsRequest) (*logs.ListLogsResponse, error) {
+	if req.GetLimit() < 0 || req.GetLimit() > data.MaxPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %d", data.MaxPageSize)
+	}
+
+	query := data.LogQuery{
+		LogFilter: data.LogFilter{
+			Name:     req.GetName(),
+			Text:     req.GetText(),
+			Severity: req.GetSeverity(),
+			Service:  req.GetService(),
+			TraceID:  req.GetTraceId(),
+			Fields:   req.GetFields(),
+		},
+		OldestFirst: req.GetOldestFirst(),
+		Limit:       int(req.GetLimit()),
+		Cursor:      req.GetCursor(),
+	}
+	if req.GetSince() != nil {
+		query.Since = req.GetSince().AsTime()
+	}
+	if req.GetUntil() != nil {
+		query.Until = req.GetUntil().AsTime()
+	}
+
+	entries, next, err := l.Models.LogEntry.Query(ctx, query)
+	if errors.Is(err, data.ErrInvalidCursor) || errors.Is(err, data.ErrInvalidFilter) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	} else if err != nil {
+		log.Println("Error querying logs:", err)
+		return nil, status.Error(codes.Internal, "could not query logs")
+	}
+
+	resp := &logs.ListLogsResponse{NextCursor: next}
+	for _, entry := range entries {
+		resp.Entries = append(resp.Entries, logEntryMessage(entry))
+	}
+	return resp, nil
+}
+
+// GetLog returns one log entry, like GET /logs/:id
+func (l *LogServer) GetLog(ctx context.Context, req *logs.GetLogRequest) (*logs.LogEntry, error) {
+	entry, err := l.Models.LogEntry.GetOne(req.GetId())
+	if errors.Is(err, data.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		log.Println("Error getting log entry:", err)
+		return nil, status.Error(codes.Internal, "could not get log entry")
+	}
+	return logEntryMessage(entry), nil
+}
+
+// writeError converts an error of the BatchWriter to a gRPC status
+func writeError(err error) error {
+	switch {
+	case errors.Is(err, data.ErrOverloaded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, data.ErrClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	default:
+		log.Println("Error writing log entries:", err)
+		return status.Error(codes.Internal, "could not write log entries")
+	}
+}
+
+// logEntryFromMessage converts an entry sent over gRPC to one to store
+func logEntryFromMessage(input *logs.Log) data.LogEntry {
+	return data.LogEntry{
+		Name:     input.GetName(),
+		Data:     input.GetData(),
+		Severity: input.GetSeverity(),
+		Service:  input.GetService(),
+		Host:     input.GetHost(),
+		TraceID:  input.GetTraceId(),
+		Fields:   input.GetFields(),
+	}
+}
+
+// logEntryMessage converts a stored log entry to its gRPC message
+func logEntryMessage(entry *data.LogEntry) *logs.LogEntry {
+	return &logs.LogEntry{
+		Id:        entry.ID,
+		Name:      entry.Name,
+		Data:      entry.Data,
+		Severity:  entry.Severity,
+		Service:   entry.Service,
+		Host:      entry.Host,
+		TraceId:   entry.TraceID,
+		Fields:    entry.Fields,
+		CreatedAt: timestamppb.New(entry.CreatedAt),
+		UpdatedAt: timestamppb.New(entry.UpdatedAt),
+	}
+}
+
 func (app *Config) gRPCListen() {
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", gRpcPort))
 	if err != nil {
 		log.Fatalf("Failed to listen for gRPC: %v", err)
 	}
 
-	s := grpc.NewServer()
-
-	logs.RegisterLogServiceServer(s, &LogServer{Models: app.Models})
+	s := app.gRPCServer()
 
 	log.Printf("gRPC Server started on port %s", gRpcPort)
 
@@ -51,3 +259,54 @@ func (app *Config) gRPCListen() {
 		log.Fatalf("Failed to listen for gRPC: %v", err)
 	}
 }
+
+// gRPCServer builds a gRPC server with the log service registered on it
+func (app *Config) gRPCServer() *grpc.Server {
+	s := grpc.NewServer(grpc.UnaryInterceptor(app.unaryAuth), grpc.StreamInterceptor(app.streamAuth))
+
+	logs.RegisterLogServiceServer(s, &LogServer{Models: app.Models, Writer: app.Writer, Feed: app.Feed})
+
+	return s
+}
+
+// unaryAuth checks the access token of a call before it is handled
+func (app *Config) unaryAuth(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := app.grpcAuthorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamAuth checks the access token of a stream before it is handled
+func (app *Config) streamAuth(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := app.grpcAuthorize(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// grpcAuthorize checks that the bearer token in a call's "authorization" metadata grants
+// the permission that method needs
+func (app *Config) grpcAuthorize(ctx context.Context, method string) error {
+	permission, ok := grpcPermissions[method]
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "%s is not allowed", method)
+	}
+
+	var header string
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		header = values[0]
+	}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return status.Error(codes.Unauthenticated, "missing access token")
+	}
+	claims, err := app.Tokens.Parse(token)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	if !claims.Can(permission) {
+		return status.Error(codes.PermissionDenied, "missing permission "+permission)
+	}
+	return nil
+}
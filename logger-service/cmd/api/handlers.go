@@ -1,18 +1,30 @@
 package main
 
 import (
+	"authz"
+	"errors"
+	"fmt"
+	"log"
 	"logservice/data"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
+// JSONPayload is an entry to write. Only name and data are required; see data.LogEntry
+// for the rest.
 type JSONPayload struct {
-	Name string `json:"name"`
-	Data string `json:"data"`
+	Name     string            `json:"name"`
+	Data     string            `json:"data"`
+	Severity string            `json:"severity,omitempty"`
+	Service  string            `json:"service,omitempty"`
+	Host     string            `json:"host,omitempty"`
+	TraceID  string            `json:"trace_id,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
 }
 
-// WriteLog handles the logging of data.
+// WriteLog handles the logging of data. The entry is queued to be written with the next
+// batch; with ?sync=true the response waits until it is stored.
 func (app *Config) WriteLog(c *gin.Context) {
 	// Read JSON into var
 	var requestPayload JSONPayload
@@ -23,20 +35,102 @@ func (app *Config) WriteLog(c *gin.Context) {
 
 	// Insert data
 	event := data.LogEntry{
-		Name: requestPayload.Name,
-		Data: requestPayload.Data,
+		Name:     requestPayload.Name,
+		Data:     requestPayload.Data,
+		Severity: requestPayload.Severity,
+		Service:  requestPayload.Service,
+		Host:     requestPayload.Host,
+		TraceID:  requestPayload.TraceID,
+		Fields:   requestPayload.Fields,
 	}
-
-	if err := app.Models.LogEntry.Insert(event); err != nil {
+	if err := event.Normalize(); err != nil {
 		app.errorJSON(c, err)
 		return
 	}
 
+	ctx := c.Request.Context()
+	status := http.StatusAccepted
+	var err error
+	if c.Query("sync") == "true" {
+		err, status = app.Writer.WriteSync(ctx, event), http.StatusCreated
+	} else {
+		err = app.Writer.Write(ctx, event)
+	}
+	if errors.Is(err, data.ErrOverloaded) || errors.Is(err, data.ErrClosed) {
+		c.Header("Retry-After", "1")
+		app.errorJSON(c, err, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		log.Println("Error writing log entry:", err)
+		app.errorJSON(c, errors.New("could not write log entry"), http.StatusInternalServerError)
+		return
+	}
+
 	// Respond with success
 	resp := jsonResponse{
 		Error:   false,
 		Message: "logged",
 	}
 
-	c.JSON(http.StatusAccepted, resp)
+	c.JSON(status, resp)
+}
+
+// RedactPayload names a user whose personal data was erased, and the email the logs know
+// them by
+type RedactPayload struct {
+	UserID int    `json:"user_id" binding:"required"`
+	Email  string `json:"email" binding:"required,email"`
+}
+
+// redactionService is the service that asks for the redaction of erased users
+const redactionService = "listener-service"
+
+// requireRedactor only lets through the redaction service's own tokens, and administrators
+// with logs:admin. Redaction rewrites every entry that mentions an email, so logs:write,
+// which every service and many scripts hold, isn't enough.
+func (app *Config) requireRedactor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !app.Tokens.Authorize(c) {
+			return
+		}
+		claims, _ := authz.FromContext(c)
+		if claims.Subject != "service:"+redactionService && !claims.Can(authz.LogsAdmin) {
+			c.Abort()
+			app.errorJSON(c, errors.New("only the "+redactionService+" or an administrator can redact log entries"), http.StatusForbidden)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Redact replaces the email of an erased user in every log entry with a placeholder that
+// names the user only by ID, and logs how many entries it changed.
+func (app *Config) Redact(c *gin.Context) {
+	var requestPayload RedactPayload
+	if err := c.ShouldBindJSON(&requestPayload); err != nil {
+		app.errorJSON(c, errors.New("user_id and a valid email are required"))
+		return
+	}
+
+	placeholder := fmt.Sprintf("[erased user %d]", requestPayload.UserID)
+	redacted, err := app.Models.LogEntry.Redact(c.Request.Context(), requestPayload.Email, placeholder)
+	if err != nil {
+		log.Printf("Error redacting the entries of user %d: %v", requestPayload.UserID, err)
+		app.errorJSON(c, errors.New("could not redact log entries"), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("redacted %d log entries of erased user %d", redacted, requestPayload.UserID)
+	entry := data.LogEntry{Name: "erasure", Data: message}
+	if err := entry.Normalize(); err != nil {
+		log.Println("Error logging redaction:", err)
+	} else if err := app.Writer.WriteSync(c.Request.Context(), entry); err != nil {
+		log.Println("Error logging redaction:", err)
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: message,
+		Data:    gin.H{"redacted": redacted},
+	})
 }
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"authz"
+	"logservice/data"
+	"logservice/logs"
+)
+
+// memoryStore is an in-memory data.LogStore used in place of Mongo. Its entries are ordered
+// by when they were written, so All returns them newest first.
+type memoryStore struct {
+	mu      sync.Mutex
+	entries []*data.LogEntry
+	lastID  int
+	// writer is flushed before reading, so that tests see the entries the APIs queued
+	writer *data.BatchWriter
+}
+
+func (m *memoryStore) Insert(entry data.LogEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastID++
+	entry.ID = strconv.Itoa(m.lastID)
+	// Mongo keeps times to the millisecond
+	entry.CreatedAt = time.Now().Truncate(time.Millisecond)
+	entry.UpdatedAt = entry.CreatedAt
+	m.entries = append(m.entries, &entry)
+	return nil
+}
+
+func (m *memoryStore) InsertMany(ctx context.Context, entries []data.LogEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range entries {
+		m.lastID++
+		entries[i].ID = strconv.Itoa(m.lastID)
+		entries[i].CreatedAt = entries[i].CreatedAt.Truncate(time.Millisecond)
+		entries[i].UpdatedAt = entries[i].CreatedAt
+		if expires := entries[i].ExpiresAt; expires != nil {
+			truncated := expires.Truncate(time.Millisecond)
+			entries[i].ExpiresAt = &truncated
+		}
+		entry := entries[i]
+		m.entries = append(m.entries, &entry)
+	}
+	return nil
+}
+
+func (m *memoryStore) All() ([]*data.LogEntry, error) {
+	if m.writer != nil {
+		m.writer.Flush(context.Background())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]*data.LogEntry, 0, len(m.entries))
+	for i := len(m.entries) - 1; i >= 0; i-- {
+		entry := *m.entries[i]
+		out = append(out, &entry)
+	}
+	return out, nil
+}
+
+// newer reports whether a was written after b
+func newer(a, b *data.LogEntry) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	x, _ := strconv.Atoi(a.ID)
+	y, _ := strconv.Atoi(b.ID)
+	return x > y
+}
+
+func (m *memoryStore) Query(ctx context.Context, q data.LogQuery) ([]*data.LogEntry, string, error) {
+	var after *data.LogEntry
+	if q.Cursor != "" {
+		cursor, err := data.ParseCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &data.LogEntry{ID: cursor.ID, CreatedAt: cursor.CreatedAt}
+	}
+
+	entries, _ := m.All()
+	if q.OldestFirst {
+		slices.Reverse(entries)
+	}
+	var page []*data.LogEntry
+	for _, entry := range entries {
+		if !q.Matches(entry) || after != nil && (entry.ID == after.ID || newer(entry, after) != q.OldestFirst) {
+			continue
+		}
+		if len(page) == q.PageSize() {
+			return page, data.CursorAfter(page[len(page)-1]).String(), nil
+		}
+		page = append(page, entry)
+	}
+	return page, "", nil
+}
+
+func (m *memoryStore) Each(ctx context.Context, filter data.LogFilter, fn func(*data.LogEntry) error) error {
+	entries, _ := m.All()
+	for _, entry := range entries {
+		if !filter.Matches(entry) {
+			continue
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) GetOne(id string) (*data.LogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.entries {
+		if e.ID == id {
+			entry := *e
+			return &entry, nil
+		}
+	}
+	return nil, data.ErrNotFound
+}
+
+func (m *memoryStore) DropCollection() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = nil
+	return nil
+}
+
+func (m *memoryStore) Redact(ctx context.Context, email, replacement string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mention := regexp.MustCompile("(?i)" + regexp.QuoteMeta(email))
+	redacted := 0
+	for _, e := range m.entries {
+		if e.ReplaceMentions(mention, replacement) {
+			redacted++
+		}
+	}
+	return redacted, nil
+}
+
+func (m *memoryStore) DeleteExpired(ctx context.Context, policy data.RetentionPolicy, now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	before := len(m.entries)
+	m.entries = slices.DeleteFunc(m.entries, func(e *data.LogEntry) bool { return policy.Expired(e, now) })
+	return int64(before - len(m.entries)), nil
+}
+
+func (m *memoryStore) Restamp(ctx context.Context, policy data.RetentionPolicy) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var changed int64
+	for _, e := range m.entries {
+		before := e.ExpiresAt
+		e.ExpiresAt = nil
+		policy.Stamp(e)
+		if (before == nil) != (e.ExpiresAt == nil) || before != nil && !before.Equal(*e.ExpiresAt) {
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+func (m *memoryStore) Stats(ctx context.Context) (data.CollectionStats, error) {
+	entries, _ := m.All()
+	stats := data.CollectionStats{Count: int64(len(entries)), TTLIndex: true}
+	for _, entry := range entries {
+		stats.Size += int64(len(entry.Name) + len(entry.Data))
+		if stats.Oldest == nil || entry.CreatedAt.Before(*stats.Oldest) {
+			stats.Oldest = &entry.CreatedAt
+		}
+	}
+	stats.StorageSize = stats.Size
+	return stats, nil
+}
+
+func newTestApp(t *testing.T) (*Config, *memoryStore) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	store := &memoryStore{}
+	feed := data.NewFeed()
+	store.writer = data.NewBatchWriter(store, data.BatchConfig{Feed: feed})
+	t.Cleanup(func() { store.writer.Close(context.Background()) })
+	return &Config{
+		Models:        data.Models{LogEntry: store},
+		Writer:        store.writer,
+		Feed:          feed,
+		Tokens:        testTokens,
+		Retention:     data.NewSweeper(store, data.RetentionPolicy{}),
+		SweepInterval: defaultSweepInterval,
+	}, store
+}
+
+// testTokens signs the access tokens sent to the logger in tests, like the authentication
+// service, and verifies them
+var testTokens = func() *authz.Tokens {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	return authz.NewSigner(key)
+}()
+
+// testToken returns an access token granting permissions
+func testToken(permissions ...string) string {
+	token, err := testTokens.Sign(authz.Claims{
+		Permissions:      permissions,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "1"},
+	}, time.Minute)
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+// postLog sends payload to the HTTP API with token as the bearer token, if any
+func postLog(t *testing.T, srv *httptest.Server, payload JSONPayload, token string) *http.Response {
+	t.Helper()
+	body, _ := json.Marshal(payload)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/log", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func assertSingleEntry(t *testing.T, store *memoryStore, name, value string) {
+	t.Helper()
+	entries, _ := store.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 persisted entry, got %d", len(entries))
+	}
+	if entries[0].Name != name || entries[0].Data != value {
+		t.Errorf("persisted %q/%q, want %q/%q", entries[0].Name, entries[0].Data, name, value)
+	}
+	if entries[0].CreatedAt.IsZero() {
+		t.Errorf("persisted entry has no created_at")
+	}
+}
+
+func TestWriteLogHTTP(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	token := testToken(authz.LogsWrite)
+	resp := postLog(t, srv, JSONPayload{Name: "event", Data: "via http"}, token)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	assertSingleEntry(t, store, "event", "via http")
+}
+
+func TestWriteLogHTTPRequiresPermission(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	readOnly := testToken(authz.LogsRead)
+	for token, want := range map[string]int{"": http.StatusUnauthorized, readOnly: http.StatusForbidden} {
+		resp := postLog(t, srv, JSONPayload{Name: "event", Data: "denied"}, token)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("token %q: got %d, want %d", token, resp.StatusCode, want)
+		}
+	}
+	if entries, _ := store.All(); len(entries) != 0 {
+		t.Errorf("unauthorized requests wrote %d entries", len(entries))
+	}
+}
+
+func TestRedactHTTP(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	store.Insert(data.LogEntry{Name: "authentication", Data: "Grace@Example.com logged in"})
+	store.Insert(data.LogEntry{Name: "authentication", Data: "ada@example.com logged in"})
+	store.Insert(data.LogEntry{Name: "mail to grace@example.com", Data: "sent"})
+	store.Insert(data.LogEntry{Name: "signup", Data: "new user", Fields: map[string]string{"email": "grace@example.com", "plan": "free"}})
+
+	redact := func(token string, payload RedactPayload) *http.Response {
+		t.Helper()
+		body, _ := json.Marshal(payload)
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/redact", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Writing logs doesn't allow rewriting them, whoever holds the token
+	brokerToken, _ := testTokens.ServiceToken("broker-service")
+	for _, token := range []string{testToken(authz.LogsWrite), brokerToken} {
+		resp := redact(token, RedactPayload{UserID: 7, Email: "grace@example.com"})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected 403 for a logs:write token, got %d", resp.StatusCode)
+		}
+	}
+
+	token, _ := testTokens.ServiceToken("listener-service")
+	resp := redact(token, RedactPayload{UserID: 7, Email: "not an email"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid email, got %d", resp.StatusCode)
+	}
+
+	resp = redact(token, RedactPayload{UserID: 7, Email: "grace@example.com"})
+	defer resp.Body.Close()
+
+	var out jsonResponse
+	json.NewDecoder(resp.Body).Decode(&out)
+	if resp.StatusCode != http.StatusOK || out.Message != "redacted 3 log entries of erased user 7" {
+		t.Fatalf("expected 3 entries to be redacted, got %d %+v", resp.StatusCode, out)
+	}
+
+	entries, _ := store.All()
+	if len(entries) != 5 || entries[0].Name != "erasure" || entries[0].Data != out.Message {
+		t.Fatalf("expected the redaction to be logged, got %+v", entries)
+	}
+	if entries[1].Fields["email"] != "[erased user 7]" || entries[1].Fields["plan"] != "free" ||
+		entries[2].Name != "mail to [erased user 7]" || entries[3].Data != "ada@example.com logged in" ||
+		entries[4].Data != "[erased user 7] logged in" {
+		t.Errorf("unexpected entries after redaction: %+v %+v %+v %+v", entries[1], entries[2], entries[3], entries[4])
+	}
+}
+
+func TestLogInfoRPC(t *testing.T) {
+	app, store := newTestApp(t)
+
+	lis := bufconn.Listen(1 << 16)
+	defer lis.Close()
+	go app.rpcServe(lis)
+
+	conn, err := lis.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var result string
+	if err := client.Call("RPCServer.LogInfo", RPCPayload{Name: "event", Data: "via rpc"}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result != "Processed payload via RPC:event" {
+		t.Errorf("unexpected RPC result %q", result)
+	}
+	assertSingleEntry(t, store, "event", "via rpc")
+}
+
+// grpcClient serves the gRPC API of app over an in-memory connection and returns a client
+// for it
+// grpcClient returns a client of app's gRPC server whose calls carry a token that can read
+// and write logs
+func grpcClient(t *testing.T, app *Config) logs.LogServiceClient {
+	t.Helper()
+	return grpcClientWithToken(t, app, testToken(authz.LogsRead, authz.LogsWrite))
+}
+
+// bearerToken sends a token in the "authorization" metadata of every call
+type bearerToken string
+
+func (b bearerToken) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(b)}, nil
+}
+
+func (bearerToken) RequireTransportSecurity() bool { return false }
+
+// grpcClientWithToken returns a client of app's gRPC server whose calls carry token, or no
+// token when it is empty
+func grpcClientWithToken(t *testing.T, app *Config, token string) logs.LogServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 16)
+	s := app.gRPCServer()
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	opts := []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerToken(token)))
+	}
+	conn, err := grpc.NewClient("passthrough:///bufnet", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return logs.NewLogServiceClient(conn)
+}
+
+func TestWriteLogGRPC(t *testing.T) {
+	app, store := newTestApp(t)
+	client := grpcClient(t, app)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.WriteLog(ctx, &logs.LogRequest{
+		LogEntry: &logs.Log{Name: "event", Data: "via grpc"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetResult() != "logged!" {
+		t.Errorf("unexpected gRPC result %q", resp.GetResult())
+	}
+	assertSingleEntry(t, store, "event", "via grpc")
+}
+
+func TestGRPCRequiresPermission(t *testing.T) {
+	app, store := newTestApp(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Calls without a valid token are refused before they are handled
+	for _, token := range []string{"", "not-a-token"} {
+		client := grpcClientWithToken(t, app, token)
+		_, err := client.WriteLog(ctx, &logs.LogRequest{LogEntry: &logs.Log{Name: "event", Data: "anonymous"}})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("WriteLog with token %q: got %v, want Unauthenticated", token, err)
+		}
+		if _, err := client.ListLogs(ctx, &logs.ListLogsRequest{}); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("ListLogs with token %q: got %v, want Unauthenticated", token, err)
+		}
+		if _, err := client.GetLog(ctx, &logs.GetLogRequest{Id: "1"}); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("GetLog with token %q: got %v, want Unauthenticated", token, err)
+		}
+	}
+
+	// Each call needs the permission of its HTTP route
+	writer := grpcClientWithToken(t, app, testToken(authz.LogsWrite))
+	if _, err := writer.ListLogs(ctx, &logs.ListLogsRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ListLogs with logs:write: got %v, want PermissionDenied", err)
+	}
+	reader := grpcClientWithToken(t, app, testToken(authz.LogsRead))
+	_, err := reader.WriteLog(ctx, &logs.LogRequest{LogEntry: &logs.Log{Name: "event", Data: "read only"}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("WriteLog with logs:read: got %v, want PermissionDenied", err)
+	}
+	if entries, _ := store.All(); len(entries) != 0 {
+		t.Errorf("refused calls wrote %+v", entries)
+	}
+}
+
+func TestWriteLogSync(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	token := testToken(authz.LogsWrite)
+	body, _ := json.Marshal(JSONPayload{Name: "event", Data: "durable"})
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/log?sync=true", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Read past All, which would flush the writer itself
+	store.mu.Lock()
+	stored := len(store.entries)
+	store.mu.Unlock()
+	if resp.StatusCode != http.StatusCreated || stored != 1 {
+		t.Fatalf("expected the entry to be stored before the response, got %d with %d entries", resp.StatusCode, stored)
+	}
+}
+
+func TestWriteLogAfterShutdown(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+	client := grpcClient(t, app)
+
+	token := testToken(authz.LogsWrite)
+	postLog(t, srv, JSONPayload{Name: "event", Data: "queued"}, token).Body.Close()
+	if err := app.Writer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertSingleEntry(t, store, "event", "queued")
+
+	resp := postLog(t, srv, JSONPayload{Name: "event", Data: "too late"}, token)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("expected entries after shutdown to be refused, got %d", resp.StatusCode)
+	}
+	_, err := client.WriteLog(context.Background(), &logs.LogRequest{LogEntry: &logs.Log{Name: "event"}})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expected entries after shutdown to be refused over gRPC, got %v", err)
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"authz"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"logservice/data"
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
@@ -25,6 +31,15 @@ var client *mongo.Client
 
 type Config struct {
 	Models data.Models
+	// Writer batches the entries of all three APIs into InsertMany calls
+	Writer *data.BatchWriter
+	// Feed is sent the entries Writer stores, for the gRPC TailLogs
+	Feed *data.Feed
+	// Tokens checks the permissions of callers of the HTTP API
+	Tokens *authz.Tokens
+	// Retention deletes the entries the retention rules no longer keep, every SweepInterval
+	Retention     *data.Sweeper
+	SweepInterval time.Duration
 }
 
 func main() {
@@ -35,21 +50,58 @@ func main() {
 	}
 	client = mongoClient
 
-	// create a context in order to disconnect
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-
-	// close connection
+	// close connection, once the queued entries are written
 	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
 		if err = client.Disconnect(ctx); err != nil {
 			panic(err)
 		}
 	}()
 
+	key, err := authz.PublicKeyFromEnv()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	retention, err := data.ParseRetention(os.Getenv("LOG_RETENTION"))
+	if err != nil {
+		log.Panic(err)
+	}
+	sweepInterval := envDuration("LOG_RETENTION_SWEEP_INTERVAL")
+	if sweepInterval == 0 {
+		sweepInterval = defaultSweepInterval
+	}
+
+	models := data.New(client)
+	feed := data.NewFeed()
 	app := Config{
-		Models: data.New(client),
+		Models: models,
+		Writer: data.NewBatchWriter(models.LogEntry, data.BatchConfig{
+			Size:      envInt("LOG_BATCH_SIZE"),
+			Interval:  envDuration("LOG_BATCH_INTERVAL"),
+			Buffer:    envInt("LOG_BATCH_BUFFER"),
+			Feed:      feed,
+			Retention: retention,
+		}),
+		Feed:          feed,
+		Tokens:        authz.NewVerifier(key),
+		Retention:     data.NewSweeper(models.LogEntry, retention),
+		SweepInterval: sweepInterval,
+	}
+
+	// Queries still work without the indexes, only slower, and without the TTL index the
+	// sweeper still deletes old entries
+	if err := data.CreateIndexes(); err != nil {
+		log.Println("Error creating log indexes:", err)
 	}
 
+	// The sweeper restamps the entries stored before the retention rules changed, then
+	// applies the rules to them
+	stopSweeping := make(chan struct{})
+	defer close(stopSweeping)
+	go app.Retention.Run(app.SweepInterval, stopSweeping)
+
 	go app.rpcListen()
 	go app.gRPCListen()
 
@@ -62,11 +114,52 @@ func main() {
 		Handler: router,
 	}
 
-	err = srv.ListenAndServe()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Panic(err)
+		}
+	}()
+
+	// On shutdown, finish the requests in flight and then write the entries still queued
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down")
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error shutting down the web server:", err)
+	}
+	if err := app.Writer.Close(shutdownCtx); err != nil {
+		log.Println("Error writing the queued log entries:", err)
+	}
+}
+
+// envInt reads a number from the environment, or 0 if it's not set
+func envInt(key string) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
 	if err != nil {
-		log.Panic()
+		log.Panicf("%s must be a number: %v", key, err)
 	}
+	return n
+}
 
+// envDuration reads a duration such as 200ms from the environment, or 0 if it's not set
+func envDuration(key string) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Panicf("%s must be a duration: %v", key, err)
+	}
+	return d
 }
 
 func (app *Config) rpcListen() error {
@@ -77,14 +170,27 @@ func (app *Config) rpcListen() error {
 	}
 	defer listen.Close()
 
+	return app.rpcServe(listen)
+}
+
+// rpcServe registers RPCServer and serves RPC connections accepted on listen
+func (app *Config) rpcServe(listen net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.Register(&RPCServer{Models: app.Models, Writer: app.Writer}); err != nil {
+		return err
+	}
+
 	for {
 		rpcConn, err := listen.Accept()
 		if err != nil {
-			continue
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
 		}
-		go rpc.ServeConn(rpcConn)
+		go server.ServeConn(rpcConn)
 	}
-
 }
 
 func connectToMongo() (*mongo.Client, error) {
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"logservice/data"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listLogsResponse is a page of log entries, and the cursor of the next page, which is empty
+// on the last one
+type listLogsResponse struct {
+	Entries    []*data.LogEntry `json:"entries"`
+	NextCursor string           `json:"next_cursor"`
+}
+
+// ListLogs returns a page of log entries, newest first. The query string can filter them
+// by name, severity, service and trace_id, by fields with fields[key]=value, by creation
+// time with since and until (RFC 3339, until is exclusive) and by text in the name or data
+// with q; sort=oldest reverses the order, and limit and cursor page through them.
+func (app *Config) ListLogs(c *gin.Context) {
+	query, err := logQuery(c)
+	if err != nil {
+		app.errorJSON(c, err)
+		return
+	}
+
+	entries, next, err := app.Models.LogEntry.Query(c.Request.Context(), query)
+	if errors.Is(err, data.ErrInvalidCursor) || errors.Is(err, data.ErrInvalidFilter) {
+		app.errorJSON(c, err)
+		return
+	} else if err != nil {
+		log.Println("Error querying logs:", err)
+		app.errorJSON(c, errors.New("could not query logs"), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []*data.LogEntry{}
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: strconv.Itoa(len(entries)) + " log entries",
+		Data:    listLogsResponse{Entries: entries, NextCursor: next},
+	})
+}
+
+// GetLog returns the log entry with the ID in the path
+func (app *Config) GetLog(c *gin.Context) {
+	entry, err := app.Models.LogEntry.GetOne(c.Param("id"))
+	if errors.Is(err, data.ErrNotFound) {
+		app.errorJSON(c, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error getting log entry:", err)
+		app.errorJSON(c, errors.New("could not get log entry"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: "log entry " + entry.ID,
+		Data:    entry,
+	})
+}
+
+// logQuery reads the filters, order and page of ListLogs from the query string
+func logQuery(c *gin.Context) (data.LogQuery, error) {
+	query := data.LogQuery{
+		LogFilter: data.LogFilter{
+			Name:     c.Query("name"),
+			Text:     c.Query("q"),
+			Severity: c.Query("severity"),
+			Service:  c.Query("service"),
+			TraceID:  c.Query("trace_id"),
+		},
+		Cursor: c.Query("cursor"),
+	}
+	if fields := c.QueryMap("fields"); len(fields) > 0 {
+		query.Fields = fields
+	}
+	if err := query.Check(); err != nil {
+		return query, err
+	}
+
+	var err error
+	if query.Since, err = queryTime(c, "since"); err != nil {
+		return query, err
+	}
+	if query.Until, err = queryTime(c, "until"); err != nil {
+		return query, err
+	}
+
+	switch c.DefaultQuery("sort", "newest") {
+	case "newest":
+	case "oldest":
+		query.OldestFirst = true
+	default:
+		return query, errors.New("sort must be newest or oldest")
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > data.MaxPageSize {
+			return query, errors.New("limit must be between 1 and " + strconv.Itoa(data.MaxPageSize))
+		}
+		query.Limit = n
+	}
+
+	return query, nil
+}
+
+// queryTime reads an RFC 3339 time from the query string, or the zero time if it's not there
+func queryTime(c *gin.Context, key string) (time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New(key + " must be an RFC 3339 time")
+	}
+	return t, nil
+}
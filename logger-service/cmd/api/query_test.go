@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"authz"
+	"logservice/data"
+	"logservice/logs"
+)
+
+// seedLogs writes five entries, one a minute from base
+func seedLogs(store *memoryStore, base time.Time) {
+	for i, entry := range []data.LogEntry{
+		{Name: "authentication", Data: "grace@example.com logged in"},
+		{Name: "mail", Data: "sent to ada@example.com"},
+		{Name: "authentication", Data: "Ada@example.com logged in"},
+		{Name: "authentication", Data: "grace@example.com logged out"},
+		{Name: "mail", Data: "sent to grace@example.com"},
+	} {
+		store.Insert(entry)
+		store.entries[i].CreatedAt = base.Add(time.Duration(i) * time.Minute)
+	}
+}
+
+// listLogs gets path from the HTTP API with a token that can read logs
+func listLogs(t *testing.T, srv *httptest.Server, path string) (int, listLogsResponse) {
+	t.Helper()
+	token := testToken(authz.LogsRead)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Data listLogsResponse `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out.Data
+}
+
+func entryData(entries []*data.LogEntry) []string {
+	var out []string
+	for _, entry := range entries {
+		out = append(out, entry.Data)
+	}
+	return out
+}
+
+func TestListLogsHTTP(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	seedLogs(store, base)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"sent to grace@example.com", "grace@example.com logged out", "Ada@example.com logged in", "sent to ada@example.com", "grace@example.com logged in"}},
+		{"?name=mail", []string{"sent to grace@example.com", "sent to ada@example.com"}},
+		{"?q=ADA%40", []string{"Ada@example.com logged in", "sent to ada@example.com"}},
+		{"?name=authentication&sort=oldest", []string{"grace@example.com logged in", "Ada@example.com logged in", "grace@example.com logged out"}},
+		{"?since=" + url.QueryEscape(base.Add(time.Minute).Format(time.RFC3339)) +
+			"&until=" + url.QueryEscape(base.Add(3*time.Minute).Format(time.RFC3339)),
+			[]string{"Ada@example.com logged in", "sent to ada@example.com"}},
+	}
+	for _, tt := range tests {
+		status, page := listLogs(t, srv, "/logs"+tt.query)
+		if got := entryData(page.Entries); status != http.StatusOK || !slices.Equal(got, tt.want) || page.NextCursor != "" {
+			t.Errorf("%q: got %d %q (next %q), want %q", tt.query, status, got, page.NextCursor, tt.want)
+		}
+	}
+}
+
+func TestListLogsHTTPPages(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	// Entries written in the same millisecond are told apart by ID
+	seedLogs(store, time.Now().Truncate(time.Millisecond))
+	for _, entry := range store.entries {
+		entry.CreatedAt = store.entries[0].CreatedAt
+	}
+
+	for _, sort := range []string{"newest", "oldest"} {
+		var got []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages == 3 {
+				t.Fatalf("%s: expected 3 pages, still going", sort)
+			}
+			status, page := listLogs(t, srv, "/logs?limit=2&sort="+sort+"&cursor="+cursor)
+			if status != http.StatusOK || len(page.Entries) == 0 || len(page.Entries) > 2 {
+				t.Fatalf("%s: unexpected page %d %+v", sort, status, page)
+			}
+			got = append(got, entryData(page.Entries)...)
+			if cursor = page.NextCursor; cursor == "" {
+				break
+			}
+		}
+
+		_, all := listLogs(t, srv, "/logs?sort="+sort)
+		if want := entryData(all.Entries); !slices.Equal(got, want) {
+			t.Errorf("%s: paged through %q, want %q", sort, got, want)
+		}
+	}
+}
+
+func TestListLogsHTTPInvalid(t *testing.T) {
+	app, _ := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	for _, query := range []string{"since=yesterday", "until=2024-05-01", "sort=random", "limit=0", "limit=501", "cursor=nonsense"} {
+		if status, _ := listLogs(t, srv, "/logs?"+query); status != http.StatusBadRequest {
+			t.Errorf("%q: got %d, want 400", query, status)
+		}
+	}
+
+	writeOnly := testToken(authz.LogsWrite)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/logs", nil)
+	req.Header.Set("Authorization", "Bearer "+writeOnly)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected reading logs to need logs:read, got %d", resp.StatusCode)
+	}
+}
+
+func TestGetLogHTTP(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	store.Insert(data.LogEntry{Name: "event", Data: "first"})
+	store.Insert(data.LogEntry{Name: "event", Data: "second"})
+
+	token := testToken(authz.LogsRead)
+	for id, want := range map[string]int{"2": http.StatusOK, "3": http.StatusNotFound} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/logs/"+id, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Data data.LogEntry `json:"data"`
+		}
+		json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+
+		if resp.StatusCode != want {
+			t.Errorf("log %s: got %d, want %d", id, resp.StatusCode, want)
+		} else if want == http.StatusOK && (out.Data.ID != id || out.Data.Data != "second") {
+			t.Errorf("log %s: unexpected entry %+v", id, out.Data)
+		}
+	}
+}
+
+func TestListLogsGRPC(t *testing.T) {
+	app, store := newTestApp(t)
+	client := grpcClient(t, app)
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	seedLogs(store, base)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.ListLogs(ctx, &logs.ListLogsRequest{
+		Text:        "grace",
+		Since:       timestamppb.New(base.Add(time.Minute)),
+		OldestFirst: true,
+		Limit:       1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetEntries()) != 1 || resp.GetEntries()[0].GetData() != "grace@example.com logged out" || resp.GetNextCursor() == "" {
+		t.Fatalf("unexpected first page %+v", resp)
+	}
+
+	resp, err = client.ListLogs(ctx, &logs.ListLogsRequest{
+		Text:        "grace",
+		Since:       timestamppb.New(base.Add(time.Minute)),
+		OldestFirst: true,
+		Limit:       1,
+		Cursor:      resp.GetNextCursor(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := resp.GetEntries()[0]
+	if len(resp.GetEntries()) != 1 || entry.GetData() != "sent to grace@example.com" || resp.GetNextCursor() != "" {
+		t.Fatalf("unexpected last page %+v", resp)
+	}
+	if !entry.GetCreatedAt().AsTime().Equal(base.Add(4*time.Minute)) || entry.GetId() != "5" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	if _, err := client.ListLogs(ctx, &logs.ListLogsRequest{Cursor: "nonsense"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected an invalid cursor to be refused, got %v", err)
+	}
+}
+
+func TestGetLogGRPC(t *testing.T) {
+	app, store := newTestApp(t)
+	client := grpcClient(t, app)
+	store.Insert(data.LogEntry{Name: "event", Data: "via grpc"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	entry, err := client.GetLog(ctx, &logs.GetLogRequest{Id: "1"})
+	if err != nil || entry.GetName() != "event" || entry.GetData() != "via grpc" {
+		t.Fatalf("unexpected entry %+v (%v)", entry, err)
+	}
+	if _, err := client.GetLog(ctx, &logs.GetLogRequest{Id: "2"}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected a missing entry to be not found, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"logservice/data"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultSweepInterval is how often the sweeper runs unless LOG_RETENTION_SWEEP_INTERVAL
+// says otherwise
+const defaultSweepInterval = time.Hour
+
+// retentionRuleResponse is a retention rule, with its age written like in LOG_RETENTION
+type retentionRuleResponse struct {
+	Name     string `json:"name,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	MaxAge   string `json:"max_age"`
+}
+
+// retentionResponse is the size of the logs and how they are kept
+type retentionResponse struct {
+	Collection data.CollectionStats    `json:"collection"`
+	Rules      []retentionRuleResponse `json:"rules"`
+	// Default is the age of the entries no rule matches, empty when they are kept forever
+	Default       string            `json:"default,omitempty"`
+	SweepInterval string            `json:"sweep_interval"`
+	LastSweep     *data.SweepStatus `json:"last_sweep"`
+}
+
+// RetentionStatus returns the size of the logs collection, the retention rules and how
+// the last sweep went
+func (app *Config) RetentionStatus(c *gin.Context) {
+	stats, err := app.Models.LogEntry.Stats(c.Request.Context())
+	if err != nil {
+		log.Println("Error reading log collection stats:", err)
+		app.errorJSON(c, errors.New("could not read log collection stats"), http.StatusInternalServerError)
+		return
+	}
+
+	policy := app.Retention.Policy()
+	resp := retentionResponse{
+		Collection:    stats,
+		Rules:         []retentionRuleResponse{},
+		SweepInterval: app.SweepInterval.String(),
+		LastSweep:     app.Retention.LastSweep(),
+	}
+	for _, rule := range policy.Rules {
+		resp.Rules = append(resp.Rules, retentionRuleResponse{Name: rule.Name, Severity: rule.Severity, MaxAge: formatAge(rule.MaxAge)})
+	}
+	if policy.Default > 0 {
+		resp.Default = formatAge(policy.Default)
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("%d log entries", stats.Count),
+		Data:    resp,
+	})
+}
+
+// SweepExpired deletes the entries the retention rules no longer keep now, rather than at
+// the next sweep, for example after a rule was shortened
+func (app *Config) SweepExpired(c *gin.Context) {
+	deleted, err := app.Retention.Sweep(c.Request.Context())
+	if err != nil {
+		log.Println("Error deleting expired log entries:", err)
+		app.errorJSON(c, errors.New("could not delete expired log entries"), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(c, http.StatusOK, jsonResponse{
+		Error:   false,
+		Message: fmt.Sprintf("deleted %d expired log entries", deleted),
+		Data:    gin.H{"deleted": deleted},
+	})
+}
+
+// formatAge writes whole days as 30d, and other ages as Go durations
+func formatAge(age time.Duration) string {
+	const day = 24 * time.Hour
+	if age%day == 0 {
+		return fmt.Sprintf("%dd", age/day)
+	}
+	return age.String()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"authz"
+	"logservice/data"
+)
+
+// adminRequest sends a request with a token that can administer logs, and decodes the
+// data of the response into out
+func adminRequest(t *testing.T, srv *httptest.Server, method, path string, out any) int {
+	t.Helper()
+	token := testToken(authz.LogsAdmin)
+	req, _ := http.NewRequest(method, srv.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body := struct {
+		Data any `json:"data"`
+	}{Data: out}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode
+}
+
+func TestRetention(t *testing.T) {
+	app, store := newTestApp(t)
+	policy, err := data.ParseRetention("severity=debug:1h,name=audit:90d,*:30d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.writer = data.NewBatchWriter(store, data.BatchConfig{Retention: policy})
+	t.Cleanup(func() { store.writer.Close(context.Background()) })
+	app.Writer, app.Retention = store.writer, data.NewSweeper(store, policy)
+
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	// Entries are written with the time the TTL index deletes them
+	token := testToken(authz.LogsWrite)
+	for _, payload := range []JSONPayload{
+		{Name: "audit", Data: "kept for 90 days"},
+		{Name: "audit", Data: "debug, kept for an hour", Severity: "debug"},
+		{Name: "mail", Data: "kept for 30 days"},
+	} {
+		resp := postLog(t, srv, payload, token)
+		resp.Body.Close()
+	}
+	entries, _ := store.All()
+	for _, entry := range entries {
+		age := map[string]time.Duration{"kept for 90 days": 90 * 24 * time.Hour, "debug, kept for an hour": time.Hour, "kept for 30 days": 30 * 24 * time.Hour}[entry.Data]
+		if entry.ExpiresAt == nil || !entry.ExpiresAt.Equal(entry.CreatedAt.Add(age)) {
+			t.Errorf("%q: expires at %v, want %v", entry.Data, entry.ExpiresAt, entry.CreatedAt.Add(age))
+		}
+	}
+
+	// Entries from before the rules existed have no expiry, and are left to the sweeper
+	store.Insert(data.LogEntry{Name: "audit", Data: "old audit"})
+	store.Insert(data.LogEntry{Name: "mail", Data: "old mail"})
+	store.mu.Lock()
+	for _, entry := range store.entries[3:] {
+		entry.CreatedAt = time.Now().Add(-60 * 24 * time.Hour)
+	}
+	store.mu.Unlock()
+
+	var swept struct {
+		Deleted int64 `json:"deleted"`
+	}
+	if status := adminRequest(t, srv, http.MethodPost, "/retention/sweep", &swept); status != http.StatusOK || swept.Deleted != 1 {
+		t.Fatalf("expected the old mail entry to be deleted, got %d %+v", status, swept)
+	}
+	if _, err := store.GetOne("5"); err != data.ErrNotFound {
+		t.Errorf("expected the old mail entry to be gone, got %v", err)
+	}
+
+	var status retentionResponse
+	if code := adminRequest(t, srv, http.MethodGet, "/retention", &status); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if status.Collection.Count != 4 || status.Default != "30d" || len(status.Rules) != 2 ||
+		status.Rules[0] != (retentionRuleResponse{Severity: "debug", MaxAge: "1h0m0s"}) ||
+		status.Rules[1] != (retentionRuleResponse{Name: "audit", MaxAge: "90d"}) {
+		t.Errorf("unexpected retention status %+v", status)
+	}
+	if status.LastSweep == nil || status.LastSweep.Deleted != 1 || status.LastSweep.Error != "" {
+		t.Errorf("unexpected last sweep %+v", status.LastSweep)
+	}
+
+	// Retention is only for admins
+	reader := testToken(authz.LogsRead)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/retention", nil)
+	req.Header.Set("Authorization", "Bearer "+reader)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected retention to need logs:admin, got %d", resp.StatusCode)
+	}
+}
+
+func TestRetentionKeepsForeverByDefault(t *testing.T) {
+	app, store := newTestApp(t)
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	store.Insert(data.LogEntry{Name: "event", Data: "old"})
+	store.entries[0].CreatedAt = time.Now().Add(-10 * 365 * 24 * time.Hour)
+
+	var swept struct {
+		Deleted int64 `json:"deleted"`
+	}
+	if status := adminRequest(t, srv, http.MethodPost, "/retention/sweep", &swept); status != http.StatusOK || swept.Deleted != 0 {
+		t.Fatalf("expected nothing to be deleted, got %d %+v", status, swept)
+	}
+
+	var status retentionResponse
+	adminRequest(t, srv, http.MethodGet, "/retention", &status)
+	if status.Collection.Count != 1 || len(status.Rules) != 0 || status.Default != "" || status.LastSweep != nil {
+		t.Errorf("unexpected retention status %+v", status)
+	}
+}
+
+func TestRetentionRestamp(t *testing.T) {
+	_, store := newTestApp(t)
+	short, _ := data.ParseRetention("name=audit:1d,*:7d")
+	long, _ := data.ParseRetention("name=audit:90d")
+
+	// Entries written under the short rules expire with them
+	writer := data.NewBatchWriter(store, data.BatchConfig{Retention: short})
+	created := time.Now().Add(-2 * 24 * time.Hour).Truncate(time.Millisecond)
+	for _, entry := range []data.LogEntry{{Name: "audit", Data: "old audit", CreatedAt: created}, {Name: "mail", Data: "old mail", CreatedAt: created}} {
+		if err := writer.WriteSync(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close(context.Background())
+
+	// Lengthening the audit rule and dropping the default keeps them past their old expiry
+	sweeper := data.NewSweeper(store, long)
+	if changed, err := sweeper.Restamp(context.Background()); err != nil || changed != 2 {
+		t.Fatalf("expected both entries to be restamped, got %d (%v)", changed, err)
+	}
+	if deleted, err := sweeper.Sweep(context.Background()); err != nil || deleted != 0 {
+		t.Fatalf("expected nothing to be deleted, got %d (%v)", deleted, err)
+	}
+	audit, _ := store.GetOne("1")
+	if audit.ExpiresAt == nil || !audit.ExpiresAt.Equal(created.Add(90*24*time.Hour)) {
+		t.Errorf("old audit entry expires at %v, want %v", audit.ExpiresAt, created.Add(90*24*time.Hour))
+	}
+	if mail, _ := store.GetOne("2"); mail.ExpiresAt != nil {
+		t.Errorf("expected the old mail entry to be kept forever, expires at %v", mail.ExpiresAt)
+	}
+
+	// Restamping again changes nothing
+	if changed, _ := sweeper.Restamp(context.Background()); changed != 0 {
+		t.Errorf("expected nothing to be restamped twice, got %d", changed)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"net/http"
 
+	"authz"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -30,7 +32,18 @@ func (app *Config) routes() *gin.Engine {
 	// })
 
 	// Log route
-	router.POST("/log", app.WriteLog)
+	router.POST("/log", app.Tokens.Require(authz.LogsWrite), app.WriteLog)
+
+	// Reading logs
+	router.GET("/logs", app.Tokens.Require(authz.LogsRead), app.ListLogs)
+	router.GET("/logs/:id", app.Tokens.Require(authz.LogsRead), app.GetLog)
+
+	// Redaction of erased users' emails
+	router.POST("/redact", app.requireRedactor(), app.Redact)
+
+	// Retention of old entries
+	router.GET("/retention", app.Tokens.Require(authz.LogsAdmin), app.RetentionStatus)
+	router.POST("/retention/sweep", app.Tokens.Require(authz.LogsAdmin), app.SweepExpired)
 
 	// 	return r
 	return router
@@ -4,27 +4,50 @@ import (
 	"context"
 	"log"
 	"logservice/data"
-	"time"
 )
 
 // RPCServer is the type for our RPC Server. Methods that take this as a receiver are available
 // over RPC, as long as they are exported.
-type RPCServer struct{}
+type RPCServer struct {
+	Models data.Models
+	Writer *data.BatchWriter
+}
 
-// RPCPayload is the type for data we receive from RPC
+// RPCPayload is the type for data we receive from RPC. Clients that only send Name and
+// Data keep working, as gob leaves the fields they don't have empty.
 type RPCPayload struct {
-	Name string
-	Data string
+	Name     string
+	Data     string
+	Severity string
+	Service  string
+	Host     string
+	TraceID  string
+	Fields   map[string]string
+	// Sync waits until the entry is stored, rather than only queued to be
+	Sync bool
 }
 
 // LogInfo writes our payload to mongo
 func (r *RPCServer) LogInfo(payload RPCPayload, resp *string) error {
-	collection := client.Database("logs").Collection("logs")
-	_, err := collection.InsertOne(context.TODO(), data.LogEntry{
-		Name:      payload.Name,
-		Data:      payload.Data,
-		CreatedAt: time.Now(),
-	})
+	entry := data.LogEntry{
+		Name:     payload.Name,
+		Data:     payload.Data,
+		Severity: payload.Severity,
+		Service:  payload.Service,
+		Host:     payload.Host,
+		TraceID:  payload.TraceID,
+		Fields:   payload.Fields,
+	}
+	if err := entry.Normalize(); err != nil {
+		return err
+	}
+
+	var err error
+	if payload.Sync {
+		err = r.Writer.WriteSync(context.Background(), entry)
+	} else {
+		err = r.Writer.Write(context.Background(), entry)
+	}
 	if err != nil {
 		log.Println("error writing to mongo", err)
 		return err
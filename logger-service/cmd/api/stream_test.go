@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"authz"
+	"logservice/logs"
+)
+
+func TestWriteLogsGRPC(t *testing.T) {
+	app, store := newTestApp(t)
+	client := grpcClient(t, app)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.WriteLogs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// More than a chunk, so some are stored while the stream is still open
+	for i := range writeLogsChunk + 100 {
+		if err := stream.Send(&logs.Log{Name: "bulk", Data: fmt.Sprint(i), Service: "importer"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.Send(&logs.Log{Name: "bulk", Severity: "fatal"})
+	stream.Send(&logs.Log{Name: "bulk", Fields: map[string]string{"a.b": "dotted"}})
+
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetAccepted() != writeLogsChunk+100 || resp.GetRejected() != 2 {
+		t.Errorf("unexpected acknowledgement %+v", resp)
+	}
+
+	// The acknowledgement means they are stored, so read past All, which would flush
+	store.mu.Lock()
+	stored := len(store.entries)
+	store.mu.Unlock()
+	if stored != writeLogsChunk+100 {
+		t.Errorf("expected every accepted entry to be stored, got %d", stored)
+	}
+}
+
+func TestWriteLogsGRPCAfterShutdown(t *testing.T) {
+	app, _ := newTestApp(t)
+	client := grpcClient(t, app)
+	app.Writer.Close(context.Background())
+
+	stream, err := client.WriteLogs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&logs.Log{Name: "bulk"})
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected the stream to fail, got %v", err)
+	}
+}
+
+func TestTailLogsGRPC(t *testing.T) {
+	app, _ := newTestApp(t)
+	client := grpcClient(t, app)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tail, err := client.TailLogs(ctx, &logs.TailLogsRequest{Severity: "error", Fields: map[string]string{"region": "eu"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *logs.LogEntry, 100)
+	go func() {
+		for {
+			entry, err := tail.Recv()
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- entry
+		}
+	}()
+
+	// The tail starts on the server a little after the call returns, so write probes until
+	// one arrives
+	probe := &logs.LogRequest{Sync: true, LogEntry: &logs.Log{Name: "probe", Severity: "error", Fields: map[string]string{"region": "eu"}}}
+	for ready := false; !ready; {
+		if _, err := client.WriteLog(ctx, probe); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-received:
+			ready = true
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("the tail never started")
+		}
+	}
+
+	for _, entry := range []*logs.Log{
+		{Name: "payment", Data: "ignored", Severity: "info", Fields: map[string]string{"region": "eu"}},
+		{Name: "payment", Data: "ignored", Severity: "error", Fields: map[string]string{"region": "us"}},
+		{Name: "payment", Data: "declined", Severity: "error", Fields: map[string]string{"region": "eu"}},
+	} {
+		if _, err := client.WriteLog(ctx, &logs.LogRequest{LogEntry: entry, Sync: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for entry := range received {
+		if entry.GetName() == "probe" {
+			continue
+		}
+		if entry.GetData() != "declined" || entry.GetId() == "" || entry.GetCreatedAt() == nil {
+			t.Fatalf("unexpected entry %+v", entry)
+		}
+		return
+	}
+	t.Fatal("the tail ended without the entry")
+}
+
+func TestTailLogsGRPCInvalidFilter(t *testing.T) {
+	app, _ := newTestApp(t)
+	client := grpcClient(t, app)
+
+	tail, err := client.TailLogs(context.Background(), &logs.TailLogsRequest{Severity: "fatal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tail.Recv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected an invalid filter to be refused, got %v", err)
+	}
+}
+
+func TestStreamsRequirePermission(t *testing.T) {
+	app, store := newTestApp(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	anonymous := grpcClientWithToken(t, app, "")
+	tail, err := anonymous.TailLogs(ctx, &logs.TailLogsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tail.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("TailLogs without a token: got %v, want Unauthenticated", err)
+	}
+
+	// Writing needs logs:write, and tailing logs:read
+	reader := grpcClientWithToken(t, app, testToken(authz.LogsRead))
+	stream, err := reader.WriteLogs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&logs.Log{Name: "event", Data: "read only"})
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("WriteLogs with logs:read: got %v, want PermissionDenied", err)
+	}
+	writer := grpcClientWithToken(t, app, testToken(authz.LogsWrite))
+	tail, err = writer.TailLogs(ctx, &logs.TailLogsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tail.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("TailLogs with logs:write: got %v, want PermissionDenied", err)
+	}
+	if entries, _ := store.All(); len(entries) != 0 {
+		t.Errorf("refused streams wrote %+v", entries)
+	}
+}
@@ -0,0 +1,302 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	// ErrOverloaded is returned when an entry waited too long for room in the queue
+	ErrOverloaded = errors.New("too many log entries are waiting to be written, try again later")
+	// ErrClosed is returned for entries written after the writer was closed
+	ErrClosed = errors.New("the log writer is closed")
+)
+
+// BatchInserter stores several entries at once, and sets their IDs. LogEntry implements
+// it with InsertMany. When only some entries can't be stored, it returns a
+// mongo.BulkWriteException listing their indexes, and stores the rest.
+type BatchInserter interface {
+	InsertMany(ctx context.Context, entries []LogEntry) error
+}
+
+// BatchConfig tunes a BatchWriter. Zero fields take the defaults.
+type BatchConfig struct {
+	// Size is the most entries written at once, 500 by default
+	Size int
+	// Interval is the longest an entry waits for its batch to fill, 200ms by default
+	Interval time.Duration
+	// Buffer is how many entries can wait to be written, ten batches by default
+	Buffer int
+	// MaxWait is how long Write waits for room in a full buffer, 5s by default
+	MaxWait time.Duration
+	// Feed, when set, is sent the entries once they are stored
+	Feed *Feed
+	// Retention sets when each entry expires; the zero policy keeps them all forever
+	Retention RetentionPolicy
+}
+
+func (c BatchConfig) withDefaults() BatchConfig {
+	if c.Size <= 0 {
+		c.Size = 500
+	}
+	if c.Interval <= 0 {
+		c.Interval = 200 * time.Millisecond
+	}
+	if c.Buffer <= 0 {
+		c.Buffer = 10 * c.Size
+	}
+	if c.MaxWait <= 0 {
+		c.MaxWait = 5 * time.Second
+	}
+	return c
+}
+
+// pending is an entry waiting to be written. done is nil unless the caller waits for it.
+type pending struct {
+	entry LogEntry
+	done  chan error
+}
+
+// BatchWriter coalesces entries from many callers into InsertMany calls. A batch is
+// written when it is full or has waited for Interval, whichever comes first. When the
+// store can't keep up and the buffer fills, Write blocks for up to MaxWait, slowing the
+// callers down, and then gives up with ErrOverloaded.
+type BatchWriter struct {
+	store   BatchInserter
+	config  BatchConfig
+	queue   chan pending
+	flushes chan chan struct{}
+	stopped chan struct{}
+
+	// mu guards closed; Write holds it for reading while sending so that Close can't
+	// close the queue under it
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewBatchWriter starts a BatchWriter that writes to store. Close it to write what is
+// still queued.
+func NewBatchWriter(store BatchInserter, config BatchConfig) *BatchWriter {
+	config = config.withDefaults()
+	w := &BatchWriter{
+		store:   store,
+		config:  config,
+		queue:   make(chan pending, config.Buffer),
+		flushes: make(chan chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Write queues entry to be written with the next batch. It returns once the entry is
+// queued, not stored, so an entry can still be lost if its batch fails.
+func (w *BatchWriter) Write(ctx context.Context, entry LogEntry) error {
+	return w.enqueue(ctx, pending{entry: entry})
+}
+
+// WriteSync writes entry with the next batch and waits until the batch is stored, for
+// callers that can't afford to lose the entry.
+func (w *BatchWriter) WriteSync(ctx context.Context, entry LogEntry) error {
+	return w.WriteAll(ctx, []LogEntry{entry})
+}
+
+// WriteAll writes entries, in one or more batches, and waits until they are all stored.
+// It returns the first error of those batches.
+func (w *BatchWriter) WriteAll(ctx context.Context, entries []LogEntry) error {
+	done := make(chan error, len(entries))
+	for _, entry := range entries {
+		if err := w.enqueue(ctx, pending{entry: entry, done: done}); err != nil {
+			return err
+		}
+	}
+
+	var first error
+	for range entries {
+		select {
+		case err := <-done:
+			if first == nil {
+				first = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return first
+}
+
+func (w *BatchWriter) enqueue(ctx context.Context, p pending) error {
+	// An entry is created when it arrives, not when its batch is written
+	if p.entry.CreatedAt.IsZero() {
+		p.entry.CreatedAt = time.Now()
+	}
+	w.config.Retention.Stamp(&p.entry)
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	timer := time.NewTimer(w.config.MaxWait)
+	defer timer.Stop()
+
+	select {
+	case w.queue <- p:
+		return nil
+	case <-timer.C:
+		return ErrOverloaded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush writes every entry queued so far, and returns once they are written
+func (w *BatchWriter) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case w.flushes <- done:
+	case <-w.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops taking entries and writes the ones still queued. It returns early if ctx
+// ends first, in which case those entries may be lost.
+func (w *BatchWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *BatchWriter) run() {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	batch := make([]pending, 0, w.config.Size)
+	add := func(p pending) {
+		batch = append(batch, p)
+		if len(batch) == w.config.Size {
+			w.write(batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case p, ok := <-w.queue:
+			if !ok {
+				w.write(batch)
+				return
+			}
+			add(p)
+
+		case <-ticker.C:
+			w.write(batch)
+			batch = batch[:0]
+
+		case done := <-w.flushes:
+			for n := len(w.queue); n > 0; n-- {
+				p, ok := <-w.queue
+				if !ok {
+					break
+				}
+				add(p)
+			}
+			w.write(batch)
+			batch = batch[:0]
+			close(done)
+		}
+	}
+}
+
+// write stores batch and tells the callers waiting for it how that went
+func (w *BatchWriter) write(batch []pending) {
+	if len(batch) == 0 {
+		return
+	}
+
+	entries := make([]LogEntry, len(batch))
+	for i, p := range batch {
+		entries[i] = p.entry
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// When only some entries failed, the others were stored, and their callers are told so
+	err := w.store.InsertMany(ctx, entries)
+	failed, partial := failedIndexes(err)
+	switch {
+	case partial:
+		log.Printf("Error writing %d of %d log entries: %v", len(failed), len(entries), err)
+	case err != nil:
+		log.Printf("Error writing %d log entries: %v", len(entries), err)
+	}
+
+	stored := entries
+	if partial {
+		stored = make([]LogEntry, 0, len(entries)-len(failed))
+		for i, entry := range entries {
+			if failed[i] == nil {
+				stored = append(stored, entry)
+			}
+		}
+	}
+	if (err == nil || partial) && w.config.Feed != nil && len(stored) > 0 {
+		w.config.Feed.Publish(stored)
+	}
+
+	for i, p := range batch {
+		if p.done == nil {
+			continue
+		}
+		if partial {
+			p.done <- failed[i]
+		} else {
+			p.done <- err
+		}
+	}
+}
+
+// failedIndexes returns the errors of the entries that err, from InsertMany, says weren't
+// stored, by their index in the batch. partial is false unless err is a
+// mongo.BulkWriteException that lists them; with a write concern error, none of the
+// entries are known to be stored.
+func failedIndexes(err error) (failed map[int]error, partial bool) {
+	var bulk mongo.BulkWriteException
+	if !errors.As(err, &bulk) || bulk.WriteConcernError != nil || len(bulk.WriteErrors) == 0 {
+		return nil, false
+	}
+	failed = make(map[int]error, len(bulk.WriteErrors))
+	for _, we := range bulk.WriteErrors {
+		failed[we.Index] = we.WriteError
+	}
+	return failed, true
+}
@@ -0,0 +1,266 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeStore records the batches it is asked to write. Each write takes roundTrip, and at
+// most poolSize run at once, like calls over a pool of connections to Mongo.
+type fakeStore struct {
+	roundTrip time.Duration
+	pool      chan struct{}
+	err       error
+	// block, when set, holds every write until it is closed
+	block chan struct{}
+
+	mu      sync.Mutex
+	batches [][]LogEntry
+	written atomic.Int64
+}
+
+func newFakeStore(roundTrip time.Duration, poolSize int) *fakeStore {
+	return &fakeStore{roundTrip: roundTrip, pool: make(chan struct{}, poolSize)}
+}
+
+func (s *fakeStore) InsertMany(ctx context.Context, entries []LogEntry) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.pool <- struct{}{}
+	defer func() { <-s.pool }()
+	time.Sleep(s.roundTrip)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, entries)
+	s.written.Add(int64(len(entries)))
+	return s.err
+}
+
+func (s *fakeStore) Insert(entry LogEntry) error {
+	return s.InsertMany(context.Background(), []LogEntry{entry})
+}
+
+func (s *fakeStore) batchSizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sizes []int
+	for _, batch := range s.batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func TestBatchWriterFlushesFullBatches(t *testing.T) {
+	store := newFakeStore(0, 1)
+	w := NewBatchWriter(store, BatchConfig{Size: 3, Interval: time.Hour})
+
+	for i := range 7 {
+		if err := w.Write(context.Background(), LogEntry{Name: "event", Data: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for store.written.Load() < 6 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if sizes := store.batchSizes(); len(sizes) != 2 || sizes[0] != 3 || sizes[1] != 3 {
+		t.Fatalf("expected two full batches, got %v", sizes)
+	}
+
+	// The rest is written on close
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sizes := store.batchSizes(); len(sizes) != 3 || sizes[2] != 1 {
+		t.Errorf("expected the last entry to be written on close, got %v", sizes)
+	}
+	if err := w.Write(context.Background(), LogEntry{Name: "late"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected writes after close to fail, got %v", err)
+	}
+}
+
+func TestBatchWriterFlushesOnInterval(t *testing.T) {
+	store := newFakeStore(0, 1)
+	w := NewBatchWriter(store, BatchConfig{Size: 100, Interval: 10 * time.Millisecond})
+	defer w.Close(context.Background())
+
+	before := time.Now()
+	w.Write(context.Background(), LogEntry{Name: "event"})
+	for store.written.Load() == 0 {
+		if time.Since(before) > time.Second {
+			t.Fatal("expected a partial batch to be written after the interval")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	store.mu.Lock()
+	entries := store.batches[0]
+	store.mu.Unlock()
+	if entries[0].CreatedAt.IsZero() || entries[0].CreatedAt.Before(before) {
+		t.Errorf("expected the entry to be created when it was written, got %v", entries[0].CreatedAt)
+	}
+}
+
+func TestBatchWriterWriteSync(t *testing.T) {
+	store := newFakeStore(0, 1)
+	w := NewBatchWriter(store, BatchConfig{Size: 100, Interval: 10 * time.Millisecond})
+	defer w.Close(context.Background())
+
+	if err := w.WriteSync(context.Background(), LogEntry{Name: "event"}); err != nil {
+		t.Fatal(err)
+	}
+	if store.written.Load() != 1 {
+		t.Errorf("expected the entry to be stored when WriteSync returns")
+	}
+
+	store.err = errors.New("disk full")
+	if err := w.WriteSync(context.Background(), LogEntry{Name: "event"}); err != store.err {
+		t.Errorf("expected the failure of the batch, got %v", err)
+	}
+}
+
+func TestBatchWriterPartialFailure(t *testing.T) {
+	store := newFakeStore(0, 1)
+	store.err = mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Index: 1, Code: 11000, Message: "duplicate key"}},
+	}}
+	feed := NewFeed()
+	sub := feed.Subscribe(LogFilter{}, 10)
+	w := NewBatchWriter(store, BatchConfig{Size: 3, Interval: time.Hour, Feed: feed})
+	defer w.Close(context.Background())
+
+	// Only the entry the exception names fails; the callers of the others are told they
+	// were stored
+	errs := make(chan error, 3)
+	for i := range 3 {
+		go func() { errs <- w.WriteSync(context.Background(), LogEntry{Name: "event", Data: fmt.Sprint(i)}) }()
+	}
+	var failed []error
+	for range 3 {
+		if err := <-errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+	var we mongo.WriteError
+	if len(failed) != 1 || !errors.As(failed[0], &we) || we.Code != 11000 {
+		t.Fatalf("expected one entry to fail with its write error, got %v", failed)
+	}
+
+	store.mu.Lock()
+	batch := store.batches[0]
+	store.mu.Unlock()
+	for _, want := range []string{batch[0].Data, batch[2].Data} {
+		if got := <-sub.Entries; got.Data != want {
+			t.Errorf("expected the feed to get entry %s, got %s", want, got.Data)
+		}
+	}
+	select {
+	case got := <-sub.Entries:
+		t.Errorf("expected the failed entry not to be published, got %+v", got)
+	default:
+	}
+}
+
+func TestBatchWriterBackpressure(t *testing.T) {
+	store := newFakeStore(0, 1)
+	store.block = make(chan struct{})
+	w := NewBatchWriter(store, BatchConfig{Size: 1, Buffer: 2, MaxWait: 20 * time.Millisecond})
+
+	// One entry is being written, two wait in the buffer, and then there's no room
+	for i := range 3 {
+		if err := w.Write(context.Background(), LogEntry{Name: "event", Data: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	var err error
+	for time.Now().Before(deadline) {
+		if err = w.Write(context.Background(), LogEntry{Name: "event"}); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected a full buffer to refuse entries, got %v", err)
+	}
+
+	close(store.block)
+	if err := w.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(context.Background(), LogEntry{Name: "event"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+// BenchmarkIngest is a load test comparing writing each entry with its own insert to
+// writing them through a BatchWriter, from many callers at once. By default it writes to
+// a fake store where each call takes a millisecond, over a pool of 100 connections like
+// the Mongo driver's; set LOGGER_BENCH_MONGO_URL to write to a real Mongo instead:
+//
+//	go test ./data -run '^$' -bench Ingest
+func BenchmarkIngest(b *testing.B) {
+	store := benchStore(b)
+
+	b.Run("per-entry", func(b *testing.B) {
+		start := time.Now()
+		b.SetParallelism(32)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := store.Insert(LogEntry{Name: "bench", Data: "per-entry"}); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+		b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "entries/s")
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		w := NewBatchWriter(store, BatchConfig{})
+		start := time.Now()
+		b.SetParallelism(32)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := w.Write(context.Background(), LogEntry{Name: "bench", Data: "batched"}); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+		// Entries only count once they are stored
+		if err := w.Close(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "entries/s")
+	})
+}
+
+// benchStore is the store BenchmarkIngest writes to
+func benchStore(b *testing.B) interface {
+	BatchInserter
+	Insert(LogEntry) error
+} {
+	url := os.Getenv("LOGGER_BENCH_MONGO_URL")
+	if url == "" {
+		return newFakeStore(time.Millisecond, 100)
+	}
+
+	c, err := mongo.Connect(context.Background(), options.Client().ApplyURI(url))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { c.Disconnect(context.Background()) })
+
+	models := New(c)
+	b.Cleanup(func() { models.LogEntry.DropCollection() })
+	return models.LogEntry
+}
@@ -0,0 +1,86 @@
+package data
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Feed fans the entries a BatchWriter stores out to the subscribers whose filter they
+// match. It only sees the entries stored by this process.
+type Feed struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscription receives the entries of a Feed that match its filter on Entries. Entries
+// is closed when the subscription ends, either because the subscriber unsubscribed or
+// because it fell more than its buffer behind; Lagged tells the two apart.
+type Subscription struct {
+	Entries <-chan *LogEntry
+
+	entries chan *LogEntry
+	filter  LogFilter
+	lagged  atomic.Bool
+}
+
+// Lagged reports whether the subscription ended because the subscriber couldn't keep up
+func (s *Subscription) Lagged() bool {
+	return s.lagged.Load()
+}
+
+func NewFeed() *Feed {
+	return &Feed{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe starts sending the entries that match filter, buffering up to buffer of them
+// for a slow subscriber. The time range of the filter is ignored.
+func (f *Feed) Subscribe(filter LogFilter, buffer int) *Subscription {
+	filter.Since, filter.Until = time.Time{}, time.Time{}
+	entries := make(chan *LogEntry, buffer)
+	s := &Subscription{Entries: entries, entries: entries, filter: filter}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs[s] = struct{}{}
+	return s
+}
+
+// Unsubscribe ends s. It's safe to call more than once.
+func (f *Feed) Unsubscribe(s *Subscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.end(s)
+}
+
+// end removes s and closes its channel, with f.mu held
+func (f *Feed) end(s *Subscription) {
+	if _, ok := f.subs[s]; ok {
+		delete(f.subs, s)
+		close(s.entries)
+	}
+}
+
+// Publish sends entries to the subscribers. It never blocks: a subscriber whose buffer is
+// full is dropped, so one slow subscriber can't hold up writing logs.
+func (f *Feed) Publish(entries []LogEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+subscribers:
+	for s := range f.subs {
+		for i := range entries {
+			if !s.filter.Matches(&entries[i]) {
+				continue
+			}
+			entry := entries[i]
+			select {
+			case s.entries <- &entry:
+			default:
+				s.lagged.Store(true)
+				f.end(s)
+				continue subscribers
+			}
+		}
+	}
+}
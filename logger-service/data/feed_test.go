@@ -0,0 +1,38 @@
+package data
+
+import (
+	"testing"
+)
+
+func TestFeed(t *testing.T) {
+	feed := NewFeed()
+	errors := feed.Subscribe(LogFilter{Severity: SeverityError}, 10)
+	mail := feed.Subscribe(LogFilter{Name: "mail"}, 1)
+
+	feed.Publish([]LogEntry{
+		{ID: "1", Name: "mail", Severity: SeverityInfo},
+		{ID: "2", Name: "payment", Severity: SeverityError},
+		{ID: "3", Name: "mail", Severity: SeverityError},
+	})
+
+	for _, want := range []string{"2", "3"} {
+		if entry := <-errors.Entries; entry.ID != want {
+			t.Errorf("expected entry %s, got %+v", want, entry)
+		}
+	}
+
+	// The mail subscriber only had room for one entry, so it was dropped
+	if entry := <-mail.Entries; entry.ID != "1" {
+		t.Errorf("expected entry 1, got %+v", entry)
+	}
+	if _, ok := <-mail.Entries; ok || !mail.Lagged() {
+		t.Error("expected a subscriber that fell behind to be dropped")
+	}
+
+	feed.Unsubscribe(errors)
+	feed.Unsubscribe(errors)
+	if _, ok := <-errors.Entries; ok || errors.Lagged() {
+		t.Error("expected unsubscribing to end the subscription")
+	}
+	feed.Publish([]LogEntry{{ID: "4", Severity: SeverityError}})
+}
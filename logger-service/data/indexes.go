@@ -0,0 +1,36 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexes are the indexes of the logs collection. Each filter of LogFilter has one that
+// also sorts by creation time, the order queries page in.
+var indexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+	{Keys: bson.D{{Key: "name", Value: 1}, {Key: "created_at", Value: -1}}},
+	{Keys: bson.D{{Key: "severity", Value: 1}, {Key: "created_at", Value: -1}}},
+	{Keys: bson.D{{Key: "service", Value: 1}, {Key: "created_at", Value: -1}}},
+	{Keys: bson.D{{Key: "trace_id", Value: 1}}, Options: options.Index().SetSparse(true)},
+	// A wildcard index covers any key of fields
+	{Keys: bson.D{{Key: "fields.$**", Value: 1}}},
+	// Mongo deletes entries once their expires_at has passed
+	{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+}
+
+// CreateIndexes makes sure the logs collection has its indexes. Indexes that exist
+// already are left alone, so it's safe to call on every start.
+func CreateIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	collection := client.Database("logs").Collection("logs")
+
+	_, err := collection.Indexes().CreateMany(ctx, indexes)
+	return err
+}
@@ -2,7 +2,12 @@ package data
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -17,30 +22,148 @@ func New(mongo *mongo.Client) Models {
 	client = mongo
 
 	return Models{
-		LogEntry: LogEntry{},
+		LogEntry: &LogEntry{},
 	}
 }
 
 type Models struct {
-	LogEntry LogEntry
+	LogEntry LogStore
 }
 
+// LogStore is the set of operations the handlers need from log storage. LogEntry
+// implements it against Mongo; tests can swap in an in-memory implementation.
+type LogStore interface {
+	Insert(entry LogEntry) error
+	BatchInserter
+	RetentionStore
+	// Query returns a page of the entries q selects and the cursor of the next page, or
+	// ErrInvalidCursor, or an error wrapping ErrInvalidFilter
+	Query(ctx context.Context, q LogQuery) ([]*LogEntry, string, error)
+	// Each calls fn with every entry filter selects, newest first, without loading them
+	// all into memory
+	Each(ctx context.Context, filter LogFilter, fn func(*LogEntry) error) error
+	// GetOne returns the entry with the ID, or ErrNotFound
+	GetOne(id string) (*LogEntry, error)
+	DropCollection() error
+	// Redact replaces every mention of email, in any case, in the entries with
+	// replacement, as ReplaceMentions does, and returns how many entries it changed
+	Redact(ctx context.Context, email, replacement string) (int, error)
+}
+
+// Severities of log entries, from least to most severe
+const (
+	SeverityDebug    = "debug"
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityError    = "error"
+	SeverityCritical = "critical"
+)
+
+// Severities lists the severities an entry can have
+var Severities = []string{SeverityDebug, SeverityInfo, SeverityWarning, SeverityError, SeverityCritical}
+
+// MaxFields is how many fields an entry can have
+const MaxFields = 32
+
+// ErrInvalidEntry is wrapped by the errors of entries that can't be stored
+var ErrInvalidEntry = errors.New("invalid log entry")
+
+// LogEntry is one entry in the logs. Entries written before severity, service, host,
+// trace ID and fields were added have none of them.
 type LogEntry struct {
-	ID        string    `bson:"_id,omitempty" json:"id,omitempty"`
-	Name      string    `bson:"name" json:"name"`
-	Data      string    `bson:"data" json:"data"`
-	CreatedAt time.Time `bson:"created_at" json:"created_at"`
-	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	ID       string `bson:"_id,omitempty" json:"id,omitempty"`
+	Name     string `bson:"name" json:"name"`
+	Data     string `bson:"data" json:"data"`
+	Severity string `bson:"severity,omitempty" json:"severity,omitempty"`
+	// Service wrote the entry, from Host
+	Service string `bson:"service,omitempty" json:"service,omitempty"`
+	Host    string `bson:"host,omitempty" json:"host,omitempty"`
+	// TraceID ties together the entries of one request across services
+	TraceID string `bson:"trace_id,omitempty" json:"trace_id,omitempty"`
+	// Fields are more details to search by
+	Fields    map[string]string `bson:"fields,omitempty" json:"fields,omitempty"`
+	CreatedAt time.Time         `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time         `bson:"updated_at" json:"updated_at"`
+	// ExpiresAt is when the TTL index deletes the entry, unset for entries kept forever
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
+
+// Normalize lower-cases the severity of an entry, making it info when empty, and checks
+// that the entry can be stored. Its errors wrap ErrInvalidEntry.
+func (l *LogEntry) Normalize() error {
+	l.Severity = strings.ToLower(strings.TrimSpace(l.Severity))
+	if l.Severity == "" {
+		l.Severity = SeverityInfo
+	}
+	if err := checkSeverity(l.Severity); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidEntry, err)
+	}
+
+	if len(l.Fields) > MaxFields {
+		return fmt.Errorf("%w: at most %d fields are allowed", ErrInvalidEntry, MaxFields)
+	}
+	for key := range l.Fields {
+		if err := checkFieldKey(key); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidEntry, err)
+		}
+	}
+	return nil
+}
+
+func checkSeverity(severity string) error {
+	if !slices.Contains(Severities, severity) {
+		return errors.New("severity must be one of " + strings.Join(Severities, ", "))
+	}
+	return nil
+}
+
+// ReplaceMentions replaces every match of mention in the name, data, service, host and
+// field values of the entry with replacement, and reports whether it changed any. Field
+// keys can't hold an email, since they can't contain dots.
+func (l *LogEntry) ReplaceMentions(mention *regexp.Regexp, replacement string) bool {
+	changed := false
+	replace := func(s *string) {
+		if mention.MatchString(*s) {
+			*s = mention.ReplaceAllLiteralString(*s, replacement)
+			changed = true
+		}
+	}
+	replace(&l.Name)
+	replace(&l.Data)
+	replace(&l.Service)
+	replace(&l.Host)
+	for key, value := range l.Fields {
+		replace(&value)
+		l.Fields[key] = value
+	}
+	return changed
+}
+
+// checkFieldKey checks that Mongo can store and query a field under key
+func checkFieldKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+		return fmt.Errorf("field %q can't be empty, start with $ or contain dots", key)
+	}
+	return nil
 }
 
 func (l *LogEntry) Insert(entry LogEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
 	collection := client.Database("logs").Collection("logs")
 
-	_, err := collection.InsertOne(context.TODO(), LogEntry{
+	_, err := collection.InsertOne(ctx, LogEntry{
 		Name:      entry.Name,
 		Data:      entry.Data,
+		Severity:  entry.Severity,
+		Service:   entry.Service,
+		Host:      entry.Host,
+		TraceID:   entry.TraceID,
+		Fields:    entry.Fields,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
+		ExpiresAt: entry.ExpiresAt,
 	})
 	if err != nil {
 		log.Println("Error inserting into logs:", err)
@@ -50,37 +173,36 @@ func (l *LogEntry) Insert(entry LogEntry) error {
 	return nil
 }
 
-func (l *LogEntry) All() ([]*LogEntry, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-
+// InsertMany writes entries in one call and sets their IDs. Entries keep their creation
+// time, if they have one, since they may have waited for the rest of their batch.
+func (l *LogEntry) InsertMany(ctx context.Context, entries []LogEntry) error {
 	collection := client.Database("logs").Collection("logs")
 
-	opts := options.Find()
-	opts.SetSort(bson.D{{Key: "created_at", Value: -1}})
-
-	cursor, err := collection.Find(context.TODO(), bson.D{}, opts)
-	if err != nil {
-		log.Println("Finding all docs error:", err)
-		return nil, err
+	now := time.Now()
+	docs := make([]any, len(entries))
+	for i := range entries {
+		entry := &entries[i]
+		entry.ID = ""
+		if entry.CreatedAt.IsZero() {
+			entry.CreatedAt = now
+		}
+		entry.UpdatedAt = entry.CreatedAt
+		docs[i] = *entry
 	}
-	defer cursor.Close(ctx)
-
-	var logs []*LogEntry
-
-	for cursor.Next(ctx) {
-		var item LogEntry
 
-		err := cursor.Decode(&item)
-		if err != nil {
-			log.Print("Error decoding log into slice:", err)
-			return nil, err
-		} else {
-			logs = append(logs, &item)
+	// Unordered, one bad entry doesn't keep the rest of the batch from being written. Only
+	// the entries that were stored get their IDs.
+	result, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	failed, partial := failedIndexes(err)
+	if err != nil && !partial {
+		return err
+	}
+	for i, id := range result.InsertedIDs {
+		if oid, ok := id.(primitive.ObjectID); ok && failed[i] == nil {
+			entries[i].ID = oid.Hex()
 		}
 	}
-
-	return logs, nil
+	return err
 }
 
 func (l *LogEntry) GetOne(id string) (*LogEntry, error) {
@@ -91,12 +213,14 @@ func (l *LogEntry) GetOne(id string) (*LogEntry, error) {
 
 	docID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return nil, err
+		return nil, ErrNotFound
 	}
 
 	var entry LogEntry
 	err = collection.FindOne(ctx, bson.M{"_id": docID}).Decode(&entry)
-	if err != nil {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -145,3 +269,79 @@ func (l *LogEntry) Update() (*mongo.UpdateResult, error) {
 
 	return result, nil
 }
+
+// redactBatch is how many redacted entries are written to Mongo at once
+const redactBatch = 500
+
+// Redact reads the entries that mention email through a cursor and writes them back in
+// batches of redactBatch. It runs for as long as ctx allows, since redacting a large
+// collection can take a while; each batch has its own timeout.
+func (l *LogEntry) Redact(ctx context.Context, email, replacement string) (int, error) {
+	collection := client.Database("logs").Collection("logs")
+
+	pattern := primitive.Regex{Pattern: regexp.QuoteMeta(email), Options: "i"}
+	cursor, err := collection.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"name": pattern},
+		bson.M{"data": pattern},
+		bson.M{"service": pattern},
+		bson.M{"host": pattern},
+		// Fields are matched by value, whatever their key
+		bson.M{"$expr": bson.M{"$anyElementTrue": bson.A{bson.M{"$map": bson.M{
+			"input": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$fields", bson.M{}}}},
+			"in":    bson.M{"$regexMatch": bson.M{"input": "$$this.v", "regex": pattern.Pattern, "options": "i"}},
+		}}}}},
+	}}, options.Find().SetBatchSize(redactBatch))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	mention := regexp.MustCompile("(?i)" + regexp.QuoteMeta(email))
+	redacted := 0
+	var updates []mongo.WriteModel
+	write := func() error {
+		if len(updates) == 0 {
+			return nil
+		}
+		batchCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+		result, err := collection.BulkWrite(batchCtx, updates, options.BulkWrite().SetOrdered(false))
+		if result != nil {
+			redacted += int(result.ModifiedCount)
+		}
+		updates = updates[:0]
+		return err
+	}
+
+	for cursor.Next(ctx) {
+		var entry LogEntry
+		if err := cursor.Decode(&entry); err != nil {
+			return redacted, err
+		}
+		docID, err := primitive.ObjectIDFromHex(entry.ID)
+		if err != nil {
+			return redacted, err
+		}
+
+		entry.ReplaceMentions(mention, replacement)
+		updates = append(updates, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": docID}).SetUpdate(bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "name", Value: entry.Name},
+				{Key: "data", Value: entry.Data},
+				{Key: "service", Value: entry.Service},
+				{Key: "host", Value: entry.Host},
+				{Key: "fields", Value: entry.Fields},
+				{Key: "updated_at", Value: time.Now()},
+			}},
+		}))
+		if len(updates) == redactBatch {
+			if err := write(); err != nil {
+				return redacted, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return redacted, err
+	}
+	return redacted, write()
+}
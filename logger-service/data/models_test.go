@@ -0,0 +1,38 @@
+package data
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestReplaceMentions(t *testing.T) {
+	mention := regexp.MustCompile("(?i)" + regexp.QuoteMeta("grace@example.com"))
+
+	entry := LogEntry{
+		Name:    "signup of Grace@Example.com",
+		Data:    "welcome mail sent to grace@example.com",
+		Service: "grace@example.com's sandbox",
+		Host:    "sandbox-grace@example.com",
+		Fields:  map[string]string{"email": "GRACE@example.com", "referrer": "ada@example.com"},
+	}
+	if !entry.ReplaceMentions(mention, "[erased user 7]") {
+		t.Fatal("expected the entry to change")
+	}
+	want := LogEntry{
+		Name:    "signup of [erased user 7]",
+		Data:    "welcome mail sent to [erased user 7]",
+		Service: "[erased user 7]'s sandbox",
+		Host:    "sandbox-[erased user 7]",
+		Fields:  map[string]string{"email": "[erased user 7]", "referrer": "ada@example.com"},
+	}
+	if !reflect.DeepEqual(entry, want) {
+		t.Errorf("got %+v, want %+v", entry, want)
+	}
+
+	// Entries that don't mention the email are left alone
+	other := LogEntry{Name: "signup", Data: "ada@example.com", Fields: map[string]string{"email": "ada@example.com"}}
+	if other.ReplaceMentions(mention, "[erased user 7]") || other.Fields["email"] != "ada@example.com" {
+		t.Errorf("expected no change, got %+v", other)
+	}
+}
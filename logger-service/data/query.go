@@ -0,0 +1,263 @@
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// DefaultPageSize is how many entries a query returns when it doesn't say
+	DefaultPageSize = 50
+	// MaxPageSize is the most entries a query can return at once
+	MaxPageSize = 500
+)
+
+var (
+	// ErrNotFound is returned when there is no log entry with the ID asked for
+	ErrNotFound = errors.New("log entry not found")
+	// ErrInvalidCursor is returned for a cursor that no query handed out
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrInvalidFilter is wrapped by the errors of filters that no entry could match
+	ErrInvalidFilter = errors.New("invalid filter")
+)
+
+// LogFilter selects log entries. Zero fields don't filter.
+type LogFilter struct {
+	// Name matches the name exactly
+	Name string
+	// Since and Until bound the creation time; Since is inclusive, Until exclusive
+	Since time.Time
+	Until time.Time
+	// Text matches the name or data, case-insensitively
+	Text string
+	// Severity, Service and TraceID match exactly
+	Severity string
+	Service  string
+	TraceID  string
+	// Fields matches entries that have all of these fields
+	Fields map[string]string
+}
+
+// Check returns an error wrapping ErrInvalidFilter if no entry could match the filter
+func (f LogFilter) Check() error {
+	if f.Severity != "" {
+		if err := checkSeverity(f.Severity); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidFilter, err)
+		}
+	}
+	for key := range f.Fields {
+		if err := checkFieldKey(key); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidFilter, err)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether entry passes the filter
+func (f LogFilter) Matches(entry *LogEntry) bool {
+	if f.Name != "" && entry.Name != f.Name {
+		return false
+	}
+	if !f.Since.IsZero() && entry.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.CreatedAt.Before(f.Until) {
+		return false
+	}
+	if f.Severity != "" && entry.Severity != f.Severity ||
+		f.Service != "" && entry.Service != f.Service ||
+		f.TraceID != "" && entry.TraceID != f.TraceID {
+		return false
+	}
+	for key, value := range f.Fields {
+		if v, ok := entry.Fields[key]; !ok || v != value {
+			return false
+		}
+	}
+	if f.Text != "" {
+		text := strings.ToLower(f.Text)
+		return strings.Contains(strings.ToLower(entry.Name), text) || strings.Contains(strings.ToLower(entry.Data), text)
+	}
+	return true
+}
+
+func (f LogFilter) bson() bson.M {
+	filter := bson.M{}
+	if f.Name != "" {
+		filter["name"] = f.Name
+	}
+	if f.Severity != "" {
+		filter["severity"] = f.Severity
+	}
+	if f.Service != "" {
+		filter["service"] = f.Service
+	}
+	if f.TraceID != "" {
+		filter["trace_id"] = f.TraceID
+	}
+	for key, value := range f.Fields {
+		filter["fields."+key] = value
+	}
+	created := bson.M{}
+	if !f.Since.IsZero() {
+		created["$gte"] = f.Since
+	}
+	if !f.Until.IsZero() {
+		created["$lt"] = f.Until
+	}
+	if len(created) > 0 {
+		filter["created_at"] = created
+	}
+	if f.Text != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(f.Text), Options: "i"}
+		filter["$or"] = bson.A{bson.M{"name": pattern}, bson.M{"data": pattern}}
+	}
+	return filter
+}
+
+// LogQuery is a page of the log entries a filter selects, newest first unless
+// OldestFirst is set
+type LogQuery struct {
+	LogFilter
+	OldestFirst bool
+	// Limit is the page size, DefaultPageSize when zero and at most MaxPageSize
+	Limit int
+	// Cursor is the next cursor of the previous page, empty for the first one
+	Cursor string
+}
+
+// PageSize is the number of entries the query returns at most
+func (q LogQuery) PageSize() int {
+	if q.Limit <= 0 {
+		return DefaultPageSize
+	}
+	return min(q.Limit, MaxPageSize)
+}
+
+// Cursor marks the last entry of a page. Entries are ordered by creation time and then
+// ID, so pages stay stable while new entries are written.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// CursorAfter returns the cursor for the page following entry
+func CursorAfter(entry *LogEntry) Cursor {
+	return Cursor{CreatedAt: entry.CreatedAt, ID: entry.ID}
+}
+
+// String encodes the cursor for clients, who should treat it as opaque
+func (c Cursor) String() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixMilli(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseCursor decodes a cursor made by Cursor.String
+func ParseCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	millis, id, found := strings.Cut(string(raw), ":")
+	if !found || id == "" {
+		return Cursor{}, ErrInvalidCursor
+	}
+	ms, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return Cursor{CreatedAt: time.UnixMilli(ms).UTC(), ID: id}, nil
+}
+
+// Query returns a page of the entries q selects, and the cursor of the next page, which is
+// empty on the last one
+func (l *LogEntry) Query(ctx context.Context, q LogQuery) ([]*LogEntry, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	collection := client.Database("logs").Collection("logs")
+
+	if err := q.Check(); err != nil {
+		return nil, "", err
+	}
+	filter := q.bson()
+	order, after := -1, "$lt"
+	if q.OldestFirst {
+		order, after = 1, "$gt"
+	}
+	if q.Cursor != "" {
+		cursor, err := ParseCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		docID, err := primitive.ObjectIDFromHex(cursor.ID)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		filter = bson.M{"$and": bson.A{filter, bson.M{"$or": bson.A{
+			bson.M{"created_at": bson.M{after: cursor.CreatedAt}},
+			bson.M{"created_at": cursor.CreatedAt, "_id": bson.M{after: docID}},
+		}}}}
+	}
+
+	// One more than a page tells whether there is a next one
+	size := q.PageSize()
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: order}, {Key: "_id", Value: order}}).
+		SetLimit(int64(size + 1))
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var entries []*LogEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(entries) > size {
+		entries = entries[:size]
+		next = CursorAfter(entries[size-1]).String()
+	}
+	return entries, next, nil
+}
+
+// Each calls fn with every entry filter selects, newest first, reading them from Mongo as
+// it goes rather than all at once. It stops at the first error fn returns.
+func (l *LogEntry) Each(ctx context.Context, filter LogFilter, fn func(*LogEntry) error) error {
+	if err := filter.Check(); err != nil {
+		return err
+	}
+	collection := client.Database("logs").Collection("logs")
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}})
+	cursor, err := collection.Find(ctx, filter.bson(), opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var entry LogEntry
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+
+	return cursor.Err()
+}
@@ -0,0 +1,406 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RetentionStore deletes the entries a retention policy no longer keeps, and reports how
+// big the logs are. LogEntry implements it against Mongo.
+type RetentionStore interface {
+	// DeleteExpired deletes the entries that policy keeps no longer than now, and returns
+	// how many it deleted
+	DeleteExpired(ctx context.Context, policy RetentionPolicy, now time.Time) (int64, error)
+	// Restamp sets when each entry expires from policy, and returns how many entries it
+	// changed
+	Restamp(ctx context.Context, policy RetentionPolicy) (int64, error)
+	// Stats returns the size of the logs collection
+	Stats(ctx context.Context) (CollectionStats, error)
+}
+
+// RetentionRule keeps the entries it matches for MaxAge. An empty Name or Severity
+// matches any.
+type RetentionRule struct {
+	Name     string
+	Severity string
+	MaxAge   time.Duration
+}
+
+func (r RetentionRule) filter() LogFilter {
+	return LogFilter{Name: r.Name, Severity: r.Severity}
+}
+
+// RetentionPolicy decides how long entries are kept. The first rule that matches an entry
+// applies, and entries that no rule matches are kept for Default, or forever when Default
+// is zero.
+type RetentionPolicy struct {
+	Rules   []RetentionRule
+	Default time.Duration
+}
+
+// ParseRetention reads a policy written as comma-separated rules, for example
+//
+//	severity=debug:7d,name=authentication:90d,name=payment+severity=error:365d,*:30d
+//
+// Each rule selects entries by name, severity or both, joined by +, and "*" is the
+// default. Ages are Go durations such as 12h, or whole days such as 7d. An empty spec
+// keeps every entry forever.
+func ParseRetention(spec string) (RetentionPolicy, error) {
+	var policy RetentionPolicy
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.LastIndex(part, ":")
+		if i < 0 {
+			return RetentionPolicy{}, fmt.Errorf("retention rule %q has no age", part)
+		}
+		selector, age := part[:i], part[i+1:]
+		maxAge, err := parseAge(age)
+		if err != nil {
+			return RetentionPolicy{}, fmt.Errorf("retention rule %q: %w", part, err)
+		}
+
+		if selector == "*" {
+			if policy.Default != 0 {
+				return RetentionPolicy{}, errors.New("the default retention is set twice")
+			}
+			policy.Default = maxAge
+			continue
+		}
+
+		rule := RetentionRule{MaxAge: maxAge}
+		for _, term := range strings.Split(selector, "+") {
+			key, value, _ := strings.Cut(term, "=")
+			switch {
+			case value == "":
+				return RetentionPolicy{}, fmt.Errorf("retention rule %q: %q must be name=... or severity=...", part, term)
+			case key == "name":
+				rule.Name = value
+			case key == "severity":
+				if err := checkSeverity(value); err != nil {
+					return RetentionPolicy{}, fmt.Errorf("retention rule %q: %w", part, err)
+				}
+				rule.Severity = value
+			default:
+				return RetentionPolicy{}, fmt.Errorf("retention rule %q: can't select by %q", part, key)
+			}
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
+
+// parseAge reads a duration, allowing whole days such as 30d
+func parseAge(s string) (time.Duration, error) {
+	var age time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		age = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if age, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("age %q must be positive", s)
+	}
+	return age, nil
+}
+
+// IsZero reports whether the policy keeps every entry forever
+func (p RetentionPolicy) IsZero() bool {
+	return len(p.Rules) == 0 && p.Default == 0
+}
+
+// MaxAge returns how long entry is kept, or zero if it's kept forever
+func (p RetentionPolicy) MaxAge(entry *LogEntry) time.Duration {
+	for _, rule := range p.Rules {
+		if rule.filter().Matches(entry) {
+			return rule.MaxAge
+		}
+	}
+	return p.Default
+}
+
+// Stamp sets when entry expires, from its creation time
+func (p RetentionPolicy) Stamp(entry *LogEntry) {
+	if age := p.MaxAge(entry); age > 0 {
+		expires := entry.CreatedAt.Add(age)
+		entry.ExpiresAt = &expires
+	}
+}
+
+// Expired reports whether the policy keeps entry no longer than now
+func (p RetentionPolicy) Expired(entry *LogEntry, now time.Time) bool {
+	age := p.MaxAge(entry)
+	return age > 0 && !entry.CreatedAt.After(now.Add(-age))
+}
+
+// expiredFilters are the Mongo filters of the entries each rule, and then the default,
+// keeps no longer than now. Each excludes the entries of the rules before it.
+func (p RetentionPolicy) expiredFilters(now time.Time) []bson.M {
+	var filters []bson.M
+	var earlier bson.A
+	expired := func(match bson.M, age time.Duration) bson.M {
+		filter := bson.M{"created_at": bson.M{"$lte": now.Add(-age)}}
+		for key, value := range match {
+			filter[key] = value
+		}
+		if len(earlier) > 0 {
+			filter["$nor"] = append(bson.A(nil), earlier...)
+		}
+		return filter
+	}
+
+	for _, rule := range p.Rules {
+		match := rule.filter().bson()
+		filters = append(filters, expired(match, rule.MaxAge))
+		earlier = append(earlier, match)
+	}
+	if p.Default > 0 {
+		filters = append(filters, expired(bson.M{}, p.Default))
+	}
+	return filters
+}
+
+// stamp is an update that sets when the entries of a filter expire
+type stamp struct {
+	filter bson.M
+	update any
+}
+
+// stamps are the updates that give the entries of each rule, and then of the default,
+// the expiry policy sets for them. Each leaves alone the entries of the rules before it,
+// and the entries that already expire when it would set.
+func (p RetentionPolicy) stamps() []stamp {
+	var stamps []stamp
+	var earlier bson.A
+	restamp := func(match bson.M, age time.Duration) stamp {
+		filter := bson.M{}
+		for key, value := range match {
+			filter[key] = value
+		}
+		if len(earlier) > 0 {
+			filter["$nor"] = append(bson.A(nil), earlier...)
+		}
+		if age == 0 {
+			filter["expires_at"] = bson.M{"$exists": true}
+			return stamp{filter: filter, update: bson.M{"$unset": bson.M{"expires_at": ""}}}
+		}
+		expires := bson.M{"$add": bson.A{"$created_at", age.Milliseconds()}}
+		filter["$expr"] = bson.M{"$ne": bson.A{"$expires_at", expires}}
+		return stamp{filter: filter, update: bson.A{bson.M{"$set": bson.M{"expires_at": expires}}}}
+	}
+
+	for _, rule := range p.Rules {
+		match := rule.filter().bson()
+		stamps = append(stamps, restamp(match, rule.MaxAge))
+		earlier = append(earlier, match)
+	}
+	return append(stamps, restamp(bson.M{}, p.Default))
+}
+
+// Restamp sets when each entry expires from policy, so that the TTL index follows rules
+// that were lengthened or removed since the entries were written, and returns how many
+// entries it changed
+func (l *LogEntry) Restamp(ctx context.Context, policy RetentionPolicy) (int64, error) {
+	collection := client.Database("logs").Collection("logs")
+
+	var changed int64
+	for _, stamp := range policy.stamps() {
+		result, err := collection.UpdateMany(ctx, stamp.filter, stamp.update)
+		if err != nil {
+			return changed, err
+		}
+		changed += result.ModifiedCount
+	}
+	return changed, nil
+}
+
+// DeleteExpired deletes the entries that policy keeps no longer than now. The TTL index
+// deletes most of them already; this catches the entries written before their rule was
+// added or shortened.
+func (l *LogEntry) DeleteExpired(ctx context.Context, policy RetentionPolicy, now time.Time) (int64, error) {
+	collection := client.Database("logs").Collection("logs")
+
+	var deleted int64
+	for _, filter := range policy.expiredFilters(now) {
+		result, err := collection.DeleteMany(ctx, filter)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += result.DeletedCount
+	}
+	return deleted, nil
+}
+
+// CollectionStats is the size of the logs collection
+type CollectionStats struct {
+	// Count is the number of entries
+	Count int64 `json:"count"`
+	// Size is the bytes the entries take uncompressed, and StorageSize the bytes they
+	// take on disk
+	Size        int64 `json:"size"`
+	StorageSize int64 `json:"storage_size"`
+	IndexSize   int64 `json:"index_size"`
+	// Oldest is when the oldest entry was created, nil when there are none
+	Oldest *time.Time `json:"oldest,omitempty"`
+	// TTLIndex reports whether the index that expires entries exists
+	TTLIndex bool `json:"ttl_index"`
+}
+
+// Stats returns the size of the logs collection
+func (l *LogEntry) Stats(ctx context.Context) (CollectionStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	collection := client.Database("logs").Collection("logs")
+
+	var stats CollectionStats
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{{{Key: "$collStats", Value: bson.M{"storageStats": bson.M{}}}}})
+	if err != nil {
+		return stats, err
+	}
+	var results []struct {
+		StorageStats struct {
+			Count          int64 `bson:"count"`
+			Size           int64 `bson:"size"`
+			StorageSize    int64 `bson:"storageSize"`
+			TotalIndexSize int64 `bson:"totalIndexSize"`
+		} `bson:"storageStats"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return stats, err
+	}
+	if len(results) > 0 {
+		storage := results[0].StorageStats
+		stats.Count, stats.Size, stats.StorageSize, stats.IndexSize =
+			storage.Count, storage.Size, storage.StorageSize, storage.TotalIndexSize
+	}
+
+	var oldest LogEntry
+	opts := options.FindOne().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetProjection(bson.M{"created_at": 1})
+	err = collection.FindOne(ctx, bson.M{}, opts).Decode(&oldest)
+	if err == nil {
+		stats.Oldest = &oldest.CreatedAt
+	} else if !errors.Is(err, mongo.ErrNoDocuments) {
+		return stats, err
+	}
+
+	specs, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return stats, err
+	}
+	for _, spec := range specs {
+		var keys bson.D
+		if err := bson.Unmarshal(spec.KeysDocument, &keys); err != nil {
+			return stats, err
+		}
+		if len(keys) == 1 && keys[0].Key == "expires_at" && spec.ExpireAfterSeconds != nil {
+			stats.TTLIndex = true
+		}
+	}
+	return stats, nil
+}
+
+// SweepStatus is how a sweep went
+type SweepStatus struct {
+	At      time.Time `json:"at"`
+	Deleted int64     `json:"deleted"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Sweeper applies a retention policy to the entries already stored, deleting the ones it
+// no longer keeps
+type Sweeper struct {
+	store  RetentionStore
+	policy RetentionPolicy
+
+	mu   sync.Mutex
+	last *SweepStatus
+}
+
+// NewSweeper returns a Sweeper that deletes the entries of store that policy no longer
+// keeps
+func NewSweeper(store RetentionStore, policy RetentionPolicy) *Sweeper {
+	return &Sweeper{store: store, policy: policy}
+}
+
+// Policy is the retention policy the sweeper applies
+func (s *Sweeper) Policy() RetentionPolicy {
+	return s.policy
+}
+
+// Restamp sets when the entries already stored expire from the policy, and returns how
+// many it changed
+func (s *Sweeper) Restamp(ctx context.Context) (int64, error) {
+	return s.store.Restamp(ctx, s.policy)
+}
+
+// Sweep deletes the expired entries now, and returns how many it deleted
+func (s *Sweeper) Sweep(ctx context.Context) (int64, error) {
+	if s.policy.IsZero() {
+		return 0, nil
+	}
+	now := time.Now()
+	deleted, err := s.store.DeleteExpired(ctx, s.policy, now)
+
+	status := SweepStatus{At: now, Deleted: deleted}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	s.mu.Lock()
+	s.last = &status
+	s.mu.Unlock()
+	return deleted, err
+}
+
+// LastSweep returns how the last sweep went, or nil before the first one
+func (s *Sweeper) LastSweep() *SweepStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Run restamps the stored entries, then sweeps every interval, until stop is closed
+func (s *Sweeper) Run(interval time.Duration, stop <-chan struct{}) {
+	if changed, err := s.Restamp(context.Background()); err != nil {
+		log.Println("Error restamping the expiry of log entries:", err)
+	} else if changed > 0 {
+		log.Printf("Restamped the expiry of %d log entries", changed)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if deleted, err := s.Sweep(ctx); err != nil {
+			log.Println("Error deleting expired log entries:", err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d expired log entries", deleted)
+		}
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const day = 24 * time.Hour
+
+func TestParseRetention(t *testing.T) {
+	policy, err := ParseRetention("severity=debug:7d, name=authentication:90d,name=payment+severity=error:36h,*:30d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RetentionPolicy{
+		Rules: []RetentionRule{
+			{Severity: "debug", MaxAge: 7 * day},
+			{Name: "authentication", MaxAge: 90 * day},
+			{Name: "payment", Severity: "error", MaxAge: 36 * time.Hour},
+		},
+		Default: 30 * day,
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("got %+v, want %+v", policy, want)
+	}
+
+	if policy, err := ParseRetention(""); err != nil || !policy.IsZero() {
+		t.Errorf("expected an empty spec to keep everything, got %+v (%v)", policy, err)
+	}
+
+	for _, spec := range []string{"severity=debug", "severity=fatal:7d", "host=a:7d", "name:7d", "name=a:0d", "name=a:-1h", "name=a:soon", "*:1d,*:2d"} {
+		if _, err := ParseRetention(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	policy, _ := ParseRetention("severity=debug:1d,name=authentication:90d,*:30d")
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		entry LogEntry
+		age   time.Duration
+	}{
+		// The first rule that matches applies
+		{LogEntry{Name: "authentication", Severity: "debug"}, day},
+		{LogEntry{Name: "authentication", Severity: "info"}, 90 * day},
+		{LogEntry{Name: "mail", Severity: "info"}, 30 * day},
+	}
+	for _, tt := range tests {
+		entry := tt.entry
+		entry.CreatedAt = created
+		if age := policy.MaxAge(&entry); age != tt.age {
+			t.Errorf("%+v: kept for %v, want %v", tt.entry, age, tt.age)
+		}
+
+		policy.Stamp(&entry)
+		if entry.ExpiresAt == nil || !entry.ExpiresAt.Equal(created.Add(tt.age)) {
+			t.Errorf("%+v: expires at %v, want %v", tt.entry, entry.ExpiresAt, created.Add(tt.age))
+		}
+		if policy.Expired(&entry, created.Add(tt.age-time.Second)) || !policy.Expired(&entry, created.Add(tt.age)) {
+			t.Errorf("%+v: expected to expire after %v", tt.entry, tt.age)
+		}
+	}
+
+	// Without a default, the entries no rule matches are kept forever
+	policy.Default = 0
+	entry := LogEntry{Name: "mail", CreatedAt: created}
+	policy.Stamp(&entry)
+	if entry.ExpiresAt != nil || policy.Expired(&entry, created.Add(1000*day)) {
+		t.Errorf("expected the entry to be kept forever, got %+v", entry)
+	}
+}
+
+func TestRetentionExpiredFilters(t *testing.T) {
+	policy, _ := ParseRetention("severity=debug:1d,name=authentication:90d,*:30d")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Each rule leaves the entries of the rules before it alone
+	want := []bson.M{
+		{"severity": "debug", "created_at": bson.M{"$lte": now.Add(-day)}},
+		{"name": "authentication", "created_at": bson.M{"$lte": now.Add(-90 * day)},
+			"$nor": bson.A{bson.M{"severity": "debug"}}},
+		{"created_at": bson.M{"$lte": now.Add(-30 * day)},
+			"$nor": bson.A{bson.M{"severity": "debug"}, bson.M{"name": "authentication"}}},
+	}
+	if got := policy.expiredFilters(now); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRetentionStamps(t *testing.T) {
+	policy, _ := ParseRetention("severity=debug:1d,name=authentication:90d")
+	expires := func(age time.Duration) bson.M {
+		return bson.M{"$add": bson.A{"$created_at", age.Milliseconds()}}
+	}
+
+	// Each rule restamps the entries that expire at another time, and without a default
+	// the rest are kept forever
+	want := []stamp{
+		{bson.M{"severity": "debug", "$expr": bson.M{"$ne": bson.A{"$expires_at", expires(day)}}},
+			bson.A{bson.M{"$set": bson.M{"expires_at": expires(day)}}}},
+		{bson.M{"name": "authentication", "$nor": bson.A{bson.M{"severity": "debug"}},
+			"$expr": bson.M{"$ne": bson.A{"$expires_at", expires(90 * day)}}},
+			bson.A{bson.M{"$set": bson.M{"expires_at": expires(90 * day)}}}},
+		{bson.M{"$nor": bson.A{bson.M{"severity": "debug"}, bson.M{"name": "authentication"}}, "expires_at": bson.M{"$exists": true}},
+			bson.M{"$unset": bson.M{"expires_at": ""}}},
+	}
+	if got := policy.stamps(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
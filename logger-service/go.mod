@@ -10,7 +10,10 @@ require (
 	google.golang.org/protobuf v1.34.2
 )
 
+require github.com/golang-jwt/jwt/v5 v5.3.1
+
 require (
+	authz v0.0.0
 	github.com/bytedance/sonic v1.11.6 // indirect
 	github.com/bytedance/sonic/loader v0.1.1 // indirect
 	github.com/cloudwego/base64x v0.1.4 // indirect
@@ -47,3 +50,5 @@ require (
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace authz => ../authz
@@ -23,6 +23,10 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type LogServiceClient interface {
 	WriteLog(ctx context.Context, in *LogRequest, opts ...grpc.CallOption) (*LogResponse, error)
+	ListLogs(ctx context.Context, in *ListLogsRequest, opts ...grpc.CallOption) (*ListLogsResponse, error)
+	GetLog(ctx context.Context, in *GetLogRequest, opts ...grpc.CallOption) (*LogEntry, error)
+	WriteLogs(ctx context.Context, opts ...grpc.CallOption) (LogService_WriteLogsClient, error)
+	TailLogs(ctx context.Context, in *TailLogsRequest, opts ...grpc.CallOption) (LogService_TailLogsClient, error)
 }
 
 type logServiceClient struct {
@@ -42,11 +46,99 @@ func (c *logServiceClient) WriteLog(ctx context.Context, in *LogRequest, opts ..
 	return out, nil
 }
 
+func (c *logServiceClient) ListLogs(ctx context.Context, in *ListLogsRequest, opts ...grpc.CallOption) (*ListLogsResponse, error) {
+	out := new(ListLogsResponse)
+	err := c.cc.Invoke(ctx, "/logs.LogService/ListLogs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logServiceClient) GetLog(ctx context.Context, in *GetLogRequest, opts ...grpc.CallOption) (*LogEntry, error) {
+	out := new(LogEntry)
+	err := c.cc.Invoke(ctx, "/logs.LogService/GetLog", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logServiceClient) WriteLogs(ctx context.Context, opts ...grpc.CallOption) (LogService_WriteLogsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LogService_ServiceDesc.Streams[0], "/logs.LogService/WriteLogs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logServiceWriteLogsClient{stream}
+	return x, nil
+}
+
+type LogService_WriteLogsClient interface {
+	Send(*Log) error
+	CloseAndRecv() (*WriteLogsResponse, error)
+	grpc.ClientStream
+}
+
+type logServiceWriteLogsClient struct {
+	grpc.ClientStream
+}
+
+func (x *logServiceWriteLogsClient) Send(m *Log) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *logServiceWriteLogsClient) CloseAndRecv() (*WriteLogsResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(WriteLogsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *logServiceClient) TailLogs(ctx context.Context, in *TailLogsRequest, opts ...grpc.CallOption) (LogService_TailLogsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LogService_ServiceDesc.Streams[1], "/logs.LogService/TailLogs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logServiceTailLogsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LogService_TailLogsClient interface {
+	Recv() (*LogEntry, error)
+	grpc.ClientStream
+}
+
+type logServiceTailLogsClient struct {
+	grpc.ClientStream
+}
+
+func (x *logServiceTailLogsClient) Recv() (*LogEntry, error) {
+	m := new(LogEntry)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // LogServiceServer is the server API for LogService service.
 // All implementations must embed UnimplementedLogServiceServer
 // for forward compatibility
 type LogServiceServer interface {
 	WriteLog(context.Context, *LogRequest) (*LogResponse, error)
+	ListLogs(context.Context, *ListLogsRequest) (*ListLogsResponse, error)
+	GetLog(context.Context, *GetLogRequest) (*LogEntry, error)
+	WriteLogs(LogService_WriteLogsServer) error
+	TailLogs(*TailLogsRequest, LogService_TailLogsServer) error
 	mustEmbedUnimplementedLogServiceServer()
 }
 
@@ -57,6 +149,18 @@ type UnimplementedLogServiceServer struct {
 func (UnimplementedLogServiceServer) WriteLog(context.Context, *LogRequest) (*LogResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method WriteLog not implemented")
 }
+func (UnimplementedLogServiceServer) ListLogs(context.Context, *ListLogsRequest) (*ListLogsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListLogs not implemented")
+}
+func (UnimplementedLogServiceServer) GetLog(context.Context, *GetLogRequest) (*LogEntry, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLog not implemented")
+}
+func (UnimplementedLogServiceServer) WriteLogs(LogService_WriteLogsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WriteLogs not implemented")
+}
+func (UnimplementedLogServiceServer) TailLogs(*TailLogsRequest, LogService_TailLogsServer) error {
+	return status.Errorf(codes.Unimplemented, "method TailLogs not implemented")
+}
 func (UnimplementedLogServiceServer) mustEmbedUnimplementedLogServiceServer() {}
 
 // UnsafeLogServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -88,6 +192,89 @@ func _LogService_WriteLog_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _LogService_ListLogs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListLogsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServiceServer).ListLogs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/logs.LogService/ListLogs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServiceServer).ListLogs(ctx, req.(*ListLogsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LogService_GetLog_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetLogRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServiceServer).GetLog(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/logs.LogService/GetLog",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServiceServer).GetLog(ctx, req.(*GetLogRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LogService_WriteLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LogServiceServer).WriteLogs(&logServiceWriteLogsServer{stream})
+}
+
+type LogService_WriteLogsServer interface {
+	SendAndClose(*WriteLogsResponse) error
+	Recv() (*Log, error)
+	grpc.ServerStream
+}
+
+type logServiceWriteLogsServer struct {
+	grpc.ServerStream
+}
+
+func (x *logServiceWriteLogsServer) SendAndClose(m *WriteLogsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *logServiceWriteLogsServer) Recv() (*Log, error) {
+	m := new(Log)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _LogService_TailLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TailLogsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LogServiceServer).TailLogs(m, &logServiceTailLogsServer{stream})
+}
+
+type LogService_TailLogsServer interface {
+	Send(*LogEntry) error
+	grpc.ServerStream
+}
+
+type logServiceTailLogsServer struct {
+	grpc.ServerStream
+}
+
+func (x *logServiceTailLogsServer) Send(m *LogEntry) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // LogService_ServiceDesc is the grpc.ServiceDesc for LogService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -99,7 +286,26 @@ var LogService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "WriteLog",
 			Handler:    _LogService_WriteLog_Handler,
 		},
+		{
+			MethodName: "ListLogs",
+			Handler:    _LogService_ListLogs_Handler,
+		},
+		{
+			MethodName: "GetLog",
+			Handler:    _LogService_GetLog_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WriteLogs",
+			Handler:       _LogService_WriteLogs_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "TailLogs",
+			Handler:       _LogService_TailLogs_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "logs.proto",
 }
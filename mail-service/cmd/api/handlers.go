@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
 
@@ -8,11 +9,15 @@ import (
 )
 
 // mailMessage is the structure for the email payload.
+// Template names one of the templates in ./templates and Data holds the values it
+// renders; both are optional.
 type mailMessage struct {
-	From    string `json:"from"`
-	To      string `json:"to"`
-	Subject string `json:"subject"`
-	Message string `json:"message"`
+	From     string         `json:"from"`
+	To       string         `json:"to"`
+	Subject  string         `json:"subject"`
+	Message  string         `json:"message"`
+	Template string         `json:"template,omitempty"`
+	Data     map[string]any `json:"data,omitempty"`
 }
 
 // SendMail handles sending an email.
@@ -27,16 +32,22 @@ func (app *Config) SendMail(c *gin.Context) {
 	}
 
 	msg := Message{
-		From:    requestPayload.From,
-		To:      requestPayload.To,
-		Subject: requestPayload.Subject,
-		Data:    requestPayload.Message,
+		From:     requestPayload.From,
+		To:       requestPayload.To,
+		Subject:  requestPayload.Subject,
+		Template: requestPayload.Template,
+		Data:     requestPayload.Message,
+		DataMap:  requestPayload.Data,
 	}
 
 	// Send the email
 	if err := app.Mailer.SendSMTPMessage(msg); err != nil {
 		log.Println("Error sending email:", err)
-		app.errorJSON(c, err)
+		if errors.Is(err, errUnknownTemplate) {
+			app.errorJSON(c, err)
+		} else {
+			app.errorJSON(c, err, http.StatusInternalServerError)
+		}
 		return
 	}
 
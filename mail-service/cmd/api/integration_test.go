@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"authz"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestMain(m *testing.M) {
+	// Templates are loaded relative to the service root, as they are in the container
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// capturedMail is a message received by the fake SMTP server
+type capturedMail struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// smtpServer is a minimal in-process SMTP server that records every message it accepts
+type smtpServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []capturedMail
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{listener: lis}
+	t.Cleanup(func() { lis.Close() })
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+	var msg capturedMail
+	reply("220 localhost fake SMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg = capturedMail{From: addressArg(line)}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.To = append(msg.To, addressArg(line))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var body bytes.Buffer
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				body.WriteString(strings.TrimPrefix(l, "."))
+			}
+			msg.Data = body.Bytes()
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *smtpServer) received() []capturedMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]capturedMail(nil), s.messages...)
+}
+
+func addressArg(line string) string {
+	_, arg, _ := strings.Cut(line, ":")
+	return strings.Trim(strings.TrimSpace(arg), "<>")
+}
+
+// mailParts extracts the decoded body of each MIME part of a message, keyed by media type
+func mailParts(t *testing.T, raw []byte) (*mail.Message, map[string]string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := map[string]string{}
+	var walk func(header map[string][]string, body io.Reader)
+	walk = func(header map[string][]string, body io.Reader) {
+		mediaType, params, err := mime.ParseMediaType(mail.Header(header).Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			mr := multipart.NewReader(body, params["boundary"])
+			for {
+				p, err := mr.NextRawPart()
+				if err != nil {
+					return
+				}
+				walk(p.Header, p)
+			}
+		}
+		if strings.EqualFold(mail.Header(header).Get("Content-Transfer-Encoding"), "quoted-printable") {
+			body = quotedprintable.NewReader(body)
+		}
+		b, _ := io.ReadAll(body)
+		parts[mediaType] = string(b)
+	}
+	walk(msg.Header, msg.Body)
+	return msg, parts
+}
+
+// newMailService starts the mail service router, sending through a fake SMTP server
+func newMailService(t *testing.T) (*httptest.Server, *smtpServer) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	smtp := newSMTPServer(t)
+
+	app := Config{
+		Mailer: Mail{
+			Domain:      "localhost",
+			Host:        "127.0.0.1",
+			Port:        smtp.port(),
+			Encryption:  "none",
+			FromName:    "Test",
+			FromAddress: "noreply@example.com",
+		},
+		Tokens: testTokens,
+	}
+	srv := httptest.NewServer(app.routes())
+	t.Cleanup(srv.Close)
+	return srv, smtp
+}
+
+// testTokens signs the access tokens sent to the mail service in tests, like the authentication
+// service, and verifies them
+var testTokens = func() *authz.Tokens {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	return authz.NewSigner(key)
+}()
+
+// testToken returns an access token granting permissions
+func testToken(permissions ...string) string {
+	token, err := testTokens.Sign(authz.Claims{
+		Permissions:      permissions,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: "1"},
+	}, time.Minute)
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+func postMail(t *testing.T, srv *httptest.Server, msg mailMessage) int {
+	t.Helper()
+	token := testToken(authz.MailSend)
+	return postMailWithToken(t, srv, msg, token)
+}
+
+func postMailWithToken(t *testing.T, srv *httptest.Server, msg mailMessage, token string) int {
+	t.Helper()
+	body, _ := json.Marshal(msg)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/send", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSendMail(t *testing.T) {
+	srv, smtp := newMailService(t)
+
+	status := postMail(t, srv, mailMessage{
+		From:    "me@example.com",
+		To:      "you@there.com",
+		Subject: "Test email",
+		Message: "Hello world!",
+	})
+	if status != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", status)
+	}
+
+	sent := smtp.received()
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(sent))
+	}
+	if sent[0].From != "me@example.com" || len(sent[0].To) != 1 || sent[0].To[0] != "you@there.com" {
+		t.Errorf("unexpected envelope %s -> %v", sent[0].From, sent[0].To)
+	}
+
+	msg, parts := mailParts(t, sent[0].Data)
+	if got := msg.Header.Get("Subject"); got != "Test email" {
+		t.Errorf("subject = %q", got)
+	}
+	if plain := parts["text/plain"]; !strings.Contains(plain, "Hello world!") || strings.Contains(plain, "<p>") {
+		t.Errorf("plain part = %q", plain)
+	}
+	if html := parts["text/html"]; !strings.Contains(html, "<p>Hello world!</p>") {
+		t.Errorf("html part = %q", html)
+	}
+}
+
+func TestSendMailWithTemplate(t *testing.T) {
+	srv, smtp := newMailService(t)
+
+	link := "http://localhost:8081/verify?token=abc123"
+	status := postMail(t, srv, mailMessage{
+		To:       "new@example.com",
+		Subject:  "Verify your email address",
+		Template: "verify-email",
+		Data:     map[string]any{"first_name": "Ada", "link": link, "expires_in": "24 hours"},
+	})
+	if status != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", status)
+	}
+
+	sent := smtp.received()
+	if len(sent) != 1 || sent[0].From != "noreply@example.com" {
+		t.Fatalf("unexpected messages %+v", sent)
+	}
+	_, parts := mailParts(t, sent[0].Data)
+	if plain := parts["text/plain"]; !strings.Contains(plain, "Hi Ada,") || !strings.Contains(plain, link) {
+		t.Errorf("plain part = %q", plain)
+	}
+	if html := parts["text/html"]; !strings.Contains(html, `href="`+link+`"`) {
+		t.Errorf("html part = %q", html)
+	}
+}
+
+func TestSendMailUnknownTemplate(t *testing.T) {
+	srv, smtp := newMailService(t)
+
+	for _, name := range []string{"does-not-exist", "../templates/mail"} {
+		if status := postMail(t, srv, mailMessage{To: "a@b.com", Template: name}); status != http.StatusBadRequest {
+			t.Errorf("template %q: expected 400, got %d", name, status)
+		}
+	}
+	if sent := smtp.received(); len(sent) != 0 {
+		t.Errorf("expected nothing to be sent, got %d messages", len(sent))
+	}
+}
+
+func TestSendMailRequiresPermission(t *testing.T) {
+	srv, smtp := newMailService(t)
+	msg := mailMessage{From: "me@example.com", To: "you@example.com", Subject: "Hi", Message: "Hello"}
+
+	logsOnly := testToken(authz.LogsWrite)
+	tests := map[string]int{
+		"":            http.StatusUnauthorized,
+		"not-a-token": http.StatusUnauthorized,
+		logsOnly:      http.StatusForbidden,
+	}
+	for token, want := range tests {
+		if got := postMailWithToken(t, srv, msg, token); got != want {
+			t.Errorf("token %q: got %d, want %d", token, got, want)
+		}
+	}
+	if got := smtp.received(); len(got) != 0 {
+		t.Errorf("unauthorized requests sent %d messages", len(got))
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
+	"os"
+	"regexp"
 	"time"
 
 	"github.com/vanng822/go-premailer/premailer"
@@ -26,11 +30,36 @@ type Message struct {
 	FromName    string
 	To          string
 	Subject     string
+	Template    string
 	Attachments []string
 	Data        any
 	DataMap     map[string]any
 }
 
+// defaultTemplate is used for messages that don't name a template
+const defaultTemplate = "mail"
+
+var templateName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// errUnknownTemplate is returned when a message names a template that doesn't exist
+var errUnknownTemplate = errors.New("unknown template")
+
+// templateFile returns the path of the html or plain variant of the named template
+func templateFile(name, variant string) (string, error) {
+	if name == "" {
+		name = defaultTemplate
+	}
+	if !templateName.MatchString(name) {
+		return "", errUnknownTemplate
+	}
+
+	path := fmt.Sprintf("./templates/%s.%s.gohtml", name, variant)
+	if _, err := os.Stat(path); err != nil {
+		return "", errUnknownTemplate
+	}
+	return path, nil
+}
+
 func (m *Mail) SendSMTPMessage(msg Message) error {
 	if msg.From == "" {
 		msg.From = m.FromAddress
@@ -40,9 +69,12 @@ func (m *Mail) SendSMTPMessage(msg Message) error {
 		msg.FromName = m.FromName
 	}
 
-	data := map[string]any {
+	data := map[string]any{
 		"message": msg.Data,
 	}
+	for key, value := range msg.DataMap {
+		data[key] = value
+	}
 
 	msg.DataMap = data
 
@@ -96,7 +128,10 @@ func (m *Mail) SendSMTPMessage(msg Message) error {
 }
 
 func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
-	templateToRender := "./templates/mail.html.gohtml"
+	templateToRender, err := templateFile(msg.Template, "html")
+	if err != nil {
+		return "", err
+	}
 
 	t, err := template.New("email-html").ParseFiles(templateToRender)
 	if err != nil {
@@ -118,7 +153,10 @@ func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
 }
 
 func (m *Mail) buildPlainTextMessage(msg Message) (string, error) {
-	templateToRender := "./templates/mail.plain.gohtml"
+	templateToRender, err := templateFile(msg.Template, "plain")
+	if err != nil {
+		return "", err
+	}
 
 	t, err := template.New("email-plain").ParseFiles(templateToRender)
 	if err != nil {
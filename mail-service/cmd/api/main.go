@@ -6,17 +6,27 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+
+	"authz"
 )
 
 type Config struct {
 	Mailer Mail
+	// Tokens checks that callers of /send hold the mail:send permission
+	Tokens *authz.Tokens
 }
 
 const webPort = "80"
 
 func main() {
+	key, err := authz.PublicKeyFromEnv()
+	if err != nil {
+		log.Panic(err)
+	}
+
 	app := Config{
 		Mailer: createMail(),
+		Tokens: authz.NewVerifier(key),
 	}
 
 	log.Println("Starting mail service on port", webPort)
@@ -26,7 +36,7 @@ func main() {
 		Handler: app.routes(),
 	}
 
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if err != nil {
 		log.Panic(err)
 	}
@@ -3,6 +3,8 @@ package main
 import (
 	"net/http"
 
+	"authz"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -28,7 +30,7 @@ func (app *Config) routes() *gin.Engine {
 	})
 
 	// Define routes
-	r.POST("/send", app.SendMail)
+	r.POST("/send", app.Tokens.Require(authz.MailSend), app.SendMail)
 
 	return r
 }
@@ -9,7 +9,10 @@ require (
 	github.com/xhit/go-simple-mail/v2 v2.16.0
 )
 
+require github.com/golang-jwt/jwt/v5 v5.3.1
+
 require (
+	authz v0.0.0
 	github.com/PuerkitoBio/goquery v1.9.1 // indirect
 	github.com/andybalholm/cascadia v1.3.2 // indirect
 	github.com/bytedance/sonic v1.11.6 // indirect
@@ -44,3 +47,5 @@ require (
 	google.golang.org/protobuf v1.34.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace authz => ../authz